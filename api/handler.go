@@ -1,37 +1,53 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/artwork"
 	"github.com/ibiscum/bobcaygeon/cluster"
-	"github.com/ibiscum/bobcaygeon/player/forwarding"
 	"github.com/ibiscum/bobcaygeon/raop"
+	"github.com/ibiscum/bobcaygeon/receiver"
+	"github.com/ibiscum/bobcaygeon/rtsp"
 	"golang.org/x/net/context"
 )
 
 // Server represents the gRPC server
 type Server struct {
 	UnimplementedAirPlayManagementServer
-	airplayServer    *raop.AirplayServer
-	forwardingPlayer *forwarding.Player
-	nodes            *memberlist.Memberlist
+	receivers *receiver.Registry
+	nodes     *memberlist.Memberlist
 }
 
 // NewServer instantiates a new RPC server
-func NewServer(airplayServer *raop.AirplayServer, forwardingPlayer *forwarding.Player, nodes *memberlist.Memberlist) *Server {
-	return &Server{airplayServer: airplayServer, forwardingPlayer: forwardingPlayer, nodes: nodes}
+func NewServer(receivers *receiver.Registry, nodes *memberlist.Memberlist) *Server {
+	return &Server{receivers: receivers, nodes: nodes}
+}
+
+func unknownReceiver(id string) *ManagementResponse {
+	return &ManagementResponse{ReturnCode: 400, Message: fmt.Sprintf("no receiver with id: %s", id)}
 }
 
 // ToggleBroadcast tells node to broadcast that it is an airplay service
 func (s *Server) ToggleBroadcast(ctx context.Context, in *BroadcastRequest) (*ManagementResponse, error) {
-	s.airplayServer.ToggleAdvertise(in.ShouldBroadcast)
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	rcv.AirplayServer.ToggleAdvertise(in.ShouldBroadcast)
 	return &ManagementResponse{ReturnCode: 200}, nil
 }
 
 // ChangeServiceName will change the name of that is broadcast for the airplay service
 func (s *Server) ChangeServiceName(ctx context.Context, in *NameChangeRequest) (*ManagementResponse, error) {
-	err := s.airplayServer.ChangeName(in.NewName)
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	err := rcv.AirplayServer.ChangeName(in.NewName)
 	returnCode := 200
 	if err != nil {
 		log.Println("Problem changing name: ", err)
@@ -42,6 +58,10 @@ func (s *Server) ChangeServiceName(ctx context.Context, in *NameChangeRequest) (
 
 // ForwardToNodes adds nodes to forward music to
 func (s *Server) ForwardToNodes(ctx context.Context, in *AddRemoveNodesRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
 	self := s.nodes.LocalNode().Name
 
 	filter := func(node *memberlist.Node) bool {
@@ -58,13 +78,17 @@ func (s *Server) ForwardToNodes(ctx context.Context, in *AddRemoveNodesRequest)
 
 	nodesToAdd := cluster.FilterMembersByFn(filter, s.nodes)
 	for _, nodeToAdd := range nodesToAdd {
-		s.forwardingPlayer.AddSessionForNode(nodeToAdd)
+		rcv.Player.AddSessionForNode(nodeToAdd)
 	}
 	return &ManagementResponse{ReturnCode: int32(200)}, nil
 }
 
 // RemoveForwardToNodes removes nodes we were forwarding music to
 func (s *Server) RemoveForwardToNodes(ctx context.Context, in *AddRemoveNodesRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
 	self := s.nodes.LocalNode().Name
 	filter := func(node *memberlist.Node) bool {
 		if node.Name == self {
@@ -81,10 +105,10 @@ func (s *Server) RemoveForwardToNodes(ctx context.Context, in *AddRemoveNodesReq
 	if !in.GetRemoveAll() {
 		nodesToRemove := cluster.FilterMembersByFn(filter, s.nodes)
 		for _, nodeToRemove := range nodesToRemove {
-			s.forwardingPlayer.RemoveSessionForNode(nodeToRemove)
+			rcv.Player.RemoveSessionForNode(nodeToRemove)
 		}
 	} else {
-		s.forwardingPlayer.RemoveAllSessions()
+		rcv.Player.RemoveAllSessions()
 	}
 
 	return &ManagementResponse{ReturnCode: int32(200)}, nil
@@ -92,12 +116,219 @@ func (s *Server) RemoveForwardToNodes(ctx context.Context, in *AddRemoveNodesReq
 
 // GetCurrentTrack returns the current playing track on this node
 func (s *Server) GetCurrentTrack(ctx context.Context, in *GetTrackRequest) (*Track, error) {
-	track := s.forwardingPlayer.GetTrack()
-	return &Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork}, nil
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return nil, fmt.Errorf("no receiver with id: %s", in.ReceiverId)
+	}
+	track := rcv.Player.GetTrack()
+	// the receiver knows best, going by the audio coming in
+	if progress, ok := rcv.AirplayServer.Progress(); ok {
+		track.Position = progress.Position()
+		track.Duration = progress.Duration()
+	}
+	return &Track{Artist: track.Artist, Album: track.Album, Title: track.Title, ArtworkHash: track.ArtworkHash,
+		Genre: track.Genre, Composer: track.Composer, Year: int32(track.Year),
+		TrackNumber: int32(track.TrackNumber), TrackCount: int32(track.TrackCount),
+		DiscNumber: int32(track.DiscNumber), DiscCount: int32(track.DiscCount),
+		Duration: track.Duration.Milliseconds(), Position: track.Position.Milliseconds(), PersistentId: track.PersistentID}, nil
 }
 
 // GetMuted returns if the speaker is hard muted
 func (s *Server) GetMuted(ctx context.Context, in *GetMutedRequest) (*SpeakerMuteResponse, error) {
-	muted := s.forwardingPlayer.GetIsMuted()
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return nil, fmt.Errorf("no receiver with id: %s", in.ReceiverId)
+	}
+	muted := rcv.Player.GetIsMuted()
 	return &SpeakerMuteResponse{IsMuted: muted}, nil
 }
+
+// SetMuted hard mutes, or unmutes, the speaker
+func (s *Server) SetMuted(ctx context.Context, in *SetMutedRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	rcv.Player.SetMute(in.IsMuted)
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// SetPassword sets the password senders need to stream to this speaker, an empty password removes it
+func (s *Server) SetPassword(ctx context.Context, in *PasswordRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	// the nodes we forward to have passwords of their own, so the one we forward with is left as is
+	rcv.AirplayServer.SetPassword(in.Password)
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// ListReceivers returns the receivers hosted by this node
+func (s *Server) ListReceivers(ctx context.Context, in *ListReceiversRequest) (*ListReceiversResponse, error) {
+	var receivers []*Receiver
+	for _, rcv := range s.receivers.List() {
+		transport := "udp"
+		if rcv.Transport() == rtsp.Interleaved {
+			transport = "tcp"
+		}
+		policy, idleTimeout := rcv.AirplayServer.GetArbitrationPolicy()
+		receivers = append(receivers, &Receiver{
+			Id:                rcv.ID,
+			Name:              rcv.AirplayServer.Name(),
+			Port:              int32(rcv.AirplayServer.Port()),
+			Broadcasting:      rcv.AirplayServer.IsAdvertising(),
+			PasswordProtected: rcv.AirplayServer.HasPassword(),
+			Transport:         transport,
+			Arbitration:       policy.String(),
+			IdleTimeout:       int32(idleTimeout.Seconds()),
+		})
+	}
+	return &ListReceiversResponse{Receivers: receivers}, nil
+}
+
+// AddReceiver starts an additional receiver on this node, advertised under its own name
+func (s *Server) AddReceiver(ctx context.Context, in *AddReceiverRequest) (*ManagementResponse, error) {
+	config := receiver.Config{ID: in.Id, Name: in.Name, Port: int(in.Port), Password: in.Password, Transport: in.Transport,
+		Arbitration: in.Arbitration, IdleTimeout: int(in.IdleTimeout)}
+	_, err := s.receivers.Create(config)
+	if err != nil {
+		log.Println("Problem adding receiver: ", err)
+		return &ManagementResponse{ReturnCode: 400, Message: err.Error()}, nil
+	}
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// RemoveReceiver stops a receiver and removes it from this node
+func (s *Server) RemoveReceiver(ctx context.Context, in *RemoveReceiverRequest) (*ManagementResponse, error) {
+	err := s.receivers.Remove(in.Id)
+	if err != nil {
+		log.Println("Problem removing receiver: ", err)
+		return &ManagementResponse{ReturnCode: 400, Message: err.Error()}, nil
+	}
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// SetArbitrationPolicy sets what happens when a sender wants to stream while another one is
+func (s *Server) SetArbitrationPolicy(ctx context.Context, in *ArbitrationPolicyRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	policy, err := raop.ParseArbitrationPolicy(in.Policy)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 400, Message: err.Error()}, nil
+	}
+	if in.IdleTimeout < 0 {
+		return &ManagementResponse{ReturnCode: 400, Message: "idle timeout must not be negative"}, nil
+	}
+	rcv.AirplayServer.SetArbitrationPolicy(policy, time.Duration(in.IdleTimeout)*time.Second)
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// SetAccessRules replaces the rules deciding which senders may stream to the receiver
+func (s *Server) SetAccessRules(ctx context.Context, in *AccessRulesRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	rules := make([]*raop.AccessRule, 0, len(in.Rules))
+	for _, r := range in.Rules {
+		rule, err := raop.NewAccessRule(r.Allow, r.Match, r.Value)
+		if err != nil {
+			return &ManagementResponse{ReturnCode: 400, Message: err.Error()}, nil
+		}
+		rules = append(rules, rule)
+	}
+	rcv.AirplayServer.SetAccessRules(rules)
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// GetAccessRules returns the rules deciding which senders may stream to the receiver
+func (s *Server) GetAccessRules(ctx context.Context, in *GetAccessRulesRequest) (*AccessRulesResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return &AccessRulesResponse{ReturnCode: 400, Message: fmt.Sprintf("no receiver with id: %s", in.ReceiverId)}, nil
+	}
+	var rules []*AccessRule
+	for _, rule := range rcv.AirplayServer.GetAccessRules() {
+		rules = append(rules, &AccessRule{Allow: rule.Allow, Match: rule.Match.String(), Value: rule.Value})
+	}
+	return &AccessRulesResponse{ReturnCode: 200, Rules: rules}, nil
+}
+
+// ListSessions returns the sessions in progress on the receiver
+func (s *Server) ListSessions(ctx context.Context, in *ListSessionsRequest) (*ListSessionsResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return &ListSessionsResponse{ReturnCode: 400, Message: fmt.Sprintf("no receiver with id: %s", in.ReceiverId)}, nil
+	}
+	var sessions []*Session
+	for _, info := range rcv.AirplayServer.Sessions() {
+		sessions = append(sessions, &Session{
+			Id:            info.ID,
+			RemoteAddress: info.RemoteAddress,
+			DacpId:        info.DacpID,
+			UserAgent:     info.UserAgent,
+			Codec:         info.Codec,
+			Encrypted:     info.Encrypted,
+			Streaming:     info.Streaming,
+			StartTime:     info.Started.Unix(),
+			Packets:       info.Stats.Packets,
+			Bytes:         info.Stats.Bytes,
+			DecodeErrors:  info.Stats.DecodeErrors,
+		})
+	}
+	return &ListSessionsResponse{ReturnCode: 200, Sessions: sessions}, nil
+}
+
+// CloseSession kicks the sender of a session on the receiver
+func (s *Server) CloseSession(ctx context.Context, in *CloseSessionRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	err := rcv.AirplayServer.CloseSession(in.SessionId)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 400, Message: err.Error()}, nil
+	}
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// PlaybackControl remote controls the sender streaming to the receiver
+func (s *Server) PlaybackControl(ctx context.Context, in *PlaybackControlRequest) (*ManagementResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return unknownReceiver(in.ReceiverId), nil
+	}
+	command, err := raop.ParsePlaybackCommand(in.Command)
+	if err != nil {
+		return &ManagementResponse{ReturnCode: 400, Message: err.Error()}, nil
+	}
+	err = rcv.AirplayServer.PlaybackControl(command)
+	if err != nil {
+		log.Println("Problem controlling playback: ", err)
+		return &ManagementResponse{ReturnCode: 500, Message: err.Error()}, nil
+	}
+	return &ManagementResponse{ReturnCode: 200}, nil
+}
+
+// GetArtwork returns the artwork of the receiver's track with the given hash, scaled down if asked to
+func (s *Server) GetArtwork(ctx context.Context, in *GetArtworkRequest) (*ArtworkResponse, error) {
+	rcv := s.receivers.Get(in.ReceiverId)
+	if rcv == nil {
+		return &ArtworkResponse{ReturnCode: 400, Message: fmt.Sprintf("no receiver with id: %s", in.ReceiverId)}, nil
+	}
+	if in.MaxSize < 0 {
+		return &ArtworkResponse{ReturnCode: 400, Message: "maxSize must not be negative"}, nil
+	}
+	art, err := rcv.Player.GetArtwork(in.Hash, int(in.MaxSize))
+	if errors.Is(err, artwork.ErrNotFound) {
+		return &ArtworkResponse{ReturnCode: 404, Message: err.Error()}, nil
+	}
+	if err != nil {
+		log.Println("Problem getting artwork: ", err)
+		return &ArtworkResponse{ReturnCode: 500, Message: err.Error()}, nil
+	}
+	return &ArtworkResponse{ReturnCode: 200, Data: art.Data, MimeType: art.MimeType}, nil
+}
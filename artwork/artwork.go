@@ -0,0 +1,224 @@
+package artwork
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"sync"
+)
+
+const (
+	// JPEG mime type of JPEG artwork
+	JPEG = "image/jpeg"
+	// PNG mime type of PNG artwork
+	PNG = "image/png"
+	// None is the content type senders use to signal there is no artwork
+	None = "image/none"
+
+	// DefaultCapacity is how many pieces of artwork a store keeps by default
+	DefaultCapacity = 8
+
+	// maxPixels is the most pixels artwork may have to be scaled down, decoding takes
+	// 4 bytes a pixel whatever the size of the data, so this keeps it to 64MB
+	maxPixels = 4096 * 4096
+)
+
+// thumbnailSizes are the sizes thumbnails are made in, smallest first; a requested size is
+// snapped down to one of them so a handful of thumbnails is kept per piece of artwork
+var thumbnailSizes = []int{32, 64, 128, 256, 512, 1024}
+
+var (
+	// ErrNotFound returned when there is no artwork with the requested hash
+	ErrNotFound = errors.New("artwork not found")
+	// ErrTooLarge returned when artwork has too many pixels to be scaled down
+	ErrTooLarge = errors.New("artwork too large to scale")
+)
+
+// Artwork is an image for a track, identified by the hash of its content
+type Artwork struct {
+	Hash     string
+	MimeType string
+	Data     []byte
+}
+
+// Hash returns the hash artwork with the given content is identified by
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// New checks the image is one we support and wraps it as Artwork. The type is worked out from
+// the data itself, since senders are not always right about it
+func New(data []byte) (*Artwork, error) {
+	if len(data) == 0 {
+		return nil, errors.New("artwork is empty")
+	}
+	mimeType := http.DetectContentType(data)
+	if mimeType != JPEG && mimeType != PNG {
+		return nil, fmt.Errorf("unsupported artwork type: %s", mimeType)
+	}
+	return &Artwork{Hash: Hash(data), MimeType: mimeType, Data: data}, nil
+}
+
+type thumbnailKey struct {
+	hash    string
+	maxSize int
+}
+
+// Store keeps the most recent artwork, and thumbnails made of it, by hash
+type Store struct {
+	lock       sync.RWMutex
+	capacity   int
+	artworks   map[string]*Artwork
+	order      []string
+	thumbnails map[thumbnailKey]*Artwork
+}
+
+// NewStore instantiates a new Store keeping up to capacity pieces of artwork
+func NewStore(capacity int) *Store {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Store{capacity: capacity, artworks: make(map[string]*Artwork), thumbnails: make(map[thumbnailKey]*Artwork)}
+}
+
+// Put adds the artwork to the store, dropping the oldest artwork if the store is full
+func (s *Store) Put(artwork *Artwork) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.artworks[artwork.Hash]; exists {
+		return
+	}
+	s.artworks[artwork.Hash] = artwork
+	s.order = append(s.order, artwork.Hash)
+	for len(s.order) > s.capacity {
+		oldest := s.order[0]
+		s.order = s.order[1:]
+		delete(s.artworks, oldest)
+		for key := range s.thumbnails {
+			if key.hash == oldest {
+				delete(s.thumbnails, key)
+			}
+		}
+	}
+}
+
+// Get returns the artwork with the given hash
+func (s *Store) Get(hash string) (*Artwork, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	artwork, ok := s.artworks[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return artwork, nil
+}
+
+// Thumbnail returns the artwork with the given hash scaled down to fit in maxSize by maxSize pixels,
+// in the same format. Artwork that already fits, or a maxSize of 0, returns the original. The size
+// is snapped down to one of the thumbnail sizes, the smallest being 32 pixels
+func (s *Store) Thumbnail(hash string, maxSize int) (*Artwork, error) {
+	original, err := s.Get(hash)
+	if err != nil || maxSize <= 0 {
+		return original, err
+	}
+	maxSize = thumbnailSize(maxSize)
+	key := thumbnailKey{hash: hash, maxSize: maxSize}
+	s.lock.RLock()
+	thumbnail, ok := s.thumbnails[key]
+	s.lock.RUnlock()
+	if ok {
+		return thumbnail, nil
+	}
+	thumbnail, err = makeThumbnail(original, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	// only keep it if the original wasn't dropped in the meantime
+	if _, exists := s.artworks[hash]; exists {
+		s.thumbnails[key] = thumbnail
+	}
+	s.lock.Unlock()
+	return thumbnail, nil
+}
+
+// thumbnailSize returns the largest thumbnail size within maxSize, the smallest size when none is
+func thumbnailSize(maxSize int) int {
+	size := thumbnailSizes[0]
+	for _, s := range thumbnailSizes {
+		if s <= maxSize {
+			size = s
+		}
+	}
+	return size
+}
+
+func makeThumbnail(original *Artwork, maxSize int) (*Artwork, error) {
+	// the header tells the size, before decoding what could be a huge image
+	config, _, err := image.DecodeConfig(bytes.NewReader(original.Data))
+	if err != nil {
+		return nil, err
+	}
+	width, height := config.Width, config.Height
+	if width <= maxSize && height <= maxSize {
+		return original, nil
+	}
+	if int64(width)*int64(height) > maxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrTooLarge, width, height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(original.Data))
+	if err != nil {
+		return nil, err
+	}
+	// keep the aspect ratio
+	if width >= height {
+		height = max(1, height*maxSize/width)
+		width = maxSize
+	} else {
+		width = max(1, width*maxSize/height)
+		height = maxSize
+	}
+	scaled := scale(img, width, height)
+	var buf bytes.Buffer
+	if original.MimeType == PNG {
+		err = png.Encode(&buf, scaled)
+	} else {
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Artwork{Hash: Hash(buf.Bytes()), MimeType: original.MimeType, Data: buf.Bytes()}, nil
+}
+
+// scale scales the image down to the given size, averaging the source pixels covered by each target pixel
+func scale(src image.Image, width int, height int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
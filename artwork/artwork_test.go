@@ -0,0 +1,148 @@
+package artwork
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(t *testing.T, width int, height int, encoder func(*bytes.Buffer, image.Image) error) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := encoder(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) }
+
+func encodeJPEG(buf *bytes.Buffer, img image.Image) error { return jpeg.Encode(buf, img, nil) }
+
+func TestNewDetectsType(t *testing.T) {
+	a, err := New(testImage(t, 10, 10, encodePNG))
+	if err != nil || a.MimeType != PNG {
+		t.Error("Expected PNG artwork", err)
+	}
+	a, err = New(testImage(t, 10, 10, encodeJPEG))
+	if err != nil || a.MimeType != JPEG {
+		t.Error("Expected JPEG artwork", err)
+	}
+	if _, err := New([]byte("not an image")); err == nil {
+		t.Error("Expected error for unsupported data")
+	}
+	if _, err := New(nil); err == nil {
+		t.Error("Expected error for empty data")
+	}
+}
+
+func TestStoreEvictsOldest(t *testing.T) {
+	s := NewStore(2)
+	var hashes []string
+	for i := 1; i <= 3; i++ {
+		a, err := New(testImage(t, i, i, encodePNG))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put(a)
+		hashes = append(hashes, a.Hash)
+	}
+	if _, err := s.Get(hashes[0]); err != ErrNotFound {
+		t.Error("Expected oldest artwork to be dropped")
+	}
+	for _, hash := range hashes[1:] {
+		if _, err := s.Get(hash); err != nil {
+			t.Error("Expected artwork to be kept", err)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	s := NewStore(0)
+	a, err := New(testImage(t, 200, 100, encodeJPEG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(a)
+	thumbnail, err := s.Thumbnail(a.Hash, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbnail.MimeType != JPEG {
+		t.Error("Expected thumbnail in the same format got:", thumbnail.MimeType)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(thumbnail.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 64 || config.Height != 32 {
+		t.Errorf("Expected 64x32 got: %dx%d", config.Width, config.Height)
+	}
+	// artwork that already fits is returned as is
+	small, _ := s.Thumbnail(a.Hash, 500)
+	if small.Hash != a.Hash {
+		t.Error("Expected original artwork when it fits")
+	}
+	if _, err := s.Thumbnail("unknown", 50); err != ErrNotFound {
+		t.Error("Expected not found for unknown hash")
+	}
+}
+
+func TestThumbnailSizesSnapped(t *testing.T) {
+	s := NewStore(0)
+	a, err := New(testImage(t, 200, 100, encodePNG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(a)
+	// every size asked for doesn't make a thumbnail of its own
+	for maxSize := 1; maxSize < 200; maxSize++ {
+		thumbnail, err := s.Thumbnail(a.Hash, maxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(thumbnail.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := thumbnailSize(maxSize); config.Width != expected {
+			t.Errorf("Expected width %d for %d got: %d", expected, maxSize, config.Width)
+		}
+	}
+	if len(s.thumbnails) != 3 {
+		t.Errorf("Expected thumbnails of 32, 64 and 128 pixels got: %d", len(s.thumbnails))
+	}
+	for maxSize, expected := range map[int]int{1: 32, 32: 32, 100: 64, 128: 128, 5000: 1024} {
+		if size := thumbnailSize(maxSize); size != expected {
+			t.Errorf("Expected %d for %d got: %d", expected, maxSize, size)
+		}
+	}
+}
+
+func TestThumbnailRefusesHugeImages(t *testing.T) {
+	data := testImage(t, 2, 2, encodePNG)
+	// make the header claim 100000x100000 pixels, the IHDR chunk follows the signature
+	binary.BigEndian.PutUint32(data[16:20], 100000)
+	binary.BigEndian.PutUint32(data[20:24], 100000)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	s := NewStore(0)
+	a, err := New(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(a)
+	if _, err := s.Thumbnail(a.Hash, 50); !errors.Is(err, ErrTooLarge) {
+		t.Error("Expected too large error got:", err)
+	}
+}
@@ -35,8 +35,9 @@ if [ ! -z "$TRAVIS_TAG" ]; then
 fi
 
 
-go build -o bcg-$TRAVIS_OS_NAME-$BCG_VERSION cmd/bcg.go
-go build -o bcg-mgmt-$TRAVIS_OS_NAME-$BCG_VERSION cmd/mgmt/bcg-mgmt.go
+BCG_LDFLAGS="-X github.com/ibiscum/bobcaygeon/cluster.Version=$BCG_VERSION"
+go build -ldflags "$BCG_LDFLAGS" -o bcg-$TRAVIS_OS_NAME-$BCG_VERSION cmd/bcg.go
+go build -ldflags "$BCG_LDFLAGS" -o bcg-mgmt-$TRAVIS_OS_NAME-$BCG_VERSION cmd/mgmt/bcg-mgmt.go
 
 
 #TODO: refactor linux build overall
@@ -1,10 +1,11 @@
 package cluster
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
+	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
@@ -26,70 +27,142 @@ const (
 	Frontend
 )
 
+// String returns the name of the node type: music, mgmt or frontend
+func (t NodeType) String() string {
+	switch t {
+	case Music:
+		return "music"
+	case Mgmt:
+		return "mgmt"
+	case Frontend:
+		return "frontend"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
 const (
 	// ServiceType is the type used to advertise the cluster to join
 	ServiceType = "_bobcaygeon._tcp"
 )
 
-// NodeMeta is metadata passed to other members about this node
-type NodeMeta struct {
-	RtspPort int
-	APIPort  int
-	RaftPort int
-	NodeType NodeType
-}
-
 // EventDelegate handles the delgate functions from the memberlist
 type EventDelegate struct {
 	// keep a list of delegates so that we can have more than one
 	// interested party for the membership events
 	eventDelegates []memberlist.EventDelegate
+	mu             sync.RWMutex
 }
 
+// messageType is the first byte of the messages nodes send each other, saying what they carry
+type messageType byte
+
+const (
+	// keyringMessage carries a keyring operation to apply
+	keyringMessage messageType = iota + 1
+	// eventMessage carries an event gossiped to every node
+	eventMessage
+)
+
 // Delegate handles memberlist events
 type Delegate struct {
 	MetaData *NodeMeta
+	// Keys applies the keyring operations other nodes send, nil to ignore them
+	Keys *KeyManager
+	// Events gossips events between nodes, nil to ignore them
+	Events *EventBus
+	// State exchanges the statuses of the nodes on push/pull, nil to not share them
+	State *StateStore
+	// Election says whether the node leads, nil for nodes not taking part in elections
+	Election *Election
 }
 
 // NodeMeta is used to retrieve meta-data about the current node
 // when broadcasting an alive message.
 func (d Delegate) NodeMeta(limit int) []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-
-	err := enc.Encode(d.MetaData)
+	meta := *d.MetaData
+	if d.Election != nil {
+		meta.Leader = d.Election.Leading()
+	}
+	encoded, err := EncodeNodeMeta(&meta)
 	if err != nil {
 		log.Println("Error encoding node metadata", err)
+		return nil
 	}
-
-	return buf.Bytes()
+	if len(encoded) > limit {
+		// what other nodes need to reach us matters more than the capabilities
+		log.Printf("Node metadata is %d bytes, over the limit of %d, leaving out capabilities\n", len(encoded), limit)
+		withoutCapabilities := meta
+		withoutCapabilities.Capabilities = Capabilities{}
+		encoded, err = EncodeNodeMeta(&withoutCapabilities)
+		if err != nil || len(encoded) > limit {
+			log.Println("Error encoding node metadata within limit", err)
+			return nil
+		}
+	}
+	return encoded
 }
 
 // GetBroadcasts is called when user data messages can be broadcast.
-func (Delegate) GetBroadcasts(overhead, limit int) [][]byte {
-	return make([][]byte, 0)
+func (d Delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	if d.Events == nil {
+		return make([][]byte, 0)
+	}
+	return d.Events.GetBroadcasts(overhead, limit)
 }
 
 // LocalState is used for a TCP Push/Pull. This is sent to
 // the remote side in addition to the membership information.
-func (Delegate) LocalState(join bool) []byte {
-	return make([]byte, 0)
+func (d Delegate) LocalState(join bool) []byte {
+	if d.State == nil {
+		return make([]byte, 0)
+	}
+	return d.State.LocalState()
 }
 
 // MergeRemoteState is invoked after a TCP Push/Pull.
-func (Delegate) MergeRemoteState(buf []byte, join bool) {}
+func (d Delegate) MergeRemoteState(buf []byte, join bool) {
+	if d.State != nil {
+		d.State.MergeRemoteState(buf)
+	}
+}
 
 // NotifyMsg is called when a user-data message is received.
-func (Delegate) NotifyMsg([]byte) {}
+func (d Delegate) NotifyMsg(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	switch messageType(msg[0]) {
+	case keyringMessage:
+		if d.Keys != nil {
+			d.Keys.handleMessage(msg[1:])
+		}
+	case eventMessage:
+		if d.Events != nil {
+			d.Events.handleMessage(msg[1:])
+		}
+	default:
+		log.Printf("Ignoring message of unknown type %d\n", msg[0])
+	}
+}
 
 // NewEventDelegate instantiates a new EventDelegate struct
 func NewEventDelegate(d []memberlist.EventDelegate) *EventDelegate {
 	return &EventDelegate{eventDelegates: d}
 }
 
+// Add adds a delegate, notified of the membership events from then on
+func (ed *EventDelegate) Add(delegate memberlist.EventDelegate) {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	ed.eventDelegates = append(ed.eventDelegates, delegate)
+}
+
 // NotifyJoin is invoked when a node is detected to have joined.
 // The Node argument must not be modified.
 func (ed *EventDelegate) NotifyJoin(node *memberlist.Node) {
+	ed.mu.RLock()
+	defer ed.mu.RUnlock()
 	for _, delegate := range ed.eventDelegates {
 		delegate.NotifyJoin(node)
 	}
@@ -98,6 +171,8 @@ func (ed *EventDelegate) NotifyJoin(node *memberlist.Node) {
 // NotifyLeave is invoked when a node is detected to have left.
 // The Node argument must not be modified.
 func (ed *EventDelegate) NotifyLeave(node *memberlist.Node) {
+	ed.mu.RLock()
+	defer ed.mu.RUnlock()
 	for _, delegate := range ed.eventDelegates {
 		delegate.NotifyLeave(node)
 	}
@@ -107,27 +182,27 @@ func (ed *EventDelegate) NotifyLeave(node *memberlist.Node) {
 // updated, usually involving the meta data. The Node argument
 // must not be modified.
 func (ed *EventDelegate) NotifyUpdate(node *memberlist.Node) {
+	ed.mu.RLock()
+	defer ed.mu.RUnlock()
 	for _, delegate := range ed.eventDelegates {
 		delegate.NotifyUpdate(node)
 	}
 }
 
-// DecodeNodeMeta decodes node meta data from bytes into something useful
-func DecodeNodeMeta(nodeMeta []byte) NodeMeta {
-	dec := gob.NewDecoder(bytes.NewReader(nodeMeta))
-	var meta NodeMeta
-	err := dec.Decode(&meta)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return meta
+// FilterMembers filters down the memberlist to return only nodes of the given type, nodes
+// whose metadata can't be read, i.e: running an incompatible version, are left out
+func FilterMembers(memberType NodeType, list *memberlist.Memberlist) []*memberlist.Node {
+	return filterNodes(memberType, list.Members())
 }
 
-// FilterMembers filters down the memberlist to return only nodes of the given type
-func FilterMembers(memberType NodeType, list *memberlist.Memberlist) []*memberlist.Node {
+func filterNodes(memberType NodeType, members []*memberlist.Node) []*memberlist.Node {
 	var nodes []*memberlist.Node
-	for _, member := range list.Members() {
-		meta := DecodeNodeMeta(member.Meta)
+	for _, member := range members {
+		meta, err := DecodeNodeMeta(member.Meta)
+		if err != nil {
+			log.Printf("Skipping node %s: %s\n", member.Name, err)
+			continue
+		}
 		if meta.NodeType == memberType {
 			nodes = append(nodes, member)
 		}
@@ -146,14 +221,32 @@ func FilterMembersByFn(filter MemberFilter, list *memberlist.Memberlist) []*memb
 	return nodes
 }
 
-// SearchForCluster searches for a cluster to join
-func SearchForCluster() *zeroconf.ServiceEntry {
+// IsMemberAddress returns whether a node of the cluster, other than this one, has the given IP address
+func IsMemberAddress(list *memberlist.Memberlist, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	self := list.LocalNode().Name
+	for _, member := range list.Members() {
+		if member.Name != self && member.Addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchForCluster searches for a node of the cluster with the given id to join, the nodes
+// skip returns true for, by name, are passed over. i.e: this node and the ones already joined
+func SearchForCluster(clusterID string, skip func(name string) bool) *zeroconf.ServiceEntry {
 	// next we use mdns to try to find a cluster to join.
 	// the curent leader (and receiving airplay server)
 	// will be broadcasting a service to join
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
-		log.Fatalln("Failed to initialize resolver:", err.Error())
+		// i.e: no multicast capable interface, there may still be seeds to join through
+		log.Println("Failed to initialize resolver:", err.Error())
+		return nil
 	}
 
 	entries := make(chan *zeroconf.ServiceEntry)
@@ -162,20 +255,28 @@ func SearchForCluster() *zeroconf.ServiceEntry {
 	defer cancel()
 	err = resolver.Browse(ctx, ServiceType, "local", entries)
 	if err != nil {
-		log.Fatalln("Failed to browse:", err.Error())
+		log.Println("Failed to browse:", err.Error())
+		return nil
 	}
 	log.Println("searching for cluster to join")
 	var entry *zeroconf.ServiceEntry
 	foundEntry := make(chan *zeroconf.ServiceEntry)
 	// what we do is spin of a goroutine that will process the entries registered in
-	// mDNS for our service.  As soon as we detect there is one with an IP4 address
-	// we send it off and cancel to stop the searching.
+	// mDNS for our service.  As soon as we detect there is one with an address we
+	// can join on we send it off and cancel to stop the searching.
 	// there is an issue, https://github.com/grandcat/zeroconf/issues/27 where we
-	// could get an entry back without an IP4 addr, it will come in later as an update
+	// could get an entry back without an addr, it will come in later as an update
 	// so we wait until we find the addr, or timeout
 	go func(results <-chan *zeroconf.ServiceEntry, foundEntry chan *zeroconf.ServiceEntry) {
 		for e := range results {
-			if (len(e.AddrIPv4)) > 0 {
+			if id := entryClusterID(e); id != clusterID {
+				log.Printf("Passing over %s, it belongs to cluster %q\n", e.Instance, id)
+				continue
+			}
+			if skip != nil && skip(e.Instance) {
+				continue
+			}
+			if len(entryAddresses(e)) > 0 {
 				foundEntry <- e
 				cancel()
 			}
@@ -183,7 +284,7 @@ func SearchForCluster() *zeroconf.ServiceEntry {
 	}(entries, foundEntry)
 
 	select {
-	// this should be ok, since we only expect one service of the _bobcaygeon_ type to be found
+	// this should be ok, since we only expect one cluster with our id to be found
 	case entry = <-foundEntry:
 		log.Println("Found cluster to join")
 	case <-ctx.Done():
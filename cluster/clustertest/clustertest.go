@@ -0,0 +1,67 @@
+// Package clustertest runs cluster nodes in process for tests
+package clustertest
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Timeout is how long to wait for something to arrive from the cluster
+const Timeout = 5 * time.Second
+
+// NewList creates a memberlist on loopback that is shut down with the test, configure sets up
+// the delegates and anything else of the config before it's created
+func NewList(t testing.TB, name string, configure func(*memberlist.Config)) *memberlist.Memberlist {
+	t.Helper()
+	c := memberlist.DefaultLocalConfig()
+	c.Name = name
+	c.BindAddr = "127.0.0.1"
+	c.BindPort = 0
+	c.LogOutput = io.Discard
+	if configure != nil {
+		configure(c)
+	}
+	list, err := memberlist.Create(c)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	t.Cleanup(func() {
+		list.Shutdown()
+	})
+	return list
+}
+
+// Address is where other lists join the list
+func Address(list *memberlist.Memberlist) string {
+	return fmt.Sprintf("127.0.0.1:%d", list.LocalNode().Port)
+}
+
+// Join joins the list to the cluster other is in
+func Join(t testing.TB, list *memberlist.Memberlist, other *memberlist.Memberlist) {
+	t.Helper()
+	_, err := list.Join([]string{Address(other)})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+}
+
+// Receive waits for the next value on the channel, failing the test when it's closed or
+// nothing arrives in time
+func Receive[T any](t testing.TB, values <-chan T) T {
+	t.Helper()
+	select {
+	case value, ok := <-values:
+		if !ok {
+			t.Fatal("Unexpected close of the channel")
+		}
+		return value
+	case <-time.After(Timeout):
+		t.Fatal("Timed out waiting for a value")
+	}
+	var none T
+	return none
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// NodeConfig is how a node takes part in the cluster, the [node] settings every kind of node has
+type NodeConfig struct {
+	Name        string `toml:"name"`
+	ClusterPort int    `toml:"cluster-port"`
+	// ClusterID keeps clusters sharing a network apart, only nodes with the same id join each other
+	ClusterID string `toml:"cluster-id"`
+	// EncryptKey is the base64 encoded key to encrypt gossip with, KeyringFile where the keys
+	// rotated in since are kept, taking precedence over EncryptKey once written
+	EncryptKey  string `toml:"encrypt-key"`
+	KeyringFile string `toml:"keyring-file"`
+	// BindAddr is the address to listen for cluster traffic on, "::" to take IPv6 peers too
+	BindAddr string `toml:"bind-addr"`
+	// AdvertiseAddr is the address other nodes reach this one on, needed when BindAddr is "::"
+	AdvertiseAddr string `toml:"advertise-addr"`
+	// Seeds are nodes to join the cluster through, for networks where mDNS doesn't get across
+	Seeds []string `toml:"seeds"`
+	// SRV is a DNS name with SRV records pointing at nodes to join
+	SRV         string `toml:"srv"`
+	DisableMDNS bool   `toml:"disable-mdns"`
+	// JoinAttempts is how many times to look for a cluster to join, JoinRetryInterval the seconds
+	// to wait after the first failed attempt
+	JoinAttempts      int `toml:"join-attempts"`
+	JoinRetryInterval int `toml:"join-retry-interval"`
+}
+
+// JoinConfig says where to look for the cluster to join, defaultAttempts is how many times to
+// look when not configured; 0 keeps looking until joined
+func (n NodeConfig) JoinConfig(defaultAttempts int) JoinConfig {
+	attempts := n.JoinAttempts
+	if attempts <= 0 {
+		attempts = defaultAttempts
+	}
+	return JoinConfig{
+		ClusterID:     n.ClusterID,
+		Seeds:         n.Seeds,
+		SRV:           n.SRV,
+		DisableMDNS:   n.DisableMDNS,
+		Attempts:      attempts,
+		RetryInterval: time.Duration(n.JoinRetryInterval) * time.Second,
+	}
+}
+
+// Gossip is what a node gossips with
+type Gossip struct {
+	// Config is the memberlist configuration, the Delegate and event delegate are left to set
+	Config *memberlist.Config
+	// Keys rotates the keys gossip is encrypted with
+	Keys *KeyManager
+	// Events are gossiped to, and from, every node
+	Events *EventBus
+}
+
+// NewGossip sets up the gossip of the node: its name and addresses, encryption with the keys
+// from the config, and a filter keeping the nodes of other clusters out
+func NewGossip(node NodeConfig) (*Gossip, error) {
+	err := ValidateClusterID(node.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+	c := memberlist.DefaultLANConfig()
+	c.Name = node.Name
+	c.BindPort = node.ClusterPort
+	c.AdvertisePort = node.ClusterPort
+	if node.BindAddr != "" {
+		c.BindAddr = node.BindAddr
+	}
+	c.AdvertiseAddr = node.AdvertiseAddr
+	keyring, err := LoadKeyring(node.EncryptKey, node.KeyringFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load gossip encryption keys: %w", err)
+	}
+	if keyring == nil {
+		log.Println("Gossip is not encrypted, any device on the network can join the cluster")
+	}
+	c.Keyring = keyring
+	clusterFilter := ClusterFilter{ClusterID: node.ClusterID}
+	c.Merge = clusterFilter
+	c.Alive = clusterFilter
+	return &Gossip{Config: c, Keys: NewKeyManager(keyring, node.KeyringFile), Events: NewEventBus(node.Name)}, nil
+}
@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+func TestNodeConfigEmbedded(t *testing.T) {
+	// the binaries embed NodeConfig in their [node] section
+	var config struct {
+		Node struct {
+			NodeConfig
+			APIPort int `toml:"api-port"`
+		} `toml:"node"`
+	}
+	err := toml.Unmarshal([]byte("[node]\nname = \"kitchen\"\ncluster-port = 7946\napi-port = 7777\nseeds = [\"10.0.0.2\"]\njoin-retry-interval = 2\n"), &config)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if config.Node.Name != "kitchen" || config.Node.ClusterPort != 7946 || config.Node.APIPort != 7777 {
+		t.Errorf("Unexpected config %+v", config.Node)
+	}
+	join := config.Node.JoinConfig(3)
+	if join.Attempts != 3 || join.RetryInterval != 2*time.Second || len(join.Seeds) != 1 {
+		t.Errorf("Unexpected join config %+v", join)
+	}
+}
+
+func TestNewGossip(t *testing.T) {
+	gossip, err := NewGossip(NodeConfig{Name: "kitchen", ClusterPort: 7946, ClusterID: "upstairs"})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if gossip.Config.Name != "kitchen" || gossip.Config.BindPort != 7946 || gossip.Config.AdvertisePort != 7946 {
+		t.Errorf("Unexpected memberlist config %+v", gossip.Config)
+	}
+	if gossip.Config.Keyring != nil || gossip.Config.Merge == nil || gossip.Config.Alive == nil {
+		t.Error("Expected unencrypted gossip keeping other clusters out")
+	}
+	if _, err := NewGossip(NodeConfig{Name: "kitchen", ClusterID: "not a valid id!"}); err == nil {
+		t.Error("Expected error for an invalid cluster id")
+	}
+}
@@ -0,0 +1,210 @@
+package cluster
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	defaultRetryInterval = 2 * time.Second
+	maxRetryInterval     = 30 * time.Second
+)
+
+// ErrNoCluster is returned when there is no cluster to join
+var ErrNoCluster = errors.New("no cluster to join")
+
+// JoinConfig says where to look for a cluster to join and how hard to try, the static
+// seeds, the SRV records and mDNS are all used together
+type JoinConfig struct {
+	// ClusterID is the cluster to join, mDNS entries of other clusters are passed over
+	ClusterID string
+	// Seeds are nodes to join: host, host:port, IPv6 address or [IPv6 address]:port. Without
+	// a port the cluster port of this node is used
+	Seeds []string
+	// SRV is a DNS name with SRV records pointing at nodes to join, i.e: _bobcaygeon._tcp.example.com
+	SRV string
+	// DisableMDNS stops browsing for the cluster with mDNS, for networks without multicast
+	DisableMDNS bool
+	// Attempts is how many times to look for and join the cluster, 0 keeps trying until joined
+	Attempts int
+	// RetryInterval is how long to wait after the first failed attempt, doubled after every attempt
+	RetryInterval time.Duration
+}
+
+var (
+	// rejoinInterval is how often a node left alone looks for the cluster again
+	rejoinInterval = 30 * time.Second
+	// mergeInterval is how often a node of a cluster looks for the nodes it doesn't know of, so
+	// clusters that formed apart, i.e: while the network was split, merge
+	mergeInterval = 5 * time.Minute
+)
+
+// lookupSRV looks up SRV records, swapped out in tests
+var lookupSRV = net.LookupSRV
+
+// searchMDNS browses mDNS for the addresses of a node of the cluster to join, passing over the
+// nodes skip returns true for, swapped out in tests
+var searchMDNS = func(clusterID string, skip func(name string) bool) []string {
+	return entryAddresses(SearchForCluster(clusterID, skip))
+}
+
+// FindPeers returns the addresses of the nodes to try joining, from the seeds, the SRV records and mDNS
+func FindPeers(config JoinConfig) []string {
+	return findPeers(config, nil)
+}
+
+// findPeers returns the addresses of the nodes to try joining, the nodes found with mDNS that
+// skip returns true for are passed over
+func findPeers(config JoinConfig, skip func(name string) bool) []string {
+	var peers []string
+	seen := make(map[string]bool)
+	add := func(addresses ...string) {
+		for _, address := range addresses {
+			if address != "" && !seen[address] {
+				seen[address] = true
+				peers = append(peers, address)
+			}
+		}
+	}
+	// memberlist takes care of seeds without a port, including bare IPv6 addresses
+	for _, seed := range config.Seeds {
+		add(strings.TrimSpace(seed))
+	}
+	if config.SRV != "" {
+		add(resolveSRV(config.SRV)...)
+	}
+	if !config.DisableMDNS {
+		add(searchMDNS(config.ClusterID, skip)...)
+	}
+	return peers
+}
+
+// JoinCluster looks for and joins the cluster, retrying as configured. ErrNoCluster
+// is returned if no other node could be found or reached
+func JoinCluster(list *memberlist.Memberlist, config JoinConfig) error {
+	wait := config.RetryInterval
+	if wait <= 0 {
+		wait = defaultRetryInterval
+	}
+	err := ErrNoCluster
+	for attempt := 1; config.Attempts <= 0 || attempt <= config.Attempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("Could not join cluster: %s, retrying in %s\n", err, wait)
+			time.Sleep(wait)
+			wait = min(wait*2, maxRetryInterval)
+		}
+		// our own mDNS entry may be found, it's passed over along with the members
+		peers := findPeers(config, isMember(list))
+		if len(peers) == 0 {
+			err = ErrNoCluster
+			continue
+		}
+		log.Println("Joining cluster through", strings.Join(peers, ", "))
+		_, err = list.Join(peers)
+		if err != nil {
+			continue
+		}
+		// the seeds or SRV records may include this node, which doesn't make a cluster
+		if list.NumMembers() > 1 {
+			return nil
+		}
+		err = ErrNoCluster
+	}
+	return err
+}
+
+// KeepJoining keeps looking for the cluster in the background, until stopped; every so often
+// while alone, and now and then once in a cluster so clusters that formed apart merge
+func KeepJoining(list *memberlist.Memberlist, config JoinConfig) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			wait := mergeInterval
+			if list.NumMembers() <= 1 {
+				wait = rejoinInterval
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(wait):
+			}
+			peers := findPeers(config, isMember(list))
+			if len(peers) == 0 {
+				continue
+			}
+			before := list.NumMembers()
+			// joining the members we have is harmless, it syncs state with them
+			_, err := list.Join(peers)
+			if err != nil {
+				log.Println("Could not join cluster:", err)
+				continue
+			}
+			if after := list.NumMembers(); after > before {
+				log.Printf("Joined %d more nodes of the cluster\n", after-before)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+		<-stopped
+	}
+}
+
+// isMember returns whether the node with the given name is a member of the list, this node included
+func isMember(list *memberlist.Memberlist) func(name string) bool {
+	names := make(map[string]bool)
+	for _, node := range list.Members() {
+		names[node.Name] = true
+	}
+	return func(name string) bool {
+		return names[name]
+	}
+}
+
+// resolveSRV returns the addresses of the targets of the SRV records of the given name
+func resolveSRV(name string) []string {
+	_, records, err := lookupSRV("", "", name)
+	if err != nil {
+		log.Printf("Could not look up SRV records for %s: %s\n", name, err)
+		return nil
+	}
+	addresses := make([]string, 0, len(records))
+	// the records come sorted by priority, and randomized by weight within a priority
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	return addresses
+}
+
+// entryAddresses returns the addresses a mDNS entry can be joined on, IPv4 first. Link local
+// IPv6 addresses are left out, they can't be used without knowing the interface they are on
+func entryAddresses(entry *zeroconf.ServiceEntry) []string {
+	if entry == nil {
+		return nil
+	}
+	port := strconv.Itoa(entry.Port)
+	var addresses []string
+	for _, ip := range entry.AddrIPv4 {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	for _, ip := range entry.AddrIPv6 {
+		if !ip.IsLinkLocalUnicast() {
+			addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return addresses
+}
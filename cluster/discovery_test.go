@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/cluster/clustertest"
+)
+
+func stubDiscovery(t *testing.T, records []*net.SRV, mdns []string) {
+	origLookup, origSearch := lookupSRV, searchMDNS
+	t.Cleanup(func() {
+		lookupSRV, searchMDNS = origLookup, origSearch
+	})
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if records == nil {
+			return "", nil, errors.New("no such host")
+		}
+		return name, records, nil
+	}
+	searchMDNS = func(string, func(string) bool) []string {
+		return mdns
+	}
+}
+
+func TestFindPeers(t *testing.T) {
+	stubDiscovery(t, []*net.SRV{{Target: "bcg1.example.com.", Port: 7676}, {Target: "bcg2.example.com.", Port: 7677}},
+		[]string{"10.0.1.5:7676", "10.0.1.9:7676"})
+	peers := FindPeers(JoinConfig{Seeds: []string{" 10.0.1.5:7676", "fd00::5", "[fd00::6]:7676"}, SRV: "_bobcaygeon._tcp.example.com"})
+	expected := []string{"10.0.1.5:7676", "fd00::5", "[fd00::6]:7676", "bcg1.example.com:7676", "bcg2.example.com:7677", "10.0.1.9:7676"}
+	if !reflect.DeepEqual(expected, peers) {
+		t.Errorf("Expected %v got: %v", expected, peers)
+	}
+}
+
+func TestFindPeersWithoutMDNS(t *testing.T) {
+	stubDiscovery(t, nil, []string{"10.0.1.9:7676"})
+	peers := FindPeers(JoinConfig{Seeds: []string{"10.0.1.5"}, SRV: "_bobcaygeon._tcp.example.com", DisableMDNS: true})
+	// the failed SRV lookup leaves just the seed
+	expected := []string{"10.0.1.5"}
+	if !reflect.DeepEqual(expected, peers) {
+		t.Errorf("Expected %v got: %v", expected, peers)
+	}
+}
+
+func TestEntryAddresses(t *testing.T) {
+	entry := zeroconf.NewServiceEntry("node", ServiceType, "local.")
+	entry.Port = 7676
+	entry.AddrIPv4 = []net.IP{net.ParseIP("10.0.1.5")}
+	entry.AddrIPv6 = []net.IP{net.ParseIP("fe80::1"), net.ParseIP("fd00::5")}
+	addresses := entryAddresses(entry)
+	expected := []string{"10.0.1.5:7676", "[fd00::5]:7676"}
+	if !reflect.DeepEqual(expected, addresses) {
+		t.Errorf("Expected %v got: %v", expected, addresses)
+	}
+	if entryAddresses(nil) != nil {
+		t.Error("Expected no addresses for no entry")
+	}
+}
+
+func newTestList(t *testing.T, name string) *memberlist.Memberlist {
+	return newClusterTestList(t, name, "")
+}
+
+// newClusterTestList creates a memberlist on loopback for a node of the given cluster
+func newClusterTestList(t *testing.T, name string, clusterID string) *memberlist.Memberlist {
+	return clustertest.NewList(t, name, func(c *memberlist.Config) {
+		c.Delegate = Delegate{MetaData: &NodeMeta{ClusterID: clusterID, NodeType: Music}}
+		filter := ClusterFilter{ClusterID: clusterID}
+		c.Merge = filter
+		c.Alive = filter
+	})
+}
+
+func TestJoinCluster(t *testing.T) {
+	stubDiscovery(t, nil, nil)
+	first := newTestList(t, "first")
+	second := newTestList(t, "second")
+	seed := fmt.Sprintf("127.0.0.1:%d", first.LocalNode().Port)
+	err := JoinCluster(second, JoinConfig{Seeds: []string{seed}, Attempts: 1})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if second.NumMembers() != 2 {
+		t.Errorf("Expected 2 members got: %d", second.NumMembers())
+	}
+}
+
+func TestJoinClusterGivesUp(t *testing.T) {
+	stubDiscovery(t, nil, nil)
+	list := newTestList(t, "alone")
+	config := JoinConfig{Attempts: 2, RetryInterval: time.Millisecond}
+	if err := JoinCluster(list, config); err != ErrNoCluster {
+		t.Errorf("Expected ErrNoCluster got: %v", err)
+	}
+	// a seed pointing back at this node doesn't make a cluster
+	config.Seeds = []string{fmt.Sprintf("127.0.0.1:%d", list.LocalNode().Port)}
+	if err := JoinCluster(list, config); err != ErrNoCluster {
+		t.Errorf("Expected ErrNoCluster got: %v", err)
+	}
+}
+
+func TestKeepJoiningMergesClusters(t *testing.T) {
+	origRejoin, origMerge := rejoinInterval, mergeInterval
+	rejoinInterval, mergeInterval = 10*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		rejoinInterval, mergeInterval = origRejoin, origMerge
+	})
+	// the network was split when the nodes started, so both lead a cluster of their own
+	den := newElectionTestNode(t, "den")
+	den.start(t, nil)
+	kitchen := newElectionTestNode(t, "kitchen")
+	kitchen.start(t, nil)
+	waitForLeader(t, den, den)
+	waitForLeader(t, kitchen, kitchen)
+
+	stubDiscovery(t, nil, []string{clustertest.Address(den.list)})
+	stop := KeepJoining(kitchen.list, JoinConfig{})
+	defer stop()
+	waitForLeader(t, den, den, kitchen)
+	if !isMember(kitchen.list)("den") || !isMember(den.list)("kitchen") {
+		t.Error("Expected the clusters to merge")
+	}
+	if isMember(kitchen.list)("bedroom") {
+		t.Error("Expected bedroom not to be a member")
+	}
+}
@@ -0,0 +1,207 @@
+package cluster
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// electionSettle is how long membership is left to settle before holding an election, as it
+// changes in bursts; a node joining hears of the other nodes one at a time
+const electionSettle = 500 * time.Millisecond
+
+// Election elects, among the music nodes of a cluster without a management node, the one leader
+// taking AirPlay streams and forwarding them to the other music nodes. Whether a node leads is
+// gossiped in its metadata; the leader with the lowest name keeps leading, so nodes joining don't
+// take over, and when there is none, i.e: it left, the music node with the lowest name takes
+// over. While a management node is a member the zones it sets up decide, so no election is held
+type Election struct {
+	node string
+	// delegate is told about membership changes while this node leads
+	delegate memberlist.EventDelegate
+	// onChange is called when this node starts, or stops, leading
+	onChange func(leading bool)
+	settle   time.Duration
+	list     atomic.Pointer[memberlist.Memberlist]
+	trigger  chan struct{}
+	done     chan struct{}
+	stop     sync.Once
+
+	mu      sync.Mutex
+	leading bool
+	// members holds the metadata of the members as notified, memberlist updates the
+	// metadata of the nodes it hands out in place
+	members map[string]NodeMeta
+}
+
+// NewElection instantiates an Election for the node with the given name, delegate is told
+// about membership changes while the node leads, to forward to the nodes joining
+func NewElection(node string, delegate memberlist.EventDelegate, onChange func(leading bool)) *Election {
+	return &Election{
+		node:     node,
+		delegate: delegate,
+		onChange: onChange,
+		settle:   electionSettle,
+		trigger:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		members:  make(map[string]NodeMeta),
+	}
+}
+
+// Start starts holding elections among the members of the list, one right away and one
+// whenever membership changes. The Election must be the event delegate of the list, and
+// started once the node joined the cluster, so it doesn't lead a cluster of its own first
+func (e *Election) Start(list *memberlist.Memberlist) {
+	e.list.Store(list)
+	go e.run()
+	e.hold()
+}
+
+// Stop stops holding elections
+func (e *Election) Stop() {
+	e.stop.Do(func() {
+		close(e.done)
+	})
+}
+
+// Leading returns whether this node is the leader
+func (e *Election) Leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading
+}
+
+// NotifyJoin is invoked when a node is detected to have joined.
+// The Node argument must not be modified.
+func (e *Election) NotifyJoin(node *memberlist.Node) {
+	e.setMember(node)
+	if e.delegate != nil && node.Name != e.node && e.Leading() {
+		e.delegate.NotifyJoin(node)
+	}
+	e.hold()
+}
+
+// NotifyLeave is invoked when a node is detected to have left.
+// The Node argument must not be modified.
+func (e *Election) NotifyLeave(node *memberlist.Node) {
+	e.mu.Lock()
+	delete(e.members, node.Name)
+	e.mu.Unlock()
+	if e.delegate != nil && node.Name != e.node && e.Leading() {
+		e.delegate.NotifyLeave(node)
+	}
+	e.hold()
+}
+
+// NotifyUpdate is invoked when a node is detected to have
+// updated, usually involving the meta data. The Node argument
+// must not be modified.
+func (e *Election) NotifyUpdate(node *memberlist.Node) {
+	e.setMember(node)
+	if e.delegate != nil && node.Name != e.node && e.Leading() {
+		e.delegate.NotifyUpdate(node)
+	}
+	// nodes starting or stopping to lead say so through their metadata
+	e.hold()
+}
+
+// setMember keeps the metadata of the member, the nodes we can't read are left out
+// as they can't be forwarded to either
+func (e *Election) setMember(node *memberlist.Node) {
+	meta, err := DecodeNodeMeta(node.Meta)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		delete(e.members, node.Name)
+		return
+	}
+	e.members[node.Name] = meta
+}
+
+// hold has an election held, memberlist notifies of membership changes with the members
+// locked so elections, which update the metadata of this node, are held apart
+func (e *Election) hold() {
+	select {
+	case e.trigger <- struct{}{}:
+	default:
+		// one is due already
+	}
+}
+
+func (e *Election) run() {
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-e.trigger:
+		}
+		select {
+		case <-e.done:
+			return
+		case <-time.After(e.settle):
+		}
+		e.elect()
+	}
+}
+
+// elect elects the leader among the members, updating the metadata of this node, and
+// telling onChange, when it starts or stops leading
+func (e *Election) elect() {
+	e.mu.Lock()
+	// a management node coordinates the cluster, nobody leads next to it
+	leader, ok := electLeader(e.node, e.leading, e.members)
+	leading := ok && leader == e.node
+	changed := leading != e.leading
+	e.leading = leading
+	e.mu.Unlock()
+	if !changed {
+		return
+	}
+	if leading {
+		log.Println("Elected leader")
+	} else if !ok {
+		log.Println("Stepping down, a management node joined")
+	} else {
+		log.Printf("Stepping down, %s is leader\n", leader)
+	}
+	// the other nodes learn who leads through our metadata
+	err := e.list.Load().UpdateNode(0)
+	if err != nil {
+		log.Println("Could not update node metadata", err)
+	}
+	if e.onChange != nil {
+		e.onChange(leading)
+	}
+}
+
+// electLeader returns the name of the music node to lead among the members, false when a
+// management node is a member. leading is whether this node leads, its metadata in the
+// members may not be up to date yet
+func electLeader(self string, leading bool, members map[string]NodeMeta) (string, bool) {
+	// this node takes part, even before hearing about itself
+	leader, lowest := "", self
+	if leading {
+		leader = self
+	}
+	for name, meta := range members {
+		if meta.NodeType == Mgmt {
+			return "", false
+		}
+		if meta.NodeType != Music || name == self {
+			continue
+		}
+		if meta.Leader && (leader == "" || name < leader) {
+			leader = name
+		}
+		if name < lowest {
+			lowest = name
+		}
+	}
+	if leader != "" {
+		return leader, true
+	}
+	return lowest, true
+}
@@ -0,0 +1,159 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/cluster/clustertest"
+)
+
+func TestElectLeader(t *testing.T) {
+	kitchen := NodeMeta{NodeType: Music}
+	den := NodeMeta{NodeType: Music}
+	patio := NodeMeta{NodeType: Music, Leader: true}
+	frontend := NodeMeta{NodeType: Frontend}
+
+	for _, tc := range []struct {
+		name     string
+		self     string
+		leading  bool
+		members  map[string]NodeMeta
+		expected string
+	}{
+		{"lowest name without a leader", "kitchen", false, map[string]NodeMeta{"kitchen": kitchen, "den": den, "a-frontend": frontend}, "den"},
+		{"leader keeps leading", "den", false, map[string]NodeMeta{"kitchen": kitchen, "den": den, "patio": patio}, "patio"},
+		{"lowest named leader wins", "kitchen", true, map[string]NodeMeta{"kitchen": kitchen, "den": den, "patio": patio}, "kitchen"},
+		{"alone", "kitchen", false, nil, "kitchen"},
+	} {
+		leader, ok := electLeader(tc.self, tc.leading, tc.members)
+		if !ok || leader != tc.expected {
+			t.Errorf("%s: expected %s got: %s %v", tc.name, tc.expected, leader, ok)
+		}
+	}
+	mgmt := NodeMeta{NodeType: Mgmt}
+	if _, ok := electLeader("kitchen", false, map[string]NodeMeta{"den": den, "mgmt": mgmt}); ok {
+		t.Error("Expected no election with a management node")
+	}
+}
+
+// recordingDelegate records the names of the nodes it is told joined
+type recordingDelegate struct {
+	joined chan string
+}
+
+func (d recordingDelegate) NotifyJoin(node *memberlist.Node) {
+	d.joined <- node.Name
+}
+
+func (recordingDelegate) NotifyLeave(*memberlist.Node) {}
+
+func (recordingDelegate) NotifyUpdate(*memberlist.Node) {}
+
+type electionNode struct {
+	list     *memberlist.Memberlist
+	election *Election
+	joined   chan string
+	changes  chan bool
+}
+
+func newElectionTestNode(t *testing.T, name string) *electionNode {
+	node := &electionNode{joined: make(chan string, 16), changes: make(chan bool, 16)}
+	node.election = NewElection(name, recordingDelegate{joined: node.joined}, func(leading bool) {
+		node.changes <- leading
+	})
+	node.election.settle = 10 * time.Millisecond
+	node.list = clustertest.NewList(t, name, func(c *memberlist.Config) {
+		c.GossipInterval = 10 * time.Millisecond
+		c.Delegate = Delegate{MetaData: &NodeMeta{NodeType: Music}, Election: node.election}
+		c.Events = node.election
+	})
+	t.Cleanup(node.election.Stop)
+	return node
+}
+
+// start starts the election of the node, after joining the other node when given
+func (n *electionNode) start(t *testing.T, other *electionNode) {
+	if other != nil {
+		n.join(t, other)
+	}
+	n.election.Start(n.list)
+}
+
+func (n *electionNode) join(t *testing.T, other *electionNode) {
+	clustertest.Join(t, n.list, other.list)
+}
+
+// waitForLeader waits for the given node to be the only one of the nodes leading
+func waitForLeader(t *testing.T, leader *electionNode, nodes ...*electionNode) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var leading []string
+		for _, node := range nodes {
+			if node.election.Leading() {
+				leading = append(leading, node.list.LocalNode().Name)
+			}
+		}
+		if len(leading) == 1 && leading[0] == leader.list.LocalNode().Name {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be the only leader got: %v", leader.list.LocalNode().Name, leading)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestElection(t *testing.T) {
+	// both start a cluster of their own, so both lead
+	den := newElectionTestNode(t, "den")
+	den.start(t, nil)
+	kitchen := newElectionTestNode(t, "kitchen")
+	kitchen.start(t, nil)
+	waitForLeader(t, den, den)
+	waitForLeader(t, kitchen, kitchen)
+
+	kitchen.join(t, den)
+	waitForLeader(t, den, den, kitchen)
+
+	// a node joining doesn't take over, even with a lower name
+	bedroom := newElectionTestNode(t, "bedroom")
+	bedroom.start(t, den)
+	waitForLeader(t, den, den, kitchen, bedroom)
+	// and the leader forwards to it
+	deadline := time.After(5 * time.Second)
+	for joined := ""; joined != "bedroom"; {
+		select {
+		case joined = <-den.joined:
+		case <-deadline:
+			t.Fatal("Expected the leader to be told bedroom joined")
+		}
+	}
+
+	// when the leader leaves another node takes over
+	err := den.list.Leave(time.Second)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	waitForLeader(t, bedroom, kitchen, bedroom)
+}
+
+func TestElectionStepsDownForMgmt(t *testing.T) {
+	den := newElectionTestNode(t, "den")
+	den.start(t, nil)
+	waitForLeader(t, den, den)
+	if !clustertest.Receive(t, den.changes) {
+		t.Fatal("Expected den to be told it leads")
+	}
+
+	mgmt := clustertest.NewList(t, "mgmt", func(c *memberlist.Config) {
+		c.Delegate = Delegate{MetaData: &NodeMeta{NodeType: Mgmt}}
+	})
+	clustertest.Join(t, mgmt, den.list)
+	if clustertest.Receive(t, den.changes) {
+		t.Error("Expected den to be told it stopped leading")
+	}
+	if den.election.Leading() {
+		t.Error("Expected den to step down when a management node joins")
+	}
+}
@@ -0,0 +1,252 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// EventType says what happened in the cluster
+type EventType string
+
+const (
+	// TrackChanged a receiver started playing another track, the payload is a TrackInfo
+	TrackChanged EventType = "track-changed"
+	// VolumeChanged the volume of a receiver changed, the payload is a VolumeInfo
+	VolumeChanged EventType = "volume-changed"
+	// SessionStarted a receiver started streaming, the payload is a SessionInfo
+	SessionStarted EventType = "session-started"
+	// SessionStopped a receiver stopped streaming, the payload is a SessionInfo
+	SessionStopped EventType = "session-stopped"
+	// ZoneChanged a zone was created, updated or deleted, the payload is a ZoneInfo
+	ZoneChanged EventType = "zone-changed"
+)
+
+const (
+	// maxEventSize keeps an event, along with the headers and encryption, within a single gossip packet
+	maxEventSize = 1024
+	// eventRetransmitMult is how many times, scaled by the size of the cluster, an event is gossiped
+	eventRetransmitMult = 4
+	// seenEvents is how many event ids are remembered to drop the copies gossip delivers
+	seenEvents = 1024
+	// subscriptionBuffer is how many events a subscriber can fall behind before events are dropped for it
+	subscriptionBuffer = 64
+)
+
+// ErrEventTooLarge is returned when publishing an event that doesn't fit in a gossip packet
+var ErrEventTooLarge = errors.New("event too large")
+
+// Event is something that happened on a node, gossiped to every node of the cluster
+type Event struct {
+	Type EventType `json:"type"`
+	// Node is the name of the node the event happened on
+	Node string `json:"node"`
+	// Seq tells the events of a node apart
+	Seq     uint64          `json:"seq"`
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode decodes the payload of the event into the info type of the event type
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// DefaultReceiverID is the id of the receiver of a music node taking part in the cluster, the
+// others are virtual receivers making zones of their own
+const DefaultReceiverID = "default"
+
+// TrackInfo is the payload of TrackChanged events
+type TrackInfo struct {
+	ReceiverID  string `json:"receiver"`
+	Artist      string `json:"artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Title       string `json:"title,omitempty"`
+	ArtworkHash string `json:"artwork,omitempty"`
+}
+
+// VolumeInfo is the payload of VolumeChanged events
+type VolumeInfo struct {
+	ReceiverID string `json:"receiver"`
+	// Volume is between 0 (mute) and 1 (full volume)
+	Volume float64 `json:"volume"`
+}
+
+// SessionInfo is the payload of SessionStarted and SessionStopped events
+type SessionInfo struct {
+	ReceiverID string `json:"receiver"`
+}
+
+// ZoneInfo is the payload of ZoneChanged events
+type ZoneInfo struct {
+	ZoneID      string   `json:"zone"`
+	DisplayName string   `json:"name,omitempty"`
+	SpeakerIDs  []string `json:"speakers,omitempty"`
+	Deleted     bool     `json:"deleted,omitempty"`
+}
+
+type eventID struct {
+	node string
+	seq  uint64
+}
+
+// eventBroadcast is an event queued for gossiping
+type eventBroadcast struct {
+	msg []byte
+}
+
+// Invalidates returns false, every event is delivered
+func (eventBroadcast) Invalidates(memberlist.Broadcast) bool {
+	return false
+}
+
+// Message returns the message to gossip
+func (b eventBroadcast) Message() []byte {
+	return b.msg
+}
+
+// Finished is invoked when the event is done being gossiped
+func (eventBroadcast) Finished() {}
+
+// EventBus gossips events to every node of the cluster, and hands the events of
+// every node, this one included, to the subscribers of this node
+type EventBus struct {
+	node  string
+	queue *memberlist.TransmitLimitedQueue
+	list  atomic.Pointer[memberlist.Memberlist]
+	seq   atomic.Uint64
+
+	mu          sync.Mutex
+	seen        map[eventID]bool
+	seenOrder   []eventID
+	subscribers map[*subscription]bool
+}
+
+type subscription struct {
+	events chan Event
+	// types are the event types subscribed to, all of them when empty
+	types map[EventType]bool
+}
+
+// NewEventBus instantiates an EventBus for the node with the given name
+func NewEventBus(node string) *EventBus {
+	bus := &EventBus{node: node, seen: make(map[eventID]bool), subscribers: make(map[*subscription]bool)}
+	bus.queue = &memberlist.TransmitLimitedQueue{NumNodes: bus.numNodes, RetransmitMult: eventRetransmitMult}
+	// starting from the time keeps the sequence going up across restarts, so the
+	// events of a restarted node aren't taken for ones already seen
+	bus.seq.Store(uint64(time.Now().UnixNano()))
+	return bus
+}
+
+// SetMemberlist sets the memberlist the events are gossiped over, until it is set
+// events are only handed to the subscribers of this node
+func (b *EventBus) SetMemberlist(list *memberlist.Memberlist) {
+	b.list.Store(list)
+}
+
+func (b *EventBus) numNodes() int {
+	list := b.list.Load()
+	if list == nil {
+		return 1
+	}
+	return list.NumMembers()
+}
+
+// Publish gossips an event of the given type to the cluster, the payload is the info type of the event type
+func (b *EventBus) Publish(eventType EventType, payload interface{}) error {
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	event := Event{Type: eventType, Node: b.node, Seq: b.seq.Add(1), Time: time.Now(), Payload: encodedPayload}
+	msg, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	if len(msg) > maxEventSize {
+		return fmt.Errorf("%w: %s is %d bytes", ErrEventTooLarge, eventType, len(msg))
+	}
+	b.deliver(event, msg)
+	return nil
+}
+
+// Subscribe subscribes to events of the given types, or all events when none are given. Events
+// are dropped for subscribers falling behind, the returned function ends the subscription
+func (b *EventBus) Subscribe(types ...EventType) (<-chan Event, func()) {
+	sub := &subscription{events: make(chan Event, subscriptionBuffer), types: make(map[EventType]bool)}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+	b.mu.Lock()
+	b.subscribers[sub] = true
+	b.mu.Unlock()
+	var once sync.Once
+	return sub.events, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+			close(sub.events)
+		})
+	}
+}
+
+// GetBroadcasts returns the events to piggyback on gossip messages
+func (b *EventBus) GetBroadcasts(overhead, limit int) [][]byte {
+	return b.queue.GetBroadcasts(overhead, limit)
+}
+
+// handleMessage handles an event gossiped by another node
+func (b *EventBus) handleMessage(payload []byte) {
+	var event Event
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		log.Println("Invalid event message", err)
+		return
+	}
+	// the message is only valid for the duration of the call
+	msg := append([]byte{byte(eventMessage)}, payload...)
+	b.deliver(event, msg)
+}
+
+// deliver hands the event to the subscribers and queues it to be gossiped on, unless it was seen before
+func (b *EventBus) deliver(event Event, msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := eventID{node: event.Node, seq: event.Seq}
+	if b.seen[id] {
+		return
+	}
+	b.seen[id] = true
+	b.seenOrder = append(b.seenOrder, id)
+	if len(b.seenOrder) > seenEvents {
+		delete(b.seen, b.seenOrder[0])
+		b.seenOrder = b.seenOrder[1:]
+	}
+	// every node passes the event on, so it reaches the nodes the publisher didn't gossip to
+	b.queue.QueueBroadcast(eventBroadcast{msg: msg})
+	for sub := range b.subscribers {
+		if len(sub.types) > 0 && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			log.Printf("Subscriber falling behind, dropping %s event from %s\n", event.Type, event.Node)
+		}
+	}
+}
+
+func encodeEvent(event Event) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(eventMessage)}, payload...), nil
+}
@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/cluster/clustertest"
+)
+
+func TestPublishToLocalSubscribers(t *testing.T) {
+	bus := NewEventBus("node")
+	tracks, unsubscribeTracks := bus.Subscribe(TrackChanged)
+	defer unsubscribeTracks()
+	all, unsubscribeAll := bus.Subscribe()
+	defer unsubscribeAll()
+
+	err := bus.Publish(VolumeChanged, VolumeInfo{ReceiverID: "kitchen", Volume: 0.5})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	err = bus.Publish(TrackChanged, TrackInfo{ReceiverID: "kitchen", Artist: "The Tragically Hip", Title: "Bobcaygeon"})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	event := clustertest.Receive(t, all)
+	var volume VolumeInfo
+	if err := event.Decode(&volume); err != nil || event.Type != VolumeChanged || volume.Volume != 0.5 {
+		t.Errorf("Unexpected event %+v: %+v %v", event, volume, err)
+	}
+	if event.Node != "node" {
+		t.Errorf("Expected the event to come from node got: %s", event.Node)
+	}
+	if event := clustertest.Receive(t, all); event.Type != TrackChanged {
+		t.Errorf("Expected a track changed event got: %s", event.Type)
+	}
+	// the volume change isn't for the track subscriber
+	event = clustertest.Receive(t, tracks)
+	var track TrackInfo
+	if err := event.Decode(&track); err != nil || event.Type != TrackChanged || track.Title != "Bobcaygeon" {
+		t.Errorf("Unexpected event %+v: %+v %v", event, track, err)
+	}
+}
+
+func TestEventsDeliveredOnce(t *testing.T) {
+	publisher := NewEventBus("publisher")
+	bus := NewEventBus("node")
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	err := publisher.Publish(SessionStarted, SessionInfo{ReceiverID: "default"})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	msgs := publisher.GetBroadcasts(0, 1400)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 broadcast got: %d", len(msgs))
+	}
+	// gossip delivers the same event more than once
+	bus.handleMessage(msgs[0][1:])
+	bus.handleMessage(msgs[0][1:])
+	clustertest.Receive(t, events)
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected second delivery %+v", event)
+	default:
+	}
+	// and the node passes it on
+	if msgs := bus.GetBroadcasts(0, 1400); len(msgs) != 1 {
+		t.Errorf("Expected the event to be queued for gossip got: %d", len(msgs))
+	}
+}
+
+func TestPublishTooLarge(t *testing.T) {
+	bus := NewEventBus("node")
+	err := bus.Publish(TrackChanged, TrackInfo{Title: strings.Repeat("a", maxEventSize)})
+	if !errors.Is(err, ErrEventTooLarge) {
+		t.Errorf("Expected ErrEventTooLarge got: %v", err)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	bus := NewEventBus("node")
+	events, unsubscribe := bus.Subscribe()
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Error("Expected the channel to be closed")
+	}
+	if err := bus.Publish(SessionStopped, SessionInfo{}); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func newEventTestList(t *testing.T, name string) (*memberlist.Memberlist, *EventBus) {
+	events := NewEventBus(name)
+	list := clustertest.NewList(t, name, func(c *memberlist.Config) {
+		c.GossipInterval = 10 * time.Millisecond
+		c.Delegate = Delegate{MetaData: &NodeMeta{NodeType: Music}, Events: events}
+	})
+	events.SetMemberlist(list)
+	return list, events
+}
+
+func TestEventsReachEveryNode(t *testing.T) {
+	first, firstEvents := newEventTestList(t, "first")
+	var subscriptions []<-chan Event
+	for i := 0; i < 3; i++ {
+		list, events := newEventTestList(t, fmt.Sprintf("node-%d", i))
+		clustertest.Join(t, list, first)
+		subscription, unsubscribe := events.Subscribe(ZoneChanged)
+		defer unsubscribe()
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	zone := ZoneInfo{ZoneID: "1", DisplayName: "Downstairs", SpeakerIDs: []string{"node-0", "node-1"}}
+	err := firstEvents.Publish(ZoneChanged, zone)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for _, subscription := range subscriptions {
+		event := clustertest.Receive(t, subscription)
+		var received ZoneInfo
+		if err := event.Decode(&received); err != nil || !reflect.DeepEqual(zone, received) {
+			t.Errorf("Expected %+v got: %+v %v", zone, received, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// clusterIDKey is the key of the mDNS TXT record carrying the cluster id
+	clusterIDKey = "cluster"
+	// maxClusterIDLength keeps the id well within a TXT record string
+	maxClusterIDLength = 63
+)
+
+// ValidateClusterID checks the cluster id is usable, the empty id is the default cluster
+func ValidateClusterID(id string) error {
+	if len(id) > maxClusterIDLength {
+		return fmt.Errorf("cluster id %q is longer than %d characters", id, maxClusterIDLength)
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("cluster id %q may only hold letters, digits, '-', '_' and '.'", id)
+		}
+	}
+	return nil
+}
+
+// TXTRecords returns the mDNS TXT records to advertise the cluster with
+func TXTRecords(clusterID string) []string {
+	records := []string{"txtv=0", "lo=1", "la=2"}
+	if clusterID != "" {
+		records = append(records, clusterIDKey+"="+clusterID)
+	}
+	return records
+}
+
+// entryClusterID returns the cluster id advertised by a mDNS entry, empty for the default
+// cluster, which nodes from before cluster ids were introduced belong to
+func entryClusterID(entry *zeroconf.ServiceEntry) string {
+	for _, record := range entry.Text {
+		key, value, found := strings.Cut(record, "=")
+		if found && key == clusterIDKey {
+			return value
+		}
+	}
+	return ""
+}
+
+// ClusterFilter keeps nodes of other clusters out of the memberlist, both when
+// joining and when hearing about nodes through gossip
+type ClusterFilter struct {
+	ClusterID string
+}
+
+// NotifyMerge is invoked when joining a cluster, cancelling the join if any of
+// the peers belongs to another cluster
+func (f ClusterFilter) NotifyMerge(peers []*memberlist.Node) error {
+	for _, peer := range peers {
+		if err := f.check(peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotifyAlive is invoked when hearing about a live node, ignoring it if it belongs to another cluster
+func (f ClusterFilter) NotifyAlive(peer *memberlist.Node) error {
+	return f.check(peer)
+}
+
+func (f ClusterFilter) check(peer *memberlist.Node) error {
+	meta, err := DecodeNodeMeta(peer.Meta)
+	if err != nil {
+		// nodes we can't read are left out of FilterMembers anyways, so the default
+		// cluster lets them in. Named clusters need proof of membership
+		if f.ClusterID == "" {
+			return nil
+		}
+		return fmt.Errorf("node %s: %w", peer.Name, err)
+	}
+	if meta.ClusterID != f.ClusterID {
+		return fmt.Errorf("node %s belongs to cluster %q, not %q", peer.Name, meta.ClusterID, f.ClusterID)
+	}
+	return nil
+}
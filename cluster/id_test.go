@@ -0,0 +1,93 @@
+package cluster
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/hashicorp/memberlist"
+)
+
+func TestValidateClusterID(t *testing.T) {
+	for _, id := range []string{"", "upstairs", "test-1.office_2"} {
+		if err := ValidateClusterID(id); err != nil {
+			t.Errorf("Expected %q to be valid got: %s", id, err)
+		}
+	}
+	for _, id := range []string{"up stairs", "a=b", strings.Repeat("a", 64)} {
+		if err := ValidateClusterID(id); err == nil {
+			t.Errorf("Expected %q to be invalid", id)
+		}
+	}
+}
+
+func TestEntryClusterID(t *testing.T) {
+	entry := zeroconf.NewServiceEntry("node", ServiceType, "local.")
+	entry.Text = TXTRecords("upstairs")
+	if id := entryClusterID(entry); id != "upstairs" {
+		t.Errorf("Expected upstairs got: %s", id)
+	}
+	entry.Text = TXTRecords("")
+	if !reflect.DeepEqual([]string{"txtv=0", "lo=1", "la=2"}, entry.Text) {
+		t.Errorf("Unexpected records for the default cluster: %v", entry.Text)
+	}
+	if id := entryClusterID(entry); id != "" {
+		t.Errorf("Expected the default cluster got: %s", id)
+	}
+}
+
+func nodeOf(t *testing.T, name string, clusterID string) *memberlist.Node {
+	meta, err := EncodeNodeMeta(&NodeMeta{ClusterID: clusterID})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return &memberlist.Node{Name: name, Meta: meta}
+}
+
+func TestClusterFilter(t *testing.T) {
+	filter := ClusterFilter{ClusterID: "upstairs"}
+	if err := filter.NotifyAlive(nodeOf(t, "a", "upstairs")); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if err := filter.NotifyAlive(nodeOf(t, "b", "downstairs")); err == nil {
+		t.Error("Expected a node of another cluster to be rejected")
+	}
+	if err := filter.NotifyAlive(nodeOf(t, "c", "")); err == nil {
+		t.Error("Expected a node of the default cluster to be rejected")
+	}
+	if err := filter.NotifyAlive(&memberlist.Node{Name: "d", Meta: []byte("garbage")}); err == nil {
+		t.Error("Expected a node with unreadable metadata to be rejected")
+	}
+	if err := filter.NotifyMerge([]*memberlist.Node{nodeOf(t, "a", "upstairs"), nodeOf(t, "b", "downstairs")}); err == nil {
+		t.Error("Expected a merge with a node of another cluster to be cancelled")
+	}
+	// the default cluster lets in nodes it can't read, as it did before cluster ids
+	if err := (ClusterFilter{}).NotifyAlive(&memberlist.Node{Name: "d", Meta: []byte("garbage")}); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestClustersStaySeparate(t *testing.T) {
+	stubDiscovery(t, nil, nil)
+	upstairs := newClusterTestList(t, "upstairs-1", "upstairs")
+	downstairs := newClusterTestList(t, "downstairs-1", "downstairs")
+	joining := newClusterTestList(t, "upstairs-2", "upstairs")
+
+	seeds := []string{fmt.Sprintf("127.0.0.1:%d", downstairs.LocalNode().Port)}
+	if err := JoinCluster(joining, JoinConfig{ClusterID: "upstairs", Seeds: seeds, Attempts: 1}); err == nil {
+		t.Error("Expected joining another cluster to fail")
+	}
+	if joining.NumMembers() != 1 || downstairs.NumMembers() != 1 {
+		t.Errorf("Expected the clusters to stay separate, got %d and %d members", joining.NumMembers(), downstairs.NumMembers())
+	}
+
+	seeds = []string{fmt.Sprintf("127.0.0.1:%d", upstairs.LocalNode().Port)}
+	if err := JoinCluster(joining, JoinConfig{ClusterID: "upstairs", Seeds: seeds, Attempts: 1}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if joining.NumMembers() != 2 {
+		t.Errorf("Expected 2 members got: %d", joining.NumMembers())
+	}
+}
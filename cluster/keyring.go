@@ -0,0 +1,225 @@
+package cluster
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// KeyOperation is an operation on the keyring gossip is encrypted with
+type KeyOperation string
+
+const (
+	// KeyInstall adds a key to the keyring, nodes then accept messages encrypted with it
+	KeyInstall KeyOperation = "install"
+	// KeyUse makes an installed key the primary key, nodes then encrypt messages with it
+	KeyUse KeyOperation = "use"
+	// KeyRemove removes a key from the keyring, the primary key can't be removed
+	KeyRemove KeyOperation = "remove"
+)
+
+// ErrEncryptionDisabled is returned for keyring operations on a node without gossip encryption,
+// which can only be turned on by configuring a key and restarting the node
+var ErrEncryptionDisabled = errors.New("gossip encryption is not enabled")
+
+// DecodeKey decodes a base64 encoded gossip encryption key, which must be 16, 24 or 32 bytes
+// to select AES-128, AES-192 or AES-256
+func DecodeKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	if err := memberlist.ValidateKey(decoded); err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return decoded, nil
+}
+
+// LoadKeyring builds the keyring to encrypt gossip with. The keyring file, once it exists, takes
+// precedence over the encrypt key as it holds the keys rotated in since. Without either nil is
+// returned, leaving gossip unencrypted
+func LoadKeyring(encryptKey string, keyringFile string) (*memberlist.Keyring, error) {
+	var keys []string
+	if keyringFile != "" {
+		data, err := os.ReadFile(keyringFile)
+		switch {
+		case err == nil:
+			err = json.Unmarshal(data, &keys)
+			if err != nil {
+				return nil, fmt.Errorf("invalid keyring file %s: %w", keyringFile, err)
+			}
+			if len(keys) == 0 {
+				return nil, fmt.Errorf("keyring file %s holds no keys", keyringFile)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, err
+		}
+	}
+	if len(keys) == 0 && encryptKey != "" {
+		keys = []string{encryptKey}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	decoded := make([][]byte, len(keys))
+	for i, key := range keys {
+		var err error
+		decoded[i], err = DecodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the first key is the primary one
+	keyring, err := memberlist.NewKeyring(decoded[1:], decoded[0])
+	if err != nil {
+		return nil, err
+	}
+	if keyringFile != "" {
+		err = writeKeyring(keyring, keyringFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keyring, nil
+}
+
+// writeKeyring writes the keys of the keyring to the file, primary key first. The keys are
+// written to a temporary file renamed over the keyring file, so it never holds only some of them
+func writeKeyring(keyring *memberlist.Keyring, keyringFile string) error {
+	data, err := json.Marshal(encodeKeys(keyring))
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(keyringFile), filepath.Base(keyringFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), keyringFile)
+}
+
+// encodeKeys returns the base64 encoded keys of the keyring, primary key first
+func encodeKeys(keyring *memberlist.Keyring) []string {
+	var keys []string
+	for _, key := range keyring.GetKeys() {
+		keys = append(keys, base64.StdEncoding.EncodeToString(key))
+	}
+	return keys
+}
+
+// keyMessage is sent to other nodes to have them apply a keyring operation
+type keyMessage struct {
+	Operation KeyOperation `json:"op"`
+	Key       string       `json:"key"`
+}
+
+// KeyManager applies keyring operations to this node, and to the rest of the cluster, keeping
+// the keyring file, if there is one, up to date so rotated keys survive restarts
+type KeyManager struct {
+	keyring     *memberlist.Keyring
+	keyringFile string
+	mu          sync.Mutex
+}
+
+// NewKeyManager instantiates a KeyManager for the keyring, which is nil when gossip isn't encrypted
+func NewKeyManager(keyring *memberlist.Keyring, keyringFile string) *KeyManager {
+	return &KeyManager{keyring: keyring, keyringFile: keyringFile}
+}
+
+// ListKeys returns the base64 encoded keys of this node, primary key first
+func (km *KeyManager) ListKeys() ([]string, error) {
+	if km.keyring == nil {
+		return nil, ErrEncryptionDisabled
+	}
+	return encodeKeys(km.keyring), nil
+}
+
+// Apply applies the keyring operation to this node, then sends it to every other member of
+// the cluster. The names of the members it couldn't be sent to are returned
+func (km *KeyManager) Apply(list *memberlist.Memberlist, op KeyOperation, key string) ([]string, error) {
+	err := km.apply(op, key)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(keyMessage{Operation: op, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte{byte(keyringMessage)}, payload...)
+	var failed []string
+	for _, member := range list.Members() {
+		if member.Name == list.LocalNode().Name {
+			continue
+		}
+		err := list.SendReliable(member, msg)
+		if err != nil {
+			log.Printf("Could not send keyring operation to %s: %s\n", member.Name, err)
+			failed = append(failed, member.Name)
+		}
+	}
+	return failed, nil
+}
+
+// apply applies the keyring operation to this node only
+func (km *KeyManager) apply(op KeyOperation, key string) error {
+	if km.keyring == nil {
+		return ErrEncryptionDisabled
+	}
+	decoded, err := DecodeKey(key)
+	if err != nil {
+		return err
+	}
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	switch op {
+	case KeyInstall:
+		err = km.keyring.AddKey(decoded)
+	case KeyUse:
+		err = km.keyring.UseKey(decoded)
+	case KeyRemove:
+		err = km.keyring.RemoveKey(decoded)
+	default:
+		return fmt.Errorf("unknown keyring operation: %s", op)
+	}
+	if err != nil {
+		return err
+	}
+	if km.keyringFile != "" {
+		return writeKeyring(km.keyring, km.keyringFile)
+	}
+	return nil
+}
+
+// handleMessage applies a keyring operation sent by another node, the message having been
+// decrypted with our keyring is what makes it trusted
+func (km *KeyManager) handleMessage(payload []byte) {
+	var msg keyMessage
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		log.Println("Invalid keyring message", err)
+		return
+	}
+	err = km.apply(msg.Operation, msg.Key)
+	if err != nil {
+		log.Printf("Could not apply keyring operation %s: %s\n", msg.Operation, err)
+		return
+	}
+	log.Printf("Applied keyring operation %s\n", msg.Operation)
+}
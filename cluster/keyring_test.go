@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/cluster/clustertest"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestDecodeKey(t *testing.T) {
+	if _, err := DecodeKey(testKey('a')); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if _, err := DecodeKey("not base64!"); err == nil {
+		t.Error("Expected invalid base64 to be rejected")
+	}
+	if _, err := DecodeKey(base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Error("Expected a key of the wrong size to be rejected")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keyring, err := LoadKeyring("", "")
+	if err != nil || keyring != nil {
+		t.Errorf("Expected no keyring without keys, got: %v %v", keyring, err)
+	}
+	keyringFile := filepath.Join(t.TempDir(), "keyring.json")
+	keyring, err = LoadKeyring(testKey('a'), keyringFile)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if keys := encodeKeys(keyring); !reflect.DeepEqual([]string{testKey('a')}, keys) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	// the keyring file, written on the first load, wins over the configured key
+	err = os.WriteFile(keyringFile, []byte(fmt.Sprintf(`["%s","%s"]`, testKey('b'), testKey('a'))), 0600)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	keyring, err = LoadKeyring(testKey('a'), keyringFile)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if primary := base64.StdEncoding.EncodeToString(keyring.GetPrimaryKey()); primary != testKey('b') {
+		t.Errorf("Expected the primary key from the keyring file got: %s", primary)
+	}
+	if _, err := LoadKeyring("bad", ""); err == nil {
+		t.Error("Expected an invalid key to be rejected")
+	}
+}
+
+func TestKeyManagerDisabled(t *testing.T) {
+	keys := NewKeyManager(nil, "")
+	if _, err := keys.ListKeys(); err != ErrEncryptionDisabled {
+		t.Errorf("Expected ErrEncryptionDisabled got: %v", err)
+	}
+	if err := keys.apply(KeyInstall, testKey('a')); err != ErrEncryptionDisabled {
+		t.Errorf("Expected ErrEncryptionDisabled got: %v", err)
+	}
+}
+
+func newEncryptedTestList(t *testing.T, name string, keyringFile string) (*memberlist.Memberlist, *KeyManager) {
+	keyring, err := LoadKeyring(testKey('a'), keyringFile)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	keys := NewKeyManager(keyring, keyringFile)
+	list := clustertest.NewList(t, name, func(c *memberlist.Config) {
+		c.Keyring = keyring
+		c.Delegate = Delegate{MetaData: &NodeMeta{NodeType: Music}, Keys: keys}
+	})
+	return list, keys
+}
+
+func waitForKeys(t *testing.T, keys *KeyManager, expected []string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		current, _ := keys.ListKeys()
+		if reflect.DeepEqual(expected, current) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected keys %v got: %v", expected, current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	mgmt, mgmtKeys := newEncryptedTestList(t, "mgmt", "")
+	keyringFile := filepath.Join(t.TempDir(), "keyring.json")
+	speaker, speakerKeys := newEncryptedTestList(t, "speaker", keyringFile)
+	clustertest.Join(t, speaker, mgmt)
+
+	for _, step := range []struct {
+		op       KeyOperation
+		key      string
+		expected []string
+	}{
+		{KeyInstall, testKey('b'), []string{testKey('a'), testKey('b')}},
+		{KeyUse, testKey('b'), []string{testKey('b'), testKey('a')}},
+		{KeyRemove, testKey('a'), []string{testKey('b')}},
+	} {
+		failed, err := mgmtKeys.Apply(mgmt, step.op, step.key)
+		if err != nil || len(failed) > 0 {
+			t.Fatalf("Unexpected result for %s: %v %v", step.op, failed, err)
+		}
+		waitForKeys(t, mgmtKeys, step.expected)
+		waitForKeys(t, speakerKeys, step.expected)
+	}
+
+	// the rotated keys survive a restart
+	keyring, err := LoadKeyring(testKey('a'), keyringFile)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if keys := encodeKeys(keyring); !reflect.DeepEqual([]string{testKey('b')}, keys) {
+		t.Errorf("Expected the rotated keys to be kept got: %v", keys)
+	}
+	if _, err := mgmtKeys.Apply(mgmt, KeyRemove, testKey('b')); err == nil {
+		t.Error("Expected removing the primary key to fail")
+	}
+	if mgmt.NumMembers() != 2 {
+		t.Errorf("Expected the nodes to still be members got: %d", mgmt.NumMembers())
+	}
+}
+
+func TestWriteKeyring(t *testing.T) {
+	dir := t.TempDir()
+	keyringFile := filepath.Join(dir, "keyring.json")
+	keyring, err := LoadKeyring(testKey('a'), keyringFile)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	err = keyring.AddKey([]byte(strings.Repeat("b", 32)))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	err = writeKeyring(keyring, keyringFile)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	info, err := os.Stat(keyringFile)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the keyring file to be private got: %v", info.Mode().Perm())
+	}
+	// no temporary files are left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the keyring file got: %v", entries)
+	}
+}
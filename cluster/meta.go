@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// Version is the software version nodes advertise, set at build time with
+// -ldflags "-X github.com/ibiscum/bobcaygeon/cluster.Version=<version>"
+var Version = "dev"
+
+const (
+	// metaVersion is bumped only for changes older nodes can't make sense of, fields can be
+	// added without bumping it as nodes ignore the fields they don't know about. Nodes from
+	// before versioning send no version, which decodes as 0
+	metaVersion = 1
+)
+
+// Capabilities describes what a node can do, for picking and tuning the nodes to stream to
+type Capabilities struct {
+	// Codecs are the encoding names, as in a SDP rtpmap, the node can play
+	Codecs          []string
+	SoftwareVersion string
+	HardwareModel   string
+	// OutputLatency is how long it takes audio handed to the node's output to be heard
+	OutputLatency time.Duration
+}
+
+// NodeMeta is metadata passed to other members about this node
+type NodeMeta struct {
+	// ClusterID is the cluster the node belongs to, empty for the default cluster
+	ClusterID    string
+	RtspPort     int
+	APIPort      int
+	RaftPort     int
+	NodeType     NodeType
+	Capabilities Capabilities
+	// Leader is set on the music node elected to take AirPlay streams and forward them to the others
+	Leader bool
+}
+
+// DefaultCapabilities returns the capabilities of this build running on this host
+func DefaultCapabilities(codecs []string) Capabilities {
+	return Capabilities{Codecs: codecs, SoftwareVersion: Version, HardwareModel: runtime.GOOS + "/" + runtime.GOARCH}
+}
+
+// gobMeta is how NodeMeta goes over the wire. The fields of the NodeMeta of nodes from before
+// versioning come first, under the same names, as gob matches fields by name; those nodes skip
+// the fields they don't know about, Version included
+type gobMeta struct {
+	RtspPort        int
+	APIPort         int
+	RaftPort        int
+	NodeType        NodeType
+	ClusterID       string
+	Codecs          []string
+	SoftwareVersion string
+	HardwareModel   string
+	// in milliseconds
+	OutputLatency int64
+	Leader        bool
+	Version       int
+}
+
+// EncodeNodeMeta encodes node metadata for sending to other members
+func EncodeNodeMeta(meta *NodeMeta) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&gobMeta{
+		RtspPort:        meta.RtspPort,
+		APIPort:         meta.APIPort,
+		RaftPort:        meta.RaftPort,
+		NodeType:        meta.NodeType,
+		ClusterID:       meta.ClusterID,
+		Codecs:          meta.Capabilities.Codecs,
+		SoftwareVersion: meta.Capabilities.SoftwareVersion,
+		HardwareModel:   meta.Capabilities.HardwareModel,
+		OutputLatency:   meta.Capabilities.OutputLatency.Milliseconds(),
+		Leader:          meta.Leader,
+		Version:         metaVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeNodeMeta decodes node meta data from bytes into something useful
+func DecodeNodeMeta(nodeMeta []byte) (NodeMeta, error) {
+	if len(nodeMeta) == 0 {
+		return NodeMeta{}, errors.New("no node metadata")
+	}
+	var wire gobMeta
+	err := gob.NewDecoder(bytes.NewReader(nodeMeta)).Decode(&wire)
+	if err != nil {
+		return NodeMeta{}, fmt.Errorf("invalid node metadata: %w", err)
+	}
+	if wire.Version > metaVersion {
+		return NodeMeta{}, fmt.Errorf("unsupported node metadata version: %d", wire.Version)
+	}
+	return NodeMeta{
+		ClusterID: wire.ClusterID,
+		RtspPort:  wire.RtspPort,
+		APIPort:   wire.APIPort,
+		RaftPort:  wire.RaftPort,
+		NodeType:  wire.NodeType,
+		Capabilities: Capabilities{
+			Codecs:          wire.Codecs,
+			SoftwareVersion: wire.SoftwareVersion,
+			HardwareModel:   wire.HardwareModel,
+			OutputLatency:   time.Duration(wire.OutputLatency) * time.Millisecond,
+		},
+		Leader: wire.Leader,
+	}, nil
+}
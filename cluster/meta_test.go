@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestNodeMetaRoundTrip(t *testing.T) {
+	meta := &NodeMeta{ClusterID: "upstairs", RtspPort: 5000, APIPort: 7777, NodeType: Music, Capabilities: Capabilities{
+		Codecs: []string{"AppleLossless"}, SoftwareVersion: "1.2.3", HardwareModel: "linux/arm", OutputLatency: 250 * time.Millisecond}}
+	encoded, err := EncodeNodeMeta(meta)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	decoded, err := DecodeNodeMeta(encoded)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !reflect.DeepEqual(*meta, decoded) {
+		t.Errorf("Expected %+v got: %+v", *meta, decoded)
+	}
+}
+
+// newerNodeMeta is metadata as sent by a newer node
+type newerNodeMeta struct {
+	RtspPort int
+	APIPort  int
+	NodeType NodeType
+	Speakers int
+	Version  int
+}
+
+func encodeGob(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeNodeMetaIgnoresUnknownFields(t *testing.T) {
+	meta, err := DecodeNodeMeta(encodeGob(t, &newerNodeMeta{RtspPort: 5000, APIPort: 7777, NodeType: Music, Speakers: 4, Version: metaVersion}))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if meta.RtspPort != 5000 || meta.APIPort != 7777 || meta.NodeType != Music {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+}
+
+// legacyNodeMeta is the NodeMeta of nodes from before the metadata was versioned
+type legacyNodeMeta struct {
+	RtspPort int
+	APIPort  int
+	RaftPort int
+	NodeType NodeType
+}
+
+func TestDecodeLegacyNodeMeta(t *testing.T) {
+	meta, err := DecodeNodeMeta(encodeGob(t, &legacyNodeMeta{APIPort: 7778, RaftPort: 7000, NodeType: Mgmt}))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if meta.APIPort != 7778 || meta.RaftPort != 7000 || meta.NodeType != Mgmt {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+}
+
+func TestLegacyNodesReadNodeMeta(t *testing.T) {
+	encoded, err := EncodeNodeMeta(&NodeMeta{ClusterID: "upstairs", RtspPort: 5000, APIPort: 7777, NodeType: Music,
+		Capabilities: Capabilities{Codecs: []string{"AppleLossless"}}, Leader: true})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// nodes from before versioning decode gob into their NodeMeta, and exit if they can't
+	var legacy legacyNodeMeta
+	err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(&legacy)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if legacy.RtspPort != 5000 || legacy.APIPort != 7777 || legacy.NodeType != Music {
+		t.Errorf("Unexpected metadata %+v", legacy)
+	}
+}
+
+func TestDecodeNodeMetaErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":           nil,
+		"unknown version": encodeGob(t, &newerNodeMeta{RtspPort: 5000, Version: metaVersion + 1}),
+		"garbage":         []byte("not metadata"),
+	}
+	for name, encoded := range tests {
+		if _, err := DecodeNodeMeta(encoded); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDelegateNodeMetaLimit(t *testing.T) {
+	codecs := make([]string, 100)
+	for i := range codecs {
+		codecs[i] = "SomeLongCodecName"
+	}
+	d := Delegate{MetaData: &NodeMeta{RtspPort: 5000, NodeType: Music, Capabilities: Capabilities{Codecs: codecs}}}
+	encoded := d.NodeMeta(memberlist.MetaMaxSize)
+	if len(encoded) == 0 || len(encoded) > memberlist.MetaMaxSize {
+		t.Fatal("Expected metadata within the limit, got bytes:", len(encoded))
+	}
+	meta, err := DecodeNodeMeta(encoded)
+	if err != nil || meta.RtspPort != 5000 || len(meta.Capabilities.Codecs) != 0 {
+		t.Errorf("Expected metadata without capabilities got: %+v %v", meta, err)
+	}
+}
+
+func TestFilterNodesSkipsUnreadable(t *testing.T) {
+	music, _ := EncodeNodeMeta(&NodeMeta{NodeType: Music})
+	mgmt, _ := EncodeNodeMeta(&NodeMeta{NodeType: Mgmt})
+	members := []*memberlist.Node{
+		{Name: "music", Meta: music},
+		{Name: "broken", Meta: []byte("bcg\x09")},
+		{Name: "mgmt", Meta: mgmt},
+	}
+	nodes := filterNodes(Music, members)
+	if len(nodes) != 1 || nodes[0].Name != "music" {
+		t.Error("Expected only the music node", nodes)
+	}
+}
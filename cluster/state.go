@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// stateVersion is the version of the state documents nodes exchange on push/pull
+const stateVersion = 1
+
+// ReceiverStatus is what a receiver of a node is doing
+type ReceiverStatus struct {
+	ID      string `json:"id"`
+	Playing bool   `json:"playing,omitempty"`
+	// TrackID is the persistent id the sender has for the current track, 0 when unknown
+	TrackID uint64  `json:"track,omitempty"`
+	Volume  float64 `json:"volume"`
+	Muted   bool    `json:"muted,omitempty"`
+	// Sender is the address of the sender streaming to the receiver, empty when none is
+	Sender string `json:"sender,omitempty"`
+	// ForwardingTo are the names of the nodes the receiver forwards audio to
+	ForwardingTo []string `json:"forwarding,omitempty"`
+}
+
+// NodeStatus is what a node is doing, as last heard from it
+type NodeStatus struct {
+	Node string `json:"node"`
+	// Version is when the status was taken by the node, in unix nanoseconds, telling newer statuses from older ones
+	Version   uint64           `json:"version"`
+	Receivers []ReceiverStatus `json:"receivers,omitempty"`
+}
+
+// Updated returns when the status was taken by the node
+func (s NodeStatus) Updated() time.Time {
+	return time.Unix(0, int64(s.Version))
+}
+
+// stateDocument is what nodes exchange on push/pull; the statuses of every node they know of,
+// so statuses spread beyond the nodes exchanging them
+type stateDocument struct {
+	Version int          `json:"v"`
+	Nodes   []NodeStatus `json:"nodes"`
+}
+
+// StateStore holds the statuses of every node of the cluster, kept eventually consistent
+// through the memberlist push/pull state exchange
+type StateStore struct {
+	node string
+	// local returns the status of the receivers of this node
+	local func() []ReceiverStatus
+	list  atomic.Pointer[memberlist.Memberlist]
+
+	mu       sync.RWMutex
+	statuses map[string]NodeStatus
+}
+
+// NewStateStore instantiates a StateStore for the node with the given name, local returns the
+// status of the receivers of the node, nil for nodes without receivers
+func NewStateStore(node string, local func() []ReceiverStatus) *StateStore {
+	return &StateStore{node: node, local: local, statuses: make(map[string]NodeStatus)}
+}
+
+// SetMemberlist sets the memberlist of the cluster, the statuses of nodes that left it are dropped
+func (s *StateStore) SetMemberlist(list *memberlist.Memberlist) {
+	s.list.Store(list)
+}
+
+// localStatus takes the status of this node
+func (s *StateStore) localStatus() NodeStatus {
+	status := NodeStatus{Node: s.node, Version: uint64(time.Now().UnixNano())}
+	if s.local != nil {
+		status.Receivers = s.local()
+	}
+	return status
+}
+
+// members returns the names of the members of the cluster, nil if the memberlist isn't set
+func (s *StateStore) members() map[string]bool {
+	list := s.list.Load()
+	if list == nil {
+		return nil
+	}
+	members := make(map[string]bool)
+	for _, member := range list.Members() {
+		members[member.Name] = true
+	}
+	return members
+}
+
+// Statuses returns the statuses of every node of the cluster, this one included, by node name
+func (s *StateStore) Statuses() []NodeStatus {
+	members := s.members()
+	s.mu.Lock()
+	statuses := []NodeStatus{s.localStatus()}
+	for node, status := range s.statuses {
+		if members != nil && !members[node] {
+			delete(s.statuses, node)
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	s.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Node < statuses[j].Node
+	})
+	return statuses
+}
+
+// Status returns the status of the given node
+func (s *StateStore) Status(node string) (NodeStatus, bool) {
+	if node == s.node {
+		return s.localStatus(), true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status, ok := s.statuses[node]
+	return status, ok
+}
+
+// LocalState returns the state document to send on push/pull
+func (s *StateStore) LocalState() []byte {
+	encoded, err := json.Marshal(stateDocument{Version: stateVersion, Nodes: s.Statuses()})
+	if err != nil {
+		log.Println("Error encoding node state", err)
+		return nil
+	}
+	return encoded
+}
+
+// MergeRemoteState merges the state document received on push/pull, keeping the newest status of every node
+func (s *StateStore) MergeRemoteState(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	var doc stateDocument
+	err := json.Unmarshal(buf, &doc)
+	if err != nil {
+		log.Println("Invalid node state", err)
+		return
+	}
+	if doc.Version != stateVersion {
+		log.Printf("Ignoring node state of unsupported version: %d\n", doc.Version)
+		return
+	}
+	members := s.members()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, status := range doc.Nodes {
+		// nobody knows better than us what we are doing
+		if status.Node == s.node || (members != nil && !members[status.Node]) {
+			continue
+		}
+		if current, ok := s.statuses[status.Node]; ok && current.Version >= status.Version {
+			continue
+		}
+		s.statuses[status.Node] = status
+	}
+}
@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/cluster/clustertest"
+)
+
+func stateOf(t *testing.T, nodes ...NodeStatus) []byte {
+	s := NewStateStore("remote", nil)
+	for _, status := range nodes {
+		s.statuses[status.Node] = status
+	}
+	doc := s.LocalState()
+	if doc == nil {
+		t.Fatal("Expected a state document")
+	}
+	return doc
+}
+
+func TestMergeRemoteStateKeepsNewest(t *testing.T) {
+	s := NewStateStore("local", func() []ReceiverStatus {
+		return []ReceiverStatus{{ID: "default", Volume: 1}}
+	})
+	kitchen := NodeStatus{Node: "kitchen", Version: 2, Receivers: []ReceiverStatus{{ID: "default", Playing: true, TrackID: 42, Volume: 0.5}}}
+	s.MergeRemoteState(stateOf(t, kitchen, NodeStatus{Node: "local", Version: uint64(time.Now().Add(time.Hour).UnixNano())}))
+	// an older status doesn't replace a newer one
+	s.MergeRemoteState(stateOf(t, NodeStatus{Node: "kitchen", Version: 1}))
+
+	status, ok := s.Status("kitchen")
+	if !ok || !reflect.DeepEqual(kitchen, status) {
+		t.Errorf("Expected %+v got: %+v", kitchen, status)
+	}
+	// what others think of us doesn't override what we know
+	local, _ := s.Status("local")
+	if len(local.Receivers) != 1 || local.Receivers[0].Volume != 1 {
+		t.Errorf("Unexpected local status %+v", local)
+	}
+	statuses := s.Statuses()
+	// the remote node sends its own status too
+	if len(statuses) != 3 || statuses[0].Node != "kitchen" || statuses[1].Node != "local" || statuses[2].Node != "remote" {
+		t.Errorf("Unexpected statuses %+v", statuses)
+	}
+}
+
+func TestMergeRemoteStateIgnoresUnknownVersions(t *testing.T) {
+	s := NewStateStore("local", nil)
+	s.MergeRemoteState([]byte(`{"v":2,"nodes":[{"node":"kitchen","version":1}]}`))
+	s.MergeRemoteState([]byte("garbage"))
+	s.MergeRemoteState(nil)
+	if _, ok := s.Status("kitchen"); ok {
+		t.Error("Expected state of an unknown version to be ignored")
+	}
+}
+
+func newStateTestList(t *testing.T, name string, receivers []ReceiverStatus) (*memberlist.Memberlist, *StateStore) {
+	state := NewStateStore(name, func() []ReceiverStatus {
+		return receivers
+	})
+	list := clustertest.NewList(t, name, func(c *memberlist.Config) {
+		c.Delegate = Delegate{MetaData: &NodeMeta{NodeType: Music}, State: state}
+	})
+	state.SetMemberlist(list)
+	return list, state
+}
+
+func TestStateExchangedOnJoin(t *testing.T) {
+	kitchenStatus := []ReceiverStatus{{ID: "default", Playing: true, TrackID: 42, Volume: 0.5, Sender: "10.0.1.20:51234", ForwardingTo: []string{"den"}}}
+	kitchen, _ := newStateTestList(t, "kitchen", kitchenStatus)
+	den, denState := newStateTestList(t, "den", []ReceiverStatus{{ID: "default", Volume: 1}})
+	clustertest.Join(t, den, kitchen)
+	status, ok := denState.Status("kitchen")
+	if !ok || !reflect.DeepEqual(kitchenStatus, status.Receivers) {
+		t.Errorf("Expected %+v got: %+v", kitchenStatus, status.Receivers)
+	}
+
+	// nodes that left are dropped
+	err := kitchen.Leave(time.Second)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(denState.Statuses()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the status of the node that left to be dropped got: %+v", denState.Statuses())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// MemberEventType says how the membership of the cluster changed
+type MemberEventType string
+
+const (
+	// MemberJoined a node joined the cluster
+	MemberJoined MemberEventType = "join"
+	// MemberLeft a node left the cluster, or was found dead
+	MemberLeft MemberEventType = "leave"
+	// MemberUpdated the metadata of a node changed
+	MemberUpdated MemberEventType = "update"
+)
+
+const (
+	// HealthAlive the node is a member of the cluster
+	HealthAlive = "alive"
+	// HealthLeft the node left the cluster, or was found dead; memberlist doesn't tell which
+	HealthLeft = "left"
+)
+
+// watchBuffer is how many events a watcher can fall behind before its watch is ended
+const watchBuffer = 64
+
+// Member is a node of the cluster, as last notified
+type Member struct {
+	Name string
+	Addr net.IP
+	Port uint16
+	// Meta is the metadata of the node, unless it couldn't be read; MetaErr then says why
+	Meta    NodeMeta
+	MetaErr error
+	// Health is alive while the node is a member, left once it isn't
+	Health string
+	// RTT is the round trip time of the last probe of the node from this one, 0 until probed
+	RTT time.Duration
+}
+
+// Address returns the address the node gossips on
+func (m Member) Address() string {
+	return net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port)))
+}
+
+// MemberEvent is a change in the membership of the cluster
+type MemberEvent struct {
+	Type   MemberEventType
+	Member Member
+	Time   time.Time
+}
+
+// MemberWatcher keeps track of the members of the cluster for watchers to follow along. It
+// is an event delegate, to be set before the memberlist is created so it knows of every member,
+// and a ping delegate to know the round trip times to them
+type MemberWatcher struct {
+	mu       sync.Mutex
+	members  map[string]Member
+	rtts     map[string]time.Duration
+	watchers map[chan MemberEvent]bool
+}
+
+// NewMemberWatcher instantiates a MemberWatcher
+func NewMemberWatcher() *MemberWatcher {
+	return &MemberWatcher{members: make(map[string]Member), rtts: make(map[string]time.Duration),
+		watchers: make(map[chan MemberEvent]bool)}
+}
+
+// Watch returns the current members, by name, and the changes to the membership from then
+// on. A watcher falling behind has the channel closed, to watch again for the members it
+// missed; the returned function ends the watch
+func (w *MemberWatcher) Watch() ([]Member, <-chan MemberEvent, func()) {
+	events := make(chan MemberEvent, watchBuffer)
+	w.mu.Lock()
+	members := make([]Member, 0, len(w.members))
+	for _, member := range w.members {
+		members = append(members, member)
+	}
+	w.watchers[events] = true
+	w.mu.Unlock()
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members, events, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.endWatch(events)
+	}
+}
+
+// endWatch closes the channel of the watch, unless it was ended before
+func (w *MemberWatcher) endWatch(events chan MemberEvent) {
+	if w.watchers[events] {
+		delete(w.watchers, events)
+		close(events)
+	}
+}
+
+// NotifyJoin is invoked when a node is detected to have joined.
+// The Node argument must not be modified.
+func (w *MemberWatcher) NotifyJoin(node *memberlist.Node) {
+	w.notify(MemberJoined, node)
+}
+
+// NotifyLeave is invoked when a node is detected to have left.
+// The Node argument must not be modified.
+func (w *MemberWatcher) NotifyLeave(node *memberlist.Node) {
+	w.notify(MemberLeft, node)
+}
+
+// NotifyUpdate is invoked when a node is detected to have
+// updated, usually involving the meta data. The Node argument
+// must not be modified.
+func (w *MemberWatcher) NotifyUpdate(node *memberlist.Node) {
+	w.notify(MemberUpdated, node)
+}
+
+// AckPayload is invoked when an ack is being sent; the returned bytes will be appended to the ack
+func (w *MemberWatcher) AckPayload() []byte {
+	return nil
+}
+
+// NotifyPingComplete is invoked when an ack for a ping is received
+func (w *MemberWatcher) NotifyPingComplete(other *memberlist.Node, rtt time.Duration, payload []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	member, ok := w.members[other.Name]
+	if !ok {
+		return
+	}
+	w.rtts[other.Name] = rtt
+	member.RTT = rtt
+	w.members[other.Name] = member
+}
+
+func (w *MemberWatcher) notify(eventType MemberEventType, node *memberlist.Node) {
+	// memberlist updates the node in place once we return, so we keep a copy
+	member := Member{Name: node.Name, Addr: append(net.IP(nil), node.Addr...), Port: node.Port, Health: HealthAlive}
+	if eventType == MemberLeft {
+		member.Health = HealthLeft
+	}
+	member.Meta, member.MetaErr = DecodeNodeMeta(node.Meta)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	member.RTT = w.rtts[node.Name]
+	event := MemberEvent{Type: eventType, Member: member, Time: time.Now()}
+	if eventType == MemberLeft {
+		delete(w.members, node.Name)
+		delete(w.rtts, node.Name)
+	} else {
+		w.members[node.Name] = member
+	}
+	for events := range w.watchers {
+		select {
+		case events <- event:
+		default:
+			w.endWatch(events)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/cluster/clustertest"
+)
+
+func newWatchedTestList(t *testing.T, name string, meta *NodeMeta) (*memberlist.Memberlist, *MemberWatcher) {
+	members := NewMemberWatcher()
+	list := clustertest.NewList(t, name, func(c *memberlist.Config) {
+		c.Delegate = Delegate{MetaData: meta}
+		c.Events = members
+		c.Ping = members
+	})
+	return list, members
+}
+
+func TestWatchMembers(t *testing.T) {
+	mgmt, members := newWatchedTestList(t, "mgmt", &NodeMeta{NodeType: Mgmt})
+	snapshot, events, stop := members.Watch()
+	defer stop()
+	if len(snapshot) != 1 || snapshot[0].Name != "mgmt" || snapshot[0].Meta.NodeType != Mgmt {
+		t.Fatalf("Expected the node itself in the snapshot got: %+v", snapshot)
+	}
+
+	kitchen, _ := newWatchedTestList(t, "kitchen", &NodeMeta{NodeType: Music, RtspPort: 5000, Capabilities: Capabilities{Codecs: []string{"AppleLossless"}}})
+	clustertest.Join(t, kitchen, mgmt)
+	event := clustertest.Receive(t, events)
+	member := event.Member
+	if event.Type != MemberJoined || member.Name != "kitchen" || member.Health != HealthAlive {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if member.MetaErr != nil || member.Meta.NodeType != Music || member.Meta.RtspPort != 5000 || len(member.Meta.Capabilities.Codecs) != 1 {
+		t.Errorf("Unexpected metadata %+v %v", member.Meta, member.MetaErr)
+	}
+	if expected := clustertest.Address(kitchen); member.Address() != expected {
+		t.Errorf("Expected address %s got: %s", expected, member.Address())
+	}
+
+	err := kitchen.Leave(time.Second)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	event = clustertest.Receive(t, events)
+	if event.Type != MemberLeft || event.Member.Name != "kitchen" || event.Member.Health != HealthLeft {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if snapshot, _, stop := members.Watch(); len(snapshot) != 1 {
+		t.Errorf("Expected the node that left to be gone got: %+v", snapshot)
+	} else {
+		stop()
+	}
+}
+
+func TestWatchFallingBehind(t *testing.T) {
+	members := NewMemberWatcher()
+	_, events, stop := members.Watch()
+	defer stop()
+	node := &memberlist.Node{Name: "kitchen", Meta: []byte("not metadata")}
+	for i := 0; i <= watchBuffer; i++ {
+		members.NotifyUpdate(node)
+	}
+	received := 0
+	for event := range events {
+		if event.Member.MetaErr == nil {
+			t.Errorf("Expected the metadata not to be readable got: %+v", event.Member.Meta)
+		}
+		received++
+	}
+	if received != watchBuffer {
+		t.Errorf("Expected %d events before the watch ended got: %d", watchBuffer, received)
+	}
+}
+
+func TestWatchRoundTripTimes(t *testing.T) {
+	members := NewMemberWatcher()
+	meta, err := EncodeNodeMeta(&NodeMeta{NodeType: Music})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	kitchen := &memberlist.Node{Name: "kitchen", Meta: meta}
+	// the nodes that aren't members are left out
+	members.NotifyPingComplete(kitchen, time.Millisecond, nil)
+	members.NotifyJoin(kitchen)
+	snapshot, events, stop := members.Watch()
+	defer stop()
+	if snapshot[0].RTT != 0 {
+		t.Errorf("Expected no round trip time before the node was probed got: %s", snapshot[0].RTT)
+	}
+	members.NotifyPingComplete(kitchen, 3*time.Millisecond, nil)
+	if snapshot, _, stop := members.Watch(); snapshot[0].RTT != 3*time.Millisecond {
+		t.Errorf("Expected the round trip time of the probe got: %s", snapshot[0].RTT)
+	} else {
+		stop()
+	}
+	members.NotifyUpdate(kitchen)
+	if event := clustertest.Receive(t, events); event.Member.RTT != 3*time.Millisecond || event.Member.Health != HealthAlive {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	members.NotifyLeave(kitchen)
+	if event := clustertest.Receive(t, events); event.Member.Health != HealthLeft {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
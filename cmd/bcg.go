@@ -8,14 +8,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/grandcat/zeroconf"
 	"github.com/hashicorp/memberlist"
 	"github.com/ibiscum/bobcaygeon/api"
 	"github.com/ibiscum/bobcaygeon/cluster"
 	"github.com/ibiscum/bobcaygeon/player"
-	"github.com/ibiscum/bobcaygeon/player/forwarding"
-	"github.com/ibiscum/bobcaygeon/raop"
+	"github.com/ibiscum/bobcaygeon/receiver"
 	"github.com/pelletier/go-toml"
 	"google.golang.org/grpc"
 
@@ -28,19 +28,34 @@ var (
 )
 
 type rtspConfig struct {
-	Name string `toml:"name"`
-	Port int    `toml:"port"`
+	Name        string `toml:"name"`
+	Port        int    `toml:"port"`
+	Password    string `toml:"password"`
+	Transport   string `toml:"transport"`
+	Arbitration string `toml:"arbitration"`
+	IdleTimeout int    `toml:"idle-timeout"`
+	// PrivateKeyFile and IdentityFile override the key and MAC address the receiver identifies itself with
+	PrivateKeyFile string `toml:"private-key-file"`
+	IdentityFile   string `toml:"identity-file"`
+	// ForwardPassword is the password of the nodes forwarded to, Password when not set
+	ForwardPassword string `toml:"forward-password"`
 }
 
+// defaultJoinAttempts is how many times to look for a cluster to join before starting one
+const defaultJoinAttempts = 3
+
 type nodeConfig struct {
-	APIPort     int    `toml:"api-port"`
-	ClusterPort int    `toml:"cluster-port"`
-	Name        string `toml:"name"`
+	cluster.NodeConfig
+	APIPort int `toml:"api-port"`
+	// OutputLatency is how many milliseconds it takes for audio played by the node to be heard
+	OutputLatency int `toml:"output-latency"`
 }
 
 type conf struct {
 	Node nodeConfig `toml:"node"`
 	Rtsp rtspConfig `toml:"rtsp"`
+	// additional virtual receivers, each advertised as its own AirPlay target
+	Receivers []receiver.Config `toml:"receivers"`
 }
 
 func main() {
@@ -72,74 +87,119 @@ func main() {
 	}
 	nodeName := config.Node.Name
 	log.Printf("Starting node: %s\n", nodeName)
-	metaData := &cluster.NodeMeta{RtspPort: config.Rtsp.Port, NodeType: cluster.Music, APIPort: config.Node.APIPort}
-	c := memberlist.DefaultLANConfig()
-	c.Name = nodeName
-	c.BindPort = config.Node.ClusterPort
-	c.AdvertisePort = config.Node.ClusterPort
-	c.Delegate = cluster.Delegate{MetaData: metaData}
-
-	list, err := memberlist.Create(c)
+	capabilities := cluster.DefaultCapabilities(player.Codecs())
+	capabilities.OutputLatency = time.Duration(config.Node.OutputLatency) * time.Millisecond
+	metaData := &cluster.NodeMeta{ClusterID: config.Node.ClusterID, RtspPort: config.Rtsp.Port, NodeType: cluster.Music, APIPort: config.Node.APIPort,
+		Capabilities: capabilities}
+	gossip, err := cluster.NewGossip(config.Node.NodeConfig)
 	if err != nil {
-		panic("Failed to create memberlist: " + err.Error())
+		log.Fatal(err)
 	}
-
-	var delegates []memberlist.EventDelegate
-	var streamPlayer player.Player
-	forwardingPlayer, err := forwarding.NewPlayer()
+	c, events := gossip.Config, gossip.Events
+	receivers := receiver.NewRegistry(*verbose)
+	receivers.SetEvents(events)
+	// the receiver from the [rtsp] section is the default one, it is the one taking
+	// part in the cluster; forwarded to by the leader, or forwarding when leader
+	defaultReceiver, err := receivers.Add(receiver.Config{
+		ID:              receiver.DefaultID,
+		Name:            config.Rtsp.Name,
+		Port:            config.Rtsp.Port,
+		Password:        config.Rtsp.Password,
+		ForwardPassword: config.Rtsp.ForwardPassword,
+		Transport:       config.Rtsp.Transport,
+		Arbitration:     config.Rtsp.Arbitration,
+		IdleTimeout:     config.Rtsp.IdleTimeout,
+		PrivateKeyFile:  config.Rtsp.PrivateKeyFile,
+		IdentityFile:    config.Rtsp.IdentityFile,
+	})
 	if err != nil {
-		panic("Failed to initialize player" + err.Error())
+		log.Fatal("Could not initialize receiver: ", err)
 	}
-	streamPlayer = forwardingPlayer
-	// we use our airplay server to handle both scenarios
-	// the "leader" and the "follower".  If we are a follower
-	// we don't advertise as an airplay server
-	advertise := false
-	// next we use mdns to try to find a cluster to join.
-	// the curent leader (and receiving airplay server)
-	// will be broadcasting a service to join
-	entry := cluster.SearchForCluster()
-
-	// if the entry is nil, then we didn't find a cluster to join, so assume leadership
-	if entry == nil {
-		log.Println("starting cluster, I am now initial leader")
-		delegates = append(delegates, forwardingPlayer)
-
-		nd := cluster.NewEventDelegate(delegates)
-		c.Events = nd
-
-		advertise = true
-	} else {
-		log.Println("Joining cluster")
-		_, err = list.Join([]string{fmt.Sprintf("%s:%d", entry.AddrIPv4[0].String(), entry.Port)})
+	for _, receiverConfig := range config.Receivers {
+		_, err := receivers.Add(receiverConfig)
 		if err != nil {
-			panic("Failed to join cluster: " + err.Error())
+			log.Fatal("Could not initialize receiver: ", err)
+		}
+	}
+	forwardingPlayer := defaultReceiver.Player
+	// the status of our receivers is shared with, along with the ones of, the other nodes
+	state := cluster.NewStateStore(nodeName, receivers.Status)
+	// we use our airplay server to handle both scenarios
+	// the "leader" and the "follower".  The elected leader advertises
+	// as an airplay server and forwards to the other music nodes
+	var list *memberlist.Memberlist
+	election := cluster.NewElection(nodeName, forwardingPlayer, func(leading bool) {
+		if leading {
+			for _, node := range cluster.FilterMembers(cluster.Music, list) {
+				if node.Name != nodeName {
+					forwardingPlayer.AddSessionForNode(node)
+				}
+			}
+		} else {
+			forwardingPlayer.RemoveAllSessions()
 		}
-		musicNodes := cluster.FilterMembers(cluster.Music, list)
-		if len(musicNodes) <= 1 {
-			log.Println("I am only music node, becoming leader")
-			delegates = append(delegates, forwardingPlayer)
-
-			nd := cluster.NewEventDelegate(delegates)
-			c.Events = nd
-			advertise = true
+		defaultReceiver.AirplayServer.ToggleAdvertise(leading)
+	})
+	c.Delegate = cluster.Delegate{MetaData: metaData, Keys: gossip.Keys, Events: events, State: state, Election: election}
+	c.Events = election
+
+	list, err = memberlist.Create(c)
+	if err != nil {
+		panic("Failed to create memberlist: " + err.Error())
+	}
+	events.SetMemberlist(list)
+	state.SetMemberlist(list)
+	receivers.SetMemberCheck(func(address string) bool {
+		return cluster.IsMemberAddress(list, address)
+	})
+
+	// start broadcasting the service, before searching so nodes starting at
+	// the same time find each other
+	if !config.Node.DisableMDNS {
+		log.Println("broadcasting my join info")
+		server, err := zeroconf.Register(nodeName, cluster.ServiceType, "local.", config.Node.ClusterPort, cluster.TXTRecords(config.Node.ClusterID), nil)
+		if err != nil {
+			log.Println("Error starting zeroconf service", err)
+		} else {
+			defer server.Shutdown()
 		}
 	}
 
-	// start broadcasting the service
-	log.Println("broadcasting my join info")
-	server, err := zeroconf.Register(nodeName, cluster.ServiceType, "local.", config.Node.ClusterPort, []string{"txtv=0", "lo=1", "la=2"}, nil)
+	// next we look for a cluster to join through the seeds, SRV records
+	// and mdns; the nodes of the cluster will be broadcasting a service to join
+	joinConfig := config.Node.JoinConfig(defaultJoinAttempts)
+	err = cluster.JoinCluster(list, joinConfig)
 	if err != nil {
-		log.Println("Error starting zeroconf service", err)
+		log.Println("No cluster joined:", err)
+		log.Println("starting cluster")
+	} else {
+		log.Println("Joined cluster")
 	}
-	defer server.Shutdown()
 
-	airplayServer := raop.NewAirplayServer(config.Rtsp.Port, config.Rtsp.Name, streamPlayer)
-	go airplayServer.Start(*verbose, advertise)
-	defer airplayServer.Stop()
+	// the default receiver is advertised once elected leader
+	defer receivers.StopAll()
+	err = defaultReceiver.Start(*verbose, false)
+	if err != nil {
+		log.Fatal("Error starting the receiver", err)
+	}
+	// virtual receivers are zones of their own, so they are always advertised
+	for _, rcv := range receivers.List() {
+		if rcv != defaultReceiver {
+			err = rcv.Start(*verbose, true)
+			if err != nil {
+				log.Fatalf("Error starting receiver %s: %s\n", rcv.ID, err)
+			}
+		}
+	}
+	election.Start(list)
+	defer election.Stop()
+	// keep looking for the cluster, when a cluster formed apart is joined the
+	// election leaves one leader
+	stopJoining := cluster.KeepJoining(list, joinConfig)
+	defer stopJoining()
 
 	// start the API server
-	go startAPIServer(config.Node.APIPort, airplayServer, forwardingPlayer, list)
+	go startAPIServer(config.Node.APIPort, receivers, list)
 
 	// Clean exit.
 	sig := make(chan os.Signal, 1)
@@ -155,14 +215,14 @@ func main() {
 	log.Println("Goodbye.")
 }
 
-func startAPIServer(apiServerPort int, airplayServer *raop.AirplayServer, forwardingPlayer *forwarding.Player, nodes *memberlist.Memberlist) {
+func startAPIServer(apiServerPort int, receivers *receiver.Registry, nodes *memberlist.Memberlist) {
 	// create a listener
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", apiServerPort))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 	// create a server instance
-	s := api.NewServer(airplayServer, forwardingPlayer, nodes)
+	s := api.NewServer(receivers, nodes)
 	// create a gRPC server object
 	grpcServer := grpc.NewServer()
 	// attach the Ping service to the server
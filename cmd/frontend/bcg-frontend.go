@@ -13,7 +13,6 @@ import (
 	"net/http"
 
 	petname "github.com/dustinkirkland/golang-petname"
-	"github.com/grandcat/zeroconf"
 	"github.com/hashicorp/memberlist"
 	"github.com/ibiscum/bobcaygeon/cluster"
 	"github.com/ibiscum/bobcaygeon/cmd/frontend/control"
@@ -27,10 +26,9 @@ var (
 )
 
 type nodeConfig struct {
-	APIPort       int    `toml:"api-port"`
-	ClusterPort   int    `toml:"cluster-port"`
-	Name          string `toml:"name"`
-	WebServerPort int    `toml:"web-server-port"`
+	cluster.NodeConfig
+	APIPort       int `toml:"api-port"`
+	WebServerPort int `toml:"web-server-port"`
 }
 
 type conf struct {
@@ -49,7 +47,11 @@ func newMemberHandler(cp *control.ControlPlane) *memberHandler {
 // The Node argument must not be modified.
 func (m *memberHandler) NotifyJoin(node *memberlist.Node) {
 	log.Println("Node Joined " + node.Name)
-	meta := cluster.DecodeNodeMeta(node.Meta)
+	meta, err := cluster.DecodeNodeMeta(node.Meta)
+	if err != nil {
+		log.Printf("Ignoring node %s: %s\n", node.Name, err)
+		return
+	}
 	if meta.NodeType == cluster.Mgmt {
 		ep := control.MgmtEndpoint{Host: node.Addr.String(), Port: uint32(meta.APIPort)}
 		m.cp.AddEndpoint(ep)
@@ -61,7 +63,11 @@ func (m *memberHandler) NotifyJoin(node *memberlist.Node) {
 // The Node argument must not be modified.
 func (m *memberHandler) NotifyLeave(node *memberlist.Node) {
 	log.Println("Node Left" + node.Name)
-	meta := cluster.DecodeNodeMeta(node.Meta)
+	meta, err := cluster.DecodeNodeMeta(node.Meta)
+	if err != nil {
+		log.Printf("Ignoring node %s: %s\n", node.Name, err)
+		return
+	}
 	if meta.NodeType == cluster.Mgmt {
 		ep := control.MgmtEndpoint{Host: node.Addr.String(), Port: uint32(meta.APIPort)}
 		m.cp.RemoveEndpoint(ep)
@@ -103,31 +109,28 @@ func main() {
 	nodeName := config.Node.Name
 
 	log.Printf("Starting frontend node: %s\n", nodeName)
-	metaData := &cluster.NodeMeta{NodeType: cluster.Frontend, APIPort: config.Node.APIPort}
-	c := memberlist.DefaultLANConfig()
-	c.Name = nodeName
-	c.BindPort = config.Node.ClusterPort
-	c.AdvertisePort = config.Node.ClusterPort
-	c.Delegate = cluster.Delegate{MetaData: metaData}
+	metaData := &cluster.NodeMeta{ClusterID: config.Node.ClusterID, NodeType: cluster.Frontend, APIPort: config.Node.APIPort, Capabilities: cluster.DefaultCapabilities(nil)}
+	gossip, err := cluster.NewGossip(config.Node.NodeConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, events := gossip.Config, gossip.Events
+	// we have no receivers, but pass on the statuses of the nodes that do
+	state := cluster.NewStateStore(nodeName, nil)
+	c.Delegate = cluster.Delegate{MetaData: metaData, Keys: gossip.Keys, Events: events, State: state}
 
 	list, err := memberlist.Create(c)
-
-	var entry *zeroconf.ServiceEntry
-	found := false
-
-	// since we are a management node, we are an 'add on' so we will loop
-	// until we know that there is atleast one bcg music playing node
-	for found != true {
-		entry = cluster.SearchForCluster()
-		if entry != nil {
-			found = true
-		}
+	if err != nil {
+		log.Fatal(err)
 	}
+	events.SetMemberlist(list)
+	state.SetMemberlist(list)
 
-	log.Println("Joining cluster")
-	_, err = list.Join([]string{fmt.Sprintf("%s:%d", entry.AddrIPv4[0].String(), entry.Port)})
+	// since we are a frontend node, we are an 'add on' so we keep looking
+	// until we find a cluster with atleast one bcg music playing node
+	err = cluster.JoinCluster(list, config.Node.JoinConfig(0))
 	if err != nil {
-		panic("Failed to join cluster: " + err.Error())
+		log.Fatal("Failed to join cluster: ", err)
 	}
 
 	controlPlane := control.NewControlPlane(config.Node.APIPort)
@@ -136,7 +139,10 @@ func main() {
 	// proxy with their connection info
 	var endpoints []control.MgmtEndpoint
 	for _, member := range cluster.FilterMembers(cluster.Mgmt, list) {
-		meta := cluster.DecodeNodeMeta(member.Meta)
+		meta, err := cluster.DecodeNodeMeta(member.Meta)
+		if err != nil {
+			continue
+		}
 		ep := control.MgmtEndpoint{Host: member.Addr.String(), Port: uint32(meta.APIPort)}
 		endpoints = append(endpoints, ep)
 
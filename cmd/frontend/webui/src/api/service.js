@@ -1,4 +1,4 @@
-import { GetSpeakersRequest, GetZonesRequest, GetTrackRequest, SetSpeakerDisplayNameRequest, GetMuteRequest, SetMuteRequest } from './management_pb.js';
+import { GetSpeakersRequest, GetZonesRequest, GetTrackRequest, SetSpeakerDisplayNameRequest, GetMuteRequest, SetMuteRequest, GetArtworkRequest } from './management_pb.js';
 import { BobcaygeonManagementPromiseClient } from './management_grpc_web_pb.js';
 
 const mgmtService = new BobcaygeonManagementPromiseClient(`http://${window.location.hostname}:9211`);
@@ -24,6 +24,16 @@ export const getCurrentTrackForSpeaker = async (speakerId) => {
     return trackResp;
 }
 
+// returns the artwork with the given hash for a given speaker, scaled down to fit in maxSize
+export const getArtworkForSpeaker = async (speakerId, hash, maxSize) => {
+    const request = new GetArtworkRequest();
+    request.setSpeakerid(speakerId);
+    request.setHash(hash);
+    request.setMaxsize(maxSize);
+    const artworkResp = await mgmtService.getArtwork(request);
+    return artworkResp;
+}
+
 export const changeDisplayNameForSpeaker = async (speakerId, displayName, updateBroadcast) => {
     const request = new SetSpeakerDisplayNameRequest();
     request.setSpeakerid(speakerId);
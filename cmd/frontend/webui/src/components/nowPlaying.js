@@ -1,17 +1,22 @@
 import { useEffect, useState } from 'react';
 import styled from 'styled-components';
-import { getCurrentTrackForSpeaker } from '../api/service';
+import { getCurrentTrackForSpeaker, getArtworkForSpeaker } from '../api/service';
 
 function NowPlaying(props) {
     const [track, setTrack] = useState();
 
     useEffect(() => {
         if (props.speakerId) {
-            getCurrentTrackForSpeaker(props.speakerId).then(currentTrack => {
-                const blob = new Blob([currentTrack.getArtwork()], { type: "image/jpeg" });
-                const urlCreator = window.URL || window.webkitURL;
-                const imageUrl = urlCreator.createObjectURL(blob);
-                currentTrack.artworkUrl = imageUrl;
+            getCurrentTrackForSpeaker(props.speakerId).then(async currentTrack => {
+                if (currentTrack.getArtworkhash()) {
+                    // twice the size it is shown at, for high density displays
+                    const artwork = await getArtworkForSpeaker(props.speakerId, currentTrack.getArtworkhash(), 400);
+                    if (artwork.getResponsecode() === 200) {
+                        const blob = new Blob([artwork.getData()], { type: artwork.getMimetype() });
+                        const urlCreator = window.URL || window.webkitURL;
+                        currentTrack.artworkUrl = urlCreator.createObjectURL(blob);
+                    }
+                }
                 setTrack(currentTrack);
             });
         }
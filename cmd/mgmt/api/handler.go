@@ -21,7 +21,10 @@ func NewServer(service service.MgmtService) *Server {
 func (s *Server) GetSpeakers(ctx context.Context, in *GetSpeakersRequest) (*GetSpeakersResponse, error) {
 	var speakers []*Speaker
 	for _, member := range s.service.GetSpeakers() {
-		speaker := &Speaker{Id: member.ID, DisplayName: member.DisplayName}
+		speaker := &Speaker{Id: member.ID, DisplayName: member.DisplayName, Volume: member.Volume}
+		if member.Playing != nil {
+			speaker.Playing = toAPITrack(member.Playing)
+		}
 		speakers = append(speakers, speaker)
 	}
 	return &GetSpeakersResponse{ReturnCode: 200, Speakers: speakers}, nil
@@ -117,16 +120,115 @@ func (s *Server) GetCurrentTrack(ctx context.Context, in *GetTrackRequest) (*Tra
 		if err != nil {
 			return &Track{}, nil
 		}
-		return &Track{Artist: t.Artist, Album: t.Album, Title: t.Title, Artwork: t.Artwork}, nil
+		return toAPITrack(t), nil
 	} else {
 		t, err := s.service.GetTrackForSpeaker(in.SpeakerId)
 		if err != nil {
 			return &Track{}, nil
 		}
-		return &Track{Artist: t.Artist, Album: t.Album, Title: t.Title, Artwork: t.Artwork}, nil
+		return toAPITrack(t), nil
 	}
 }
 
+func toAPITrack(t *service.Track) *Track {
+	return &Track{Artist: t.Artist, Album: t.Album, Title: t.Title, ArtworkHash: t.ArtworkHash,
+		Genre: t.Genre, Composer: t.Composer, Year: int32(t.Year),
+		TrackNumber: int32(t.TrackNumber), TrackCount: int32(t.TrackCount),
+		DiscNumber: int32(t.DiscNumber), DiscCount: int32(t.DiscCount),
+		Duration: t.Duration.Milliseconds(), Position: t.Position.Milliseconds(), PersistentId: t.PersistentID}
+}
+
+// GetArtwork gets the artwork of the track playing in a zone or on a speaker
+func (s *Server) GetArtwork(ctx context.Context, in *GetArtworkRequest) (*ArtworkResponse, error) {
+	if in.Hash == "" {
+		return &ArtworkResponse{ResponseCode: 400, Message: "No artwork hash specified"}, nil
+	}
+	if in.MaxSize < 0 {
+		return &ArtworkResponse{ResponseCode: 400, Message: "maxSize must not be negative"}, nil
+	}
+	var artwork *service.Artwork
+	var err error
+	if in.ZoneId != "" {
+		artwork, err = s.service.GetArtworkForZone(in.ZoneId, in.Hash, int(in.MaxSize))
+	} else if in.SpeakerId != "" {
+		artwork, err = s.service.GetArtworkForSpeaker(in.SpeakerId, in.Hash, int(in.MaxSize))
+	} else {
+		return &ArtworkResponse{ResponseCode: 400, Message: "No zone or speaker id specified"}, nil
+	}
+	if err == service.ErrArtworkNotFound {
+		return &ArtworkResponse{ResponseCode: 404, Message: err.Error()}, nil
+	}
+	if err != nil {
+		return &ArtworkResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &ArtworkResponse{ResponseCode: 200, Data: artwork.Data, MimeType: artwork.MimeType}, nil
+}
+
+// ManageKeyring installs, uses or removes a gossip encryption key on every node, or lists the keys
+func (s *Server) ManageKeyring(ctx context.Context, in *KeyringRequest) (*KeyringResponse, error) {
+	var failedNodes []string
+	var err error
+	switch in.Operation {
+	case "list":
+	case "install", "use", "remove":
+		if in.Key == "" {
+			return &KeyringResponse{ResponseCode: 400, Message: "No key specified"}, nil
+		}
+		failedNodes, err = s.service.ManageKeyring(in.Operation, in.Key)
+	default:
+		return &KeyringResponse{ResponseCode: 400, Message: "Unknown operation: " + in.Operation}, nil
+	}
+	if err == service.ErrEncryptionDisabled {
+		return &KeyringResponse{ResponseCode: 400, Message: err.Error()}, nil
+	}
+	if err != nil {
+		return &KeyringResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	keys, err := s.service.ListKeys()
+	if err == service.ErrEncryptionDisabled {
+		return &KeyringResponse{ResponseCode: 400, Message: err.Error()}, nil
+	}
+	if err != nil {
+		return &KeyringResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &KeyringResponse{ResponseCode: 200, Keys: keys, FailedNodes: failedNodes}, nil
+}
+
+// WatchMembers streams the members of the cluster, then the changes to the membership
+func (s *Server) WatchMembers(in *WatchMembersRequest, stream BobcaygeonManagement_WatchMembersServer) error {
+	return s.service.WatchMembers(stream.Context(), func(event *service.MemberEvent) error {
+		return stream.Send(toAPIMemberEvent(event))
+	})
+}
+
+func toAPIMemberEvent(e *service.MemberEvent) *MemberEvent {
+	event := &MemberEvent{
+		Type:      e.Type,
+		Name:      e.Name,
+		NodeType:  e.NodeType,
+		Address:   e.Address,
+		Health:    e.Health,
+		Rtt:       e.RTT.Microseconds(),
+		MetaError: e.MetaError,
+		Time:      e.Time.UnixMilli(),
+		Snapshot:  e.Snapshot,
+	}
+	if e.Meta != nil {
+		event.Meta = &NodeMetadata{
+			ClusterId:       e.Meta.ClusterID,
+			RtspPort:        int32(e.Meta.RtspPort),
+			ApiPort:         int32(e.Meta.APIPort),
+			RaftPort:        int32(e.Meta.RaftPort),
+			Codecs:          e.Meta.Codecs,
+			SoftwareVersion: e.Meta.SoftwareVersion,
+			HardwareModel:   e.Meta.HardwareModel,
+			OutputLatency:   e.Meta.OutputLatency.Milliseconds(),
+			Leader:          e.Meta.Leader,
+		}
+	}
+	return event
+}
+
 // SetMuteForSpeaker will mute or unmute the given speaker
 func (s *Server) SetMuteForSpeaker(ctx context.Context, in *SetMuteRequest) (*UpdateResponse, error) {
 	if in.SpeakerId == "" {
@@ -144,3 +246,66 @@ func (s *Server) GetMuteForSpeaker(ctx context.Context, in *GetMuteRequest) (*Sp
 	muted, _ := s.service.GetIsMutedForSpeaker(in.SpeakerId)
 	return &SpeakerMuteResponse{IsMuted: muted}, nil
 }
+
+// SetPasswordForSpeaker sets the password senders need to stream to the given speaker
+func (s *Server) SetPasswordForSpeaker(ctx context.Context, in *SetSpeakerPasswordRequest) (*UpdateResponse, error) {
+	if in.SpeakerId == "" {
+		return &UpdateResponse{ResponseCode: 400, Message: "No speaker id specified"}, nil
+	}
+	err := s.service.SetPasswordForSpeaker(in.SpeakerId, in.Password)
+	if err != nil {
+		return &UpdateResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &UpdateResponse{ResponseCode: 200}, nil
+}
+
+// SetAccessRulesForSpeaker sets the rules deciding which senders may stream to the given speaker
+func (s *Server) SetAccessRulesForSpeaker(ctx context.Context, in *SetSpeakerAccessRulesRequest) (*UpdateResponse, error) {
+	if in.SpeakerId == "" {
+		return &UpdateResponse{ResponseCode: 400, Message: "No speaker id specified"}, nil
+	}
+	var rules []*service.AccessRule
+	for _, rule := range in.Rules {
+		rules = append(rules, &service.AccessRule{Allow: rule.Allow, Match: rule.Match, Value: rule.Value})
+	}
+	err := s.service.SetAccessRulesForSpeaker(in.SpeakerId, rules)
+	if err != nil {
+		return &UpdateResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &UpdateResponse{ResponseCode: 200}, nil
+}
+
+// GetAccessRulesForSpeaker returns the rules deciding which senders may stream to the given speaker
+func (s *Server) GetAccessRulesForSpeaker(ctx context.Context, in *GetSpeakerAccessRulesRequest) (*GetSpeakerAccessRulesResponse, error) {
+	if in.SpeakerId == "" {
+		return &GetSpeakerAccessRulesResponse{ResponseCode: 400, Message: "No speaker id specified"}, nil
+	}
+	rules, err := s.service.GetAccessRulesForSpeaker(in.SpeakerId)
+	if err != nil {
+		return &GetSpeakerAccessRulesResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	var apiRules []*AccessRule
+	for _, rule := range rules {
+		apiRules = append(apiRules, &AccessRule{Allow: rule.Allow, Match: rule.Match, Value: rule.Value})
+	}
+	return &GetSpeakerAccessRulesResponse{ResponseCode: 200, Rules: apiRules}, nil
+}
+
+// PlaybackControl remote controls the sender streaming to a zone or a speaker
+func (s *Server) PlaybackControl(ctx context.Context, in *PlaybackControlRequest) (*UpdateResponse, error) {
+	if in.Command == "" {
+		return &UpdateResponse{ResponseCode: 400, Message: "No command specified"}, nil
+	}
+	var err error
+	if in.ZoneId != "" {
+		err = s.service.PlaybackControlForZone(in.ZoneId, in.Command)
+	} else if in.SpeakerId != "" {
+		err = s.service.PlaybackControlForSpeaker(in.SpeakerId, in.Command)
+	} else {
+		return &UpdateResponse{ResponseCode: 400, Message: "No zone or speaker id specified"}, nil
+	}
+	if err != nil {
+		return &UpdateResponse{ResponseCode: 500, Message: err.Error()}, nil
+	}
+	return &UpdateResponse{ResponseCode: 200}, nil
+}
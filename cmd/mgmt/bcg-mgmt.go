@@ -24,10 +24,12 @@ var (
 	configPath = flag.String("config", "bcg-mgmt.toml", "Path to the config file for the node")
 )
 
+// defaultJoinAttempts is how many times to look for a cluster to join when not configured
+const defaultJoinAttempts = 3
+
 type nodeConfig struct {
-	APIPort     int    `toml:"api-port"`
-	ClusterPort int    `toml:"cluster-port"`
-	Name        string `toml:"name"`
+	cluster.NodeConfig
+	APIPort int `toml:"api-port"`
 }
 
 type mgmtConfig struct {
@@ -53,10 +55,13 @@ func newMemberHandler(ds *raft.DistributedStore, service *raft.DistributedMgmtSe
 // The Node argument must not be modified.
 func (m *memberHandler) NotifyJoin(node *memberlist.Node) {
 	log.Println("Node Joined " + node.Name)
-	meta := cluster.DecodeNodeMeta(node.Meta)
+	meta, err := cluster.DecodeNodeMeta(node.Meta)
+	if err != nil {
+		log.Printf("Ignoring node %s: %s\n", node.Name, err)
+		return
+	}
 	if meta.NodeType == cluster.Mgmt {
-		raftPort := cluster.DecodeNodeMeta(node.Meta).RaftPort
-		raftJoinAddr := fmt.Sprintf("%s:%d", node.Addr.String(), raftPort)
+		raftJoinAddr := fmt.Sprintf("%s:%d", node.Addr.String(), meta.RaftPort)
 		err := m.store.Join(node.Name, raftJoinAddr)
 		if err != nil {
 			log.Println("Problem joining distributed store: ", err)
@@ -72,7 +77,11 @@ func (m *memberHandler) NotifyJoin(node *memberlist.Node) {
 // The Node argument must not be modified.
 func (m *memberHandler) NotifyLeave(node *memberlist.Node) {
 	log.Println("NotifyLeave: Node Left" + node.Name)
-	meta := cluster.DecodeNodeMeta(node.Meta)
+	meta, err := cluster.DecodeNodeMeta(node.Meta)
+	if err != nil {
+		log.Printf("Ignoring node %s: %s\n", node.Name, err)
+		return
+	}
 	if meta.NodeType == cluster.Mgmt {
 		log.Println("NotifyLeave: cluster management")
 	}
@@ -120,39 +129,56 @@ func main() {
 
 	nodeName := config.Node.Name
 	log.Printf("Starting management API node: %s\n", nodeName)
-	metaData := &cluster.NodeMeta{NodeType: cluster.Mgmt, APIPort: config.Node.APIPort, RaftPort: config.Mgmt.RaftPort}
-	c := memberlist.DefaultLANConfig()
-	c.Name = nodeName
-	c.BindPort = config.Node.ClusterPort
-	c.AdvertisePort = config.Node.ClusterPort
-	c.Delegate = cluster.Delegate{MetaData: metaData}
+	metaData := &cluster.NodeMeta{ClusterID: config.Node.ClusterID, NodeType: cluster.Mgmt, APIPort: config.Node.APIPort, RaftPort: config.Mgmt.RaftPort,
+		Capabilities: cluster.DefaultCapabilities(nil)}
+	gossip, err := cluster.NewGossip(config.Node.NodeConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, events := gossip.Config, gossip.Events
+	// we have no receivers, but pass on the statuses of the nodes that do
+	state := cluster.NewStateStore(nodeName, nil)
+	c.Delegate = cluster.Delegate{MetaData: metaData, Keys: gossip.Keys, Events: events, State: state}
+	// set before creating the memberlist so membership is watched from the start
+	members := cluster.NewMemberWatcher()
+	eventDelegate := cluster.NewEventDelegate([]memberlist.EventDelegate{members})
+	c.Events = eventDelegate
+	// and the round trip times to the members
+	c.Ping = members
 
 	list, err := memberlist.Create(c)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	entry := cluster.SearchForCluster()
-
-	if entry != nil {
-		log.Println("Joining cluster")
-		_, err = list.Join([]string{fmt.Sprintf("%s:%d", entry.AddrIPv4[0].String(), entry.Port)})
+	events.SetMemberlist(list)
+	state.SetMemberlist(list)
+
+	// start broadcasting the service, before searching so nodes starting at
+	// the same time find each other
+	if !config.Node.DisableMDNS {
+		log.Println("broadcasting my join info")
+		server, err := zeroconf.Register(nodeName, cluster.ServiceType, "local.", config.Node.ClusterPort, cluster.TXTRecords(config.Node.ClusterID), nil)
 		if err != nil {
-			panic("Failed to join cluster: " + err.Error())
+			log.Println("Error starting zeroconf service", err)
+		} else {
+			defer server.Shutdown()
 		}
 	}
-	// start broadcasting the service
-	log.Println("broadcasting my join info")
-	server, err := zeroconf.Register(nodeName, cluster.ServiceType, "local.", config.Node.ClusterPort, []string{"txtv=0", "lo=1", "la=2"}, nil)
+	joinConfig := config.Node.JoinConfig(defaultJoinAttempts)
+	err = cluster.JoinCluster(list, joinConfig)
 	if err != nil {
-		log.Println("Error starting zeroconf service", err)
+		log.Println("Not joining a cluster:", err)
 	}
-	defer server.Shutdown()
+	// keep looking for the cluster, so clusters that formed apart merge
+	stopJoining := cluster.KeepJoining(list, joinConfig)
+	defer stopJoining()
 
 	store := initDistributedStore(list, config.Node.Name, config.Mgmt.RaftPort, config.Mgmt.StorageDir)
-	service := raft.NewDistributedMgmtService(list, store)
+	service := raft.NewDistributedMgmtService(list, store, gossip.Keys, events, members)
+	stopFollowing := service.FollowPlayback()
+	defer stopFollowing()
 	// sets up the delegate to handle when members join or leave
-	c.Events = cluster.NewEventDelegate([]memberlist.EventDelegate{newMemberHandler(store, service)})
+	eventDelegate.Add(newMemberHandler(store, service))
 	go startAPIServer(config.Node.APIPort, list, service)
 	// Clean exit.
 	sig := make(chan os.Signal, 1)
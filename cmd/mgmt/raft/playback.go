@@ -0,0 +1,103 @@
+package raft
+
+import (
+	"log"
+	"sync"
+
+	"github.com/ibiscum/bobcaygeon/cluster"
+)
+
+// receiverKey identifies a receiver of a speaker, a speaker can host virtual receivers
+// next to the default one
+type receiverKey struct {
+	speakerID  string
+	receiverID string
+}
+
+// playback is what the receivers last said they play, and at what volume, by the events they publish
+type playback struct {
+	lock    sync.RWMutex
+	tracks  map[receiverKey]cluster.TrackInfo
+	volumes map[receiverKey]float64
+}
+
+func newPlayback() *playback {
+	return &playback{tracks: make(map[receiverKey]cluster.TrackInfo), volumes: make(map[receiverKey]float64)}
+}
+
+// apply records the track or volume change of the receiver the event comes from
+func (p *playback) apply(event cluster.Event) {
+	switch event.Type {
+	case cluster.TrackChanged:
+		var track cluster.TrackInfo
+		if err := event.Decode(&track); err != nil {
+			log.Printf("Invalid track change from %s: %s\n", event.Node, err)
+			return
+		}
+		p.lock.Lock()
+		p.tracks[receiverKey{event.Node, track.ReceiverID}] = track
+		p.lock.Unlock()
+	case cluster.VolumeChanged:
+		var volume cluster.VolumeInfo
+		if err := event.Decode(&volume); err != nil {
+			log.Printf("Invalid volume change from %s: %s\n", event.Node, err)
+			return
+		}
+		p.lock.Lock()
+		p.volumes[receiverKey{event.Node, volume.ReceiverID}] = volume.Volume
+		p.lock.Unlock()
+	}
+}
+
+// get returns the track and volume the receiver of the speaker last said it plays at, nil for
+// what it hasn't said
+func (p *playback) get(speakerID string, receiverID string) (*cluster.TrackInfo, *float64) {
+	key := receiverKey{speakerID, receiverID}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var track *cluster.TrackInfo
+	if t, ok := p.tracks[key]; ok {
+		track = &t
+	}
+	var volume *float64
+	if v, ok := p.volumes[key]; ok {
+		volume = &v
+	}
+	return track, volume
+}
+
+// remove forgets what the receivers of the speaker play, once it left
+func (p *playback) remove(speakerID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key := range p.tracks {
+		if key.speakerID == speakerID {
+			delete(p.tracks, key)
+		}
+	}
+	for key := range p.volumes {
+		if key.speakerID == speakerID {
+			delete(p.volumes, key)
+		}
+	}
+}
+
+// FollowPlayback keeps up with the tracks the speakers play, and their volume, from the events
+// they publish, until stopped
+func (dms *DistributedMgmtService) FollowPlayback() (stop func()) {
+	if dms.events == nil {
+		return func() {}
+	}
+	events, unsubscribe := dms.events.Subscribe(cluster.TrackChanged, cluster.VolumeChanged)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			dms.playback.apply(event)
+		}
+	}()
+	return func() {
+		unsubscribe()
+		<-done
+	}
+}
@@ -0,0 +1,86 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/ibiscum/bobcaygeon/cluster"
+)
+
+func TestFollowPlayback(t *testing.T) {
+	events := cluster.NewEventBus("kitchen")
+	dms := NewDistributedMgmtService(nil, nil, nil, events, nil)
+	stop := dms.FollowPlayback()
+
+	expected := cluster.TrackInfo{ReceiverID: cluster.DefaultReceiverID, Artist: "The Tragically Hip", Title: "Bobcaygeon"}
+	if err := events.Publish(cluster.TrackChanged, expected); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := events.Publish(cluster.VolumeChanged, cluster.VolumeInfo{ReceiverID: cluster.DefaultReceiverID, Volume: 0.5}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := events.Publish(cluster.SessionStopped, cluster.SessionInfo{ReceiverID: cluster.DefaultReceiverID}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// the events published before stopping are still applied
+	stop()
+
+	track, volume := dms.playback.get("kitchen", cluster.DefaultReceiverID)
+	if track == nil || *track != expected {
+		t.Errorf("Expected %+v got: %+v", expected, track)
+	}
+	if volume == nil || *volume != 0.5 {
+		t.Errorf("Expected volume 0.5 got: %v", volume)
+	}
+	if track, volume := dms.playback.get("den", cluster.DefaultReceiverID); track != nil || volume != nil {
+		t.Errorf("Expected nothing for a speaker that said nothing got: %+v %v", track, volume)
+	}
+
+	// nothing is followed once stopped
+	if err := events.Publish(cluster.VolumeChanged, cluster.VolumeInfo{ReceiverID: cluster.DefaultReceiverID, Volume: 1}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, volume := dms.playback.get("kitchen", cluster.DefaultReceiverID); *volume != 0.5 {
+		t.Errorf("Expected volume 0.5 got: %v", *volume)
+	}
+
+	dms.playback.remove("kitchen")
+	if track, volume := dms.playback.get("kitchen", cluster.DefaultReceiverID); track != nil || volume != nil {
+		t.Errorf("Expected nothing for a speaker that left got: %+v %v", track, volume)
+	}
+}
+
+func TestFollowPlaybackOfVirtualReceivers(t *testing.T) {
+	events := cluster.NewEventBus("kitchen")
+	dms := NewDistributedMgmtService(nil, nil, nil, events, nil)
+	stop := dms.FollowPlayback()
+
+	speaker := cluster.TrackInfo{ReceiverID: cluster.DefaultReceiverID, Title: "Bobcaygeon"}
+	virtual := cluster.TrackInfo{ReceiverID: "patio", Title: "Ahead by a Century"}
+	for _, payload := range []interface{}{
+		speaker,
+		cluster.VolumeInfo{ReceiverID: cluster.DefaultReceiverID, Volume: 0.5},
+		// the virtual receiver on the same node plays along, it doesn't change what the speaker plays
+		virtual,
+		cluster.VolumeInfo{ReceiverID: "patio", Volume: 1},
+	} {
+		eventType := cluster.VolumeChanged
+		if _, ok := payload.(cluster.TrackInfo); ok {
+			eventType = cluster.TrackChanged
+		}
+		if err := events.Publish(eventType, payload); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	stop()
+
+	if track, volume := dms.playback.get("kitchen", cluster.DefaultReceiverID); track == nil || *track != speaker || volume == nil || *volume != 0.5 {
+		t.Errorf("Expected %+v at 0.5 got: %+v %v", speaker, track, volume)
+	}
+	if track, volume := dms.playback.get("kitchen", "patio"); track == nil || *track != virtual || volume == nil || *volume != 1 {
+		t.Errorf("Expected %+v at 1 got: %+v %v", virtual, track, volume)
+	}
+	dms.playback.remove("kitchen")
+	if track, _ := dms.playback.get("kitchen", "patio"); track != nil {
+		t.Errorf("Expected the virtual receivers to be forgotten with the speaker got: %+v", track)
+	}
+}
@@ -2,11 +2,11 @@ package raft
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
-	"strconv"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -14,15 +14,19 @@ import (
 	"github.com/ibiscum/bobcaygeon/cluster"
 	"github.com/ibiscum/bobcaygeon/cmd/mgmt/api"
 	"github.com/ibiscum/bobcaygeon/cmd/mgmt/service"
-	"github.com/ibiscum/bobcaygeon/rtsp"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 // DistributedMgmtService implements MgmtService with a distributed backing store
 type DistributedMgmtService struct {
-	nodes *memberlist.Memberlist
-	store *DistributedStore
+	nodes   *memberlist.Memberlist
+	store   *DistributedStore
+	keys    *cluster.KeyManager
+	events  *cluster.EventBus
+	members *cluster.MemberWatcher
+	// playback is kept up to date by FollowPlayback
+	playback *playback
 }
 
 type closableClient struct {
@@ -31,8 +35,10 @@ type closableClient struct {
 }
 
 // NewDistributedMgmtService instantiates the DistributedMgmtService
-func NewDistributedMgmtService(nodes *memberlist.Memberlist, store *DistributedStore) *DistributedMgmtService {
-	return &DistributedMgmtService{nodes: nodes, store: store}
+func NewDistributedMgmtService(nodes *memberlist.Memberlist, store *DistributedStore, keys *cluster.KeyManager,
+	events *cluster.EventBus, members *cluster.MemberWatcher) *DistributedMgmtService {
+	return &DistributedMgmtService{nodes: nodes, store: store, keys: keys, events: events, members: members,
+		playback: newPlayback()}
 }
 
 // GetSpeakers returns information about the speaker (bcg apps) under our management
@@ -48,6 +54,13 @@ func (dms *DistributedMgmtService) GetSpeakers() []*service.Speaker {
 			displayName = speakerConfig.DisplayName
 		}
 		speaker := &service.Speaker{ID: member.Name, DisplayName: displayName}
+		// the speaker is its default receiver, the virtual ones are zones of their own
+		track, volume := dms.playback.get(member.Name, cluster.DefaultReceiverID)
+		if track != nil {
+			speaker.Playing = &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title,
+				ArtworkHash: track.ArtworkHash}
+		}
+		speaker.Volume = volume
 		speakers = append(speakers, speaker)
 	}
 
@@ -188,6 +201,7 @@ func (dms *DistributedMgmtService) CreateZone(displayName string, speakerIDs []s
 	if err != nil {
 		log.Fatal(err)
 	}
+	dms.publishZoneChanged(zc, false)
 	return id, nil
 }
 
@@ -265,6 +279,7 @@ func (dms *DistributedMgmtService) AddSpeakersToZone(zoneID string, speakerIDs [
 	if err != nil {
 		return err
 	}
+	dms.publishZoneChanged(zone, false)
 	return nil
 }
 
@@ -340,6 +355,7 @@ func (dms *DistributedMgmtService) RemoveSpeakersFromZone(zoneID string, speaker
 	if err != nil {
 		return err
 	}
+	dms.publishZoneChanged(zone, false)
 
 	return nil
 }
@@ -415,6 +431,7 @@ func (dms *DistributedMgmtService) DeleteZone(zoneID string) error {
 	if err != nil {
 		return err
 	}
+	dms.publishZoneChanged(zone, true)
 	return nil
 }
 
@@ -462,6 +479,7 @@ func (dms *DistributedMgmtService) ChangeZoneName(zoneID string, newName string)
 	if err != nil {
 		return err
 	}
+	dms.publishZoneChanged(zone, false)
 
 	return nil
 }
@@ -509,7 +527,7 @@ func (dms *DistributedMgmtService) GetTrackForZone(zoneID string) (*service.Trac
 	if err != nil {
 		return nil, err
 	}
-	return &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork}, nil
+	return trackFromSpeaker(track), nil
 }
 
 // GetTrackForSpeaker returns the track that is playing for the given speaker
@@ -523,13 +541,182 @@ func (dms *DistributedMgmtService) GetTrackForSpeaker(speakerID string) (*servic
 	if err != nil {
 		return nil, err
 	}
-	return &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title, Artwork: track.Artwork}, nil
+	return trackFromSpeaker(track), nil
+}
+
+// PlaybackControlForZone remote controls the sender streaming to the zone, which streams to the zone leader
+func (dms *DistributedMgmtService) PlaybackControlForZone(zoneID string, command string) error {
+	zc := dms.store.GetZoneConfigs()
+	var zone ZoneConfig
+	for _, zoneConfig := range zc {
+		if zoneConfig.ID == zoneID {
+			zone = zoneConfig
+			break
+		}
+	}
+	if zone.ID == "" {
+		return fmt.Errorf("zone: %s not found", zoneID)
+	}
+	return dms.PlaybackControlForSpeaker(zone.Leader, command)
+}
+
+// PlaybackControlForSpeaker remote controls the sender streaming to the given speaker
+func (dms *DistributedMgmtService) PlaybackControlForSpeaker(speakerID string, command string) error {
+	client, err := dms.getSpeakerClient(speakerID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	resp, err := client.PlaybackControl(context.Background(), &speakerAPI.PlaybackControlRequest{Command: command})
+	if err != nil {
+		return err
+	}
+	if resp.ReturnCode != 200 {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
+
+// GetArtworkForZone returns artwork of the track playing in the zone, as known by the zone leader
+func (dms *DistributedMgmtService) GetArtworkForZone(zoneID string, hash string, maxSize int) (*service.Artwork, error) {
+	zc := dms.store.GetZoneConfigs()
+	var zone ZoneConfig
+	for _, zoneConfig := range zc {
+		if zoneConfig.ID == zoneID {
+			zone = zoneConfig
+			break
+		}
+	}
+	if zone.ID == "" {
+		return nil, fmt.Errorf("zone: %s not found", zoneID)
+	}
+	return dms.GetArtworkForSpeaker(zone.Leader, hash, maxSize)
+}
+
+// GetArtworkForSpeaker returns artwork of the track playing on the given speaker
+func (dms *DistributedMgmtService) GetArtworkForSpeaker(speakerID string, hash string, maxSize int) (*service.Artwork, error) {
+	client, err := dms.getSpeakerClient(speakerID)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	resp, err := client.GetArtwork(context.Background(), &speakerAPI.GetArtworkRequest{Hash: hash, MaxSize: int32(maxSize)})
+	if err != nil {
+		return nil, err
+	}
+	if resp.ReturnCode == 404 {
+		return nil, service.ErrArtworkNotFound
+	}
+	if resp.ReturnCode != 200 {
+		return nil, errors.New(resp.Message)
+	}
+	return &service.Artwork{MimeType: resp.MimeType, Data: resp.Data}, nil
+}
+
+func trackFromSpeaker(track *speakerAPI.Track) *service.Track {
+	return &service.Track{Artist: track.Artist, Album: track.Album, Title: track.Title, ArtworkHash: track.ArtworkHash,
+		Genre: track.Genre, Composer: track.Composer, Year: int(track.Year),
+		TrackNumber: int(track.TrackNumber), TrackCount: int(track.TrackCount),
+		DiscNumber: int(track.DiscNumber), DiscCount: int(track.DiscCount),
+		Duration: time.Duration(track.Duration) * time.Millisecond, Position: time.Duration(track.Position) * time.Millisecond,
+		PersistentID: track.PersistentId}
+}
+
+// publishZoneChanged lets every node know the zone changed
+func (dms *DistributedMgmtService) publishZoneChanged(zone ZoneConfig, deleted bool) {
+	if dms.events == nil {
+		return
+	}
+	err := dms.events.Publish(cluster.ZoneChanged, cluster.ZoneInfo{ZoneID: zone.ID, DisplayName: zone.DisplayName,
+		SpeakerIDs: zone.Speakers, Deleted: deleted})
+	if err != nil {
+		log.Println("Error publishing zone change", err)
+	}
+}
+
+// ManageKeyring applies the keyring operation to this node, then sends it to every other node
+func (dms *DistributedMgmtService) ManageKeyring(operation string, key string) ([]string, error) {
+	failed, err := dms.keys.Apply(dms.nodes, cluster.KeyOperation(operation), key)
+	if err == cluster.ErrEncryptionDisabled {
+		return nil, service.ErrEncryptionDisabled
+	}
+	return failed, err
+}
+
+// ListKeys returns the gossip encryption keys of this node, primary key first
+func (dms *DistributedMgmtService) ListKeys() ([]string, error) {
+	keys, err := dms.keys.ListKeys()
+	if err == cluster.ErrEncryptionDisabled {
+		return nil, service.ErrEncryptionDisabled
+	}
+	return keys, err
+}
+
+// WatchMembers sends the members of the cluster, as joins, then the changes to the membership
+func (dms *DistributedMgmtService) WatchMembers(ctx context.Context, send func(*service.MemberEvent) error) error {
+	members, events, stop := dms.members.Watch()
+	defer stop()
+	for _, member := range members {
+		event := toMemberEvent(cluster.MemberEvent{Type: cluster.MemberJoined, Member: member, Time: time.Now()})
+		event.Snapshot = true
+		err := send(event)
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				return service.ErrWatchFellBehind
+			}
+			err := send(toMemberEvent(event))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func toMemberEvent(event cluster.MemberEvent) *service.MemberEvent {
+	member := event.Member
+	memberEvent := &service.MemberEvent{
+		Type:    string(event.Type),
+		Name:    member.Name,
+		Address: member.Address(),
+		Health:  member.Health,
+		RTT:     member.RTT,
+		Time:    event.Time,
+	}
+	if member.MetaErr != nil {
+		memberEvent.MetaError = member.MetaErr.Error()
+		return memberEvent
+	}
+	meta := member.Meta
+	memberEvent.NodeType = meta.NodeType.String()
+	memberEvent.Meta = &service.NodeMetadata{
+		ClusterID:       meta.ClusterID,
+		RtspPort:        meta.RtspPort,
+		APIPort:         meta.APIPort,
+		RaftPort:        meta.RaftPort,
+		Codecs:          meta.Capabilities.Codecs,
+		SoftwareVersion: meta.Capabilities.SoftwareVersion,
+		HardwareModel:   meta.Capabilities.HardwareModel,
+		OutputLatency:   meta.Capabilities.OutputLatency,
+		Leader:          meta.Leader,
+	}
+	return memberEvent
 }
 
 func (dms *DistributedMgmtService) getLeaderAPIAddress(leader *net.TCPAddr) string {
 	for _, member := range cluster.FilterMembers(cluster.Mgmt, dms.nodes) {
 		memberIP := member.Addr.String()
-		meta := cluster.DecodeNodeMeta(member.Meta)
+		meta, err := cluster.DecodeNodeMeta(member.Meta)
+		if err != nil {
+			continue
+		}
 		if (leader.IP == nil && isLocalIP(memberIP) || leader.IP.String() == memberIP) && leader.Port == meta.RaftPort {
 			memberAPIAddress := fmt.Sprintf("%s:%d", memberIP, meta.APIPort)
 			return memberAPIAddress
@@ -590,8 +777,8 @@ func (dms *DistributedMgmtService) getLeaderClient(leader string) (api.Bobcaygeo
 func (dms *DistributedMgmtService) getSpeakerClient(speakerID string) (*closableClient, error) {
 
 	filter := func(node *memberlist.Node) bool {
-		meta := cluster.DecodeNodeMeta(node.Meta)
-		return meta.NodeType == cluster.Music && speakerID == node.Name
+		meta, err := cluster.DecodeNodeMeta(node.Meta)
+		return err == nil && meta.NodeType == cluster.Music && speakerID == node.Name
 	}
 
 	speakers := cluster.FilterMembersByFn(filter, dms.nodes)
@@ -599,7 +786,10 @@ func (dms *DistributedMgmtService) getSpeakerClient(speakerID string) (*closable
 		return nil, fmt.Errorf("could not find speaker with id: %s", speakerID)
 	}
 	speaker := speakers[0]
-	meta := cluster.DecodeNodeMeta(speaker.Meta)
+	meta, err := cluster.DecodeNodeMeta(speaker.Meta)
+	if err != nil {
+		return nil, err
+	}
 	speakerAPIAddress := fmt.Sprintf("%s:%d", speaker.Addr.String(), meta.APIPort)
 	conn, err := grpc.NewClient(speakerAPIAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -616,6 +806,24 @@ func (dms *DistributedMgmtService) HandleMusicNodeJoin(node *memberlist.Node) {
 	if !dms.store.AmLeader() {
 		return
 	}
+	// a speaker that restarts forgets any password or access rules that were pushed to it, so push them again
+	speakerConfig, err := dms.store.GetSpeakerConfig(node.Name)
+	if err != nil {
+		log.Printf("Error retrieving config for: %s. Error: %s\n", node.Name, err)
+	} else {
+		if speakerConfig.Password != "" {
+			err = dms.pushPassword(node.Name, speakerConfig.Password)
+			if err != nil {
+				log.Printf("Could not push password to: %s, %s\n", node.Name, err)
+			}
+		}
+		if len(speakerConfig.AccessRules) > 0 {
+			err = dms.pushAccessRules(node.Name, speakerConfig.AccessRules)
+			if err != nil {
+				log.Printf("Could not push access rules to: %s, %s\n", node.Name, err)
+			}
+		}
+	}
 	log.Printf("%s has re-joined, checking if it belongs in a zone\n", node.Name)
 	zones := dms.store.GetZoneConfigs()
 	var updateZone ZoneConfig
@@ -642,7 +850,7 @@ func (dms *DistributedMgmtService) HandleMusicNodeJoin(node *memberlist.Node) {
 	}
 
 	// for both cases, where this node is a member or a leader, we will remove it from the other speakers
-	err := dms.removeFromAllSpeakers([]string{node.Name})
+	err = dms.removeFromAllSpeakers([]string{node.Name})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -718,6 +926,7 @@ func (dms *DistributedMgmtService) HandleMusicNodeJoin(node *memberlist.Node) {
 // HandleMusicNodeLeave will try to preserve any zone by promoting a new leader,
 // if it is the leader who has left
 func (dms *DistributedMgmtService) HandleMusicNodeLeave(node *memberlist.Node) {
+	dms.playback.remove(node.Name)
 	if !dms.store.AmLeader() {
 		return
 	}
@@ -784,6 +993,7 @@ func (dms *DistributedMgmtService) HandleMusicNodeLeave(node *memberlist.Node) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	dms.publishZoneChanged(updateZone, false)
 }
 
 // SetMuteForSpeaker will mute or unmute the given speaker
@@ -802,41 +1012,20 @@ func (dms *DistributedMgmtService) SetMuteForSpeaker(speakerID string, isMuted b
 		}
 		return nil
 	}
-	filter := func(node *memberlist.Node) bool {
-		meta := cluster.DecodeNodeMeta(node.Meta)
-		return meta.NodeType == cluster.Music && speakerID == node.Name
-	}
-
-	speakers := cluster.FilterMembersByFn(filter, dms.nodes)
-	if len(speakers) != 1 {
-		return fmt.Errorf("Could not find speaker with id: %s", speakerID)
+	// senders may only set the volume of their own session, so we mute through the speaker API
+	client, err := dms.getSpeakerClient(speakerID)
+	if err != nil {
+		return err
 	}
-	speaker := speakers[0]
-	meta := cluster.DecodeNodeMeta(speaker.Meta)
-
-	// volume is a 'pure' RTSP/RAOP function, so we will use the RTSP client to play with mute
-	client, err := rtsp.NewClient(speaker.Addr.String(), meta.RtspPort)
+	defer client.Close()
+	resp, err := client.SetMuted(context.Background(), &speakerAPI.SetMutedRequest{IsMuted: isMuted})
 	if err != nil {
 		return err
 	}
-	req := rtsp.NewRequest()
-	req.Method = rtsp.Set_Parameter
-	sessionID := strconv.FormatInt(time.Now().Unix(), 10)
-	localAddress := client.LocalAddress()
-	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-	req.Headers["Content-Type"] = "text/parameters"
-	var body string
-	if isMuted {
-		req.Headers["X-BCG-Muted"] = "muted"
-		//airplay servers understands mute as -144
-		body = fmt.Sprintf("volume: %f", -144.0)
-	} else {
-		req.Headers["X-BCG-Muted"] = "unmuted"
-		body = fmt.Sprintf("volume: %f", 0.0)
+	if resp.ReturnCode != 200 {
+		return errors.New(resp.Message)
 	}
-	req.Body = []byte(body)
-	_, err = client.Send(req)
-	return err
+	return nil
 }
 
 // GetIsMutedForSpeaker returns if the given speaker is hard muted
@@ -853,3 +1042,126 @@ func (dms *DistributedMgmtService) GetIsMutedForSpeaker(speakerID string) (bool,
 	return mutedResp.GetIsMuted(), nil
 
 }
+
+// SetPasswordForSpeaker sets the password senders need to stream to the given speaker
+func (dms *DistributedMgmtService) SetPasswordForSpeaker(speakerID string, password string) error {
+	if !dms.store.AmLeader() {
+		client, err := dms.getLeaderClient(dms.store.GetLeader())
+		if err != nil {
+			return err
+		}
+		resp, err := client.SetPasswordForSpeaker(context.Background(), &api.SetSpeakerPasswordRequest{SpeakerId: speakerID, Password: password})
+		if err != nil {
+			return err
+		}
+		if resp.ResponseCode != 200 {
+			return errors.New(resp.Message)
+		}
+		return nil
+	}
+	speakerConfig, err := dms.store.GetSpeakerConfig(speakerID)
+	if err != nil {
+		log.Printf("Error retrieving config for: %s. Error: %s\n", speakerID, err)
+		return err
+	}
+	if speakerConfig.ID == "" {
+		speakerConfig.ID = speakerID
+	}
+	err = dms.pushPassword(speakerID, password)
+	if err != nil {
+		return err
+	}
+	// store it so we can re-apply it if the speaker restarts
+	speakerConfig.Password = password
+	return dms.store.SaveSpeakerConfig(speakerConfig)
+}
+
+func (dms *DistributedMgmtService) pushPassword(speakerID string, password string) error {
+	client, err := dms.getSpeakerClient(speakerID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	resp, err := client.SetPassword(context.Background(), &speakerAPI.PasswordRequest{Password: password})
+	if err != nil {
+		return err
+	}
+	if resp.ReturnCode != 200 {
+		return fmt.Errorf("error setting password of speaker: %v", resp.ReturnCode)
+	}
+	return nil
+}
+
+// SetAccessRulesForSpeaker sets the rules deciding which senders may stream to the given speaker
+func (dms *DistributedMgmtService) SetAccessRulesForSpeaker(speakerID string, rules []*service.AccessRule) error {
+	if !dms.store.AmLeader() {
+		client, err := dms.getLeaderClient(dms.store.GetLeader())
+		if err != nil {
+			return err
+		}
+		var apiRules []*api.AccessRule
+		for _, rule := range rules {
+			apiRules = append(apiRules, &api.AccessRule{Allow: rule.Allow, Match: rule.Match, Value: rule.Value})
+		}
+		resp, err := client.SetAccessRulesForSpeaker(context.Background(), &api.SetSpeakerAccessRulesRequest{SpeakerId: speakerID, Rules: apiRules})
+		if err != nil {
+			return err
+		}
+		if resp.ResponseCode != 200 {
+			return errors.New(resp.Message)
+		}
+		return nil
+	}
+	speakerConfig, err := dms.store.GetSpeakerConfig(speakerID)
+	if err != nil {
+		log.Printf("Error retrieving config for: %s. Error: %s\n", speakerID, err)
+		return err
+	}
+	if speakerConfig.ID == "" {
+		speakerConfig.ID = speakerID
+	}
+	var storedRules []AccessRule
+	for _, rule := range rules {
+		storedRules = append(storedRules, AccessRule{Allow: rule.Allow, Match: rule.Match, Value: rule.Value})
+	}
+	// the speaker validates the rules, so only store them once it accepted them
+	err = dms.pushAccessRules(speakerID, storedRules)
+	if err != nil {
+		return err
+	}
+	speakerConfig.AccessRules = storedRules
+	return dms.store.SaveSpeakerConfig(speakerConfig)
+}
+
+// GetAccessRulesForSpeaker returns the rules deciding which senders may stream to the given speaker
+func (dms *DistributedMgmtService) GetAccessRulesForSpeaker(speakerID string) ([]*service.AccessRule, error) {
+	speakerConfig, err := dms.store.GetSpeakerConfig(speakerID)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*service.AccessRule
+	for _, rule := range speakerConfig.AccessRules {
+		rules = append(rules, &service.AccessRule{Allow: rule.Allow, Match: rule.Match, Value: rule.Value})
+	}
+	return rules, nil
+}
+
+func (dms *DistributedMgmtService) pushAccessRules(speakerID string, rules []AccessRule) error {
+	client, err := dms.getSpeakerClient(speakerID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	var speakerRules []*speakerAPI.AccessRule
+	for _, rule := range rules {
+		speakerRules = append(speakerRules, &speakerAPI.AccessRule{Allow: rule.Allow, Match: rule.Match, Value: rule.Value})
+	}
+	resp, err := client.SetAccessRules(context.Background(), &speakerAPI.AccessRulesRequest{Rules: speakerRules})
+	if err != nil {
+		return err
+	}
+	if resp.ReturnCode != 200 {
+		return fmt.Errorf("error setting access rules of speaker: %v, %s", resp.ReturnCode, resp.Message)
+	}
+	return nil
+}
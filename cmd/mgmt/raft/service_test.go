@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/cluster"
+	"github.com/ibiscum/bobcaygeon/cluster/clustertest"
+	"github.com/ibiscum/bobcaygeon/cmd/mgmt/service"
+)
+
+func newTestList(t *testing.T, name string, meta *cluster.NodeMeta, events memberlist.EventDelegate) *memberlist.Memberlist {
+	return clustertest.NewList(t, name, func(c *memberlist.Config) {
+		c.Delegate = cluster.Delegate{MetaData: meta}
+		c.Events = events
+	})
+}
+
+func TestWatchMembers(t *testing.T) {
+	members := cluster.NewMemberWatcher()
+	list := newTestList(t, "mgmt", &cluster.NodeMeta{NodeType: cluster.Mgmt, APIPort: 9999}, members)
+	dms := NewDistributedMgmtService(list, nil, nil, nil, members)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan *service.MemberEvent, 16)
+	done := make(chan error)
+	go func() {
+		done <- dms.WatchMembers(ctx, func(event *service.MemberEvent) error {
+			sent <- event
+			return nil
+		})
+	}()
+
+	event := clustertest.Receive(t, sent)
+	if !event.Snapshot || event.Type != "join" || event.Name != "mgmt" || event.NodeType != "mgmt" || event.Meta.APIPort != 9999 {
+		t.Errorf("Expected the node itself first got: %+v", event)
+	}
+
+	kitchen := newTestList(t, "kitchen", &cluster.NodeMeta{NodeType: cluster.Music, Leader: true,
+		Capabilities: cluster.Capabilities{OutputLatency: 250 * time.Millisecond}}, nil)
+	clustertest.Join(t, kitchen, list)
+	event = clustertest.Receive(t, sent)
+	if event.Snapshot || event.Type != "join" || event.Name != "kitchen" || event.NodeType != "music" || event.Health != "alive" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if event.Meta == nil || !event.Meta.Leader || event.Meta.OutputLatency != 250*time.Millisecond {
+		t.Errorf("Unexpected metadata %+v", event.Meta)
+	}
+	err := kitchen.Leave(time.Second)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if event := clustertest.Receive(t, sent); event.Type != "leave" || event.Health != "left" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected the watch to end with the context got: %v", err)
+	}
+}
+
+func TestWatchMembersSendFails(t *testing.T) {
+	members := cluster.NewMemberWatcher()
+	list := newTestList(t, "mgmt", &cluster.NodeMeta{NodeType: cluster.Mgmt}, members)
+	dms := NewDistributedMgmtService(list, nil, nil, nil, members)
+	sendErr := fmt.Errorf("client gone")
+	err := dms.WatchMembers(context.Background(), func(*service.MemberEvent) error {
+		return sendErr
+	})
+	if err != sendErr {
+		t.Errorf("Expected the send error got: %v", err)
+	}
+}
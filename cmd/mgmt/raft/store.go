@@ -24,6 +24,15 @@ const (
 type SpeakerConfig struct {
 	ID          string
 	DisplayName string
+	Password    string
+	AccessRules []AccessRule
+}
+
+// AccessRule used to store the rules deciding which senders may stream to a speaker
+type AccessRule struct {
+	Allow bool
+	Match string
+	Value string
 }
 
 // ZoneConfig used to store persistent zone configuration
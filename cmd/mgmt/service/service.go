@@ -1,5 +1,20 @@
 package service
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrArtworkNotFound returned when the speaker has no artwork with the requested hash
+var ErrArtworkNotFound = errors.New("artwork not found")
+
+// ErrEncryptionDisabled returned for keyring operations when the cluster gossip isn't encrypted
+var ErrEncryptionDisabled = errors.New("gossip encryption is not enabled")
+
+// ErrWatchFellBehind returned when a watch is ended for not keeping up with the changes it is sent
+var ErrWatchFellBehind = errors.New("watch fell behind")
+
 // MgmtService interface for handling management capabilities
 type MgmtService interface {
 	GetSpeakers() []*Speaker
@@ -14,12 +29,69 @@ type MgmtService interface {
 	GetTrackForSpeaker(speakerID string) (*Track, error)
 	SetMuteForSpeaker(speakerID string, isMuted bool) error
 	GetIsMutedForSpeaker(speakerID string) (bool, error)
+	SetPasswordForSpeaker(speakerID string, password string) error
+	SetAccessRulesForSpeaker(speakerID string, rules []*AccessRule) error
+	GetAccessRulesForSpeaker(speakerID string) ([]*AccessRule, error)
+	PlaybackControlForZone(zoneID string, command string) error
+	PlaybackControlForSpeaker(speakerID string, command string) error
+	GetArtworkForZone(zoneID string, hash string, maxSize int) (*Artwork, error)
+	GetArtworkForSpeaker(speakerID string, hash string, maxSize int) (*Artwork, error)
+	// ManageKeyring applies a keyring operation to every node, returning the nodes it couldn't be sent to
+	ManageKeyring(operation string, key string) ([]string, error)
+	ListKeys() ([]string, error)
+	// WatchMembers sends the members of the cluster, then the changes to the membership, until
+	// the context is done or sending fails
+	WatchMembers(ctx context.Context, send func(*MemberEvent) error) error
 }
 
 // Speaker speaker instance
 type Speaker struct {
 	ID          string
 	DisplayName string
+	// Playing is the track the speaker last said it plays, nil when it hasn't said
+	Playing *Track
+	// Volume is between 0 (mute) and 1, as the speaker last said, nil when it hasn't said
+	Volume *float64
+}
+
+// NodeMetadata is what a node tells the cluster about itself
+type NodeMetadata struct {
+	ClusterID       string
+	RtspPort        int
+	APIPort         int
+	RaftPort        int
+	Codecs          []string
+	SoftwareVersion string
+	HardwareModel   string
+	OutputLatency   time.Duration
+	Leader          bool
+}
+
+// MemberEvent a change in the membership of the cluster
+type MemberEvent struct {
+	// Type is join, leave or update
+	Type     string
+	Name     string
+	NodeType string
+	Address  string
+	// Health is alive, or left once the node left the cluster or was found dead
+	Health string
+	// RTT is the round trip time of the last probe of the node, 0 until probed
+	RTT time.Duration
+	// Meta is nil when the metadata of the node couldn't be read, MetaError says why
+	Meta      *NodeMetadata
+	MetaError string
+	Time      time.Time
+	// Snapshot is set on the events of the members there were when the watch started
+	Snapshot bool
+}
+
+// AccessRule allows or denies senders streaming to a speaker, matched on
+// address (IP or CIDR range), dacp-id or user-agent
+type AccessRule struct {
+	Allow bool
+	Match string
+	Value string
 }
 
 // Zone zone instance
@@ -31,8 +103,24 @@ type Zone struct {
 
 // Track represents a track
 type Track struct {
-	Artist  string
-	Album   string
-	Title   string
-	Artwork []byte
+	Artist       string
+	Album        string
+	Title        string
+	Genre        string
+	Composer     string
+	Year         int
+	TrackNumber  int
+	TrackCount   int
+	DiscNumber   int
+	DiscCount    int
+	Duration     time.Duration
+	Position     time.Duration
+	PersistentID uint64
+	ArtworkHash  string
+}
+
+// Artwork represents the artwork of a track
+type Artwork struct {
+	MimeType string
+	Data     []byte
 }
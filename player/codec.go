@@ -1,7 +1,7 @@
 package player
 
 import (
-	"strings"
+	"sort"
 
 	"github.com/ibiscum/bobcaygeon/rtsp"
 	"github.com/maghul/alac"
@@ -21,12 +21,22 @@ func decodeAlac(data []byte) ([]byte, error) {
 	return decoder.Decode(data), nil
 }
 
+// Codecs returns the encoding names of the codecs that can be played
+func Codecs() []string {
+	codecs := make([]string, 0, len(codecMap))
+	for name := range codecMap {
+		codecs = append(codecs, name)
+	}
+	sort.Strings(codecs)
+	return codecs
+}
+
 // GetCodec determins the appropriate codec from the rtsp session
 func GetCodec(session *rtsp.Session) CodecHandler {
 	var decoder CodecHandler
-	rtpmap := session.Description.Attributes["rtpmap"]
-	if strings.Contains(rtpmap, "AppleLossless") {
-		decoder = codecMap["AppleLossless"]
+	rtpmap, _ := session.Description.RtpMap()
+	if handler, ok := codecMap[rtpmap.EncodingName]; ok {
+		decoder = handler
 	} else {
 		decoder = func(data []byte) ([]byte, error) { return data, nil }
 	}
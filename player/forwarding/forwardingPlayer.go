@@ -4,15 +4,18 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"strconv"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/memberlist"
+	"github.com/ibiscum/bobcaygeon/artwork"
 	"github.com/ibiscum/bobcaygeon/cluster"
 	"github.com/ibiscum/bobcaygeon/player"
 	"github.com/ibiscum/bobcaygeon/raop"
 	"github.com/ibiscum/bobcaygeon/rtsp"
+	"github.com/ibiscum/bobcaygeon/sdp"
 )
 
 // Player will forward data packets to member nodes
@@ -24,18 +27,84 @@ type Player struct {
 	sessions  *sessionMap
 	//ap           *oto.Player
 	currentTrack player.Track
+	// progress of the current track and when we got it, for working out the position since
+	progress   player.Progress
+	progressAt time.Time
+	// artwork of the current track, and the few before it, by hash
+	artworks *artwork.Store
+	// configLock guards how we forward: the password, transport and source format, and
+	// where events are published
+	configLock sync.RWMutex
+	password   string
+	transport  rtsp.Transport
+	// description of the stream we are playing, it is forwarded in the format it comes in
+	source *sdp.SessionDescription
+	// events the player publishes to the cluster, for the receiver with the given id
+	events     *cluster.EventBus
+	receiverID string
 }
 
 // represents what a client calling an RTSP
 // server would want for a session; the actual
-// session for data transfer, as well the port
-// for making RTSP calls for control
-
-// TODO: should this be promoted to the RTSP package and
-// returned by raop.EstablishSession ??
+// session for data transfer, as well the client
+// the session was set up with, for making RTSP
+// calls for control
 type clientSession struct {
 	*rtsp.Session
+	client   *rtsp.Client
 	rtspPort int
+	// format the stream was announced in, see formatKey
+	format string
+	// closed once the session is, so nothing more is forwarded to it
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClientSession(session *rtsp.Session, client *rtsp.Client, rtspPort int, format string) *clientSession {
+	return &clientSession{Session: session, client: client, rtspPort: rtspPort, format: format, done: make(chan struct{})}
+}
+
+// formatKey returns what tells the formats streams described by source are forwarded in apart
+func formatKey(source *sdp.SessionDescription) string {
+	format := raop.StreamFormat(source)
+	return strings.Join(append(format.Attributes.Values("rtpmap"), format.Attributes.Values("fmtp")...), "\n")
+}
+
+// close ends the session, closing the client has the receiver tear down its end
+func (s *clientSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Close(make(chan struct{}, 1))
+		s.client.Close()
+	})
+}
+
+// forward hands a packet to the session for sending, unless it was closed
+func (s *clientSession) forward(pkt []byte) {
+	select {
+	case s.DataChan <- pkt:
+	case <-s.done:
+	}
+}
+
+// setParameter sends a SET_PARAMETER request with the given body to the receiver
+func (s *clientSession) setParameter(contentType string, body []byte) error {
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Set_Parameter
+	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", s.client.LocalAddress(), s.Description.Origin.SessionID)
+	req.Headers["Content-Type"] = contentType
+	if s.ID != "" {
+		req.Headers["Session"] = s.ID
+	}
+	req.Body = body
+	resp, err := s.client.Send(req)
+	if err != nil {
+		return err
+	}
+	if resp.Status != rtsp.Ok {
+		return fmt.Errorf("Non-ok status returned: %s", resp.Status.String())
+	}
+	return nil
 }
 
 type sessionMap struct {
@@ -43,26 +112,41 @@ type sessionMap struct {
 	sessions map[string]*clientSession
 }
 
-// func newSessionMap() *sessionMap {
-// 	return &sessionMap{sessions: make(map[string]*clientSession)}
-// }
+func newSessionMap() *sessionMap {
+	return &sessionMap{sessions: make(map[string]*clientSession)}
+}
 
+// addSession adds the session for the node with the given name, closing the one it replaces
 func (sm *sessionMap) addSession(name string, session *clientSession) {
 	sm.Lock()
-	defer sm.Unlock()
+	previous := sm.sessions[name]
 	sm.sessions[name] = session
+	sm.Unlock()
+	if previous != nil {
+		previous.close()
+	}
 }
 
+// removeSession removes and closes the session for the node with the given name
 func (sm *sessionMap) removeSession(name string) {
 	sm.Lock()
-	defer sm.Unlock()
+	session := sm.sessions[name]
 	delete(sm.sessions, name)
+	sm.Unlock()
+	if session != nil {
+		session.close()
+	}
 }
 
+// removeAll removes and closes all the sessions
 func (sm *sessionMap) removeAll() {
 	sm.Lock()
-	defer sm.Unlock()
+	sessions := sm.sessions
 	sm.sessions = make(map[string]*clientSession)
+	sm.Unlock()
+	for _, session := range sessions {
+		session.close()
+	}
 }
 
 // func (sm *sessionMap) sessionExists(name string) bool {
@@ -72,6 +156,27 @@ func (sm *sessionMap) removeAll() {
 // 	return present
 // }
 
+func (sm *sessionMap) getNames() []string {
+	sm.RLock()
+	defer sm.RUnlock()
+	names := make([]string, 0, len(sm.sessions))
+	for name := range sm.sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (sm *sessionMap) getNamedSessions() map[string]*clientSession {
+	sm.RLock()
+	defer sm.RUnlock()
+	sessions := make(map[string]*clientSession, len(sm.sessions))
+	for name, session := range sm.sessions {
+		sessions[name] = session
+	}
+	return sessions
+}
+
 func (sm *sessionMap) getSessions() []*clientSession {
 	sm.RLock()
 	defer sm.RUnlock()
@@ -92,7 +197,97 @@ func NewPlayer() (*Player, error) {
 	// 	return nil, err
 	// }
 	// return &Player{sessions: newSessionMap(), volume: 1, ap: ap, isMuted: false}, nil
-	return nil, nil
+	return &Player{sessions: newSessionMap(), volume: 1, isMuted: false, artworks: artwork.NewStore(artwork.DefaultCapacity)}, nil
+}
+
+// SetPassword sets the password used when connecting to nodes we forward to
+func (p *Player) SetPassword(password string) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+	p.password = password
+}
+
+// SetTransport sets the transport we prefer for streaming to nodes we forward to
+func (p *Player) SetTransport(transport rtsp.Transport) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+	p.transport = transport
+}
+
+// SetEvents sets the event bus to publish what the player does to, as the receiver with the given id
+func (p *Player) SetEvents(events *cluster.EventBus, receiverID string) {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+	p.events = events
+	p.receiverID = receiverID
+}
+
+// publish publishes an event about the player, if it has an event bus
+func (p *Player) publish(eventType cluster.EventType, payload func(receiverID string) interface{}) {
+	p.configLock.RLock()
+	events, receiverID := p.events, p.receiverID
+	p.configLock.RUnlock()
+	if events == nil {
+		return
+	}
+	err := events.Publish(eventType, payload(receiverID))
+	if err != nil {
+		log.Printf("Error publishing %s event: %s\n", eventType, err)
+	}
+}
+
+// publishTrack publishes the current track, the track lock must be held
+func (p *Player) publishTrack() {
+	track := p.currentTrack
+	p.publish(cluster.TrackChanged, func(receiverID string) interface{} {
+		return cluster.TrackInfo{ReceiverID: receiverID, Artist: track.Artist, Album: track.Album,
+			Title: track.Title, ArtworkHash: track.ArtworkHash}
+	})
+}
+
+func (p *Player) getTransport() rtsp.Transport {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.transport
+}
+
+func (p *Player) getSource() *sdp.SessionDescription {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.source
+}
+
+// setSource sets the description of the stream we play, the nodes the stream was
+// announced to in another format have their sessions established again
+func (p *Player) setSource(source *sdp.SessionDescription) {
+	p.configLock.Lock()
+	p.source = source
+	p.configLock.Unlock()
+	format := formatKey(source)
+	for name, s := range p.sessions.getNamedSessions() {
+		if s.format == format {
+			continue
+		}
+		log.Printf("Stream format changed, establishing the session for %s again\n", name)
+		p.sessions.removeSession(name)
+		go p.initSession(name, net.ParseIP(s.RemotePorts.Address), s.rtspPort)
+	}
+}
+
+func (p *Player) getPassword() string {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.password
+}
+
+// setParameter forwards a SET_PARAMETER request, with what it sets, to every node downstream
+func (p *Player) setParameter(what string, contentType string, body []byte) {
+	for _, s := range p.sessions.getSessions() {
+		err := s.setParameter(contentType, body)
+		if err != nil {
+			log.Printf("Error forwarding %s: %s\n", what, err)
+		}
+	}
 }
 
 // NotifyJoin is invoked when a node is detected to have joined.
@@ -121,7 +316,11 @@ func (*Player) NotifyUpdate(node *memberlist.Node) {
 // AddSessionForNode will create a session to the given node
 func (p *Player) AddSessionForNode(node *memberlist.Node) {
 	log.Println("Adding session for node: " + node.Name)
-	meta := cluster.DecodeNodeMeta(node.Meta)
+	meta, err := cluster.DecodeNodeMeta(node.Meta)
+	if err != nil {
+		log.Printf("Not forwarding to node %s: %s\n", node.Name, err)
+		return
+	}
 	if meta.NodeType == cluster.Music {
 		go p.initSession(node.Name, node.Addr, meta.RtspPort)
 	}
@@ -130,15 +329,21 @@ func (p *Player) AddSessionForNode(node *memberlist.Node) {
 // RemoveSessionForNode will remove the session for the given node
 func (p *Player) RemoveSessionForNode(node *memberlist.Node) {
 	log.Println("Removing session for node: " + node.Name)
-	meta := cluster.DecodeNodeMeta(node.Meta)
-	// TODO: should probably explicitly close the session.
-	// next connection to node will do that, so it should be ok
-	// for now
+	meta, err := cluster.DecodeNodeMeta(node.Meta)
+	if err != nil {
+		// we never forwarded to a node we couldn't read
+		return
+	}
 	if meta.NodeType == cluster.Music {
 		p.sessions.removeSession(node.Name)
 	}
 }
 
+// ForwardingTo returns the names of the nodes the player forwards to
+func (p *Player) ForwardingTo() []string {
+	return p.sessions.getNames()
+}
+
 // RemoveAllSessions will remove all the active forwarding sessions
 func (p *Player) RemoveAllSessions() {
 	log.Println("Removing all forwarding sessions")
@@ -150,30 +355,14 @@ func (p *Player) SetVolume(volume float64) {
 	p.volLock.Lock()
 	defer p.volLock.Unlock()
 	p.volume = volume
+	p.publish(cluster.VolumeChanged, func(receiverID string) interface{} {
+		return cluster.VolumeInfo{ReceiverID: receiverID, Volume: volume}
+	})
 	// as a first pass all down stream clients will have the same
 	// volume; adjusting the volume of the forwarding player will
 	// forward the volume settings
-	go func() {
-		for _, s := range p.sessions.getSessions() {
-			client, err := rtsp.NewClient(s.RemotePorts.Address, s.rtspPort)
-			if err != nil {
-				log.Println("Error establishing RTSP connection", err)
-				continue
-			}
-			req := rtsp.NewRequest()
-			req.Method = rtsp.Set_Parameter
-			sessionID := strconv.FormatInt(time.Now().Unix(), 10)
-			localAddress := client.LocalAddress()
-			req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-			req.Headers["Content-Type"] = "text/parameters"
-			body := fmt.Sprintf("volume: %f", prepareVolume(volume))
-			req.Body = []byte(body)
-			_, err = client.Send(req)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}()
+	body := fmt.Sprintf("volume: %f", prepareVolume(volume))
+	go p.setParameter("volume", "text/parameters", []byte(body))
 }
 
 // SetMute will mute or unmute the player, mute overrides any volume settings
@@ -183,6 +372,13 @@ func (p *Player) SetMute(isMuted bool) {
 	p.isMuted = isMuted
 }
 
+// GetVolume returns the volume, between 0 (mute) and 1 (full volume)
+func (p *Player) GetVolume() float64 {
+	p.volLock.RLock()
+	defer p.volLock.RUnlock()
+	return p.volume
+}
+
 // GetIsMuted returns muted state
 func (p *Player) GetIsMuted() bool {
 	p.volLock.Lock()
@@ -193,9 +389,15 @@ func (p *Player) GetIsMuted() bool {
 // Play will play the packets received on the specified session
 // and forward the packets on
 func (p *Player) Play(session *rtsp.Session) {
+	p.setSource(session.Description)
 	decoder := player.GetCodec(session)
+	sessionInfo := func(receiverID string) interface{} {
+		return cluster.SessionInfo{ReceiverID: receiverID}
+	}
+	p.publish(cluster.SessionStarted, sessionInfo)
 
 	go func(dc player.CodecHandler) {
+		defer p.publish(cluster.SessionStopped, sessionInfo)
 		for d := range session.DataChan {
 			p.volLock.RLock()
 			// vol := p.volume
@@ -220,7 +422,7 @@ func (p *Player) Play(session *rtsp.Session) {
 				go func(pkt []byte) {
 					sessions := p.sessions.getSessions()
 					for _, s := range sessions {
-						s.DataChan <- pkt
+						s.forward(pkt)
 					}
 				}(d)
 			}()
@@ -231,84 +433,85 @@ func (p *Player) Play(session *rtsp.Session) {
 }
 
 // SetTrack sets the track for the player
-func (p *Player) SetTrack(album string, artist string, title string) {
+func (p *Player) SetTrack(track player.Track) {
 	p.trackLock.Lock()
 	defer p.trackLock.Unlock()
-	p.currentTrack.Album = album
-	p.currentTrack.Artist = artist
-	p.currentTrack.Title = title
+	// artwork is sent separately, keep what we have
+	track.ArtworkHash = p.currentTrack.ArtworkHash
+	changed := track.PersistentID != p.currentTrack.PersistentID || track.Title != p.currentTrack.Title
+	if changed {
+		// the progress we have is for the previous track
+		p.progressAt = time.Time{}
+	}
+	p.currentTrack = track
+	if changed {
+		p.publishTrack()
+	}
 	// forward the track data downstream
-	go func() {
-		for _, s := range p.sessions.getSessions() {
-			client, err := rtsp.NewClient(s.RemotePorts.Address, s.rtspPort)
-			if err != nil {
-				log.Println("Error establishing RTSP connection", err)
-				continue
-			}
-			req := rtsp.NewRequest()
-			req.Method = rtsp.Set_Parameter
-			sessionID := strconv.FormatInt(time.Now().Unix(), 10)
-			localAddress := client.LocalAddress()
-			req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-			req.Headers["Content-Type"] = "application/x-dmap-tagged"
-			input := make(map[string]interface{})
-
-			input["daap.songalbum"] = album
-			input["dmap.itemname"] = title
-			input["daap.songartist"] = artist
-			body, err := raop.EncodeDaap(input)
-			if err != nil {
-				log.Println("Error encoding song information", err)
-				continue
-			}
-			req.Body = body
-			_, err = client.Send(req)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}()
+	body, err := raop.EncodeTrack(track)
+	if err != nil {
+		log.Println("Error encoding song information", err)
+		return
+	}
+	go p.setParameter("song information", "application/x-dmap-tagged", body)
 }
 
-// SetAlbumArt sets the album art for the player
-func (p *Player) SetAlbumArt(artwork []byte) {
+// SetAlbumArt sets the album art for the player, nil if there is none. Artwork is only
+// forwarded downstream when it changed
+func (p *Player) SetAlbumArt(art *artwork.Artwork) {
 	p.trackLock.Lock()
 	defer p.trackLock.Unlock()
-	p.currentTrack.Artwork = artwork
+	hash := ""
+	contentType := artwork.None
+	var body []byte
+	if art != nil {
+		p.artworks.Put(art)
+		hash = art.Hash
+		contentType = art.MimeType
+		body = art.Data
+	}
+	if hash == p.currentTrack.ArtworkHash {
+		return
+	}
+	p.currentTrack.ArtworkHash = hash
+	p.publishTrack()
 	// forward the album art downstream
-	go func() {
-		for _, s := range p.sessions.getSessions() {
-			client, err := rtsp.NewClient(s.RemotePorts.Address, s.rtspPort)
-			if err != nil {
-				log.Println("Error establishing RTSP connection", err)
-				continue
-			}
-			req := rtsp.NewRequest()
-			req.Method = rtsp.Set_Parameter
-			sessionID := strconv.FormatInt(time.Now().Unix(), 10)
-			localAddress := client.LocalAddress()
-			req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, sessionID)
-			req.Headers["Content-Type"] = "image/jpeg"
-
-			req.Body = artwork
-			_, err = client.Send(req)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}()
+	go p.setParameter("album art", contentType, body)
 }
 
-// GetTrack returns the track
+// GetArtwork returns the artwork with the given hash, scaled down to fit in maxSize if it is bigger
+func (p *Player) GetArtwork(hash string, maxSize int) (*artwork.Artwork, error) {
+	return p.artworks.Thumbnail(hash, maxSize)
+}
+
+// SetProgress sets where playback is in the current track, and forwards it downstream
+func (p *Player) SetProgress(progress player.Progress) {
+	p.trackLock.Lock()
+	defer p.trackLock.Unlock()
+	p.progress = progress
+	p.progressAt = time.Now()
+	// the audio is forwarded as is, so the timestamps mean the same downstream
+	body := fmt.Sprintf("progress: %d/%d/%d\r\n", progress.Start, progress.Current, progress.End)
+	go p.setParameter("progress", "text/parameters", []byte(body))
+}
+
+// GetTrack returns the track, with the position worked out from the last progress update
 func (p *Player) GetTrack() player.Track {
 	p.trackLock.RLock()
 	defer p.trackLock.RUnlock()
-	return p.currentTrack
+	track := p.currentTrack
+	if !p.progressAt.IsZero() {
+		progress := p.progress.Advance(time.Since(p.progressAt))
+		track.Position = progress.Position()
+		track.Duration = progress.Duration()
+	}
+	return track
 }
 
 func (p *Player) initSession(nodeName string, ip net.IP, port int) {
 
-	session, err := raop.EstablishSession(ip.String(), port)
+	source := p.getSource()
+	session, client, err := raop.EstablishSession(ip.String(), port, p.getPassword(), p.getTransport(), source)
 
 	// do retry if we can't establish a session.  We may get
 	// the node join event before the node as fully started
@@ -321,7 +524,7 @@ func (p *Player) initSession(nodeName string, ip net.IP, port int) {
 			log.Printf("Error connecting to RTSP server: %s:%d. Retrying\n", ip.String(), port)
 		}
 		time.Sleep(3 * time.Second)
-		session, err = raop.EstablishSession(ip.String(), port)
+		session, client, err = raop.EstablishSession(ip.String(), port, p.getPassword(), p.getTransport(), source)
 	}
 
 	if err != nil {
@@ -331,11 +534,13 @@ func (p *Player) initSession(nodeName string, ip net.IP, port int) {
 
 	log.Printf("Session established for %s (%s:%d).\n", nodeName, ip.String(), port)
 
+	cSession := newClientSession(session, client, port, formatKey(source))
 	err = session.StartSending()
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Error starting to send", err)
+		cSession.close()
+		return
 	}
-	cSession := &clientSession{session, port}
 	p.sessions.addSession(nodeName, cSession)
 
 }
@@ -5,8 +5,10 @@ import (
 	"encoding/binary"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/ebitengine/oto/v3"
+	"github.com/ibiscum/bobcaygeon/artwork"
 	"github.com/ibiscum/bobcaygeon/rtsp"
 )
 
@@ -16,9 +18,11 @@ type Player interface {
 	SetVolume(volume float64)
 	SetMute(isMuted bool)
 	GetIsMuted() bool
-	SetTrack(album string, artist string, title string)
-	SetAlbumArt(artwork []byte)
+	SetTrack(track Track)
+	SetAlbumArt(art *artwork.Artwork)
+	SetProgress(progress Progress)
 	GetTrack() Track
+	GetArtwork(hash string, maxSize int) (*artwork.Artwork, error)
 }
 
 // LocalPlayer is a player that will just play the audio locally
@@ -29,10 +33,23 @@ type LocalPlayer struct {
 
 // Track represents a track playing by the player
 type Track struct {
-	Artist  string
-	Album   string
-	Title   string
-	Artwork []byte
+	Artist      string
+	Album       string
+	Title       string
+	Genre       string
+	Composer    string
+	Year        int
+	TrackNumber int
+	TrackCount  int
+	DiscNumber  int
+	DiscCount   int
+	Duration    time.Duration
+	// Position is how far into the track playback is
+	Position time.Duration
+	// PersistentID is the id the sender has for the track, it stays the same across plays
+	PersistentID uint64
+	// ArtworkHash identifies the artwork of the track, empty if there is none
+	ArtworkHash string
 }
 
 // NewLocalPlayer instantiates a new LocalPlayer
@@ -53,12 +70,17 @@ func (lp *LocalPlayer) SetVolume(volume float64) {
 }
 
 // SetTrack sets the track for the player
-func (lp *LocalPlayer) SetTrack(album string, artist string, title string) {
+func (lp *LocalPlayer) SetTrack(track Track) {
 	// no op for now
 }
 
-// SetAlbumArt sets the album art for the player
-func (lp *LocalPlayer) SetAlbumArt(artwork []byte) {
+// SetAlbumArt sets the album art for the player, nil if there is none
+func (lp *LocalPlayer) SetAlbumArt(art *artwork.Artwork) {
+	// no op for now
+}
+
+// SetProgress sets where playback is in the current track
+func (lp *LocalPlayer) SetProgress(progress Progress) {
 	// no op for now
 }
 
@@ -77,6 +99,11 @@ func (lp *LocalPlayer) GetTrack() Track {
 	return Track{}
 }
 
+// GetArtwork returns the artwork with the given hash
+func (lp *LocalPlayer) GetArtwork(hash string, maxSize int) (*artwork.Artwork, error) {
+	return nil, artwork.ErrNotFound
+}
+
 func (lp *LocalPlayer) playStream(session *rtsp.Session) {
 	op := &oto.NewContextOptions{}
 	op.SampleRate = 44100
@@ -0,0 +1,66 @@
+package player
+
+import "time"
+
+// DefaultSampleRate is the RTP clock rate of AirPlay audio streams
+const DefaultSampleRate = 44100
+
+// Progress is where playback is in the current track, as RTP timestamps the
+// way senders send it: the timestamps of the start and end of the track and
+// of what is playing right now
+type Progress struct {
+	Start   uint32
+	Current uint32
+	End     uint32
+	// SampleRate is the rate of the RTP clock
+	SampleRate int
+}
+
+// Position returns how far into the track playback is
+func (p Progress) Position() time.Duration {
+	// timestamps wrap around, subtracting as uint32 takes care of that
+	return p.toDuration(p.Current - p.Start)
+}
+
+// Duration returns the length of the track
+func (p Progress) Duration() time.Duration {
+	return p.toDuration(p.End - p.Start)
+}
+
+// At returns the progress at the given RTP timestamp, clamped to the track
+func (p Progress) At(rtpTime uint32) Progress {
+	at := p
+	switch {
+	case int32(rtpTime-p.Start) < 0:
+		at.Current = p.Start
+	case rtpTime-p.Start > p.End-p.Start:
+		at.Current = p.End
+	default:
+		at.Current = rtpTime
+	}
+	return at
+}
+
+// Advance returns the progress after playing on for the given time, clamped to the end of the track
+func (p Progress) Advance(elapsed time.Duration) Progress {
+	if elapsed <= 0 {
+		return p
+	}
+	rate := p.rate()
+	frames := elapsed.Nanoseconds() * int64(rate) / int64(time.Second)
+	if frames >= int64(p.End-p.Current) {
+		return p.At(p.End)
+	}
+	return p.At(p.Current + uint32(frames))
+}
+
+func (p Progress) rate() int {
+	if p.SampleRate <= 0 {
+		return DefaultSampleRate
+	}
+	return p.SampleRate
+}
+
+func (p Progress) toDuration(frames uint32) time.Duration {
+	return time.Duration(int64(frames) * int64(time.Second) / int64(p.rate()))
+}
@@ -0,0 +1,35 @@
+package player
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := Progress{Start: 1000, Current: 1000 + 44100*30, End: 1000 + 44100*300, SampleRate: 44100}
+	if p.Position() != 30*time.Second {
+		t.Error("Expected 30s got:", p.Position())
+	}
+	if p.Duration() != 300*time.Second {
+		t.Error("Expected 5m got:", p.Duration())
+	}
+	if p.Advance(10*time.Second).Position() != 40*time.Second {
+		t.Error("Expected 40s got:", p.Advance(10*time.Second).Position())
+	}
+	if p.Advance(time.Hour).Position() != 300*time.Second {
+		t.Error("Expected to stop at the end got:", p.Advance(time.Hour).Position())
+	}
+	if p.At(500).Position() != 0 {
+		t.Error("Expected timestamps before the start to clamp got:", p.At(500).Position())
+	}
+}
+
+func TestProgressWrapsAround(t *testing.T) {
+	p := Progress{Start: 0xFFFFFF00, Current: 0x100, End: 0x10000}
+	if p.Position() != time.Duration(0x200)*time.Second/44100 {
+		t.Error("Unexpected position across the wrap:", p.Position())
+	}
+	if p.At(0xFFFFFF80).Position() != time.Duration(0x80)*time.Second/44100 {
+		t.Error("Unexpected position before the wrap:", p.At(0xFFFFFF80).Position())
+	}
+}
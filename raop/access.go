@@ -0,0 +1,165 @@
+package raop
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/ibiscum/bobcaygeon/rtsp"
+)
+
+// AccessMatch is what part of a request an access rule is matched against
+type AccessMatch int
+
+const (
+	// MatchAddress matches the remote address, either a single IP or a CIDR range
+	MatchAddress AccessMatch = iota
+	// MatchDacpID matches the DACP-ID header, identifying the sending device
+	MatchDacpID
+	// MatchUserAgent matches (part of) the User-Agent header
+	MatchUserAgent
+)
+
+var accessMatchNames = map[AccessMatch]string{
+	MatchAddress:   "address",
+	MatchDacpID:    "dacp-id",
+	MatchUserAgent: "user-agent",
+}
+
+func (m AccessMatch) String() string {
+	return accessMatchNames[m]
+}
+
+// AccessRule allows or denies the senders matching it
+type AccessRule struct {
+	Allow bool
+	Match AccessMatch
+	Value string
+	// set for address rules
+	network *net.IPNet
+}
+
+// NewAccessRule instantiates a new rule, match is one of: address, dacp-id or user-agent
+func NewAccessRule(allow bool, match string, value string) (*AccessRule, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("access rule needs a value to match")
+	}
+	rule := &AccessRule{Allow: allow, Value: value}
+	switch strings.ToLower(match) {
+	case "address", "ip", "cidr":
+		rule.Match = MatchAddress
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		rule.network = network
+	case "dacp-id":
+		rule.Match = MatchDacpID
+	case "user-agent":
+		rule.Match = MatchUserAgent
+	default:
+		return nil, fmt.Errorf("unknown access rule match: %s", match)
+	}
+	return rule, nil
+}
+
+// parseNetwork parses a CIDR range, a single IP is treated as a range of one
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address or CIDR range: %s", value)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (r *AccessRule) matches(req *rtsp.Request, remoteAddress string) bool {
+	switch r.Match {
+	case MatchAddress:
+		ip := net.ParseIP(remoteAddress)
+		return ip != nil && r.network.Contains(ip)
+	case MatchDacpID:
+		return strings.EqualFold(req.Headers["DACP-ID"], r.Value)
+	case MatchUserAgent:
+		return strings.Contains(strings.ToLower(req.Headers["User-Agent"]), strings.ToLower(r.Value))
+	}
+	return false
+}
+
+func (r *AccessRule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+	return fmt.Sprintf("%s %s %s", action, r.Match.String(), r.Value)
+}
+
+// SetAccessRules replaces the rules deciding which senders may stream to us. Rules are evaluated
+// in order and the first match wins; a sender matching none is only let in if no rule allows anyone,
+// so a list of allow rules works as an allow list and a list of deny rules as a deny list
+func (a *AirplayServer) SetAccessRules(rules []*AccessRule) {
+	a.accessLock.Lock()
+	defer a.accessLock.Unlock()
+	a.accessRules = rules
+}
+
+// GetAccessRules returns the rules deciding which senders may stream to us
+func (a *AirplayServer) GetAccessRules() []*AccessRule {
+	a.accessLock.RLock()
+	defer a.accessLock.RUnlock()
+	return a.accessRules
+}
+
+// SetMemberCheck sets how to tell whether a remote address is the one of a node of our cluster.
+// The cluster's leader forwards what it receives to us, so the nodes of the cluster are let in
+// whatever the access rules; with gossip encrypted only nodes holding the key can be members
+func (a *AirplayServer) SetMemberCheck(isMember func(address string) bool) {
+	a.accessLock.Lock()
+	defer a.accessLock.Unlock()
+	a.isMember = isMember
+}
+
+func (a *AirplayServer) isAllowed(req *rtsp.Request, remoteAddress string) bool {
+	a.accessLock.RLock()
+	rules, isMember := a.accessRules, a.isMember
+	a.accessLock.RUnlock()
+	if isMember != nil && isMember(remoteAddress) {
+		return true
+	}
+	hasAllowRules := false
+	for _, rule := range rules {
+		if rule.matches(req, remoteAddress) {
+			return rule.Allow
+		}
+		hasAllowRules = hasAllowRules || rule.Allow
+	}
+	return !hasAllowRules
+}
+
+// checkAccess wraps a handler, turning away senders not allowed by the access rules
+func (a *AirplayServer) checkAccess(handler rtsp.RequestHandler) rtsp.RequestHandler {
+	return func(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+		if !a.isAllowed(req, remoteAddress) {
+			log.Printf("Sender %s (%s) is not allowed to stream\n", remoteAddress, req.Headers["User-Agent"])
+			resp.Status = rtsp.Forbidden
+			return
+		}
+		handler(req, resp, localAddress, remoteAddress)
+	}
+}
+
+// guard wraps a handler for a method senders must be allowed, and authenticated, for
+func (a *AirplayServer) guard(handler rtsp.RequestHandler) rtsp.RequestHandler {
+	// senders not allowed in are turned away before even being asked to authenticate
+	return a.checkAccess(a.requireAuth(handler))
+}
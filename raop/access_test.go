@@ -0,0 +1,134 @@
+package raop
+
+import (
+	"testing"
+
+	"github.com/ibiscum/bobcaygeon/rtsp"
+)
+
+func mustRule(t *testing.T, allow bool, match string, value string) *AccessRule {
+	rule, err := NewAccessRule(allow, match, value)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	return rule
+}
+
+func TestNoRulesAllowsAll(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	if !a.isAllowed(rtsp.NewRequest(), "10.0.0.2") {
+		t.Error("Expected sender to be allowed without rules")
+	}
+}
+
+func TestDenyList(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetAccessRules([]*AccessRule{mustRule(t, false, "address", "10.0.1.0/24"), mustRule(t, false, "dacp-id", "14413BE4996FEA4D")})
+	req := rtsp.NewRequest()
+	if a.isAllowed(req, "10.0.1.20") {
+		t.Error("Expected address in denied range to be rejected")
+	}
+	if !a.isAllowed(req, "10.0.2.20") {
+		t.Error("Expected address outside denied range to be allowed")
+	}
+	req.Headers["DACP-ID"] = "14413be4996fea4d"
+	if a.isAllowed(req, "10.0.2.20") {
+		t.Error("Expected denied DACP-ID to be rejected")
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetAccessRules([]*AccessRule{mustRule(t, false, "user-agent", "iPad"), mustRule(t, true, "user-agent", "iTunes")})
+	req := rtsp.NewRequest()
+	req.Headers["User-Agent"] = "iTunes/12.5.1 (Macintosh; OS X 10.11.6)"
+	if !a.isAllowed(req, "10.0.0.2") {
+		t.Error("Expected allowed User-Agent to be allowed")
+	}
+	req.Headers["User-Agent"] = "AirPlay/320.20 (iPad)"
+	if a.isAllowed(req, "10.0.0.2") {
+		t.Error("Expected denied User-Agent to be rejected")
+	}
+	req.Headers["User-Agent"] = "Bobcaygeon/1.0"
+	if a.isAllowed(req, "10.0.0.2") {
+		t.Error("Expected sender matching no allow rule to be rejected")
+	}
+}
+
+func TestSingleAddressRule(t *testing.T) {
+	rule := mustRule(t, false, "ip", "192.168.0.15")
+	if !rule.matches(rtsp.NewRequest(), "192.168.0.15") || rule.matches(rtsp.NewRequest(), "192.168.0.16") {
+		t.Error("Expected single address rule to only match that address")
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	if _, err := NewAccessRule(true, "address", "not-an-ip"); err == nil {
+		t.Error("Expected error for invalid address")
+	}
+	if _, err := NewAccessRule(true, "mac", "a4:d1:d2:80:0b:68"); err == nil {
+		t.Error("Expected error for unknown match")
+	}
+	if _, err := NewAccessRule(true, "user-agent", " "); err == nil {
+		t.Error("Expected error for empty value")
+	}
+}
+
+func TestAnnounceForbidden(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetAccessRules([]*AccessRule{mustRule(t, false, "address", "10.0.0.2")})
+	called := false
+	handler := a.checkAccess(func(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+		called = true
+	})
+	resp := rtsp.NewResponse()
+	handler(rtsp.NewRequest(), resp, "10.0.0.1", "10.0.0.2")
+	if resp.Status != rtsp.Forbidden || called {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.Forbidden.String(), resp.Status.String())
+	}
+}
+
+func TestAccessCheckedForEveryMethod(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetAccessRules([]*AccessRule{mustRule(t, false, "address", "10.0.0.2")})
+	handler := a.guard(func(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+		resp.Status = rtsp.Ok
+	})
+	for _, method := range []rtsp.Method{rtsp.Setup, rtsp.Record, rtsp.Set_Parameter, rtsp.Flush, rtsp.Teardown} {
+		req := rtsp.NewRequest()
+		req.Method = method
+		resp := rtsp.NewResponse()
+		handler(req, resp, "10.0.0.1", "10.0.0.2")
+		if resp.Status != rtsp.Forbidden {
+			t.Errorf("Expected %s to be forbidden got: %s", method, resp.Status.String())
+		}
+	}
+}
+
+func TestClusterMemberForwardsPastAccessRules(t *testing.T) {
+	port := freePort(t)
+	a := NewAirplayServer(port, "Test", &FakePlayer{})
+	// only senders from elsewhere are allowed, not the leader forwarding from here
+	a.SetAccessRules([]*AccessRule{mustRule(t, true, "address", "10.0.0.0/8")})
+	err := a.Start(false, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer a.Stop()
+
+	_, _, err = EstablishSession("127.0.0.1", port, "", rtsp.UDP, nil)
+	if err == nil {
+		t.Fatal("Expected a sender not allowed to be turned away")
+	}
+
+	a.SetMemberCheck(func(address string) bool {
+		return address == "127.0.0.1"
+	})
+	session, client, err := EstablishSession("127.0.0.1", port, "", rtsp.UDP, nil)
+	if err != nil {
+		t.Fatal("Expected the cluster member to forward to us", err)
+	}
+	done := make(chan struct{}, 1)
+	session.Close(done)
+	client.Close()
+}
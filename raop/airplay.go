@@ -2,7 +2,10 @@ package raop
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -10,8 +13,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/ibiscum/bobcaygeon/artwork"
 	"github.com/ibiscum/bobcaygeon/player"
 	"github.com/ibiscum/bobcaygeon/rtsp"
 	"github.com/ibiscum/bobcaygeon/sdp"
@@ -23,8 +28,8 @@ import (
 const (
 	airTunesServiceType = "_raop._tcp"
 	domain              = "local."
-	localTimingPort     = 6002
-	localControlPort    = 6001
+	// realm used for digest authentication, as used by other airplay receivers
+	authRealm = "raop"
 )
 
 var airtunesServiceProperties = []string{"txtvers=1",
@@ -32,7 +37,6 @@ var airtunesServiceProperties = []string{"txtvers=1",
 	"ch=2",
 	"ss=16",
 	"sr=44100",
-	"pw=false",
 	"sm=false",
 	"sv=false",
 	"ek=1",
@@ -43,21 +47,94 @@ var airtunesServiceProperties = []string{"txtvers=1",
 
 // AirplayServer server for handling the RTSP protocol
 type AirplayServer struct {
-	port          int
-	name          string
-	rtspServer    *rtsp.Server
-	zerconfServer *zeroconf.Server
-	sessions      *sessionMap
-	player        player.Player
+	port int
+	name string
+	// rtspServer is set once started, and unset once stopped
+	serverLock sync.Mutex
+	rtspServer *rtsp.Server
+	// one zeroconf server per interface we advertise on
+	zeroconfServers []*zeroconf.Server
+	sessions        *sessionMap
+	player          player.Player
+	authLock        sync.RWMutex
+	authenticator   *rtsp.DigestAuthenticator
+	policyLock      sync.RWMutex
+	policy          ArbitrationPolicy
+	idleTimeout     time.Duration
+	accessLock      sync.RWMutex
+	accessRules     []*AccessRule
+	isMember        func(address string) bool
+	// hardwareAddr is advertised as part of the service name and used in the apple challenge, when
+	// not set the MAC address of the interface the sender reached us on is used instead
+	hardwareAddr net.HardwareAddr
+	// hardwareAddrIndex tells receivers on the same host, using the interface MAC addresses, apart
+	hardwareAddrIndex int
+	// privateKey signs apple challenge responses and decrypts the stream keys
+	privateKey *rsa.PrivateKey
+	// dacpDiscovery finds the DACP services of senders, for remote controlling them
+	dacpDiscovery *DacpDiscovery
 }
 
+// sessionState tracks where a sender is in the RAOP handshake
+type sessionState int
+
+const (
+	// announced the sender has described the stream
+	announced sessionState = iota
+	// ready the transport has been set up
+	ready
+	// recording the sender is streaming audio
+	recording
+)
+
 type airplaySession struct {
-	session *rtsp.Session
-	client  *DacpClient
+	// conn is the address of the RTSP connection that owns this session
+	conn string
+	// the handshake moves the state along on the connection's goroutine, while
+	// inspecting sessions reads it from others
+	stateLock sync.RWMutex
+	state     sessionState
+	session   *rtsp.Session
+	dacpID    string
+	// the DACP client is resolved in the background, after the session started
+	clientLock   sync.RWMutex
+	client       *DacpClient
+	activeRemote string
+	// last progress the sender sent, and how far ahead of it the audio we receive is
+	progressLock sync.RWMutex
+	progress     *player.Progress
+	progressLead uint32
+	// userAgent of the sender, kept for inspecting sessions
+	userAgent string
+	started   time.Time
+}
+
+func newAirplaySession(conn string, session *rtsp.Session, dacpClient *DacpClient) *airplaySession {
+	return &airplaySession{conn: conn, state: announced, session: session, client: dacpClient, started: time.Now()}
+}
+
+func (as *airplaySession) getState() sessionState {
+	as.stateLock.RLock()
+	defer as.stateLock.RUnlock()
+	return as.state
+}
+
+func (as *airplaySession) setState(state sessionState) {
+	as.stateLock.Lock()
+	defer as.stateLock.Unlock()
+	as.state = state
 }
 
-func newAirplaySession(session *rtsp.Session, dacpClient *DacpClient) *airplaySession {
-	return &airplaySession{session, dacpClient}
+func (as *airplaySession) getClient() *DacpClient {
+	as.clientLock.RLock()
+	defer as.clientLock.RUnlock()
+	return as.client
+}
+
+func (as *airplaySession) setClient(client *DacpClient) {
+	as.clientLock.Lock()
+	defer as.clientLock.Unlock()
+	as.client = client
 }
 
 type sessionMap struct {
@@ -69,22 +146,29 @@ func newSessionMap() *sessionMap {
 	return &sessionMap{sessions: make(map[string]*airplaySession)}
 }
 
-func (sm *sessionMap) addSession(address string, session *airplaySession) {
+func (sm *sessionMap) addSession(conn string, session *airplaySession) {
 	sm.Lock()
 	defer sm.Unlock()
-	sm.sessions[address] = session
+	sm.sessions[conn] = session
 }
 
-func (sm *sessionMap) removeSession(address string) {
+// takeSession removes the session of the connection and returns it, nil when there is none;
+// of the callers taking the same session only one gets it
+func (sm *sessionMap) takeSession(conn string) *airplaySession {
 	sm.Lock()
 	defer sm.Unlock()
-	delete(sm.sessions, address)
+	s, ok := sm.sessions[conn]
+	if !ok {
+		return nil
+	}
+	delete(sm.sessions, conn)
+	return s
 }
 
-func (sm *sessionMap) getSession(address string) *airplaySession {
+func (sm *sessionMap) getSession(conn string) *airplaySession {
 	sm.RLock()
 	defer sm.RUnlock()
-	s, ok := sm.sessions[address]
+	s, ok := sm.sessions[conn]
 	if !ok {
 		return nil
 	}
@@ -92,6 +176,8 @@ func (sm *sessionMap) getSession(address string) *airplaySession {
 }
 
 func (sm *sessionMap) getSessions() []*airplaySession {
+	sm.RLock()
+	defer sm.RUnlock()
 	sessions := make([]*airplaySession, 0, len(sm.sessions))
 
 	for _, value := range sm.sessions {
@@ -102,47 +188,59 @@ func (sm *sessionMap) getSessions() []*airplaySession {
 
 // NewAirplayServer instantiates a new airplayer server
 func NewAirplayServer(port int, name string, player player.Player) *AirplayServer {
-	as := AirplayServer{port: port, name: name, player: player, sessions: newSessionMap()}
+	key, err := DefaultPrivateKey()
+	if err != nil {
+		log.Println("Error loading default private key: ", err)
+	}
+	as := AirplayServer{port: port, name: name, player: player, sessions: newSessionMap(), privateKey: key,
+		dacpDiscovery: defaultDacpDiscovery()}
 	return &as
 }
 
-// Start starts the airplay server, broadcasting on bonjour, ready to accept requests
-func (a *AirplayServer) Start(verbose bool, advertise bool) {
-
-	if advertise {
-		a.initAdvertise()
-	}
-
+// Start starts the airplay server, broadcasting on bonjour, ready to accept requests. It
+// returns once the RTSP server listens, with an error if it can't
+func (a *AirplayServer) Start(verbose bool, advertise bool) error {
 	rtspServer := rtsp.NewServer(a.port)
 
+	// OPTIONS is left unauthenticated, senders use it to check for the apple challenge
+	rtspServer.AddHandler(rtsp.Options, a.handleOptions)
+	rtspServer.AddHandler(rtsp.Announce, a.guard(a.handleAnnounce))
+	rtspServer.AddHandler(rtsp.Setup, a.guard(a.handleSetup))
+	rtspServer.AddHandler(rtsp.Record, a.guard(a.handleRecord))
+	rtspServer.AddHandler(rtsp.Set_Parameter, a.guard(a.handlSetParameter))
+	rtspServer.AddHandler(rtsp.Flush, a.guard(a.handlFlush))
+	rtspServer.AddHandler(rtsp.Teardown, a.guard(a.handleTeardown))
+	// a sender dropping its connection without a TEARDOWN still ends its session
+	rtspServer.SetDisconnectHandler(a.closeSession)
+	rtspServer.SetInterleavedHandler(a.handleInterleaved)
+	err := rtspServer.Start(verbose)
+	if err != nil {
+		return err
+	}
+	a.serverLock.Lock()
 	a.rtspServer = rtspServer
+	a.serverLock.Unlock()
 
-	rtspServer.AddHandler(rtsp.Options, handleOptions)
-	rtspServer.AddHandler(rtsp.Announce, a.handleAnnounce)
-	rtspServer.AddHandler(rtsp.Setup, a.handleSetup)
-	rtspServer.AddHandler(rtsp.Record, a.handleRecord)
-	rtspServer.AddHandler(rtsp.Set_Parameter, a.handlSetParameter)
-	rtspServer.AddHandler(rtsp.Flush, handlFlush)
-	rtspServer.AddHandler(rtsp.Teardown, a.handleTeardown)
-	rtspServer.Start(verbose)
-
+	if advertise {
+		a.initAdvertise()
+	}
+	return nil
 }
 
 // ToggleAdvertise will toggle whether or not to advertise as an airplay service
 func (a *AirplayServer) ToggleAdvertise(shouldAdvertise bool) {
 	if !shouldAdvertise {
-		if a.zerconfServer == nil {
+		if !a.IsAdvertising() {
 			log.Println("Currently not advertising, ignoring turn off advertise request")
 			return
 		}
-		// if we have a zerconfServer reference it means we are already advertising, so
-		// stop it
+		// if we have zeroconf servers it means we are already advertising, so
+		// stop them
 		log.Printf("Shutting down broadcasting of %s\n", a.name)
-		a.zerconfServer.Shutdown()
-		a.zerconfServer = nil
+		a.stopAdvertise()
 
 	} else {
-		if a.zerconfServer != nil {
+		if a.IsAdvertising() {
 			log.Println("Currently advertising, ignoring turn on advertise request")
 			return
 		}
@@ -150,30 +248,156 @@ func (a *AirplayServer) ToggleAdvertise(shouldAdvertise bool) {
 	}
 }
 
+// IsAdvertising returns whether or not we are advertising as an airplay service
+func (a *AirplayServer) IsAdvertising() bool {
+	return len(a.zeroconfServers) > 0
+}
+
+// Name returns the name the service is advertised under
+func (a *AirplayServer) Name() string {
+	return a.name
+}
+
+// Port returns the port the RTSP server listens on
+func (a *AirplayServer) Port() int {
+	return a.port
+}
+
+// HardwareAddr returns the MAC address the service identifies itself with, when it
+// goes by the interface senders reach it on this is the one of the primary interface
+func (a *AirplayServer) HardwareAddr() net.HardwareAddr {
+	return a.hardwareAddrFor("")
+}
+
+// SetHardwareAddr overrides the MAC address the service identifies itself with, on every
+// interface. Senders tell receivers apart by it, so every receiver on a host needs its own. Must be set before Start
+func (a *AirplayServer) SetHardwareAddr(addr net.HardwareAddr) {
+	a.hardwareAddr = addr
+}
+
+// SetHardwareAddrIndex sets the index of the receiver on the host, receivers other than the first one
+// identify themselves with an address derived from the interface's, so they can be told apart. Must be set before Start
+func (a *AirplayServer) SetHardwareAddrIndex(index int) {
+	a.hardwareAddrIndex = index
+}
+
+// SetIdentity sets the key and, if the identity has one, the MAC address the service identifies itself with.
+// Must be set before Start
+func (a *AirplayServer) SetIdentity(identity *Identity) {
+	if identity.PrivateKey != nil {
+		a.privateKey = identity.PrivateKey
+	}
+	if identity.HardwareAddr != nil {
+		a.hardwareAddr = identity.HardwareAddr
+	}
+}
+
+// hardwareAddrFor returns the MAC address to identify with to senders connecting to the given local address
+func (a *AirplayServer) hardwareAddrFor(localAddress string) net.HardwareAddr {
+	if a.hardwareAddr != nil {
+		return a.hardwareAddr
+	}
+	addr := interfaceHardwareAddr(localAddress)
+	if addr == nil || a.hardwareAddrIndex == 0 {
+		return addr
+	}
+	return virtualHardwareAddr(addr, a.hardwareAddrIndex)
+}
+
 // ChangeName will change the name of the broadcast service
 func (a *AirplayServer) ChangeName(newName string) error {
 	if strings.TrimSpace(newName) == "" {
 		return errors.New("New name must be non-empty")
 	}
 	a.name = strings.TrimSpace(newName)
-	// if we are advertising, stop the zeroconf server and start it so it
-	// reflects the name change
-	if a.zerconfServer != nil {
-		a.zerconfServer.Shutdown()
-		a.zerconfServer = nil
+	// if we are advertising, stop the zeroconf servers and start them so they
+	// reflect the name change
+	if a.IsAdvertising() {
+		a.stopAdvertise()
 		a.initAdvertise()
 	}
 	return nil
 }
 
+// SetPassword sets the password senders need to supply to stream to us, an empty password disables authentication
+func (a *AirplayServer) SetPassword(password string) {
+	a.authLock.Lock()
+	if password == "" {
+		a.authenticator = nil
+	} else {
+		a.authenticator = rtsp.NewDigestAuthenticator(authRealm, password)
+	}
+	a.authLock.Unlock()
+	// the password flag is part of what we advertise, so re-advertise if needed
+	if a.IsAdvertising() {
+		a.stopAdvertise()
+		a.initAdvertise()
+	}
+}
+
+// HasPassword returns whether or not senders need to authenticate
+func (a *AirplayServer) HasPassword() bool {
+	a.authLock.RLock()
+	defer a.authLock.RUnlock()
+	return a.authenticator != nil
+}
+
+// requireAuth wraps a handler, challenging any request that does not carry valid credentials
+func (a *AirplayServer) requireAuth(handler rtsp.RequestHandler) rtsp.RequestHandler {
+	return func(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+		a.authLock.RLock()
+		authenticator := a.authenticator
+		a.authLock.RUnlock()
+		if authenticator != nil && !authenticator.Authenticate(req) {
+			resp.Status = rtsp.Unauthorized
+			resp.Headers["WWW-Authenticate"] = authenticator.Challenge(req)
+			return
+		}
+		handler(req, resp, localAddress, remoteAddress)
+	}
+}
+
+func (a *AirplayServer) serviceProperties() []string {
+	properties := make([]string, 0, len(airtunesServiceProperties)+1)
+	properties = append(properties, airtunesServiceProperties...)
+	return append(properties, fmt.Sprintf("pw=%t", a.HasPassword()))
+}
+
+// initAdvertise advertises the service on every interface, each under the MAC address of
+// that interface, so the name matches the one used in the apple challenge for senders on it
 func (a *AirplayServer) initAdvertise() {
+	if a.hardwareAddr != nil {
+		a.advertise(a.hardwareAddr, nil)
+		return
+	}
+	interfaces, err := listInterfaces()
+	if err != nil {
+		log.Println("Error listing interfaces, advertising on all of them: ", err)
+	}
+	for _, hi := range interfaces {
+		if !hi.usable() || hi.iface.Flags&net.FlagMulticast == 0 || len(hi.addrs) == 0 {
+			continue
+		}
+		addr := hi.iface.HardwareAddr
+		if a.hardwareAddrIndex > 0 {
+			addr = virtualHardwareAddr(addr, a.hardwareAddrIndex)
+		}
+		a.advertise(addr, []net.Interface{hi.iface})
+	}
+	if !a.IsAdvertising() {
+		a.advertise(a.hardwareAddrFor(""), nil)
+	}
+}
+
+// advertise advertises the service under the given MAC address on the given interfaces, nil for all of them
+func (a *AirplayServer) advertise(hardwareAddr net.HardwareAddr, ifaces []net.Interface) {
 	// as per the protocol, the mac address makes up part of the service name
-	macAddr := getMacAddr().String()
+	macAddr := hardwareAddr.String()
 	macAddr = strings.Replace(macAddr, ":", "", -1)
 
 	serviceName := fmt.Sprintf("%s@%s", macAddr, a.name)
 
-	server, err := zeroconf.Register(serviceName, airTunesServiceType, domain, a.port, airtunesServiceProperties, nil)
+	server, err := zeroconf.Register(serviceName, airTunesServiceType, domain, a.port, a.serviceProperties(), ifaces)
 	if err != nil {
 		log.Fatal("couldn't start zeroconf: ", err)
 	}
@@ -183,11 +407,21 @@ func (a *AirplayServer) initAdvertise() {
 	log.Println("- Type:", airTunesServiceType)
 	log.Println("- Domain:", domain)
 	log.Println("- Port:", a.port)
+	for _, iface := range ifaces {
+		log.Println("- Interface:", iface.Name)
+	}
+
+	a.zeroconfServers = append(a.zeroconfServers, server)
+}
 
-	a.zerconfServer = server
+func (a *AirplayServer) stopAdvertise() {
+	for _, server := range a.zeroconfServers {
+		server.Shutdown()
+	}
+	a.zeroconfServers = nil
 }
 
-func handleOptions(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+func (a *AirplayServer) handleOptions(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
 	resp.Status = rtsp.Ok
 	resp.Headers["Public"] = strings.Join(rtsp.GetMethods(), " ")
 	appleChallenge, exists := req.Headers["Apple-Challenge"]
@@ -195,7 +429,7 @@ func handleOptions(req *rtsp.Request, resp *rtsp.Response, localAddress string,
 		return
 	}
 	log.Printf("Apple Challenge detected: %s\n", appleChallenge)
-	challengResponse, err := generateChallengeResponse(appleChallenge, getMacAddr(), localAddress)
+	challengResponse, err := generateChallengeResponse(appleChallenge, a.hardwareAddrFor(localAddress), localAddress, a.privateKey)
 	if err != nil {
 		log.Println("Error generating challenge response: ", err.Error())
 	}
@@ -211,19 +445,40 @@ func (a *AirplayServer) handleAnnounce(req *rtsp.Request, resp *rtsp.Response, l
 			resp.Status = rtsp.BadRequest
 			return
 		}
-		// right now, we only maintain one audio session, so close any existing one
-		a.closeAllSessions()
+		rtpmap, ok := description.RtpMap()
+		if !ok {
+			// the senders leaving it out stream ALAC, the format we go by when there is none
+			log.Println("SDP payload does not describe the stream format, assuming the default")
+			description.MediaDescription = []sdp.MediaDescription{StreamFormat(nil)}
+			rtpmap, _ = description.RtpMap()
+		}
+		log.Printf("Stream format: %s\n", rtpmap)
+		dacpID := req.Headers["DACP-ID"]
+		if !a.mayTakeOver(req.RemoteAddr, dacpID) {
+			log.Printf("Rejecting session from %s, another sender is streaming\n", remoteAddress)
+			resp.Status = rtsp.NotEnoughBandwidth
+			return
+		}
+		// right now, we only maintain one audio session, so close any existing one;
+		// a sender other than the new one is told to stop, so it knows it was preempted
+		for _, as := range a.sessions.getSessions() {
+			sameSender := as.conn == req.RemoteAddr || (dacpID != "" && as.dacpID == dacpID)
+			if !sameSender {
+				log.Printf("Session %s preempted by %s\n", as.session.ID, remoteAddress)
+			}
+			a.endSession(as.conn, !sameSender)
+		}
 		var decoder rtsp.Decrypter
 
-		if key, ok := description.Attributes["rsaaeskey"]; ok {
-			aesKey, err := aeskeyFromRsa(key)
+		if key, ok := description.Attribute("rsaaeskey"); ok {
+			aesKey, err := aeskeyFromRsa(key, a.privateKey)
 			if err != nil {
 				log.Println("error retrieving aes key", err)
 				resp.Status = rtsp.InternalServerError
 				return
 			}
 			// from: https://github.com/joelgibson/go-airplay/blob/19e70c97e3903365f0a7f5a3f3c33751f4e8fb94/airplay/rtsp.go#L149
-			aesIv64 := description.Attributes["aesiv"]
+			aesIv64, _ := description.Attribute("aesiv")
 			aesIv64 = base64pad(aesIv64)
 			aesIv, err := base64.StdEncoding.DecodeString(aesIv64)
 			if err != nil {
@@ -233,10 +488,6 @@ func (a *AirplayServer) handleAnnounce(req *rtsp.Request, resp *rtsp.Response, l
 			}
 			decoder = NewAesDecrypter(aesKey, aesIv)
 		}
-		// create the dacp client for player control and then attach to the stream
-		dacpID := req.Headers["DACP-ID"]
-		activeRemote := req.Headers["Active-Remote"]
-		dacpClient := DiscoverDacpClient(dacpID, activeRemote)
 		s := rtsp.NewSession(description, decoder)
 		err = s.InitReceive()
 		if err != nil {
@@ -244,75 +495,138 @@ func (a *AirplayServer) handleAnnounce(req *rtsp.Request, resp *rtsp.Response, l
 			resp.Status = rtsp.InternalServerError
 			return
 		}
-		session := newAirplaySession(s, dacpClient)
-		a.sessions.addSession(remoteAddress, session)
+		s.ID = newSessionID()
+		session := newAirplaySession(req.RemoteAddr, s, nil)
+		session.dacpID = dacpID
+		session.activeRemote = req.Headers["Active-Remote"]
+		session.userAgent = req.Headers["User-Agent"]
+		a.sessions.addSession(req.RemoteAddr, session)
+		// find the DACP service for player control without holding up the sender
+		go a.discoverDacpClient(session)
 	}
 	resp.Status = rtsp.Ok
 }
 
+// lookupSession finds the session belonging to the connection of the request. If there
+// is none, or the request names a different session, the response status is set and nil returned
+func (a *AirplayServer) lookupSession(req *rtsp.Request, resp *rtsp.Response) *airplaySession {
+	as := a.sessions.getSession(req.RemoteAddr)
+	sessionID, hasSessionID := req.Headers["Session"]
+	if hasSessionID && (as == nil || as.session.ID != sessionID) {
+		resp.Status = rtsp.SessionNotFound
+		return nil
+	}
+	if as == nil {
+		// no ANNOUNCE has been received on this connection yet
+		resp.Status = rtsp.MethodNotValidInThisState
+		return nil
+	}
+	return as
+}
+
 func (a *AirplayServer) handleSetup(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+	as := a.lookupSession(req, resp)
+	if as == nil {
+		return
+	}
+	if as.getState() != announced {
+		resp.Status = rtsp.MethodNotValidInThisState
+		return
+	}
 	transport, hasTransport := req.Headers["Transport"]
-	as := a.sessions.getSession(remoteAddress)
-	if hasTransport {
-		transportParts := strings.Split(transport, ";")
-		var controlPort int
-		var timingPort int
-		for _, part := range transportParts {
-			if strings.Contains(part, "control_port") {
-				controlPort, _ = strconv.Atoi(strings.Split(part, "=")[1])
-			}
-			if strings.Contains(part, "timing_port") {
-				timingPort, _ = strconv.Atoi(strings.Split(part, "=")[1])
-			}
+	if !hasTransport {
+		// nothing offered, we assume the usual UDP setup
+		transport = "RTP/AVP/UDP;unicast;mode=record"
+	}
+	// the sender lists the transports it supports in order of preference, the first one we support wins
+	var spec *rtsp.TransportSpec
+	for _, offered := range rtsp.ParseTransportHeader(transport) {
+		if strings.HasPrefix(strings.ToUpper(offered.Protocol), "RTP/AVP") {
+			spec = offered
+			break
 		}
-		as.session.RemotePorts.Address = remoteAddress
-		as.session.RemotePorts.Control = controlPort
-		as.session.RemotePorts.Timing = timingPort
+	}
+	if spec == nil {
+		resp.Status = rtsp.UnsupportedTransport
+		return
 	}
 
-	// hardcode our listening ports for now
-	as.session.LocalPorts.Control = localControlPort
-	as.session.LocalPorts.Timing = localTimingPort
+	if spec.Transport() == rtsp.Interleaved {
+		dataChannel, controlChannel := spec.Channels()
+		as.session.UseInterleaved(dataChannel, nil)
+		as.session.RemotePorts.Address = remoteAddress
+		resp.Headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;mode=record;interleaved=%d-%d", dataChannel, controlChannel)
+	} else {
+		as.session.RemotePorts.Address = remoteAddress
+		as.session.RemotePorts.Control = spec.Int("control_port")
+		as.session.RemotePorts.Timing = spec.Int("timing_port")
 
-	resp.Headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;server_port=%d;control_port=%d;timing_port=%d", as.session.LocalPorts.Data, localControlPort, localTimingPort)
-	resp.Headers["Session"] = "1"
+		local := as.session.LocalPorts
+		resp.Headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;server_port=%d;control_port=%d;timing_port=%d", local.Data, local.Control, local.Timing)
+	}
+	resp.Headers["Session"] = as.session.ID
 	resp.Headers["Audio-Jack-Status"] = "connected"
+	as.setState(ready)
 
 	resp.Status = rtsp.Ok
 }
 
 func (a *AirplayServer) handleRecord(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
-	as := a.sessions.getSession(remoteAddress)
-	err := as.session.StartReceiving()
-	if err != nil {
-		log.Println("could not start streaming session: ", err)
-		resp.Status = rtsp.InternalServerError
+	as := a.lookupSession(req, resp)
+	if as == nil {
 		return
 	}
-	a.player.Play(as.session)
+	switch as.getState() {
+	case announced:
+		resp.Status = rtsp.MethodNotValidInThisState
+		return
+	case ready:
+		err := as.session.StartReceiving()
+		if err != nil {
+			log.Println("could not start streaming session: ", err)
+			resp.Status = rtsp.InternalServerError
+			return
+		}
+		a.player.Play(as.session)
+		as.setState(recording)
+	}
+	// a RECORD while already recording (i.e. after a FLUSH) just resumes the stream
 	resp.Headers["Audio-Latency"] = "2205"
+	resp.Headers["Session"] = as.session.ID
 	resp.Status = rtsp.Ok
 
 }
 
 func (a *AirplayServer) handlSetParameter(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+	// only the sender streaming to us changes the volume and what is playing
+	as := a.lookupSession(req, resp)
+	if as == nil {
+		return
+	}
+	if as.getState() == announced {
+		resp.Status = rtsp.MethodNotValidInThisState
+		return
+	}
 	if req.Headers["Content-Type"] == "application/x-dmap-tagged" {
-		daapData := parseDaap(req.Body)
-		album := ""
-		artist := ""
-		title := ""
-		if val, ok := daapData["daap.songalbum"]; ok {
-			album = val.(string)
-		}
-		if val, ok := daapData["daap.songartist"]; ok {
-			artist = val.(string)
+		daapData, err := parseDaap(req.Body)
+		if err != nil {
+			log.Println("error parsing track info: ", err)
+			resp.Status = rtsp.BadRequest
+			return
 		}
-		if val, ok := daapData["dmap.itemname"]; ok {
-			title = val.(string)
+		track := trackFromDaap(daapData)
+		log.Printf("Now playing: %s - %s (%s)\n", track.Artist, track.Title, track.Duration)
+		a.player.SetTrack(track)
+	} else if req.Headers["Content-Type"] == artwork.None || (isArtwork(req.Headers["Content-Type"]) && len(req.Body) == 0) {
+		a.player.SetAlbumArt(nil)
+	} else if isArtwork(req.Headers["Content-Type"]) {
+		art, err := artwork.New(req.Body)
+		if err != nil {
+			log.Println("error reading artwork: ", err)
+			resp.Status = rtsp.BadRequest
+			return
 		}
-		a.player.SetTrack(album, artist, title)
-	} else if req.Headers["Content-Type"] == "image/jpeg" {
-		a.player.SetAlbumArt(req.Body)
+		a.player.SetAlbumArt(art)
 	} else if req.Headers["Content-Type"] == "text/parameters" {
 		body := string(req.Body)
 		if strings.Contains(body, "volume") {
@@ -337,69 +651,112 @@ func (a *AirplayServer) handlSetParameter(req *rtsp.Request, resp *rtsp.Response
 			a.player.SetVolume(vol)
 
 		}
+		if strings.Contains(body, "progress") {
+			progress, err := parseProgress(body)
+			if err != nil {
+				log.Println("Error parsing progress: ", err)
+				resp.Status = rtsp.BadRequest
+				return
+			}
+			a.setProgress(req.RemoteAddr, progress)
+		}
 	}
 	resp.Status = rtsp.Ok
 }
 
-func handlFlush(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+// handleInterleaved passes audio data sent on the RTSP connection on to the session of that connection
+func (a *AirplayServer) handleInterleaved(conn string, channel byte, data []byte) {
+	as := a.sessions.getSession(conn)
+	if as == nil || as.getState() != recording {
+		return
+	}
+	as.session.HandleInterleaved(channel, data)
+}
+
+func (a *AirplayServer) handlFlush(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+	as := a.lookupSession(req, resp)
+	if as == nil {
+		return
+	}
+	if as.getState() == announced {
+		resp.Status = rtsp.MethodNotValidInThisState
+		return
+	}
 	resp.Status = rtsp.Ok
 }
 
 func (a *AirplayServer) handleTeardown(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
-	a.closeSession(remoteAddress)
+	as := a.sessions.getSession(req.RemoteAddr)
+	if as == nil {
+		resp.Status = rtsp.SessionNotFound
+		return
+	}
+	a.closeSession(as.conn)
 	resp.Status = rtsp.Ok
 }
 
+// server returns the RTSP server, nil unless started
+func (a *AirplayServer) server() *rtsp.Server {
+	a.serverLock.Lock()
+	defer a.serverLock.Unlock()
+	return a.rtspServer
+}
+
 // Stop stops thes airplay server
 func (a *AirplayServer) Stop() {
 	a.closeAllSessions()
-	a.rtspServer.Stop()
-	if a.zerconfServer != nil {
-		a.zerconfServer.Shutdown()
+	a.serverLock.Lock()
+	rtspServer := a.rtspServer
+	a.rtspServer = nil
+	a.serverLock.Unlock()
+	// the server may never have started
+	if rtspServer != nil {
+		rtspServer.Stop()
 	}
+	a.stopAdvertise()
 
 }
 
-func (a *AirplayServer) closeSession(remoteAddress string) {
+func (a *AirplayServer) closeSession(conn string) {
+	a.endSession(conn, true)
+}
+
+// endSession closes the session of the connection, if notify is set the sender is told to stop
+func (a *AirplayServer) endSession(conn string, notify bool) {
 	doneChan := make(chan struct{})
-	as := a.sessions.getSession(remoteAddress)
+	// taken out first so the session is closed once, i.e: when the sender is kicked as it disconnects
+	as := a.sessions.takeSession(conn)
 	if as != nil {
 		// stops the client from sending data
-		if as.client != nil {
-			err := as.client.Stop()
+		if client := as.getClient(); notify && client != nil {
+			err := client.Stop()
 			if err != nil {
-				log.Fatal(err)
+				log.Println("Could not notify sender to stop: ", err)
 			}
 		}
 		// closes the actual listening socket
 		as.session.Close(doneChan)
 		<-doneChan
-		log.Println("Session closed")
+		log.Printf("Session %s closed\n", as.session.ID)
 		close(doneChan)
-		a.sessions.removeSession(remoteAddress)
 	}
 }
 
 func (a *AirplayServer) closeAllSessions() {
 	for _, as := range a.sessions.getSessions() {
-		a.closeSession(as.session.RemotePorts.Address)
+		a.closeSession(as.conn)
 	}
 }
 
-// getMacAddr gets the MAC hardware
-// address of the host machine: https://gist.github.com/rucuriousyet/ab2ab3dc1a339de612e162512be39283
-func getMacAddr() (addr net.HardwareAddr) {
-	interfaces, err := net.Interfaces()
-	if err == nil {
-		for _, i := range interfaces {
-			if i.Flags&net.FlagUp != 0 && !bytes.Equal(i.HardwareAddr, nil) {
-				// Don't use random as we have a real address
-				addr = i.HardwareAddr
-				break
-			}
-		}
+// newSessionID generates a random identifier for a RTSP session
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		// fall back to something that is still unique enough for a single receiver
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
-	return
+	return strings.ToUpper(hex.EncodeToString(b))
 }
 
 // normalizeVolume maps airplay volume values to a range betweeon 0 and 1
@@ -419,3 +776,8 @@ func normalizeVolume(volume float64) float64 {
 	adjusted := (volume + 30) / 30
 	return adjusted
 }
+
+// isArtwork returns whether the content type is one senders send artwork as
+func isArtwork(contentType string) bool {
+	return contentType == artwork.JPEG || contentType == artwork.PNG
+}
@@ -1,41 +1,58 @@
 package raop
 
 import (
+	"bytes"
+	"crypto/md5"
 	"fmt"
+	"image"
+	"image/png"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ibiscum/bobcaygeon/sdp"
 
+	"github.com/ibiscum/bobcaygeon/artwork"
 	"github.com/ibiscum/bobcaygeon/player"
 	"github.com/ibiscum/bobcaygeon/rtsp"
 )
 
 type FakePlayer struct {
-	muted  bool
-	album  string
-	artist string
-	title  string
+	muted      bool
+	track      player.Track
+	progress   player.Progress
+	artwork    *artwork.Artwork
+	artworkSet bool
 }
 
-func (*FakePlayer) Play(session *rtsp.Session) {}
-func (*FakePlayer) SetVolume(volume float64)   {}
-func (fp *FakePlayer) SetMute(isMuted bool)    { fp.muted = isMuted }
-func (fp *FakePlayer) GetIsMuted() bool        { return fp.muted }
-func (fp *FakePlayer) SetTrack(album string, artist string, title string) {
-	fp.album = album
-	fp.artist = artist
-	fp.title = title
+func (*FakePlayer) Play(session *rtsp.Session)              {}
+func (*FakePlayer) SetVolume(volume float64)                {}
+func (fp *FakePlayer) SetMute(isMuted bool)                 { fp.muted = isMuted }
+func (fp *FakePlayer) GetIsMuted() bool                     { return fp.muted }
+func (fp *FakePlayer) SetTrack(track player.Track)          { fp.track = track }
+func (fp *FakePlayer) SetAlbumArt(art *artwork.Artwork)     { fp.artwork, fp.artworkSet = art, true }
+func (fp *FakePlayer) SetProgress(progress player.Progress) { fp.progress = progress }
+func (*FakePlayer) GetTrack() player.Track                  { return player.Track{} }
+func (*FakePlayer) GetArtwork(hash string, maxSize int) (*artwork.Artwork, error) {
+	return nil, artwork.ErrNotFound
+}
+
+// addReadySession sets up a session for the connection of the request, as SETUP leaves it
+func addReadySession(a *AirplayServer, req *rtsp.Request) {
+	req.RemoteAddr = "10.0.0.2:5000"
+	as := newAirplaySession(req.RemoteAddr, rtsp.NewSession(sdp.NewSessionDescription(), nil), nil)
+	as.setState(ready)
+	a.sessions.addSession(as.conn, as)
 }
-func (*FakePlayer) SetAlbumArt(artwork []byte) {}
-func (*FakePlayer) GetTrack() player.Track     { return player.Track{} }
 
 func TestHandleOptions(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
 	req := rtsp.NewRequest()
 	req.Headers["Apple-Challenge"] = "gY3cmhtK9LnECNUlXFb0qg=="
 	resp := rtsp.NewResponse()
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	handleOptions(req, resp, localAddress, remoteAddress)
+	a.handleOptions(req, resp, localAddress, remoteAddress)
 	if resp.Status != rtsp.Ok {
 		t.Errorf(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
@@ -53,18 +70,23 @@ func TestHandleOptions(t *testing.T) {
 func TestHandleSetup(t *testing.T) {
 	a := NewAirplayServer(444, "Test", &FakePlayer{})
 	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	s.ID = "ABCDEF"
 	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.0:5000"
 	req.Headers["Transport"] = "RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=8888;timing_port=8889"
 	resp := rtsp.NewResponse()
 	localAddress := "192.168.0.15"
 	remoteAddress := "10.0.0.0"
-	as := newAirplaySession(s, nil)
-	a.sessions.addSession(remoteAddress, as)
+	as := newAirplaySession(req.RemoteAddr, s, nil)
+	a.sessions.addSession(req.RemoteAddr, as)
 	a.handleSetup(req, resp, localAddress, remoteAddress)
 	if resp.Status != rtsp.Ok {
 		t.Errorf(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
-	retrievedSession := a.sessions.getSession(remoteAddress).session
+	if as.getState() != ready {
+		t.Error("Expected session to be ready after SETUP")
+	}
+	retrievedSession := a.sessions.getSession(req.RemoteAddr).session
 	if retrievedSession.RemotePorts.Address != remoteAddress {
 		t.Errorf(fmt.Sprintf("Expected: %s\r\n Got: %s", remoteAddress, retrievedSession.RemotePorts.Address))
 	}
@@ -82,8 +104,8 @@ func TestHandleSetup(t *testing.T) {
 	if !ok {
 		t.Error("Expected to have Session header")
 	}
-	if val != "1" {
-		t.Errorf(fmt.Sprintf("Expected: %s\r\n Got: %s", "1", val))
+	if val != "ABCDEF" {
+		t.Errorf(fmt.Sprintf("Expected: %s\r\n Got: %s", "ABCDEF", val))
 	}
 	val, ok = resp.Headers["Audio-Jack-Status"]
 	if !ok {
@@ -94,6 +116,95 @@ func TestHandleSetup(t *testing.T) {
 	}
 }
 
+func TestHandleSetupInterleaved(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.0:5000"
+	req.Headers["Transport"] = "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"
+	a.sessions.addSession(req.RemoteAddr, newAirplaySession(req.RemoteAddr, s, nil))
+	resp := rtsp.NewResponse()
+	a.handleSetup(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.Ok {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String())
+	}
+	if s.Transport != rtsp.Interleaved {
+		t.Error("Expected session to use interleaved transport")
+	}
+	if resp.Headers["Transport"] != "RTP/AVP/TCP;unicast;mode=record;interleaved=0-1" {
+		t.Error("Unexpected Transport header", resp.Headers["Transport"])
+	}
+}
+
+func TestHandleSetupUnsupportedTransport(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.0:5000"
+	req.Headers["Transport"] = "MP2T/H2221/TCP;unicast"
+	a.sessions.addSession(req.RemoteAddr, newAirplaySession(req.RemoteAddr, s, nil))
+	resp := rtsp.NewResponse()
+	a.handleSetup(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.UnsupportedTransport {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.UnsupportedTransport.String(), resp.Status.String())
+	}
+}
+
+func TestSetupWithoutAnnounce(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.0:5000"
+	resp := rtsp.NewResponse()
+	a.handleSetup(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.MethodNotValidInThisState {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.MethodNotValidInThisState.String(), resp.Status.String())
+	}
+}
+
+func TestRecordBeforeSetup(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.0:5000"
+	a.sessions.addSession(req.RemoteAddr, newAirplaySession(req.RemoteAddr, rtsp.NewSession(sdp.NewSessionDescription(), nil), nil))
+	resp := rtsp.NewResponse()
+	a.handleRecord(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.MethodNotValidInThisState {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.MethodNotValidInThisState.String(), resp.Status.String())
+	}
+}
+
+func TestSetupUnknownSession(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	s.ID = "ABCDEF"
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.0:5000"
+	req.Headers["Session"] = "123456"
+	a.sessions.addSession(req.RemoteAddr, newAirplaySession(req.RemoteAddr, s, nil))
+	resp := rtsp.NewResponse()
+	a.handleSetup(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.SessionNotFound {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.SessionNotFound.String(), resp.Status.String())
+	}
+}
+
+func TestTeardownWithoutSession(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.0:5000"
+	resp := rtsp.NewResponse()
+	a.handleTeardown(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.SessionNotFound {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.SessionNotFound.String(), resp.Status.String())
+	}
+}
+
+func TestSessionIDsUnique(t *testing.T) {
+	if newSessionID() == newSessionID() {
+		t.Error("Expected session ids to differ")
+	}
+}
+
 func TestChangeName(t *testing.T) {
 	a := NewAirplayServer(444, "Test", &FakePlayer{})
 	err := a.ChangeName("Foo")
@@ -147,6 +258,7 @@ func TestNotMuteNoHeader(t *testing.T) {
 	req := rtsp.NewRequest()
 	req.Headers["Content-Type"] = "text/parameters"
 	req.Body = []byte("volume:111")
+	addReadySession(a, req)
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
@@ -168,6 +280,7 @@ func TestMuteWithHeader(t *testing.T) {
 	req.Headers["Content-Type"] = "text/parameters"
 	req.Headers["X-BCG-Muted"] = "muted"
 	req.Body = []byte("volume:111")
+	addReadySession(a, req)
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
@@ -189,6 +302,7 @@ func TestUnMuteWithHeader(t *testing.T) {
 	req.Headers["Content-Type"] = "text/parameters"
 	req.Headers["X-BCG-Muted"] = "unmuted"
 	req.Body = []byte("volume:111")
+	addReadySession(a, req)
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
@@ -209,6 +323,7 @@ func TestChangeVolumeDoesntUnmute(t *testing.T) {
 	req := rtsp.NewRequest()
 	req.Headers["Content-Type"] = "text/parameters"
 	req.Body = []byte("volume:111")
+	addReadySession(a, req)
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
@@ -229,6 +344,7 @@ func TestSetMetadata(t *testing.T) {
 	req := rtsp.NewRequest()
 	req.Headers["Content-Type"] = "application/x-dmap-tagged"
 	req.Body = []byte{109, 108, 105, 116, 0, 0, 6, 17, 109, 105, 107, 100, 0, 0, 0, 1, 2, 97, 115, 97, 108, 0, 0, 0, 13, 80, 104, 97, 110, 116, 111, 109, 32, 80, 111, 119, 101, 114, 97, 115, 97, 114, 0, 0, 0, 18, 84, 104, 101, 32, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 98, 114, 0, 0, 0, 2, 1, 0, 97, 115, 99, 109, 0, 0, 0, 0, 97, 115, 99, 111, 0, 0, 0, 1, 0, 97, 115, 99, 112, 0, 0, 0, 85, 84, 104, 101, 32, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 44, 32, 71, 111, 114, 100, 32, 68, 111, 119, 110, 105, 101, 44, 32, 82, 111, 98, 32, 66, 97, 107, 101, 114, 44, 32, 74, 111, 104, 110, 110, 121, 32, 70, 97, 121, 44, 32, 80, 97, 117, 108, 32, 76, 97, 110, 103, 108, 111, 105, 115, 32, 38, 32, 71, 111, 114, 100, 32, 83, 105, 110, 99, 108, 97, 105, 114, 109, 101, 105, 97, 0, 0, 0, 4, 90, 156, 21, 211, 97, 115, 100, 97, 0, 0, 0, 4, 90, 156, 21, 211, 109, 101, 105, 112, 0, 0, 0, 4, 131, 218, 135, 192, 97, 115, 112, 108, 0, 0, 0, 4, 131, 218, 135, 192, 97, 115, 100, 109, 0, 0, 0, 4, 90, 156, 97, 42, 97, 115, 100, 99, 0, 0, 0, 2, 0, 1, 97, 115, 100, 110, 0, 0, 0, 2, 0, 1, 97, 115, 101, 113, 0, 0, 0, 0, 97, 115, 103, 110, 0, 0, 0, 3, 80, 111, 112, 97, 115, 100, 116, 0, 0, 0, 24, 80, 117, 114, 99, 104, 97, 115, 101, 100, 32, 65, 65, 67, 32, 97, 117, 100, 105, 111, 32, 102, 105, 108, 101, 97, 115, 114, 118, 0, 0, 0, 1, 0, 97, 115, 115, 114, 0, 0, 0, 4, 0, 0, 172, 68, 97, 115, 115, 122, 0, 0, 0, 4, 0, 168, 248, 12, 97, 115, 115, 116, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 115, 112, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 116, 109, 0, 0, 0, 4, 0, 4, 129, 205, 97, 115, 116, 99, 0, 0, 0, 2, 0, 12, 97, 115, 116, 110, 0, 0, 0, 2, 0, 4, 97, 115, 117, 114, 0, 0, 0, 1, 0, 97, 115, 121, 114, 0, 0, 0, 2, 7, 206, 97, 115, 102, 109, 0, 0, 0, 3, 109, 52, 97, 109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 193, 161, 109, 105, 110, 109, 0, 0, 0, 10, 66, 111, 98, 99, 97, 121, 103, 101, 111, 110, 109, 112, 101, 114, 0, 0, 0, 8, 54, 178, 28, 207, 201, 245, 87, 79, 97, 115, 100, 98, 0, 0, 0, 1, 0, 97, 101, 78, 86, 0, 0, 0, 4, 0, 0, 10, 60, 97, 115, 100, 107, 0, 0, 0, 1, 0, 97, 115, 98, 116, 0, 0, 0, 2, 0, 0, 97, 103, 114, 112, 0, 0, 0, 0, 97, 101, 83, 73, 0, 0, 0, 8, 0, 0, 0, 0, 58, 50, 211, 210, 97, 101, 65, 73, 0, 0, 0, 4, 0, 2, 113, 152, 97, 101, 80, 73, 0, 0, 0, 4, 58, 50, 211, 206, 97, 101, 67, 73, 0, 0, 0, 4, 1, 181, 202, 54, 97, 101, 71, 73, 0, 0, 0, 4, 0, 0, 0, 14, 97, 115, 99, 100, 0, 0, 0, 4, 109, 112, 52, 97, 97, 115, 99, 115, 0, 0, 0, 4, 0, 0, 0, 2, 97, 101, 83, 70, 0, 0, 0, 4, 0, 2, 48, 95, 97, 101, 80, 67, 0, 0, 0, 1, 0, 97, 115, 99, 116, 0, 0, 0, 0, 97, 115, 99, 110, 0, 0, 0, 0, 97, 115, 99, 114, 0, 0, 0, 1, 0, 97, 101, 72, 86, 0, 0, 0, 1, 0, 97, 101, 77, 75, 0, 0, 0, 1, 1, 97, 101, 83, 78, 0, 0, 0, 0, 97, 101, 69, 78, 0, 0, 0, 0, 97, 101, 69, 83, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 83, 85, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 71, 72, 0, 0, 0, 4, 0, 0, 0, 1, 97, 101, 71, 68, 0, 0, 0, 4, 0, 0, 1, 20, 97, 101, 71, 85, 0, 0, 0, 8, 0, 0, 0, 0, 0, 198, 194, 172, 97, 101, 71, 82, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 71, 69, 0, 0, 0, 4, 0, 0, 8, 64, 97, 115, 97, 97, 0, 0, 0, 18, 84, 104, 101, 32, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 103, 112, 0, 0, 0, 1, 0, 109, 101, 120, 116, 0, 0, 0, 2, 0, 1, 97, 115, 101, 100, 0, 0, 0, 2, 0, 1, 97, 115, 100, 114, 0, 0, 0, 4, 53, 171, 1, 240, 97, 115, 100, 112, 0, 0, 0, 4, 90, 156, 92, 35, 97, 115, 104, 112, 0, 0, 0, 1, 1, 97, 115, 115, 110, 0, 0, 0, 10, 66, 111, 98, 99, 97, 121, 103, 101, 111, 110, 97, 115, 115, 97, 0, 0, 0, 14, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 115, 108, 0, 0, 0, 14, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 97, 115, 115, 117, 0, 0, 0, 13, 80, 104, 97, 110, 116, 111, 109, 32, 80, 111, 119, 101, 114, 97, 115, 115, 99, 0, 0, 0, 81, 84, 114, 97, 103, 105, 99, 97, 108, 108, 121, 32, 72, 105, 112, 44, 32, 71, 111, 114, 100, 32, 68, 111, 119, 110, 105, 101, 44, 32, 82, 111, 98, 32, 66, 97, 107, 101, 114, 44, 32, 74, 111, 104, 110, 110, 121, 32, 70, 97, 121, 44, 32, 80, 97, 117, 108, 32, 76, 97, 110, 103, 108, 111, 105, 115, 32, 38, 32, 71, 111, 114, 100, 32, 83, 105, 110, 99, 108, 97, 105, 114, 97, 115, 115, 115, 0, 0, 0, 0, 97, 115, 98, 107, 0, 0, 0, 1, 0, 97, 115, 112, 117, 0, 0, 0, 0, 97, 101, 67, 82, 0, 0, 0, 0, 97, 115, 97, 105, 0, 0, 0, 8, 208, 203, 58, 24, 226, 64, 152, 237, 97, 115, 108, 115, 0, 0, 0, 8, 0, 0, 0, 0, 0, 168, 248, 12, 97, 101, 83, 69, 0, 0, 0, 8, 0, 0, 0, 0, 1, 182, 58, 229, 97, 101, 68, 86, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 68, 80, 0, 0, 0, 4, 0, 0, 0, 0, 97, 101, 68, 82, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 78, 68, 0, 0, 0, 8, 0, 0, 0, 0, 10, 81, 194, 42, 97, 101, 75, 49, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 75, 50, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 68, 76, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 70, 65, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 97, 101, 88, 68, 0, 0, 0, 27, 85, 110, 105, 118, 101, 114, 115, 97, 108, 58, 105, 115, 114, 99, 58, 67, 65, 77, 49, 57, 57, 55, 48, 48, 48, 55, 55, 97, 101, 77, 107, 0, 0, 0, 4, 0, 0, 0, 1, 97, 101, 77, 88, 0, 0, 0, 0, 97, 115, 112, 99, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 114, 105, 0, 0, 0, 8, 172, 234, 51, 131, 12, 228, 253, 219, 97, 101, 67, 83, 0, 0, 0, 4, 0, 2, 195, 138, 97, 115, 107, 112, 0, 0, 0, 4, 0, 0, 0, 0, 97, 115, 97, 99, 0, 0, 0, 2, 0, 1, 97, 115, 107, 100, 0, 0, 0, 4, 131, 218, 135, 192, 109, 100, 115, 116, 0, 0, 0, 1, 1, 97, 115, 101, 115, 0, 0, 0, 1, 0, 97, 101, 67, 100, 0, 0, 0, 8, 0, 0, 191, 7, 202, 214, 154, 229, 97, 101, 67, 85, 0, 0, 0, 8, 0, 0, 0, 0, 10, 81, 194, 42, 97, 115, 114, 115, 0, 0, 0, 1, 0, 97, 115, 108, 114, 0, 0, 0, 1, 0, 97, 115, 97, 115, 0, 0, 0, 1, 32, 97, 101, 67, 70, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 2, 97, 101, 67, 75, 0, 0, 0, 1, 2, 97, 101, 71, 115, 0, 0, 0, 1, 1, 97, 101, 108, 115, 0, 0, 0, 1, 0, 97, 106, 97, 108, 0, 0, 0, 1, 0, 97, 106, 99, 65, 0, 0, 0, 1, 0, 97, 119, 114, 107, 0, 0, 0, 0, 97, 109, 118, 109, 0, 0, 0, 0, 97, 109, 118, 99, 0, 0, 0, 2, 0, 0, 97, 109, 118, 110, 0, 0, 0, 2, 0, 0, 97, 106, 117, 119, 0, 0, 0, 1, 0}
+	addReadySession(a, req)
 	resp := rtsp.NewResponse()
 
 	localAddress := "192.168.0.15"
@@ -237,14 +353,194 @@ func TestSetMetadata(t *testing.T) {
 	if resp.Status != rtsp.Ok {
 		t.Errorf(fmt.Sprintf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String()))
 	}
-	if fp.artist != "The Tragically Hip" {
-		t.Errorf(fmt.Sprintf("Expected: The Tragically Hip\r\n Got: %s", fp.artist))
+	if fp.track.Artist != "The Tragically Hip" {
+		t.Errorf(fmt.Sprintf("Expected: The Tragically Hip\r\n Got: %s", fp.track.Artist))
+	}
+	if fp.track.Album != "Phantom Power" {
+		t.Errorf(fmt.Sprintf("Expected: Phantom Power\r\n Got: %s", fp.track.Album))
+	}
+	if fp.track.Title != "Bobcaygeon" {
+		t.Errorf(fmt.Sprintf("Expected: Bobcaygeon\r\n Got: %s", fp.track.Title))
 	}
-	if fp.album != "Phantom Power" {
-		t.Errorf(fmt.Sprintf("Expected: Phantom Power\r\n Got: %s", fp.album))
+	if fp.track.Genre != "Pop" || fp.track.Year != 1998 {
+		t.Error("Expected Pop from 1998 got:", fp.track.Genre, fp.track.Year)
 	}
-	if fp.title != "Bobcaygeon" {
-		t.Errorf(fmt.Sprintf("Expected: Bobcaygeon\r\n Got: %s", fp.title))
+	if fp.track.TrackNumber != 4 || fp.track.TrackCount != 12 || fp.track.DiscNumber != 1 || fp.track.DiscCount != 1 {
+		t.Error("Unexpected track and disc numbers", fp.track)
+	}
+	if fp.track.Duration != 295373*time.Millisecond {
+		t.Error("Expected 4m55.373s got:", fp.track.Duration)
+	}
+	if fp.track.PersistentID != 0x36B21CCFC9F5574F {
+		t.Errorf("Unexpected persistent id: %x", fp.track.PersistentID)
+	}
+	if !strings.HasPrefix(fp.track.Composer, "The Tragically Hip, Gord Downie") {
+		t.Error("Unexpected composer", fp.track.Composer)
 	}
 
 }
+
+func TestAuthRequiredWithPassword(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetPassword("secret")
+	called := false
+	handler := a.requireAuth(func(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+		called = true
+		resp.Status = rtsp.Ok
+	})
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Announce
+	resp := rtsp.NewResponse()
+	handler(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.Unauthorized {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.Unauthorized.String(), resp.Status.String())
+	}
+	if called {
+		t.Error("Expected handler to not be invoked")
+	}
+	challenge, ok := resp.Headers["WWW-Authenticate"]
+	if !ok {
+		t.Error("Expected to have WWW-Authenticate header")
+	}
+	if !strings.HasPrefix(challenge, "Digest realm=\"raop\"") {
+		t.Errorf("Unexpected challenge: %s", challenge)
+	}
+}
+
+func TestAuthAcceptsValidCredentials(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetPassword("secret")
+	called := false
+	handler := a.requireAuth(func(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+		called = true
+		resp.Status = rtsp.Ok
+	})
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Announce
+	req.RequestURI = "rtsp://192.168.0.15/3413821438"
+	resp := rtsp.NewResponse()
+	handler(req, resp, "192.168.0.15", "10.0.0.0")
+	nonce := strings.TrimSuffix(strings.Split(resp.Headers["WWW-Authenticate"], "nonce=\"")[1], "\"")
+
+	md5Hex := func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	response := md5Hex(md5Hex("iTunes:raop:secret") + ":" + nonce + ":" + md5Hex("ANNOUNCE:"+req.RequestURI))
+	req.Headers["Authorization"] = fmt.Sprintf("Digest username=\"iTunes\", realm=\"raop\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", nonce, req.RequestURI, response)
+	resp = rtsp.NewResponse()
+	handler(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.Ok {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String())
+	}
+	if !called {
+		t.Error("Expected handler to be invoked")
+	}
+}
+
+func TestNoAuthWithoutPassword(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	handler := a.requireAuth(func(req *rtsp.Request, resp *rtsp.Response, localAddress string, remoteAddress string) {
+		resp.Status = rtsp.Ok
+	})
+	req := rtsp.NewRequest()
+	req.Method = rtsp.Announce
+	resp := rtsp.NewResponse()
+	handler(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.Ok {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String())
+	}
+}
+
+func TestPasswordAdvertised(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	if !containsProperty(a.serviceProperties(), "pw=false") {
+		t.Error("Expected pw=false to be advertised")
+	}
+	a.SetPassword("secret")
+	if !containsProperty(a.serviceProperties(), "pw=true") {
+		t.Error("Expected pw=true to be advertised")
+	}
+	a.SetPassword("")
+	if !containsProperty(a.serviceProperties(), "pw=false") {
+		t.Error("Expected pw=false to be advertised after removing password")
+	}
+}
+
+func containsProperty(properties []string, property string) bool {
+	for _, p := range properties {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSetArtwork(t *testing.T) {
+	fp := &FakePlayer{}
+	a := NewAirplayServer(444, "Test", fp)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	req := rtsp.NewRequest()
+	req.Headers["Content-Type"] = "image/png"
+	req.Body = buf.Bytes()
+	addReadySession(a, req)
+	resp := rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.Ok {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String())
+	}
+	if fp.artwork == nil || fp.artwork.MimeType != artwork.PNG || fp.artwork.Hash != artwork.Hash(buf.Bytes()) {
+		t.Error("Expected PNG artwork to be set got:", fp.artwork)
+	}
+
+	// senders clear the artwork with image/none
+	req.Headers["Content-Type"] = "image/none"
+	req.Body = nil
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.Ok || fp.artwork != nil || !fp.artworkSet {
+		t.Error("Expected artwork to be cleared")
+	}
+
+	req.Headers["Content-Type"] = "image/jpeg"
+	req.Body = []byte("not a jpeg")
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.0")
+	if resp.Status != rtsp.BadRequest {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.BadRequest.String(), resp.Status.String())
+	}
+}
+
+func TestSetParameterWithoutSession(t *testing.T) {
+	fp := &FakePlayer{}
+	a := NewAirplayServer(444, "Test", fp)
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Headers["Content-Type"] = "text/parameters"
+	req.Headers["X-BCG-Muted"] = "muted"
+	req.Body = []byte("volume:-30")
+	// nothing was announced on the connection
+	resp := rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.2")
+	if resp.Status != rtsp.MethodNotValidInThisState {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.MethodNotValidInThisState.String(), resp.Status.String())
+	}
+	// the session is someone else's
+	req.Headers["Session"] = "ABCDEF"
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.2")
+	if resp.Status != rtsp.SessionNotFound {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.SessionNotFound.String(), resp.Status.String())
+	}
+	// announced, but not set up yet
+	delete(req.Headers, "Session")
+	a.sessions.addSession(req.RemoteAddr, newAirplaySession(req.RemoteAddr, rtsp.NewSession(sdp.NewSessionDescription(), nil), nil))
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.2")
+	if resp.Status != rtsp.MethodNotValidInThisState {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.MethodNotValidInThisState.String(), resp.Status.String())
+	}
+	if fp.muted {
+		t.Error("Expected the player to be left alone")
+	}
+}
@@ -0,0 +1,78 @@
+package raop
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ArbitrationPolicy decides what happens when a sender wants to stream while another one already is
+type ArbitrationPolicy int
+
+const (
+	// Preempt the new sender takes over, the current one is stopped
+	Preempt ArbitrationPolicy = iota
+	// Reject the new sender is turned away for as long as there is a session
+	Reject
+	// PreemptIdle the new sender only takes over if the current session has been idle long enough
+	PreemptIdle
+)
+
+var arbitrationPolicyNames = map[ArbitrationPolicy]string{
+	Preempt:     "preempt",
+	Reject:      "reject",
+	PreemptIdle: "idle",
+}
+
+func (p ArbitrationPolicy) String() string {
+	return arbitrationPolicyNames[p]
+}
+
+// ParseArbitrationPolicy converts a policy name (preempt, reject or idle) to an ArbitrationPolicy
+func ParseArbitrationPolicy(name string) (ArbitrationPolicy, error) {
+	if name == "" {
+		return Preempt, nil
+	}
+	for policy, policyName := range arbitrationPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+	return Preempt, fmt.Errorf("unknown arbitration policy: %s", name)
+}
+
+// SetArbitrationPolicy sets how competing senders are handled, the idle timeout only applies to PreemptIdle
+func (a *AirplayServer) SetArbitrationPolicy(policy ArbitrationPolicy, idleTimeout time.Duration) {
+	a.policyLock.Lock()
+	defer a.policyLock.Unlock()
+	a.policy = policy
+	a.idleTimeout = idleTimeout
+}
+
+// GetArbitrationPolicy returns the current policy and idle timeout
+func (a *AirplayServer) GetArbitrationPolicy() (ArbitrationPolicy, time.Duration) {
+	a.policyLock.RLock()
+	defer a.policyLock.RUnlock()
+	return a.policy, a.idleTimeout
+}
+
+// mayTakeOver checks if a sender on the given connection (and with the given DACP id)
+// is allowed to start a session, given the sessions already in progress
+func (a *AirplayServer) mayTakeOver(conn string, dacpID string) bool {
+	policy, idleTimeout := a.GetArbitrationPolicy()
+	for _, as := range a.sessions.getSessions() {
+		// a sender re-announcing, possibly after reconnecting, is not competing with itself
+		if as.conn == conn || (dacpID != "" && as.dacpID == dacpID) {
+			continue
+		}
+		switch policy {
+		case Reject:
+			return false
+		case PreemptIdle:
+			if time.Since(as.session.LastActivity()) < idleTimeout {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package raop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ibiscum/bobcaygeon/rtsp"
+	"github.com/ibiscum/bobcaygeon/sdp"
+)
+
+func addActiveSession(a *AirplayServer, conn string, dacpID string) *airplaySession {
+	as := newAirplaySession(conn, rtsp.NewSession(sdp.NewSessionDescription(), nil), nil)
+	as.dacpID = dacpID
+	a.sessions.addSession(conn, as)
+	return as
+}
+
+func TestPreemptPolicy(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	addActiveSession(a, "10.0.0.1:5000", "AAAA")
+	if !a.mayTakeOver("10.0.0.2:5000", "BBBB") {
+		t.Error("Expected new sender to preempt the current one")
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetArbitrationPolicy(Reject, 0)
+	if !a.mayTakeOver("10.0.0.2:5000", "BBBB") {
+		t.Error("Expected sender to be allowed when nobody is streaming")
+	}
+	addActiveSession(a, "10.0.0.1:5000", "AAAA")
+	if a.mayTakeOver("10.0.0.2:5000", "BBBB") {
+		t.Error("Expected new sender to be rejected")
+	}
+	// the same sender reconnecting is not competing with itself
+	if !a.mayTakeOver("10.0.0.1:5001", "AAAA") {
+		t.Error("Expected sender with the same DACP-ID to be allowed")
+	}
+}
+
+func TestIdlePolicy(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetArbitrationPolicy(PreemptIdle, time.Hour)
+	addActiveSession(a, "10.0.0.1:5000", "AAAA")
+	if a.mayTakeOver("10.0.0.2:5000", "BBBB") {
+		t.Error("Expected new sender to be rejected while the session is active")
+	}
+	a.SetArbitrationPolicy(PreemptIdle, 0)
+	if !a.mayTakeOver("10.0.0.2:5000", "BBBB") {
+		t.Error("Expected new sender to preempt an idle session")
+	}
+}
+
+func TestAnnounceRejected(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.SetArbitrationPolicy(Reject, 0)
+	addActiveSession(a, "10.0.0.1:5000", "AAAA")
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Headers["Content-Type"] = "application/sdp"
+	req.Headers["DACP-ID"] = "BBBB"
+	req.Body = []byte("v=0\r\no=iTunes 3413821438 0 IN IP4 10.0.0.2\r\ns=iTunes\r\nc=IN IP4 10.0.0.1\r\nt=0 0\r\nm=audio 0 RTP/AVP 96\r\na=rtpmap:96 AppleLossless\r\n")
+	resp := rtsp.NewResponse()
+	a.handleAnnounce(req, resp, "10.0.0.1", "10.0.0.2")
+	if resp.Status != rtsp.NotEnoughBandwidth {
+		t.Errorf("Expected: %s\r\n Got: %s", rtsp.NotEnoughBandwidth.String(), resp.Status.String())
+	}
+	if a.sessions.getSession("10.0.0.1:5000") == nil {
+		t.Error("Expected the current session to be kept")
+	}
+}
+
+func TestParseArbitrationPolicy(t *testing.T) {
+	for _, name := range []string{"preempt", "reject", "idle"} {
+		policy, err := ParseArbitrationPolicy(name)
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+		if policy.String() != name {
+			t.Error("Expected "+name+" got:", policy.String())
+		}
+	}
+	_, err := ParseArbitrationPolicy("coinflip")
+	if err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestAnnounceWithoutFormat(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Headers["Content-Type"] = "application/sdp"
+	req.Body = []byte("v=0\r\no=iTunes 3413821438 0 IN IP4 10.0.0.2\r\ns=iTunes\r\nc=IN IP4 10.0.0.1\r\nt=0 0\r\n")
+	resp := rtsp.NewResponse()
+	a.handleAnnounce(req, resp, "10.0.0.1", "10.0.0.2")
+	if resp.Status != rtsp.Ok {
+		t.Fatalf("Expected: %s\r\n Got: %s", rtsp.Ok.String(), resp.Status.String())
+	}
+	sessions := a.Sessions()
+	if len(sessions) != 1 || sessions[0].Codec != "AppleLossless" {
+		t.Error("Expected the default format to be assumed got:", sessions)
+	}
+	a.closeAllSessions()
+}
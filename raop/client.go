@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/ibiscum/bobcaygeon/rtsp"
@@ -33,16 +32,40 @@ func (sm *stateMachine) transistion(client *rtsp.Client, session *rtsp.Session)
 	return sm.currentState != nil, err
 }
 
-// EstablishSession establishes a session that is ready to have data streamed through it
-func EstablishSession(ip string, port int) (*rtsp.Session, error) {
+// StreamFormat returns the media description of the stream described by source, as we forward
+// it as is; the default ALAC stream when there is no source or it doesn't describe its format
+func StreamFormat(source *sdp.SessionDescription) sdp.MediaDescription {
+	if source != nil {
+		if rtpmap, ok := source.RtpMap(); ok {
+			fmtp, _ := source.Fmtp()
+			return sdp.NewAudioDescription(rtpmap, fmtp.Parameters)
+		}
+	}
+	return sdp.NewAudioDescription(sdp.RtpMap{PayloadType: 96, EncodingName: "AppleLossless"}, sdp.DefaultALACConfig().Parameters())
+}
+
+// EstablishSession establishes a session that is ready to have data streamed through it,
+// the password is used if the receiving end is password protected. The transport is the one
+// we'd prefer, the receiver may still settle on UDP. The stream is announced in the format
+// source describes, see StreamFormat. The client the session was set up with is returned for
+// controlling the session, the receiver ends the session once it is closed
+func EstablishSession(ip string, port int, password string, transport rtsp.Transport, source *sdp.SessionDescription) (*rtsp.Session, *rtsp.Client, error) {
 
 	client, err := rtsp.NewClient(ip, port)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	client.SetPassword(password)
 	sessionDescription := sdp.NewSessionDescription()
+	sessionDescription.MediaDescription = []sdp.MediaDescription{StreamFormat(source)}
 	session := rtsp.NewSession(sessionDescription, nil)
 	session.RemotePorts.Address = client.RemoteAddress()
+	session.Transport = transport
+	err = session.InitSend()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
 
 	sm := newStateMachine()
 	handshaking := true
@@ -51,11 +74,14 @@ func EstablishSession(ip string, port int) (*rtsp.Session, error) {
 		handshaking, err = sm.transistion(client, session)
 		if err != nil {
 			log.Println("Error encountered during RTSP handshaking, ", err)
-			return nil, err
+			// releases the control and timing ports
+			session.Close(make(chan struct{}, 1))
+			client.Close()
+			return nil, nil, err
 		}
 	}
 	log.Println("done handshaking")
-	return session, nil
+	return session, client, nil
 }
 
 // our state functions below, emulating the airplay protocol, leaving
@@ -99,18 +125,8 @@ func announce(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	c.ConnectionAddress = localAddress
 	sessionDescription.ConnectData = c
 	timing := sdp.Timing{StartTime: 0, StopTime: 0}
-	sessionDescription.Timing = timing
-	m := make([]sdp.MediaDescription, 1)
-	md := sdp.MediaDescription{}
-	md.Media = "audio"
-	md.Fmt = "96"
-	md.Port = "0"
-	md.Proto = "RTP/AVP"
-	m[0] = md
-	sessionDescription.MediaDescription = m
-	a := make(map[string]string)
-	a["rtpmap"] = "96 AppleLossless"
-	sessionDescription.Attributes = a
+	sessionDescription.Timings = []sdp.Timing{timing}
+	// the media description was set up with the session, the stream is forwarded as is
 	// attach to request
 	var b bytes.Buffer
 	_, err := sdp.Write(&b, sessionDescription)
@@ -134,35 +150,40 @@ func setup(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	req.Method = rtsp.Setup
 	localAddress := client.LocalAddress()
 	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, session.Description.Origin.SessionID)
-	// hardcoded for now
-	req.Headers["Transport"] = "RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=8888;timing_port=8889"
+	udpTransport := fmt.Sprintf("RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=%d;timing_port=%d", session.LocalPorts.Control, session.LocalPorts.Timing)
+	req.Headers["Transport"] = udpTransport
+	if session.Transport == rtsp.Interleaved {
+		req.Headers["Transport"] = "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"
+	}
 	resp, err := client.Send(req)
 	if err != nil {
 		return nil, err
 	}
+	if resp.Status == rtsp.UnsupportedTransport && session.Transport == rtsp.Interleaved {
+		log.Println("Receiver does not support interleaved transport, falling back to UDP")
+		req.Headers["Transport"] = udpTransport
+		resp, err = client.Send(req)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if resp.Status != rtsp.Ok {
 		return nil, fmt.Errorf("Non-ok status returned: %s", resp.Status.String())
 	}
-	transport := resp.Headers["Transport"]
-	transportParts := strings.Split(transport, ";")
-	var controlPort int
-	var timingPort int
-	var serverPort int
-	for _, part := range transportParts {
-		if strings.Contains(part, "control_port") {
-			controlPort, _ = strconv.Atoi(strings.Split(part, "=")[1])
-		}
-		if strings.Contains(part, "timing_port") {
-			timingPort, _ = strconv.Atoi(strings.Split(part, "=")[1])
-		}
-		if strings.Contains(part, "server_port") {
-			serverPort, _ = strconv.Atoi(strings.Split(part, "=")[1])
-		}
+	session.Transport = rtsp.UDP
+	specs := rtsp.ParseTransportHeader(resp.Headers["Transport"])
+	if len(specs) > 0 && specs[0].Transport() == rtsp.Interleaved {
+		// data goes over this very connection from now on
+		dataChannel, _ := specs[0].Channels()
+		session.UseInterleaved(dataChannel, client)
+	} else if len(specs) > 0 {
+		session.RemotePorts.Control = specs[0].Int("control_port")
+		session.RemotePorts.Timing = specs[0].Int("timing_port")
+		session.RemotePorts.Data = specs[0].Int("server_port")
 	}
 	session.RemotePorts.Address = client.RemoteAddress()
-	session.RemotePorts.Control = controlPort
-	session.RemotePorts.Timing = timingPort
-	session.RemotePorts.Data = serverPort
+	// the receiver identifies the session from here on, it has to be echoed back
+	session.ID = resp.Headers["Session"]
 
 	return record, nil
 }
@@ -172,6 +193,9 @@ func record(client *rtsp.Client, session *rtsp.Session) (stateFn, error) {
 	req.Method = rtsp.Record
 	localAddress := client.LocalAddress()
 	req.RequestURI = fmt.Sprintf("rtsp://%s/%s", localAddress, session.Description.Origin.SessionID)
+	if session.ID != "" {
+		req.Headers["Session"] = session.ID
+	}
 
 	resp, err := client.Send(req)
 	if err != nil {
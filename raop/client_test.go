@@ -0,0 +1,57 @@
+package raop
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ibiscum/bobcaygeon/rtsp"
+	"github.com/ibiscum/bobcaygeon/sdp"
+)
+
+// freePort returns a TCP port nothing listens on, for starting a receiver on
+func freePort(t *testing.T) int {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func TestStreamFormat(t *testing.T) {
+	format := StreamFormat(nil)
+	if rtpmap, _ := format.RtpMap(96); rtpmap.EncodingName != "AppleLossless" {
+		t.Error("Expected ALAC by default got:", rtpmap)
+	}
+	source, err := sdp.Parse(strings.NewReader("v=0\r\no=iTunes 3413821438 0 IN IP4 10.0.0.2\r\ns=iTunes\r\nc=IN IP4 10.0.0.1\r\nt=0 0\r\nm=audio 0 RTP/AVP 96\r\na=rtpmap:96 AppleLossless\r\na=fmtp:96 4096 0 16 40 10 14 2 255 0 0 48000\r\n"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	format = StreamFormat(source)
+	if fmtp, _ := format.Fmtp(96); fmtp.Parameters != "4096 0 16 40 10 14 2 255 0 0 48000" {
+		t.Error("Expected the format of the source got:", fmtp)
+	}
+}
+
+func TestEstablishSessionAnnouncesSourceFormat(t *testing.T) {
+	port := freePort(t)
+	a := NewAirplayServer(port, "Test", &FakePlayer{})
+	err := a.Start(false, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer a.Stop()
+	source := sdp.NewSessionDescription()
+	source.MediaDescription = []sdp.MediaDescription{sdp.NewAudioDescription(sdp.RtpMap{PayloadType: 96, EncodingName: "L16", ClockRate: 44100, Channels: 2}, "")}
+	session, client, err := EstablishSession("127.0.0.1", port, "", rtsp.UDP, source)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer client.Close()
+	defer session.Close(make(chan struct{}, 1))
+	sessions := a.Sessions()
+	if len(sessions) != 1 || sessions[0].Codec != "L16" {
+		t.Error("Expected the stream to be announced as L16 got:", sessions)
+	}
+}
@@ -4,10 +4,8 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha1"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/pem"
 	"fmt"
 	"log"
 	"net"
@@ -56,16 +54,12 @@ func base64unpad(s string) string {
 	return s
 }
 
-func aeskeyFromRsa(rsaaeskey64 string) (key []byte, err error) {
+func aeskeyFromRsa(rsaaeskey64 string, privKey *rsa.PrivateKey) (key []byte, err error) {
 	s64 := base64pad(rsaaeskey64)
 	s, err := base64.StdEncoding.DecodeString(s64)
 	if err != nil {
 		return
 	}
-	privKey, err := getPrivateKey()
-	if err != nil {
-		return nil, err
-	}
 	return rsa.DecryptOAEP(sha1.New(), nil, privKey, s, nil)
 }
 
@@ -76,7 +70,7 @@ func aeskeyFromRsa(rsaaeskey64 string) (key []byte, err error) {
 // 4. padding 0s are added if less than 32 bytes
 // 5. the payload is signed with the private key
 // 6. the signed data is base64 encoded
-func generateChallengeResponse(challenge string, macAddr net.HardwareAddr, ipAddr string) (string, error) {
+func generateChallengeResponse(challenge string, macAddr net.HardwareAddr, ipAddr string, rsaPrivKey *rsa.PrivateKey) (string, error) {
 	tmp := fmt.Sprintf("building challenge for %s (ip: %s, mac: %s)", challenge, ipAddr, macAddr.String())
 	log.Print(tmp)
 
@@ -106,11 +100,6 @@ func generateChallengeResponse(challenge string, macAddr net.HardwareAddr, ipAdd
 
 	log.Println(hex.EncodeToString(decodedChallenge))
 
-	rsaPrivKey, err := getPrivateKey()
-	if err != nil {
-		return "", err
-	}
-
 	signedResponse, err := rsa.SignPKCS1v15(nil, rsaPrivKey, crypto.Hash(0), decodedChallenge)
 	if err != nil {
 		return "", err
@@ -125,12 +114,3 @@ func generateChallengeResponse(challenge string, macAddr net.HardwareAddr, ipAdd
 	log.Printf("Generated challenge response: %s\n", signedResponse64)
 	return signedResponse64, nil
 }
-
-func getPrivateKey() (*rsa.PrivateKey, error) {
-	pemBlock, _ := pem.Decode([]byte(privateKey))
-	key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	return key, nil
-}
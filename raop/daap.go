@@ -2,122 +2,544 @@ package raop
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"time"
+
+	"github.com/ibiscum/bobcaygeon/player"
+)
+
+// DMAP, the format DAAP (and DACP) data is sent in, is a sequence of elements each made of
+// a four character code, a 4 byte big endian length and the value. Containers hold more elements.
+// see: https://github.com/kylewelsby/daap/blob/master/index.js and
+// https://nto.github.io/AirPlay.html#audio-metadata-daap
+
+// DmapType is the type of the value of a DMAP element
+type DmapType int
+
+const (
+	// DmapRaw value of an unknown tag, kept as is
+	DmapRaw DmapType = iota
+	// DmapByte signed 8 bit integer
+	DmapByte
+	// DmapUByte unsigned 8 bit integer
+	DmapUByte
+	// DmapShort signed 16 bit integer
+	DmapShort
+	// DmapUShort unsigned 16 bit integer
+	DmapUShort
+	// DmapInt signed 32 bit integer
+	DmapInt
+	// DmapUInt unsigned 32 bit integer
+	DmapUInt
+	// DmapLong signed 64 bit integer
+	DmapLong
+	// DmapULong unsigned 64 bit integer
+	DmapULong
+	// DmapString UTF-8 string
+	DmapString
+	// DmapDate seconds since the epoch, as 32 bits
+	DmapDate
+	// DmapVersion major (16 bits), minor and patch (8 bits each)
+	DmapVersion
+	// DmapContainer holds more elements
+	DmapContainer
 )
 
-type contentType struct {
-	code  string
-	name  string
-	cType string
+// size of the fixed size types
+var dmapTypeSizes = map[DmapType]int{
+	DmapByte:    1,
+	DmapUByte:   1,
+	DmapShort:   2,
+	DmapUShort:  2,
+	DmapInt:     4,
+	DmapUInt:    4,
+	DmapLong:    8,
+	DmapULong:   8,
+	DmapDate:    4,
+	DmapVersion: 4,
 }
 
-// based on: https://github.com/kylewelsby/daap/blob/master/index.js
-func parseDaap(daap []byte) map[string]interface{} {
-	i := 8
-	parsedData := make(map[string]interface{})
-	for i < len(daap) {
-		itemType := string(daap[i : i+4])
-		itemLength := int(binary.BigEndian.Uint32(daap[i+4 : i+8]))
-		if itemLength != 0 {
-			data := daap[i+8 : i+8+itemLength]
-			contentType := getContentType(itemType)
-			switch contentType.cType {
-			case "byte":
-				parsedData[contentType.name] = data[0]
-			case "string":
-				parsedData[contentType.name] = string(data)
+// DmapTag describes a DMAP tag, its code, its name and the type of its value
+type DmapTag struct {
+	Code string
+	Name string
+	Type DmapType
+}
+
+// DmapVersionValue is the value of a DmapVersion element
+type DmapVersionValue struct {
+	Major uint16
+	Minor uint8
+	Patch uint8
+}
+
+func (v DmapVersionValue) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// DmapItem is a single DMAP element. Values are Go types matching the tag type, i.e: uint8 for DmapUByte,
+// time.Time for DmapDate, DmapVersionValue for DmapVersion, []DmapItem for DmapContainer and []byte for DmapRaw
+type DmapItem struct {
+	Code  string
+	Value interface{}
+}
+
+// Name returns the name of the element's tag, or the code if the tag is unknown
+func (i DmapItem) Name() string {
+	if tag, ok := dmapTagsByCode[i.Code]; ok {
+		return tag.Name
+	}
+	return i.Code
+}
+
+var dmapTags = []DmapTag{
+	// dmap
+	{"mdcl", "dmap.dictionary", DmapContainer},
+	{"mstt", "dmap.status", DmapUInt},
+	{"miid", "dmap.itemid", DmapUInt},
+	{"minm", "dmap.itemname", DmapString},
+	{"mikd", "dmap.itemkind", DmapUByte},
+	{"mper", "dmap.persistentid", DmapULong},
+	{"mcon", "dmap.container", DmapContainer},
+	{"mcti", "dmap.containeritemid", DmapUInt},
+	{"mpco", "dmap.parentcontainerid", DmapUInt},
+	{"msts", "dmap.statusstring", DmapString},
+	{"mimc", "dmap.itemcount", DmapUInt},
+	{"mctc", "dmap.containercount", DmapUInt},
+	{"mrco", "dmap.returnedcount", DmapUInt},
+	{"mtco", "dmap.specifiedtotalcount", DmapUInt},
+	{"mlcl", "dmap.listing", DmapContainer},
+	{"mlit", "dmap.listingitem", DmapContainer},
+	{"mbcl", "dmap.bag", DmapContainer},
+	{"msrv", "dmap.serverinforesponse", DmapContainer},
+	{"msau", "dmap.authenticationmethod", DmapUByte},
+	{"mslr", "dmap.loginrequired", DmapUByte},
+	{"mpro", "dmap.protocolversion", DmapVersion},
+	{"msal", "dmap.supportsautologout", DmapUByte},
+	{"msup", "dmap.supportsupdate", DmapUByte},
+	{"mspi", "dmap.supportspersistentids", DmapUByte},
+	{"msex", "dmap.supportsextensions", DmapUByte},
+	{"msbr", "dmap.supportsbrowse", DmapUByte},
+	{"msqy", "dmap.supportsquery", DmapUByte},
+	{"msix", "dmap.supportsindex", DmapUByte},
+	{"msrs", "dmap.supportsresolve", DmapUByte},
+	{"mstm", "dmap.timeoutinterval", DmapUInt},
+	{"msdc", "dmap.databasescount", DmapUInt},
+	{"mlog", "dmap.loginresponse", DmapContainer},
+	{"mlid", "dmap.sessionid", DmapUInt},
+	{"mupd", "dmap.updateresponse", DmapContainer},
+	{"musr", "dmap.serverrevision", DmapUInt},
+	{"muty", "dmap.updatetype", DmapUByte},
+	{"mudl", "dmap.deletedidlisting", DmapContainer},
+	{"mccr", "dmap.contentcodesresponse", DmapContainer},
+	{"mcnm", "dmap.contentcodesnumber", DmapUInt},
+	{"mcna", "dmap.contentcodesname", DmapString},
+	{"mcty", "dmap.contentcodestype", DmapUShort},
+	{"meds", "dmap.editcommandssupported", DmapUInt},
+	{"mdst", "dmap.downloadstatus", DmapUByte},
+	{"meia", "dmap.itemdateadded", DmapDate},
+	{"meip", "dmap.itemdateplayed", DmapDate},
+	// daap
+	{"apro", "daap.protocolversion", DmapVersion},
+	{"avdb", "daap.serverdatabases", DmapContainer},
+	{"abro", "daap.databasebrowse", DmapContainer},
+	{"abal", "daap.browsealbumlisting", DmapContainer},
+	{"abar", "daap.browseartistlisting", DmapContainer},
+	{"abcp", "daap.browsecomposerlisting", DmapContainer},
+	{"abgn", "daap.browsegenrelisting", DmapContainer},
+	{"adbs", "daap.databasesongs", DmapContainer},
+	{"aply", "daap.databaseplaylists", DmapContainer},
+	{"abpl", "daap.baseplaylist", DmapUByte},
+	{"apso", "daap.playlistsongs", DmapContainer},
+	{"arsv", "daap.resolve", DmapContainer},
+	{"arif", "daap.resolveinfo", DmapContainer},
+	{"asal", "daap.songalbum", DmapString},
+	{"asaa", "daap.songalbumartist", DmapString},
+	{"asai", "daap.songalbumid", DmapULong},
+	{"asar", "daap.songartist", DmapString},
+	{"asri", "daap.songartistid", DmapULong},
+	{"asbt", "daap.songbeatsperminute", DmapUShort},
+	{"asbr", "daap.songbitrate", DmapUShort},
+	{"ascm", "daap.songcomment", DmapString},
+	{"asco", "daap.songcompilation", DmapUByte},
+	{"ascp", "daap.songcomposer", DmapString},
+	{"ascd", "daap.songcodectype", DmapUInt},
+	{"ascs", "daap.songcodecsubtype", DmapUInt},
+	{"asct", "daap.songcategory", DmapString},
+	{"ascn", "daap.songcontentdescription", DmapString},
+	{"ascr", "daap.songcontentrating", DmapUByte},
+	{"asda", "daap.songdateadded", DmapDate},
+	{"asdm", "daap.songdatemodified", DmapDate},
+	{"asdr", "daap.songdatereleased", DmapDate},
+	{"asdp", "daap.songdatepurchased", DmapDate},
+	{"asdc", "daap.songdisccount", DmapUShort},
+	{"asdn", "daap.songdiscnumber", DmapUShort},
+	{"asdb", "daap.songdisabled", DmapUByte},
+	{"asdk", "daap.songdatakind", DmapUByte},
+	{"asdt", "daap.songdescription", DmapString},
+	{"ased", "daap.songextradata", DmapUShort},
+	{"aseq", "daap.songeqpreset", DmapString},
+	{"asfm", "daap.songformat", DmapString},
+	{"asgn", "daap.songgenre", DmapString},
+	{"asgp", "daap.songgapless", DmapUByte},
+	{"agrp", "daap.songgrouping", DmapString},
+	{"ashp", "daap.songhasbeenplayed", DmapUByte},
+	{"asky", "daap.songkeywords", DmapString},
+	{"asls", "daap.songlongsize", DmapULong},
+	{"aspu", "daap.songpodcasturl", DmapString},
+	{"asrv", "daap.songrelativevolume", DmapByte},
+	{"assr", "daap.songsamplerate", DmapUInt},
+	{"assz", "daap.songsize", DmapUInt},
+	{"asst", "daap.songstarttime", DmapUInt},
+	{"assp", "daap.songstoptime", DmapUInt},
+	{"astm", "daap.songtime", DmapUInt},
+	{"astc", "daap.songtrackcount", DmapUShort},
+	{"astn", "daap.songtracknumber", DmapUShort},
+	{"asul", "daap.songdataurl", DmapString},
+	{"asur", "daap.songuserrating", DmapUByte},
+	{"asrs", "daap.songuserratingstatus", DmapUByte},
+	{"aslr", "daap.songalbumuserrating", DmapUByte},
+	{"asas", "daap.songalbumuserratingstatus", DmapUByte},
+	{"aspc", "daap.songuserplaycount", DmapUInt},
+	{"askp", "daap.songuserskipcount", DmapUInt},
+	{"askd", "daap.songlastskipdate", DmapDate},
+	{"asac", "daap.songartworkcount", DmapUShort},
+	{"asyr", "daap.songyear", DmapUShort},
+	{"asbk", "daap.bookmarkable", DmapUByte},
+	{"assn", "daap.sortname", DmapString},
+	{"assa", "daap.sortartist", DmapString},
+	{"assl", "daap.sortalbumartist", DmapString},
+	{"assu", "daap.sortalbum", DmapString},
+	{"assc", "daap.sortcomposer", DmapString},
+	{"asss", "daap.sortseriesname", DmapString},
+	// com.apple.itunes
+	{"aeNV", "com.apple.itunes.norm-volume", DmapUInt},
+	{"aeSP", "com.apple.itunes.smart-playlist", DmapUByte},
+	{"aePC", "com.apple.itunes.is-podcast", DmapUByte},
+	{"aeHV", "com.apple.itunes.has-video", DmapUByte},
+	{"aeMK", "com.apple.itunes.mediakind", DmapUByte},
+	{"aeMk", "com.apple.itunes.extended-media-kind", DmapUInt},
+	{"aeSN", "com.apple.itunes.series-name", DmapString},
+	{"aeNN", "com.apple.itunes.network-name", DmapString},
+	{"aeEN", "com.apple.itunes.episode-num-str", DmapString},
+	{"aeES", "com.apple.itunes.episode-sort", DmapUInt},
+	{"aeSU", "com.apple.itunes.season-num", DmapUInt},
+	{"aeCR", "com.apple.itunes.content-rating", DmapString},
+	{"aeGH", "com.apple.itunes.gapless-heur", DmapUInt},
+	{"aeGD", "com.apple.itunes.gapless-enc-dr", DmapUInt},
+	{"aeGU", "com.apple.itunes.gapless-dur", DmapULong},
+	{"aeGR", "com.apple.itunes.gapless-resy", DmapULong},
+	{"aeGE", "com.apple.itunes.gapless-enc-del", DmapUInt},
+	{"aeSF", "com.apple.itunes.itms-storefrontid", DmapUInt},
+	{"aeCS", "com.apple.itunes.artworkchecksum", DmapUInt},
+	// dacp/dmcp, used by the remote control
+	{"cmst", "dmcp.playstatus", DmapContainer},
+	{"cmsr", "dmcp.serverrevision", DmapUInt},
+	{"cmgt", "dmcp.getpropertyresponse", DmapContainer},
+	{"cmvo", "dmcp.volume", DmapUInt},
+	{"caps", "dacp.playerstate", DmapUByte},
+	{"cash", "dacp.shufflestate", DmapUByte},
+	{"carp", "dacp.repeatstate", DmapUByte},
+	{"cann", "dacp.nowplayingname", DmapString},
+	{"cana", "dacp.nowplayingartist", DmapString},
+	{"canl", "dacp.nowplayingalbum", DmapString},
+	{"cang", "dacp.nowplayinggenre", DmapString},
+	{"cant", "dacp.remainingtime", DmapUInt},
+	{"cast", "dacp.tracklength", DmapUInt},
+}
+
+var (
+	dmapTagsByCode = make(map[string]DmapTag)
+	dmapTagsByName = make(map[string]DmapTag)
+)
+
+func init() {
+	for _, tag := range dmapTags {
+		dmapTagsByCode[tag.Code] = tag
+		dmapTagsByName[tag.Name] = tag
+	}
+}
+
+// LookupDmapTag returns the tag with the given four character code
+func LookupDmapTag(code string) (DmapTag, bool) {
+	tag, ok := dmapTagsByCode[code]
+	return tag, ok
+}
+
+// LookupDmapTagByName returns the tag with the given name, i.e: daap.songalbum
+func LookupDmapTagByName(name string) (DmapTag, bool) {
+	tag, ok := dmapTagsByName[name]
+	return tag, ok
+}
+
+// DecodeDmap decodes DMAP data into its elements, containers are decoded recursively. An
+// element whose value doesn't fit its type is skipped, and an element running past the end
+// of its container ends that container; the elements it holds up to there are kept. An error
+// is only returned when the data itself can't be made sense of
+func DecodeDmap(data []byte) ([]DmapItem, error) {
+	return decodeDmap(data, "")
+}
+
+// decodeDmap decodes the elements of the container with the given code, the data itself if empty
+func decodeDmap(data []byte, container string) ([]DmapItem, error) {
+	items := []DmapItem{}
+	i := 0
+	for i < len(data) {
+		var err error
+		if len(data)-i < 8 {
+			err = fmt.Errorf("truncated DMAP element header at offset %d", i)
+		} else if length := int(binary.BigEndian.Uint32(data[i+4 : i+8])); length > len(data)-i-8 {
+			err = fmt.Errorf("DMAP element %s at offset %d claims %d bytes, only %d left", data[i:i+4], i, length, len(data)-i-8)
+		}
+		if err != nil {
+			if container == "" {
+				return nil, err
 			}
+			// the length of the container still tells where the next element starts
+			log.Printf("Skipping the rest of DMAP container %s: %s\n", container, err)
+			break
+		}
+		code := string(data[i : i+4])
+		length := int(binary.BigEndian.Uint32(data[i+4 : i+8]))
+		value, err := decodeDmapValue(code, data[i+8:i+8+length])
+		if err != nil {
+			log.Println("Skipping DMAP element:", err)
+		} else {
+			items = append(items, DmapItem{Code: code, Value: value})
 		}
-		i = i + itemLength + 8
+		i += 8 + length
 	}
-	log.Println(parsedData)
-	return parsedData
+	return items, nil
 }
 
-// EncodeDaap will take a map and encode it in daap format
-func EncodeDaap(dataToEncode map[string]interface{}) ([]byte, error) {
+func decodeDmapValue(code string, data []byte) (interface{}, error) {
+	tag, ok := dmapTagsByCode[code]
+	if !ok {
+		raw := make([]byte, len(data))
+		copy(raw, data)
+		return raw, nil
+	}
+	if size, fixed := dmapTypeSizes[tag.Type]; fixed && len(data) != 0 && len(data) != size {
+		return nil, fmt.Errorf("DMAP element %s should be %d bytes, got %d", code, size, len(data))
+	}
+	// senders leave out the value of elements they have nothing for
+	padded := data
+	if len(data) == 0 {
+		padded = make([]byte, dmapTypeSizes[tag.Type])
+	}
+	switch tag.Type {
+	case DmapByte:
+		return int8(padded[0]), nil
+	case DmapUByte:
+		return padded[0], nil
+	case DmapShort:
+		return int16(binary.BigEndian.Uint16(padded)), nil
+	case DmapUShort:
+		return binary.BigEndian.Uint16(padded), nil
+	case DmapInt:
+		return int32(binary.BigEndian.Uint32(padded)), nil
+	case DmapUInt:
+		return binary.BigEndian.Uint32(padded), nil
+	case DmapLong:
+		return int64(binary.BigEndian.Uint64(padded)), nil
+	case DmapULong:
+		return binary.BigEndian.Uint64(padded), nil
+	case DmapString:
+		return string(data), nil
+	case DmapDate:
+		return time.Unix(int64(binary.BigEndian.Uint32(padded)), 0).UTC(), nil
+	case DmapVersion:
+		return DmapVersionValue{Major: binary.BigEndian.Uint16(padded[0:2]), Minor: padded[2], Patch: padded[3]}, nil
+	case DmapContainer:
+		return decodeDmap(data, code)
+	}
+	return nil, fmt.Errorf("unknown type for DMAP element %s", code)
+}
+
+// EncodeDmap encodes the elements as DMAP data, values must match the types of their tags
+func EncodeDmap(items []DmapItem) ([]byte, error) {
 	var buf []byte
-	// can't find why, but I found needed to add a padding before the daap data
-	padding := make([]byte, 8)
-	binary.BigEndian.PutUint64(padding, uint64(0))
-	// we first add a padding, from the sample I captured from apple it started
-	// with these bytes: 109, 108, 105, 116, 0, 0, 6, 17 but for now I'll just add 0s
-	buf = append(buf, padding...)
-	for k, v := range dataToEncode {
-		ct := getContentTypeForName(k)
-		itemType := ct.code
-		field := []byte(itemType)
-		// format is dataType, dataLength, data
-		buf = append(buf, field...)
-		var length []byte
-		var data []byte
-		if ct.cType == "byte" {
-			data = make([]byte, 1)
-			data[0] = v.(uint8)
-			length = make([]byte, 4)
-			// length of type byte is... one byte :)
-			binary.BigEndian.PutUint32(length, 1)
+	for _, item := range items {
+		if len(item.Code) != 4 {
+			return nil, fmt.Errorf("DMAP code must be 4 characters: %q", item.Code)
 		}
-		if ct.cType == "string" {
-			data = []byte(fmt.Sprintf("%s", v))
-			length = make([]byte, 4)
-			// add in the length of the data we want to encode
-			binary.BigEndian.PutUint32(length, uint32(len(data)))
+		data, err := encodeDmapValue(item)
+		if err != nil {
+			return nil, err
 		}
-		buf = append(buf, length...)
+		// format is code, length, data
+		buf = append(buf, item.Code...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
 		buf = append(buf, data...)
 	}
-
 	return buf, nil
 }
 
-func getContentType(code string) contentType {
-	ct := contentType{}
-	// there is a whole TON of types that can come back
-	// only parse out the ones we are interested in for now
-	switch code {
-	case "mikd":
-		ct.cType = "byte"
-		ct.code = "mikd"
-		ct.name = "dmap.itemkind"
-	case "asal":
-		ct.cType = "string"
-		ct.code = "asal"
-		ct.name = "daap.songalbum"
-	case "asar":
-		ct.cType = "string"
-		ct.code = "asar"
-		ct.name = "daap.songartist"
-	case "minm":
-		ct.cType = "string"
-		ct.code = "minm"
-		ct.name = "dmap.itemname"
-	}
-	return ct
-}
-
-func getContentTypeForName(name string) contentType {
-	ct := contentType{}
-	// there is a whole TON of types that can come back
-	// only parse out the ones we are interested in for now
-	switch name {
-	case "dmap.itemkind":
-		ct.cType = "byte"
-		ct.code = "mikd"
-		ct.name = "dmap.itemkind"
-	case "daap.songalbum":
-		ct.cType = "string"
-		ct.code = "asal"
-		ct.name = "daap.songalbum"
-	case "daap.songartist":
-		ct.cType = "string"
-		ct.code = "asar"
-		ct.name = "daap.songartist"
-	case "dmap.itemname":
-		ct.cType = "string"
-		ct.code = "minm"
-		ct.name = "dmap.itemname"
-	}
-	return ct
+func encodeDmapValue(item DmapItem) ([]byte, error) {
+	tag, ok := dmapTagsByCode[item.Code]
+	if !ok {
+		if raw, isRaw := item.Value.([]byte); isRaw {
+			return raw, nil
+		}
+		return nil, fmt.Errorf("unknown DMAP element %s needs a []byte value", item.Code)
+	}
+	switch tag.Type {
+	case DmapString:
+		if s, isString := item.Value.(string); isString {
+			return []byte(s), nil
+		}
+	case DmapDate:
+		if t, isTime := item.Value.(time.Time); isTime {
+			return binary.BigEndian.AppendUint32(nil, uint32(t.Unix())), nil
+		}
+	case DmapVersion:
+		if v, isVersion := item.Value.(DmapVersionValue); isVersion {
+			return append(binary.BigEndian.AppendUint16(nil, v.Major), v.Minor, v.Patch), nil
+		}
+	case DmapContainer:
+		if children, isContainer := item.Value.([]DmapItem); isContainer {
+			data, err := EncodeDmap(children)
+			if err != nil {
+				return nil, fmt.Errorf("in %s: %w", item.Code, err)
+			}
+			return data, nil
+		}
+	default:
+		n, isInt := toUint64(item.Value)
+		if !isInt {
+			break
+		}
+		switch dmapTypeSizes[tag.Type] {
+		case 1:
+			return []byte{byte(n)}, nil
+		case 2:
+			return binary.BigEndian.AppendUint16(nil, uint16(n)), nil
+		case 4:
+			return binary.BigEndian.AppendUint32(nil, uint32(n)), nil
+		case 8:
+			return binary.BigEndian.AppendUint64(nil, n), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value for DMAP element %s (%s): %v", item.Code, tag.Name, item.Value)
+}
+
+// toUint64 converts any Go integer to its two's complement bits
+func toUint64(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case int:
+		return uint64(v), true
+	case int8:
+		return uint64(v), true
+	case int16:
+		return uint64(v), true
+	case int32:
+		return uint64(v), true
+	case int64:
+		return uint64(v), true
+	case uint:
+		return uint64(v), true
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// parseDaap decodes the track info senders send, a dmap.listingitem, into a map keyed by tag name
+func parseDaap(daap []byte) (map[string]interface{}, error) {
+	items, err := DecodeDmap(daap)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 1 && items[0].Code == "mlit" {
+		items = items[0].Value.([]DmapItem)
+	}
+	parsedData := make(map[string]interface{})
+	for _, item := range items {
+		parsedData[item.Name()] = item.Value
+	}
+	return parsedData, nil
+}
+
+// EncodeDaap will take a map of tag names, i.e: daap.songalbum, to values and encode it in daap format,
+// as a dmap.listingitem the way senders send track info
+func EncodeDaap(dataToEncode map[string]interface{}) ([]byte, error) {
+	names := make([]string, 0, len(dataToEncode))
+	for name := range dataToEncode {
+		names = append(names, name)
+	}
+	// keep the output stable
+	sort.Strings(names)
+	items := make([]DmapItem, 0, len(names))
+	for _, name := range names {
+		tag, ok := dmapTagsByName[name]
+		if !ok {
+			return nil, errors.New("unknown DMAP tag: " + name)
+		}
+		items = append(items, DmapItem{Code: tag.Code, Value: dataToEncode[name]})
+	}
+	return EncodeDmap([]DmapItem{{Code: "mlit", Value: items}})
+}
+
+// trackFromDaap builds the track from the track info a sender sent
+func trackFromDaap(daapData map[string]interface{}) player.Track {
+	track := player.Track{}
+	track.Album, _ = daapData["daap.songalbum"].(string)
+	track.Artist, _ = daapData["daap.songartist"].(string)
+	track.Title, _ = daapData["dmap.itemname"].(string)
+	track.Genre, _ = daapData["daap.songgenre"].(string)
+	track.Composer, _ = daapData["daap.songcomposer"].(string)
+	track.PersistentID, _ = daapData["dmap.persistentid"].(uint64)
+	if year, ok := daapData["daap.songyear"].(uint16); ok {
+		track.Year = int(year)
+	}
+	if number, ok := daapData["daap.songtracknumber"].(uint16); ok {
+		track.TrackNumber = int(number)
+	}
+	if count, ok := daapData["daap.songtrackcount"].(uint16); ok {
+		track.TrackCount = int(count)
+	}
+	if number, ok := daapData["daap.songdiscnumber"].(uint16); ok {
+		track.DiscNumber = int(number)
+	}
+	if count, ok := daapData["daap.songdisccount"].(uint16); ok {
+		track.DiscCount = int(count)
+	}
+	// song time is in milliseconds
+	if duration, ok := daapData["daap.songtime"].(uint32); ok {
+		track.Duration = time.Duration(duration) * time.Millisecond
+	}
+	return track
+}
+
+// EncodeTrack encodes the track info, not the artwork, in daap format the way senders send it
+func EncodeTrack(track player.Track) ([]byte, error) {
+	input := map[string]interface{}{
+		"daap.songalbum":       track.Album,
+		"dmap.itemname":        track.Title,
+		"daap.songartist":      track.Artist,
+		"daap.songgenre":       track.Genre,
+		"daap.songcomposer":    track.Composer,
+		"daap.songyear":        track.Year,
+		"daap.songtracknumber": track.TrackNumber,
+		"daap.songtrackcount":  track.TrackCount,
+		"daap.songdiscnumber":  track.DiscNumber,
+		"daap.songdisccount":   track.DiscCount,
+		"daap.songtime":        track.Duration.Milliseconds(),
+		"dmap.persistentid":    track.PersistentID,
+	}
+	return EncodeDaap(input)
 }
@@ -1,13 +1,14 @@
 package raop
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/grandcat/zeroconf"
 )
 
 // DacpClient used to perform DACP operations
@@ -20,86 +21,204 @@ type DacpClient struct {
 }
 
 func newDacpClient(ipAddress string, port int, dacpID string, activeRemote string) *DacpClient {
-	return &DacpClient{ipAddress: ipAddress, port: port, dacpID: dacpID, activeRemote: activeRemote, httpClient: &http.Client{}}
+	return &DacpClient{ipAddress: ipAddress, port: port, dacpID: dacpID, activeRemote: activeRemote, httpClient: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// PlaybackCommand a remote control command for the sender that is streaming to us
+type PlaybackCommand int
+
+const (
+	// CommandPlay starts playback
+	CommandPlay PlaybackCommand = iota
+	// CommandPause pauses playback
+	CommandPause
+	// CommandPlayPause toggles between playing and paused
+	CommandPlayPause
+	// CommandStop stops playback
+	CommandStop
+	// CommandNext skips to the next item
+	CommandNext
+	// CommandPrevious goes back to the previous item
+	CommandPrevious
+	// CommandVolumeUp turns the volume of the sender up a step
+	CommandVolumeUp
+	// CommandVolumeDown turns the volume of the sender down a step
+	CommandVolumeDown
+	// CommandShuffleOn turns shuffle on
+	CommandShuffleOn
+	// CommandShuffleOff turns shuffle off
+	CommandShuffleOff
+	// CommandRepeatOff turns repeat off
+	CommandRepeatOff
+	// CommandRepeatOne repeats the current item
+	CommandRepeatOne
+	// CommandRepeatAll repeats all items
+	CommandRepeatAll
+)
+
+// the names double as the names used in the APIs
+var playbackCommandNames = map[PlaybackCommand]string{
+	CommandPlay:       "play",
+	CommandPause:      "pause",
+	CommandPlayPause:  "playpause",
+	CommandStop:       "stop",
+	CommandNext:       "next",
+	CommandPrevious:   "previous",
+	CommandVolumeUp:   "volumeup",
+	CommandVolumeDown: "volumedown",
+	CommandShuffleOn:  "shuffle-on",
+	CommandShuffleOff: "shuffle-off",
+	CommandRepeatOff:  "repeat-off",
+	CommandRepeatOne:  "repeat-one",
+	CommandRepeatAll:  "repeat-all",
+}
+
+// the DACP request path (after /ctrl-int/1/) for each command
+// see: https://nto.github.io/AirPlay.html#audio-remotecontrol
+var dacpCommands = map[PlaybackCommand]string{
+	CommandPlay:       "play",
+	CommandPause:      "pause",
+	CommandPlayPause:  "playpause",
+	CommandStop:       "stop",
+	CommandNext:       "nextitem",
+	CommandPrevious:   "previtem",
+	CommandVolumeUp:   "volumeup",
+	CommandVolumeDown: "volumedown",
+	CommandShuffleOn:  "setproperty?dacp.shufflestate=1",
+	CommandShuffleOff: "setproperty?dacp.shufflestate=0",
+	CommandRepeatOff:  "setproperty?dacp.repeatstate=0",
+	CommandRepeatOne:  "setproperty?dacp.repeatstate=1",
+	CommandRepeatAll:  "setproperty?dacp.repeatstate=2",
+}
+
+func (c PlaybackCommand) String() string {
+	return playbackCommandNames[c]
 }
 
+// ParsePlaybackCommand converts a command name, i.e: next, to a PlaybackCommand
+func ParsePlaybackCommand(name string) (PlaybackCommand, error) {
+	for command, commandName := range playbackCommandNames {
+		if strings.EqualFold(name, commandName) {
+			return command, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown playback command: %s", name)
+}
+
+// Play starts playback
 func (d *DacpClient) Play() error {
-	return d.executeMethod("play")
+	return d.Execute(CommandPlay)
 }
 
+// Pause pauses playback
 func (d *DacpClient) Pause() error {
-	return d.executeMethod("pause")
+	return d.Execute(CommandPause)
 }
 
+// PlayPause toggles between playing and paused
 func (d *DacpClient) PlayPause() error {
-	return d.executeMethod("playpause")
+	return d.Execute(CommandPlayPause)
 }
 
+// Stop stops playback
 func (d *DacpClient) Stop() error {
-	return d.executeMethod("stop")
+	return d.Execute(CommandStop)
 }
 
+// Next skips to the next item
 func (d *DacpClient) Next() error {
-	return d.executeMethod("nextitem")
+	return d.Execute(CommandNext)
 }
 
-func (d *DacpClient) executeMethod(method string) error {
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/ctrl-int/1/%s", d.ipAddress, d.port, method), nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	req.Header.Add("Active-Remote", d.activeRemote)
-	_, err = d.httpClient.Do(req)
-	return err
+// Previous goes back to the previous item
+func (d *DacpClient) Previous() error {
+	return d.Execute(CommandPrevious)
 }
 
-// DiscoverDacpClient will try to find the matching DACP client for stream operations
-func DiscoverDacpClient(dacpID string, activeRemote string) *DacpClient {
-	serviceType := "_dacp._tcp"
-	resolver, err := zeroconf.NewResolver(nil)
-	if err != nil {
-		log.Fatalln("Failed to initialize resolver:", err.Error())
+// VolumeUp turns the volume of the sender up a step
+func (d *DacpClient) VolumeUp() error {
+	return d.Execute(CommandVolumeUp)
+}
+
+// VolumeDown turns the volume of the sender down a step
+func (d *DacpClient) VolumeDown() error {
+	return d.Execute(CommandVolumeDown)
+}
+
+// SetShuffle turns shuffle on or off
+func (d *DacpClient) SetShuffle(shuffle bool) error {
+	if shuffle {
+		return d.Execute(CommandShuffleOn)
 	}
+	return d.Execute(CommandShuffleOff)
+}
 
-	entries := make(chan *zeroconf.ServiceEntry)
+// Execute sends the command to the sender
+func (d *DacpClient) Execute(command PlaybackCommand) error {
+	method, ok := dacpCommands[command]
+	if !ok {
+		return fmt.Errorf("unknown playback command: %d", command)
+	}
+	return d.executeMethod(method)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(5))
-	defer cancel()
-	err = resolver.Browse(ctx, serviceType, "local", entries)
+func (d *DacpClient) executeMethod(method string) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/ctrl-int/1/%s", net.JoinHostPort(d.ipAddress, strconv.Itoa(d.port)), method), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Active-Remote", d.activeRemote)
+	resp, err := d.httpClient.Do(req)
 	if err != nil {
-		log.Fatalln("Failed to browse:", err.Error())
+		return err
 	}
-	log.Println("searching for daacp airplay client")
-	instanceName := fmt.Sprintf("iTunes_Ctrl_%s", dacpID)
-	var entry *zeroconf.ServiceEntry
-	foundEntry := make(chan *zeroconf.ServiceEntry)
-	// what we do is spin of a goroutine that will process the entries registered in
-	// mDNS for our service.  As soon as we detect there is one with an IP4 address
-	// we send it off and cancel to stop the searching.
-	// there is an issue, https://github.com/grandcat/zeroconf/issues/27 where we
-	// could get an entry back without an IP4 addr, it will come in later as an update
-	// so we wait until we find the addr, or timeout
-	go func(results <-chan *zeroconf.ServiceEntry, foundEntry chan *zeroconf.ServiceEntry) {
-		for e := range results {
-			if (len(e.AddrIPv4)) > 0 && e.Instance == instanceName {
-				foundEntry <- e
-				cancel()
-			}
+	defer resp.Body.Close()
+	// senders answer with 204 No Content
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("DACP %s failed with status: %s", method, resp.Status)
+	}
+	return nil
+}
+
+// PlaybackControl sends the command to the sender that is streaming to us
+func (a *AirplayServer) PlaybackControl(command PlaybackCommand) error {
+	var target *airplaySession
+	for _, as := range a.sessions.getSessions() {
+		if as.dacpID == "" && as.getClient() == nil {
+			continue
 		}
-	}(entries, foundEntry)
-
-	select {
-	// this should be ok, since we only expect one service of the _bobcaygeon_ type to be found
-	case entry = <-foundEntry:
-		log.Println("Found daacp airplay client")
-	case <-ctx.Done():
-		log.Println("dacp airplay client not found")
+		// prefer the session actually streaming
+		if target == nil || (as.getState() == recording && target.getState() != recording) {
+			target = as
+		}
+	}
+	if target == nil {
+		return errors.New("no sender to control, nothing is streaming or the sender can't be remote controlled")
 	}
+	log.Printf("Sending %s to sender of session %s\n", command.String(), target.session.ID)
+	return a.controlSender(target, command)
+}
 
-	if entry == nil {
-		log.Println("no dacp client found, will not be able to control")
-		return nil
+// controlSender sends the command to the sender of the session, finding its DACP service
+// again if it can't be reached where we last saw it
+func (a *AirplayServer) controlSender(as *airplaySession, command PlaybackCommand) error {
+	client := as.getClient()
+	if client == nil {
+		client = a.resolveDacpClient(as, dacpResolveTimeout)
+		if client == nil {
+			return fmt.Errorf("DACP service of sender %s not found", as.dacpID)
+		}
+	}
+	err := client.Execute(command)
+	if err == nil || as.dacpID == "" {
+		return err
+	}
+	log.Println("Could not reach DACP service, resolving again: ", err)
+	a.dacpDiscovery.Forget(as.dacpID)
+	as.setClient(nil)
+	client = a.resolveDacpClient(as, dacpResolveTimeout)
+	if client == nil {
+		return err
 	}
-	client := newDacpClient(entry.AddrIPv4[0].String(), entry.Port, dacpID, activeRemote)
-	return client
+	return client.Execute(command)
 }
@@ -7,6 +7,9 @@ import (
 	"log"
 	"net/http"
 	"testing"
+
+	"github.com/ibiscum/bobcaygeon/rtsp"
+	"github.com/ibiscum/bobcaygeon/sdp"
 )
 
 // based on: http://hassansin.github.io/Unit-Testing-http-client-in-Go
@@ -175,3 +178,69 @@ func TestNext(t *testing.T) {
 		t.Errorf(fmt.Sprintf("Expected: %s, Received: %s", expectedRemote, header))
 	}
 }
+
+func TestExecuteCommands(t *testing.T) {
+	dc := newDacpClient("1.1.1.1", 333, "testID", "testActiveRemote")
+	url := ""
+	dc.httpClient = NewTestClient(func(req *http.Request) *http.Response {
+		url = req.URL.String()
+		return &http.Response{StatusCode: 204, Body: io.NopCloser(bytes.NewBufferString(``)), Header: make(http.Header)}
+	})
+	expected := map[PlaybackCommand]string{
+		CommandPrevious:   "http://1.1.1.1:333/ctrl-int/1/previtem",
+		CommandVolumeUp:   "http://1.1.1.1:333/ctrl-int/1/volumeup",
+		CommandVolumeDown: "http://1.1.1.1:333/ctrl-int/1/volumedown",
+		CommandShuffleOn:  "http://1.1.1.1:333/ctrl-int/1/setproperty?dacp.shufflestate=1",
+		CommandRepeatAll:  "http://1.1.1.1:333/ctrl-int/1/setproperty?dacp.repeatstate=2",
+	}
+	for command, expectedURL := range expected {
+		if err := dc.Execute(command); err != nil {
+			t.Error("Unexpected error", err)
+		}
+		if url != expectedURL {
+			t.Errorf("Expected: %s, Received: %s", expectedURL, url)
+		}
+	}
+}
+
+func TestExecuteFailure(t *testing.T) {
+	dc := newDacpClient("1.1.1.1", 333, "testID", "testActiveRemote")
+	dc.httpClient = NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{StatusCode: 403, Status: "403 Forbidden", Body: io.NopCloser(bytes.NewBufferString(``)), Header: make(http.Header)}
+	})
+	if err := dc.Next(); err == nil {
+		t.Error("Expected error when sender refuses the command")
+	}
+}
+
+func TestParsePlaybackCommand(t *testing.T) {
+	command, err := ParsePlaybackCommand("Previous")
+	if err != nil || command != CommandPrevious {
+		t.Error("Expected previous got:", command, err)
+	}
+	if _, err := ParsePlaybackCommand("rewind"); err == nil {
+		t.Error("Expected error for unknown command")
+	}
+}
+
+func TestPlaybackControl(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	if err := a.PlaybackControl(CommandNext); err == nil {
+		t.Error("Expected error without a session")
+	}
+	dc := newDacpClient("1.1.1.1", 333, "testID", "testActiveRemote")
+	url := ""
+	dc.httpClient = NewTestClient(func(req *http.Request) *http.Response {
+		url = req.URL.String()
+		return &http.Response{StatusCode: 204, Body: io.NopCloser(bytes.NewBufferString(``)), Header: make(http.Header)}
+	})
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	s.ID = "ABCDEF"
+	a.sessions.addSession("10.0.0.2:5000", newAirplaySession("10.0.0.2:5000", s, dc))
+	if err := a.PlaybackControl(CommandNext); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if url != "http://1.1.1.1:333/ctrl-int/1/nextitem" {
+		t.Error("Unexpected url", url)
+	}
+}
@@ -0,0 +1,276 @@
+package raop
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	dacpServiceType = "_dacp._tcp"
+	// senders advertise their DACP service as iTunes_Ctrl_<DACP-ID>
+	dacpInstancePrefix = "iTunes_Ctrl_"
+	// how long to wait before browsing again after mDNS failed on us
+	dacpBrowseRetry = 10 * time.Second
+	// how long a new session waits, in the background, for the DACP service to show up
+	dacpDiscoverTimeout = 30 * time.Second
+	// how long a remote control command waits for the DACP service to show up
+	dacpResolveTimeout = 5 * time.Second
+)
+
+// dacpRemote is where the DACP service of a sender can be reached
+type dacpRemote struct {
+	ip   string
+	port int
+}
+
+// cachedRemote is a DACP service found, kept until its records expire
+type cachedRemote struct {
+	dacpRemote
+	expires time.Time
+}
+
+// dacpBrowser browses for DACP services until the context is done, reporting every
+// service found along with how long its records live. It returns an error if browsing
+// stopped for any other reason
+type dacpBrowser func(ctx context.Context, found func(dacpID string, remote dacpRemote, ttl time.Duration)) error
+
+// DacpDiscovery watches mDNS for the DACP services of senders in the background,
+// caching where they can be reached by DACP-ID. A service is reported once per browse
+// and mDNS doesn't tell us about the ones going away, so they are only cached for as
+// long as their records live, and browsing starts over to learn about the ones still there
+type DacpDiscovery struct {
+	lock    sync.Mutex
+	remotes map[string]cachedRemote
+	waiters map[string][]chan dacpRemote
+	browse  dacpBrowser
+	started bool
+	stopped bool
+	cancel  context.CancelFunc
+	// cancels the current browse so the watcher starts a fresh one
+	refresh context.CancelFunc
+}
+
+var (
+	sharedDiscovery     *DacpDiscovery
+	sharedDiscoveryOnce sync.Once
+)
+
+// NewDacpDiscovery instantiates a new DacpDiscovery, it starts watching on first use
+func NewDacpDiscovery() *DacpDiscovery {
+	return newDacpDiscovery(browseDacp)
+}
+
+func newDacpDiscovery(browse dacpBrowser) *DacpDiscovery {
+	return &DacpDiscovery{remotes: make(map[string]cachedRemote), waiters: make(map[string][]chan dacpRemote), browse: browse}
+}
+
+// defaultDacpDiscovery returns the discovery shared by all the receivers of this node
+func defaultDacpDiscovery() *DacpDiscovery {
+	sharedDiscoveryOnce.Do(func() {
+		sharedDiscovery = NewDacpDiscovery()
+	})
+	return sharedDiscovery
+}
+
+// Resolve returns the address and port of the DACP service of the sender with the given id,
+// waiting up to the timeout for it to show up if it isn't known yet
+func (d *DacpDiscovery) Resolve(dacpID string, timeout time.Duration) (string, int, bool) {
+	remote, ok := d.resolve(dacpID, timeout)
+	return remote.ip, remote.port, ok
+}
+
+func (d *DacpDiscovery) resolve(dacpID string, timeout time.Duration) (dacpRemote, bool) {
+	d.lock.Lock()
+	if cached, ok := d.remotes[dacpID]; ok {
+		if time.Now().Before(cached.expires) {
+			d.lock.Unlock()
+			return cached.dacpRemote, true
+		}
+		// the sender may have gone, if not browsing again picks it up
+		delete(d.remotes, dacpID)
+		if d.refresh != nil {
+			d.refresh()
+		}
+	}
+	d.startLocked()
+	found := make(chan dacpRemote, 1)
+	d.waiters[dacpID] = append(d.waiters[dacpID], found)
+	d.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case remote := <-found:
+		return remote, true
+	case <-timer.C:
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		waiters := d.waiters[dacpID]
+		for i, w := range waiters {
+			if w == found {
+				d.waiters[dacpID] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(d.waiters[dacpID]) == 0 {
+			delete(d.waiters, dacpID)
+		}
+		// it may have come in just as we timed out
+		select {
+		case remote := <-found:
+			return remote, true
+		default:
+			return dacpRemote{}, false
+		}
+	}
+}
+
+// Forget drops the cached remote for the sender, i.e: because it could not be reached,
+// and browses again so it is picked up if it is back under a new address
+func (d *DacpDiscovery) Forget(dacpID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.remotes, dacpID)
+	// mDNS only reports a service once per browse, so to learn about a service
+	// that moved we need to start over
+	if d.refresh != nil {
+		d.refresh()
+	}
+}
+
+// Stop stops watching for DACP services
+func (d *DacpDiscovery) Stop() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopped = true
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+func (d *DacpDiscovery) startLocked() {
+	if d.started || d.stopped {
+		return
+	}
+	d.started = true
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	go d.watch(ctx)
+}
+
+// watch keeps browsing for DACP services until stopped, browsing again when mDNS fails
+func (d *DacpDiscovery) watch(ctx context.Context) {
+	for {
+		browseCtx, refresh := context.WithCancel(ctx)
+		d.lock.Lock()
+		d.refresh = refresh
+		d.lock.Unlock()
+		err := d.browse(browseCtx, d.add)
+		refreshed := browseCtx.Err() != nil
+		refresh()
+		if ctx.Err() != nil {
+			return
+		}
+		if refreshed {
+			continue
+		}
+		log.Println("Browsing for DACP services failed, retrying:", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dacpBrowseRetry):
+		}
+	}
+}
+
+func (d *DacpDiscovery) add(dacpID string, remote dacpRemote, ttl time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	if current, ok := d.remotes[dacpID]; !ok || current.dacpRemote != remote {
+		log.Printf("Found DACP service for %s at %s:%d\n", dacpID, remote.ip, remote.port)
+	}
+	// senders come and go, the services of the ones gone are dropped as we go
+	for id, cached := range d.remotes {
+		if !now.Before(cached.expires) {
+			delete(d.remotes, id)
+		}
+	}
+	d.remotes[dacpID] = cachedRemote{dacpRemote: remote, expires: now.Add(ttl)}
+	for _, waiter := range d.waiters[dacpID] {
+		waiter <- remote
+	}
+	delete(d.waiters, dacpID)
+}
+
+// browseDacp browses mDNS for DACP services
+func browseDacp(ctx context.Context, found func(dacpID string, remote dacpRemote, ttl time.Duration)) error {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return err
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	err = resolver.Browse(ctx, dacpServiceType, "local", entries)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case entry, ok := <-entries:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return errors.New("mDNS browsing stopped")
+			}
+			if !strings.HasPrefix(entry.Instance, dacpInstancePrefix) {
+				continue
+			}
+			// there is an issue, https://github.com/grandcat/zeroconf/issues/27 where we
+			// could get an entry back without an address, it will come in later as an update
+			var ip string
+			if len(entry.AddrIPv4) > 0 {
+				ip = entry.AddrIPv4[0].String()
+			} else if len(entry.AddrIPv6) > 0 {
+				ip = entry.AddrIPv6[0].String()
+			} else {
+				continue
+			}
+			ttl := time.Duration(entry.TTL) * time.Second
+			found(strings.TrimPrefix(entry.Instance, dacpInstancePrefix), dacpRemote{ip: ip, port: entry.Port}, ttl)
+		}
+	}
+}
+
+// discoverDacpClient finds the DACP client of the session, for player control
+func (a *AirplayServer) discoverDacpClient(as *airplaySession) {
+	if as.dacpID == "" {
+		return
+	}
+	if a.resolveDacpClient(as, dacpDiscoverTimeout) == nil {
+		log.Printf("no dacp client found for %s, will not be able to control\n", as.dacpID)
+	}
+}
+
+// resolveDacpClient looks up the DACP service of the session's sender and sets the client
+// talking to it, nil is returned if the service didn't show up in time
+func (a *AirplayServer) resolveDacpClient(as *airplaySession, timeout time.Duration) *DacpClient {
+	if as.dacpID == "" {
+		return nil
+	}
+	ip, port, ok := a.dacpDiscovery.Resolve(as.dacpID, timeout)
+	if !ok {
+		return nil
+	}
+	client := newDacpClient(ip, port, as.dacpID, as.activeRemote)
+	as.setClient(client)
+	return client
+}
@@ -0,0 +1,93 @@
+package raop
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolveWaitsForService(t *testing.T) {
+	d := newDacpDiscovery(func(ctx context.Context, found func(dacpID string, remote dacpRemote, ttl time.Duration)) error {
+		time.Sleep(10 * time.Millisecond)
+		found("14413BE4996FEA4D", dacpRemote{ip: "10.0.0.2", port: 3689}, time.Minute)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer d.Stop()
+	ip, port, ok := d.Resolve("14413BE4996FEA4D", time.Second)
+	if !ok || ip != "10.0.0.2" || port != 3689 {
+		t.Error("Expected service to be resolved got:", ip, port, ok)
+	}
+	// resolved services are cached
+	ip, _, ok = d.Resolve("14413BE4996FEA4D", 0)
+	if !ok || ip != "10.0.0.2" {
+		t.Error("Expected cached service got:", ip, ok)
+	}
+	if _, _, ok := d.Resolve("AAAA", 20*time.Millisecond); ok {
+		t.Error("Expected unknown service not to resolve")
+	}
+}
+
+func TestForgetBrowsesAgain(t *testing.T) {
+	var browses int32
+	d := newDacpDiscovery(func(ctx context.Context, found func(dacpID string, remote dacpRemote, ttl time.Duration)) error {
+		n := atomic.AddInt32(&browses, 1)
+		// the sender comes back on another port
+		found("14413BE4996FEA4D", dacpRemote{ip: "10.0.0.2", port: 3689 + int(n)}, time.Minute)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer d.Stop()
+	_, port, ok := d.Resolve("14413BE4996FEA4D", time.Second)
+	if !ok || port != 3690 {
+		t.Error("Expected port 3690 got:", port, ok)
+	}
+	d.Forget("14413BE4996FEA4D")
+	_, port, ok = d.Resolve("14413BE4996FEA4D", time.Second)
+	if !ok || port != 3691 {
+		t.Error("Expected port 3691 after browsing again got:", port, ok)
+	}
+}
+
+func TestResolveDacpClientInBackground(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	a.dacpDiscovery = newDacpDiscovery(func(ctx context.Context, found func(dacpID string, remote dacpRemote, ttl time.Duration)) error {
+		found("14413BE4996FEA4D", dacpRemote{ip: "10.0.0.2", port: 3689}, time.Minute)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer a.dacpDiscovery.Stop()
+	as := newAirplaySession("10.0.0.2:5000", nil, nil)
+	as.dacpID = "14413BE4996FEA4D"
+	as.activeRemote = "1986535575"
+	a.discoverDacpClient(as)
+	client := as.getClient()
+	if client == nil || client.port != 3689 || client.activeRemote != "1986535575" {
+		t.Error("Expected DACP client to be set", client)
+	}
+}
+
+func TestExpiredServiceEvicted(t *testing.T) {
+	var browses int32
+	d := newDacpDiscovery(func(ctx context.Context, found func(dacpID string, remote dacpRemote, ttl time.Duration)) error {
+		n := atomic.AddInt32(&browses, 1)
+		if n == 1 {
+			// the sender is gone once its records expire
+			found("14413BE4996FEA4D", dacpRemote{ip: "10.0.0.2", port: 3689}, 20*time.Millisecond)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer d.Stop()
+	if _, _, ok := d.Resolve("14413BE4996FEA4D", time.Second); !ok {
+		t.Fatal("Expected service to be resolved")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := d.Resolve("14413BE4996FEA4D", 20*time.Millisecond); ok {
+		t.Error("Expected the expired service not to resolve")
+	}
+	if atomic.LoadInt32(&browses) < 2 {
+		t.Error("Expected browsing to start over once the service expired")
+	}
+}
@@ -0,0 +1,185 @@
+package raop
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Identity is what a receiver identifies itself to senders with. A receiver without a
+// hardware address of its own uses the MAC address of the interface the sender reached it on
+type Identity struct {
+	// PrivateKey signs Apple-Challenge responses and decrypts the stream keys senders send
+	PrivateKey *rsa.PrivateKey
+	// HardwareAddr is advertised as part of the service name and used in the Apple-Challenge
+	HardwareAddr net.HardwareAddr
+}
+
+var (
+	defaultPrivateKey     *rsa.PrivateKey
+	defaultPrivateKeyErr  error
+	defaultPrivateKeyOnce sync.Once
+)
+
+// DefaultPrivateKey returns the well known AirPort Express key senders expect
+func DefaultPrivateKey() (*rsa.PrivateKey, error) {
+	defaultPrivateKeyOnce.Do(func() {
+		defaultPrivateKey, defaultPrivateKeyErr = parsePrivateKey([]byte(privateKey))
+	})
+	return defaultPrivateKey, defaultPrivateKeyErr
+}
+
+// LoadIdentity loads an identity from the given files, an empty path leaves that part
+// of the identity at its default
+func LoadIdentity(privateKeyFile string, identityFile string) (*Identity, error) {
+	identity := &Identity{}
+	var err error
+	if privateKeyFile == "" {
+		identity.PrivateKey, err = DefaultPrivateKey()
+	} else {
+		identity.PrivateKey, err = LoadPrivateKey(privateKeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if identityFile != "" {
+		identity.HardwareAddr, err = LoadHardwareAddr(identityFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+// LoadPrivateKey loads a PEM encoded RSA private key, in PKCS #1 or PKCS #8 form
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// LoadHardwareAddr loads the MAC address a receiver identifies itself with from a file
+// holding just the address, i.e: 02:0c:29:3e:5b:a1
+func LoadHardwareAddr(path string) (net.HardwareAddr, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ParseMAC(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hardware address in %s: %w", path, err)
+	}
+	if len(addr) != 6 {
+		return nil, fmt.Errorf("invalid hardware address in %s: must be 6 bytes", path)
+	}
+	return addr, nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// hostInterface is a network interface of the host along with its addresses
+type hostInterface struct {
+	iface net.Interface
+	addrs []net.Addr
+}
+
+// listInterfaces lists the network interfaces of the host, swapped out in tests
+var listInterfaces = func() ([]hostInterface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	hostInterfaces := make([]hostInterface, 0, len(interfaces))
+	for _, i := range interfaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		hostInterfaces = append(hostInterfaces, hostInterface{iface: i, addrs: addrs})
+	}
+	return hostInterfaces, nil
+}
+
+// usable returns whether the interface is one senders can reach us on, and has a MAC address to identify with
+func (hi hostInterface) usable() bool {
+	return hi.iface.Flags&net.FlagUp != 0 && hi.iface.Flags&net.FlagLoopback == 0 && len(hi.iface.HardwareAddr) == 6
+}
+
+func (hi hostInterface) hasIP(ip net.IP) bool {
+	for _, addr := range hi.addrs {
+		var ifaceIP net.IP
+		switch a := addr.(type) {
+		case *net.IPNet:
+			ifaceIP = a.IP
+		case *net.IPAddr:
+			ifaceIP = a.IP
+		}
+		if ifaceIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceHardwareAddr returns the MAC address of the interface owning the given local address,
+// falling back to the one of the first usable interface if no interface owns it
+func interfaceHardwareAddr(localAddress string) net.HardwareAddr {
+	interfaces, err := listInterfaces()
+	if err != nil {
+		return nil
+	}
+	// link local IPv6 addresses may carry the zone
+	ip := net.ParseIP(strings.SplitN(localAddress, "%", 2)[0])
+	if ip != nil {
+		for _, hi := range interfaces {
+			if hi.usable() && hi.hasIP(ip) {
+				return hi.iface.HardwareAddr
+			}
+		}
+	}
+	for _, hi := range interfaces {
+		if hi.usable() {
+			return hi.iface.HardwareAddr
+		}
+	}
+	return nil
+}
+
+// virtualHardwareAddr derives a stable, locally administered, address from the real one
+func virtualHardwareAddr(base net.HardwareAddr, index int) net.HardwareAddr {
+	addr := make(net.HardwareAddr, 6)
+	copy(addr, base)
+	addr[0] |= 0x02
+	addr[len(addr)-1] ^= byte(index)
+	addr[len(addr)-2] ^= byte(index >> 8)
+	return addr
+}
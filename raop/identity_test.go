@@ -0,0 +1,130 @@
+package raop
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fakeInterfaces(t *testing.T) {
+	eth0, _ := net.ParseMAC("54:52:00:b8:58:77")
+	docker0, _ := net.ParseMAC("02:42:ac:11:00:01")
+	interfaces := []hostInterface{
+		{iface: net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			addrs: []net.Addr{&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)}}},
+		{iface: net.Interface{Name: "docker0", Flags: net.FlagUp | net.FlagMulticast, HardwareAddr: docker0},
+			addrs: []net.Addr{&net.IPNet{IP: net.ParseIP("172.17.0.1"), Mask: net.CIDRMask(16, 32)}}},
+		{iface: net.Interface{Name: "eth0", Flags: net.FlagUp | net.FlagMulticast, HardwareAddr: eth0},
+			addrs: []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.0.15"), Mask: net.CIDRMask(24, 32)},
+				&net.IPNet{IP: net.ParseIP("fe80::5652:ff:feb8:5877"), Mask: net.CIDRMask(64, 128)}}},
+	}
+	original := listInterfaces
+	listInterfaces = func() ([]hostInterface, error) { return interfaces, nil }
+	t.Cleanup(func() { listInterfaces = original })
+}
+
+func TestInterfaceHardwareAddr(t *testing.T) {
+	fakeInterfaces(t)
+	tests := map[string]string{
+		"192.168.0.15":                 "54:52:00:b8:58:77",
+		"fe80::5652:ff:feb8:5877%eth0": "54:52:00:b8:58:77",
+		"172.17.0.1":                   "02:42:ac:11:00:01",
+		// not ours, falls back to the first usable interface
+		"10.0.0.1": "02:42:ac:11:00:01",
+		"":         "02:42:ac:11:00:01",
+	}
+	for localAddress, expected := range tests {
+		if addr := interfaceHardwareAddr(localAddress); addr.String() != expected {
+			t.Errorf("Expected %s for %s got: %s", expected, localAddress, addr)
+		}
+	}
+}
+
+func TestHardwareAddrFor(t *testing.T) {
+	fakeInterfaces(t)
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	if addr := a.hardwareAddrFor("192.168.0.15"); addr.String() != "54:52:00:b8:58:77" {
+		t.Error("Expected the MAC of the interface owning the address got:", addr)
+	}
+	a.SetHardwareAddrIndex(1)
+	eth0, _ := net.ParseMAC("54:52:00:b8:58:77")
+	if addr := a.hardwareAddrFor("192.168.0.15"); addr.String() != virtualHardwareAddr(eth0, 1).String() {
+		t.Error("Expected an address derived from the interface's got:", addr)
+	}
+	fixed, _ := net.ParseMAC("02:0c:29:3e:5b:a1")
+	a.SetIdentity(&Identity{HardwareAddr: fixed})
+	if addr := a.hardwareAddrFor("192.168.0.15"); addr.String() != fixed.String() {
+		t.Error("Expected the configured MAC got:", addr)
+	}
+	if a.privateKey == nil {
+		t.Error("Expected the default key to be kept")
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(dir, "identity")
+	err = os.WriteFile(identityFile, []byte("02:0c:29:3e:5b:a1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := LoadIdentity(keyFile, identityFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identity.PrivateKey.Equal(key) {
+		t.Error("Expected the key from the file")
+	}
+	if identity.HardwareAddr.String() != "02:0c:29:3e:5b:a1" {
+		t.Error("Expected the MAC from the file got:", identity.HardwareAddr)
+	}
+
+	identity, err = LoadIdentity("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultKey, _ := DefaultPrivateKey()
+	if !identity.PrivateKey.Equal(defaultKey) || identity.HardwareAddr != nil {
+		t.Error("Expected the default identity")
+	}
+
+	if _, err := LoadIdentity(identityFile, ""); err == nil {
+		t.Error("Expected error for a key file without a key")
+	}
+	if _, err := LoadIdentity("", keyFile); err == nil {
+		t.Error("Expected error for an identity file without a MAC")
+	}
+}
+
+func TestVirtualHardwareAddr(t *testing.T) {
+	base := net.HardwareAddr{0xa4, 0xd1, 0xd2, 0x80, 0x0b, 0x68}
+	first := virtualHardwareAddr(base, 1)
+	second := virtualHardwareAddr(base, 2)
+	if first.String() == base.String() || first.String() == second.String() {
+		t.Error("Expected distinct addresses", base, first, second)
+	}
+	if first[0]&0x02 == 0 {
+		t.Error("Expected a locally administered address", first)
+	}
+	if virtualHardwareAddr(base, 1).String() != first.String() {
+		t.Error("Expected derived address to be stable")
+	}
+}
@@ -0,0 +1,164 @@
+package raop
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ibiscum/bobcaygeon/player"
+	"github.com/ibiscum/bobcaygeon/rtsp"
+	"github.com/ibiscum/bobcaygeon/sdp"
+)
+
+// the most, in seconds, we expect senders to be ahead of playback
+const maxProgressLead = 10
+
+// SessionInfo describes a session in progress, for inspecting who is streaming
+type SessionInfo struct {
+	ID            string
+	RemoteAddress string
+	DacpID        string
+	UserAgent     string
+	Codec         string
+	Encrypted     bool
+	// Streaming is true once the sender started sending audio (RECORD)
+	Streaming bool
+	Started   time.Time
+	Stats     rtsp.SessionStats
+}
+
+// Sessions returns the sessions in progress, oldest first
+func (a *AirplayServer) Sessions() []SessionInfo {
+	var infos []SessionInfo
+	for _, as := range a.sessions.getSessions() {
+		infos = append(infos, SessionInfo{
+			ID:            as.session.ID,
+			RemoteAddress: as.conn,
+			DacpID:        as.dacpID,
+			UserAgent:     as.userAgent,
+			Codec:         codecName(as.session.Description),
+			Encrypted:     as.session.Encrypted(),
+			Streaming:     as.getState() == recording,
+			Started:       as.started,
+			Stats:         as.session.Stats(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// CloseSession kicks the sender of the session with the given id; the sender is told to stop
+// and its connection is closed
+func (a *AirplayServer) CloseSession(id string) error {
+	for _, as := range a.sessions.getSessions() {
+		if as.session.ID != id {
+			continue
+		}
+		log.Printf("Kicking session %s from %s\n", id, as.conn)
+		a.endSession(as.conn, true)
+		if rtspServer := a.server(); rtspServer != nil {
+			rtspServer.CloseConnection(as.conn)
+		}
+		return nil
+	}
+	return fmt.Errorf("no session with id: %s", id)
+}
+
+// codecName returns the encoding name from the rtpmap attribute, i.e: AppleLossless for "96 AppleLossless"
+func codecName(description *sdp.SessionDescription) string {
+	if description == nil {
+		return ""
+	}
+	rtpmap, _ := description.RtpMap()
+	return rtpmap.EncodingName
+}
+
+// parseProgress parses a progress parameter: "progress: start/current/end", as RTP timestamps
+func parseProgress(body string) (player.Progress, error) {
+	for _, line := range strings.Split(body, "\n") {
+		name, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(name) != "progress" {
+			continue
+		}
+		parts := strings.Split(strings.TrimSpace(value), "/")
+		if len(parts) != 3 {
+			return player.Progress{}, fmt.Errorf("expected start/current/end, got: %s", value)
+		}
+		var timestamps [3]uint32
+		for i, part := range parts {
+			ts, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return player.Progress{}, err
+			}
+			timestamps[i] = uint32(ts)
+		}
+		return player.Progress{Start: timestamps[0], Current: timestamps[1], End: timestamps[2]}, nil
+	}
+	return player.Progress{}, errors.New("no progress parameter")
+}
+
+// setProgress records the progress for the session of the connection and passes it on to the player
+func (a *AirplayServer) setProgress(conn string, progress player.Progress) {
+	as := a.sessions.getSession(conn)
+	if as != nil {
+		progress.SampleRate = sampleRate(as.session.Description)
+		as.progressLock.Lock()
+		as.progress = &progress
+		as.progressLead = 0
+		// the sender sends audio ahead of what is playing, remember by how much so the
+		// timestamps of the audio we receive tell us where playback is from now on
+		if rtpTime, ok := as.session.RTPTime(); ok && rtpTime-progress.Current < uint32(progress.SampleRate*maxProgressLead) {
+			as.progressLead = rtpTime - progress.Current
+		}
+		as.progressLock.Unlock()
+	}
+	log.Printf("Progress: %s of %s\n", progress.Position().Round(time.Second), progress.Duration().Round(time.Second))
+	a.player.SetProgress(progress)
+}
+
+// Progress returns where playback is in the current track, going by the audio the sender is streaming
+func (a *AirplayServer) Progress() (player.Progress, bool) {
+	for _, as := range a.sessions.getSessions() {
+		as.progressLock.RLock()
+		progress, lead := as.progress, as.progressLead
+		as.progressLock.RUnlock()
+		if progress == nil {
+			continue
+		}
+		if rtpTime, ok := as.session.RTPTime(); ok && as.getState() == recording {
+			return progress.At(rtpTime - lead), true
+		}
+		return *progress, true
+	}
+	return player.Progress{}, false
+}
+
+// sampleRate returns the rate of the RTP clock of the stream, from the fmtp attribute for
+// ALAC or the rtpmap one for other codecs, i.e: 96 mpeg4-generic/44100/2
+func sampleRate(description *sdp.SessionDescription) int {
+	if description == nil {
+		return player.DefaultSampleRate
+	}
+	rtpmap, ok := description.RtpMap()
+	if !ok {
+		return player.DefaultSampleRate
+	}
+	if rtpmap.EncodingName == "AppleLossless" {
+		if fmtp, ok := description.Fmtp(); ok {
+			if config, err := sdp.ParseALACConfig(fmtp.Parameters); err == nil && config.SampleRate > 0 {
+				return int(config.SampleRate)
+			}
+		}
+		return player.DefaultSampleRate
+	}
+	if rtpmap.ClockRate > 0 {
+		return rtpmap.ClockRate
+	}
+	return player.DefaultSampleRate
+}
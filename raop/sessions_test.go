@@ -0,0 +1,151 @@
+package raop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ibiscum/bobcaygeon/rtsp"
+	"github.com/ibiscum/bobcaygeon/sdp"
+)
+
+func TestListSessions(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	description := sdp.NewSessionDescription()
+	description.Attributes.Set("rtpmap", "96 AppleLossless")
+	s := rtsp.NewSession(description, nil)
+	s.ID = "ABCDEF"
+	as := newAirplaySession("10.0.0.2:5000", s, nil)
+	as.dacpID = "14413BE4996FEA4D"
+	as.userAgent = "iTunes/12.5.1"
+	a.sessions.addSession(as.conn, as)
+
+	sessions := a.Sessions()
+	if len(sessions) != 1 {
+		t.Fatal("Expected 1 session got:", len(sessions))
+	}
+	info := sessions[0]
+	if info.ID != "ABCDEF" || info.RemoteAddress != "10.0.0.2:5000" || info.DacpID != "14413BE4996FEA4D" || info.UserAgent != "iTunes/12.5.1" {
+		t.Error("Unexpected session info", info)
+	}
+	if info.Codec != "AppleLossless" {
+		t.Error("Expected AppleLossless got:", info.Codec)
+	}
+	if info.Encrypted || info.Streaming {
+		t.Error("Expected unencrypted session that is not streaming yet", info)
+	}
+}
+
+func TestListSessionsWhileRecording(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	as := newAirplaySession("10.0.0.2:5000", s, nil)
+	a.sessions.addSession(as.conn, as)
+	// the node status is put together on another goroutine than the handshake's
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			a.Sessions()
+		}
+	}()
+	as.setState(ready)
+	as.setState(recording)
+	<-done
+	if !a.Sessions()[0].Streaming {
+		t.Error("Expected the session to be streaming")
+	}
+}
+
+func TestCloseSession(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	s.ID = "ABCDEF"
+	a.sessions.addSession("10.0.0.2:5000", newAirplaySession("10.0.0.2:5000", s, nil))
+	if err := a.CloseSession("123456"); err == nil {
+		t.Error("Expected error closing unknown session")
+	}
+	if err := a.CloseSession("ABCDEF"); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if len(a.Sessions()) != 0 {
+		t.Error("Expected session to be removed")
+	}
+}
+
+func TestCloseSessionAsSenderDisconnects(t *testing.T) {
+	a := NewAirplayServer(444, "Test", &FakePlayer{})
+	s := rtsp.NewSession(sdp.NewSessionDescription(), nil)
+	s.ID = "ABCDEF"
+	s.UseInterleaved(0, nil)
+	if err := s.StartReceiving(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	a.sessions.addSession("10.0.0.2:5000", newAirplaySession("10.0.0.2:5000", s, nil))
+	// the sender is kicked while it drops the connection, the session is closed once
+	kicked := make(chan error)
+	go func() {
+		kicked <- a.CloseSession("ABCDEF")
+	}()
+	a.closeSession("10.0.0.2:5000")
+	<-kicked
+	if len(a.Sessions()) != 0 {
+		t.Error("Expected session to be removed")
+	}
+}
+
+func TestCodecName(t *testing.T) {
+	description := sdp.NewSessionDescription()
+	description.Attributes.Set("rtpmap", "96 mpeg4-generic/44100/2")
+	if codecName(description) != "mpeg4-generic" {
+		t.Error("Expected mpeg4-generic got:", codecName(description))
+	}
+}
+
+func TestProgressFromSetParameter(t *testing.T) {
+	fp := &FakePlayer{}
+	a := NewAirplayServer(444, "Test", fp)
+	description := sdp.NewSessionDescription()
+	description.Attributes.Set("rtpmap", "96 AppleLossless")
+	description.Attributes.Set("fmtp", "96 352 0 16 40 10 14 2 255 0 0 44100")
+	s := rtsp.NewSession(description, nil)
+	as := newAirplaySession("10.0.0.2:5000", s, nil)
+	as.setState(ready)
+	a.sessions.addSession(as.conn, as)
+
+	req := rtsp.NewRequest()
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Headers["Content-Type"] = "text/parameters"
+	req.Body = []byte("progress: 1000/442000/13231000\r\n")
+	resp := rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.2")
+	if resp.Status != rtsp.Ok {
+		t.Fatal("Expected OK got:", resp.Status.String())
+	}
+	if fp.progress.Position() != 10*time.Second || fp.progress.Duration() != 300*time.Second {
+		t.Error("Unexpected progress passed to the player", fp.progress)
+	}
+	progress, ok := a.Progress()
+	if !ok || progress.Position() != 10*time.Second {
+		t.Error("Expected position of 10s got:", progress.Position(), ok)
+	}
+
+	req.Body = []byte("progress: 1000/abc/13231000\r\n")
+	resp = rtsp.NewResponse()
+	a.handlSetParameter(req, resp, "192.168.0.15", "10.0.0.2")
+	if resp.Status != rtsp.BadRequest {
+		t.Error("Expected bad request for a malformed progress got:", resp.Status.String())
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	description := sdp.NewSessionDescription()
+	description.Attributes.Set("rtpmap", "96 mpeg4-generic/48000/2")
+	if sampleRate(description) != 48000 {
+		t.Error("Expected 48000 got:", sampleRate(description))
+	}
+	description.Attributes.Set("rtpmap", "96 AppleLossless")
+	description.Attributes.Set("fmtp", "96 352 0 16 40 10 14 2 255 0 0 44100")
+	if sampleRate(description) != 44100 {
+		t.Error("Expected 44100 got:", sampleRate(description))
+	}
+}
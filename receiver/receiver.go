@@ -0,0 +1,285 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ibiscum/bobcaygeon/cluster"
+	"github.com/ibiscum/bobcaygeon/player/forwarding"
+	"github.com/ibiscum/bobcaygeon/raop"
+	"github.com/ibiscum/bobcaygeon/rtsp"
+)
+
+// DefaultID is the id of the receiver configured in the [rtsp] section of the node config
+const DefaultID = cluster.DefaultReceiverID
+
+// Config describes a (virtual) AirPlay receiver hosted by a node
+type Config struct {
+	ID        string `toml:"id"`
+	Name      string `toml:"name"`
+	Port      int    `toml:"port"`
+	Password  string `toml:"password"`
+	Transport string `toml:"transport"`
+	// ForwardPassword is the password of the nodes the receiver forwards to, Password when not set
+	ForwardPassword string `toml:"forward-password"`
+	// Arbitration is what happens when another sender wants to stream: preempt, reject or idle
+	Arbitration string `toml:"arbitration"`
+	// IdleTimeout is how many seconds a session must be idle before it can be preempted, for the idle policy
+	IdleTimeout int `toml:"idle-timeout"`
+	// PrivateKeyFile is a PEM encoded RSA key to use instead of the AirPort Express one
+	PrivateKeyFile string `toml:"private-key-file"`
+	// IdentityFile holds the MAC address to identify with instead of the one of the interface senders reach us on
+	IdentityFile string `toml:"identity-file"`
+}
+
+// Receiver is a single AirPlay target; its RTSP server and the player it feeds,
+// which in turn forwards to its own set of nodes
+type Receiver struct {
+	ID            string
+	AirplayServer *raop.AirplayServer
+	Player        *forwarding.Player
+	transport     rtsp.Transport
+}
+
+// New instantiates a new receiver from the given config, the index tells receivers on
+// the same host apart so each can be given its own hardware address
+func New(config Config, index int) (*Receiver, error) {
+	if strings.TrimSpace(config.Name) == "" {
+		return nil, errors.New("receiver name must be non-empty")
+	}
+	if config.Port <= 0 {
+		return nil, fmt.Errorf("invalid port for receiver %s: %d", config.Name, config.Port)
+	}
+	transport, err := rtsp.ParseTransport(config.Transport)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := raop.ParseArbitrationPolicy(config.Arbitration)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := raop.LoadIdentity(config.PrivateKeyFile, config.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	id := config.ID
+	if id == "" {
+		id = config.Name
+	}
+	forwardingPlayer, err := forwarding.NewPlayer()
+	if err != nil {
+		return nil, err
+	}
+	forwardPassword := config.ForwardPassword
+	if forwardPassword == "" {
+		forwardPassword = config.Password
+	}
+	forwardingPlayer.SetPassword(forwardPassword)
+	forwardingPlayer.SetTransport(transport)
+
+	airplayServer := raop.NewAirplayServer(config.Port, config.Name, forwardingPlayer)
+	airplayServer.SetPassword(config.Password)
+	airplayServer.SetArbitrationPolicy(policy, time.Duration(config.IdleTimeout)*time.Second)
+	airplayServer.SetIdentity(identity)
+	airplayServer.SetHardwareAddrIndex(index)
+	return &Receiver{ID: id, AirplayServer: airplayServer, Player: forwardingPlayer, transport: transport}, nil
+}
+
+// Start starts the receiver, returning once it listens, or with the error it can't listen with
+func (r *Receiver) Start(verbose bool, advertise bool) error {
+	return r.AirplayServer.Start(verbose, advertise)
+}
+
+// Stop stops the receiver, ending any session and dropping the nodes it forwards to
+func (r *Receiver) Stop() {
+	r.AirplayServer.Stop()
+	r.Player.RemoveAllSessions()
+}
+
+// Status returns what the receiver is doing, for sharing with the other nodes
+func (r *Receiver) Status() cluster.ReceiverStatus {
+	status := cluster.ReceiverStatus{
+		ID:           r.ID,
+		TrackID:      r.Player.GetTrack().PersistentID,
+		Volume:       r.Player.GetVolume(),
+		Muted:        r.Player.GetIsMuted(),
+		ForwardingTo: r.Player.ForwardingTo(),
+	}
+	// sessions come oldest first, the latest one streaming is the one we play
+	for _, session := range r.AirplayServer.Sessions() {
+		if session.Streaming {
+			status.Playing = true
+			status.Sender = session.RemoteAddress
+		}
+	}
+	return status
+}
+
+// Transport returns the transport the receiver prefers when forwarding
+func (r *Receiver) Transport() rtsp.Transport {
+	return r.transport
+}
+
+// Registry keeps track of the receivers hosted by this node
+type Registry struct {
+	sync.RWMutex
+	receivers map[string]*Receiver
+	defaultID string
+	// next index handed out for deriving hardware addresses, never reused
+	// so a removed and re-added receiver doesn't take over another's identity
+	nextIndex int
+	verbose   bool
+	// events the players of the receivers publish to, if set
+	events *cluster.EventBus
+	// tells the nodes of the cluster, let in by every receiver, apart
+	isMember func(address string) bool
+}
+
+// NewRegistry instantiates a new Registry
+func NewRegistry(verbose bool) *Registry {
+	return &Registry{receivers: make(map[string]*Receiver), verbose: verbose}
+}
+
+// SetEvents sets the event bus the players of receivers added from now on publish to
+func (r *Registry) SetEvents(events *cluster.EventBus) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = events
+}
+
+// SetMemberCheck sets how the receivers, the ones added from now on as well, tell whether
+// a remote address is the one of a node of the cluster; the nodes are let in whatever
+// the access rules of the receivers, as the leader forwards to them
+func (r *Registry) SetMemberCheck(isMember func(address string) bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.isMember = isMember
+	for _, rcv := range r.receivers {
+		rcv.AirplayServer.SetMemberCheck(isMember)
+	}
+}
+
+// Add creates a receiver and adds it to the registry, without starting it. The first receiver
+// added becomes the default one, used when no receiver id is given
+func (r *Registry) Add(config Config) (*Receiver, error) {
+	r.Lock()
+	defer r.Unlock()
+	id := config.ID
+	if id == "" {
+		id = config.Name
+	}
+	if _, exists := r.receivers[id]; exists {
+		return nil, fmt.Errorf("receiver already exists: %s", id)
+	}
+	for _, existing := range r.receivers {
+		if existing.AirplayServer.Port() == config.Port {
+			return nil, fmt.Errorf("port %d already in use by receiver %s", config.Port, existing.ID)
+		}
+	}
+	rcv, err := New(config, r.nextIndex)
+	if err != nil {
+		return nil, err
+	}
+	r.nextIndex++
+	if r.events != nil {
+		rcv.Player.SetEvents(r.events, rcv.ID)
+	}
+	if r.isMember != nil {
+		rcv.AirplayServer.SetMemberCheck(r.isMember)
+	}
+	r.receivers[rcv.ID] = rcv
+	if r.defaultID == "" {
+		r.defaultID = rcv.ID
+	}
+	return rcv, nil
+}
+
+// Create adds a receiver and starts it, advertising it right away. It is used for the receivers
+// added on the fly, which have no part in the cluster leader/follower arrangement
+func (r *Registry) Create(config Config) (*Receiver, error) {
+	rcv, err := r.Add(config)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Starting receiver %s (%s) on port %d\n", rcv.ID, rcv.AirplayServer.Name(), rcv.AirplayServer.Port())
+	err = rcv.Start(r.verbose, true)
+	if err != nil {
+		// i.e: something else listens on the port
+		r.Lock()
+		delete(r.receivers, rcv.ID)
+		if r.defaultID == rcv.ID {
+			r.defaultID = ""
+		}
+		r.Unlock()
+		return nil, err
+	}
+	return rcv, nil
+}
+
+// Remove stops the receiver and removes it from the registry, the default receiver can't be removed
+func (r *Registry) Remove(id string) error {
+	r.Lock()
+	rcv, exists := r.receivers[id]
+	if !exists {
+		r.Unlock()
+		return fmt.Errorf("no receiver with id: %s", id)
+	}
+	if id == r.defaultID {
+		r.Unlock()
+		return errors.New("the default receiver can't be removed")
+	}
+	delete(r.receivers, id)
+	r.Unlock()
+	rcv.Stop()
+	return nil
+}
+
+// Get returns the receiver with the given id, or the default receiver if the id is empty
+func (r *Registry) Get(id string) *Receiver {
+	r.RLock()
+	defer r.RUnlock()
+	if id == "" {
+		id = r.defaultID
+	}
+	return r.receivers[id]
+}
+
+// Default returns the default receiver
+func (r *Registry) Default() *Receiver {
+	return r.Get("")
+}
+
+// List returns all receivers, ordered by port
+func (r *Registry) List() []*Receiver {
+	r.RLock()
+	defer r.RUnlock()
+	receivers := make([]*Receiver, 0, len(r.receivers))
+	for _, rcv := range r.receivers {
+		receivers = append(receivers, rcv)
+	}
+	sort.Slice(receivers, func(i, j int) bool {
+		return receivers[i].AirplayServer.Port() < receivers[j].AirplayServer.Port()
+	})
+	return receivers
+}
+
+// Status returns what every receiver is doing
+func (r *Registry) Status() []cluster.ReceiverStatus {
+	var statuses []cluster.ReceiverStatus
+	for _, rcv := range r.List() {
+		statuses = append(statuses, rcv.Status())
+	}
+	return statuses
+}
+
+// StopAll stops every receiver
+func (r *Registry) StopAll() {
+	for _, rcv := range r.List() {
+		rcv.Stop()
+	}
+}
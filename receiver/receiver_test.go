@@ -0,0 +1,115 @@
+package receiver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRegistryDefault(t *testing.T) {
+	r := NewRegistry(false)
+	_, err := r.Add(Config{ID: DefaultID, Name: "Bobcaygeon", Port: 5000})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	_, err = r.Add(Config{Name: "Kitchen", Port: 5001})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if r.Get("").ID != DefaultID {
+		t.Error("Expected empty id to return the default receiver")
+	}
+	if r.Get("Kitchen") == nil {
+		t.Error("Expected receiver to be identified by name when no id is given")
+	}
+	if len(r.List()) != 2 {
+		t.Error("Expected 2 receivers got:", len(r.List()))
+	}
+	err = r.Remove(DefaultID)
+	if err == nil {
+		t.Error("Expected error removing the default receiver")
+	}
+}
+
+func TestRegistryRejectsDuplicates(t *testing.T) {
+	r := NewRegistry(false)
+	_, err := r.Add(Config{ID: "a", Name: "A", Port: 5000})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	_, err = r.Add(Config{ID: "a", Name: "B", Port: 5001})
+	if err == nil {
+		t.Error("Expected error adding a receiver with an existing id")
+	}
+	_, err = r.Add(Config{ID: "b", Name: "B", Port: 5000})
+	if err == nil {
+		t.Error("Expected error adding a receiver with an existing port")
+	}
+	_, err = r.Add(Config{ID: "c", Name: "C", Port: 5002, Transport: "carrier-pigeon"})
+	if err == nil {
+		t.Error("Expected error adding a receiver with an unknown transport")
+	}
+}
+
+func TestRegistryStatus(t *testing.T) {
+	r := NewRegistry(false)
+	kitchen, err := r.Add(Config{ID: "kitchen", Name: "Kitchen", Port: 5001})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	_, err = r.Add(Config{ID: DefaultID, Name: "Bobcaygeon", Port: 5000})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	kitchen.Player.SetMute(true)
+	statuses := r.Status()
+	if len(statuses) != 2 {
+		t.Fatal("Expected 2 statuses got:", len(statuses))
+	}
+	// in port order, like List
+	if statuses[0].ID != DefaultID || statuses[1].ID != "kitchen" {
+		t.Errorf("Unexpected statuses %+v", statuses)
+	}
+	if statuses[0].Muted || !statuses[1].Muted || statuses[1].Volume != 1 {
+		t.Errorf("Unexpected statuses %+v", statuses)
+	}
+	if statuses[1].Playing || statuses[1].Sender != "" || len(statuses[1].ForwardingTo) != 0 {
+		t.Errorf("Expected an idle receiver got: %+v", statuses[1])
+	}
+}
+
+func TestRegistryCreateOnPortInUse(t *testing.T) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer lis.Close()
+	r := NewRegistry(false)
+	_, err = r.Add(Config{ID: DefaultID, Name: "Bobcaygeon", Port: 5000})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	_, err = r.Create(Config{ID: "kitchen", Name: "Kitchen", Port: lis.Addr().(*net.TCPAddr).Port})
+	if err == nil {
+		t.Fatal("Expected an error for a port in use")
+	}
+	if r.Get("kitchen") != nil {
+		t.Error("Expected the receiver not to be kept")
+	}
+}
+
+func TestRegistryRemoveNeverStarted(t *testing.T) {
+	r := NewRegistry(false)
+	_, err := r.Add(Config{ID: DefaultID, Name: "Bobcaygeon", Port: 5000})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	_, err = r.Add(Config{ID: "kitchen", Name: "Kitchen", Port: 5001})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// stopping a receiver that never started must not panic
+	err = r.Remove("kitchen")
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
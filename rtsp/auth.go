@@ -0,0 +1,183 @@
+package rtsp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digest authentication as used by RAOP, which is a subset of: https://tools.ietf.org/html/rfc2617
+// no qop, the response is simply MD5(HA1:nonce:HA2)
+
+// nonceLifetime is how long a nonce stays valid once it was last used, senders are
+// challenged again with a stale nonce after that
+const nonceLifetime = 5 * time.Minute
+
+const (
+	// maxConnNonces is how many nonces a connection holds, a sender asking for more gets its
+	// oldest ones dropped
+	maxConnNonces = 4
+	// maxNonces bounds the nonces held across all connections
+	maxNonces = 1024
+)
+
+// issuedNonce is a nonce challenged with on a connection
+type issuedNonce struct {
+	remoteAddr string
+	expires    time.Time
+}
+
+// DigestAuthenticator validates the Authorization header of incoming requests. Every challenge
+// gets a fresh nonce, valid only on the connection it was issued on and until it expires, so
+// a captured Authorization header can't be replayed
+type DigestAuthenticator struct {
+	realm    string
+	password string
+	mu       sync.Mutex
+	nonces   map[string]issuedNonce
+}
+
+// NewDigestAuthenticator instantiates a new authenticator for the given realm and password
+func NewDigestAuthenticator(realm string, password string) *DigestAuthenticator {
+	return &DigestAuthenticator{realm: realm, password: password, nonces: make(map[string]issuedNonce)}
+}
+
+// Challenge returns the value for the WWW-Authenticate header sent to the unauthenticated request,
+// with a nonce for the connection it was received on
+func (d *DigestAuthenticator) Challenge(req *Request) string {
+	now := time.Now()
+	nonce := generateNonce()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// expired nonces are kept a while to tell senders their nonce went stale
+	for issued, n := range d.nonces {
+		if now.After(n.expires.Add(nonceLifetime)) {
+			delete(d.nonces, issued)
+		}
+	}
+	stale := d.check(req, now) == errStaleNonce
+	d.evictOldest(maxConnNonces, func(n issuedNonce) bool { return n.remoteAddr == req.RemoteAddr })
+	d.evictOldest(maxNonces, func(issuedNonce) bool { return true })
+	d.nonces[nonce] = issuedNonce{remoteAddr: req.RemoteAddr, expires: now.Add(nonceLifetime)}
+	if stale {
+		// the sender knows the password, it can answer without asking the user again
+		return fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\", stale=\"true\"", d.realm, nonce)
+	}
+	return fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\"", d.realm, nonce)
+}
+
+// evictOldest drops the least recently used of the nonces matching until there's room
+// for one more of them
+func (d *DigestAuthenticator) evictOldest(max int, matches func(issuedNonce) bool) {
+	for {
+		count := 0
+		oldest := ""
+		for nonce, n := range d.nonces {
+			if !matches(n) {
+				continue
+			}
+			count++
+			if oldest == "" || n.expires.Before(d.nonces[oldest].expires) {
+				oldest = nonce
+			}
+		}
+		if count < max {
+			return
+		}
+		delete(d.nonces, oldest)
+	}
+}
+
+// Authenticate returns true if the request carries valid credentials
+func (d *DigestAuthenticator) Authenticate(req *Request) bool {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.check(req, now) == nil
+}
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errStaleNonce         = errors.New("stale nonce")
+)
+
+// check checks the credentials of the request, extending the life of the nonce when they are valid
+func (d *DigestAuthenticator) check(req *Request, now time.Time) error {
+	authorization, ok := req.Headers["Authorization"]
+	if !ok {
+		return errInvalidCredentials
+	}
+	params, err := parseDigestParams(authorization)
+	if err != nil {
+		return errInvalidCredentials
+	}
+	nonce := params["nonce"]
+	issued, ok := d.nonces[nonce]
+	// the uri is part of the response, it has to be the one requested for the response to say anything about the request
+	if !ok || issued.remoteAddr != req.RemoteAddr || params["realm"] != d.realm || params["uri"] != req.RequestURI {
+		return errInvalidCredentials
+	}
+	expected := digestResponse(params["username"], d.realm, d.password, strings.ToUpper(req.Method.String()), req.RequestURI, nonce)
+	// some senders send the hash in upper case
+	if !strings.EqualFold(expected, params["response"]) {
+		return errInvalidCredentials
+	}
+	if now.After(issued.expires) {
+		return errStaleNonce
+	}
+	issued.expires = now.Add(nonceLifetime)
+	d.nonces[nonce] = issued
+	return nil
+}
+
+// digestAuthorization builds the Authorization header value answering the given challenge
+func digestAuthorization(challenge string, username string, password string, method Method, uri string) (string, error) {
+	params, err := parseDigestParams(challenge)
+	if err != nil {
+		return "", err
+	}
+	realm := params["realm"]
+	nonce := params["nonce"]
+	response := digestResponse(username, realm, password, strings.ToUpper(method.String()), uri, nonce)
+	return fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", username, realm, nonce, uri, response), nil
+}
+
+func digestResponse(username string, realm string, password string, method string, uri string, nonce string) string {
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", username, realm, password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+	return md5Hex(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+}
+
+// parseDigestParams parses a header of the form: Digest key="value", key2="value2"
+func parseDigestParams(header string) (map[string]string, error) {
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+		return nil, fmt.Errorf("not a digest header: %s", header)
+	}
+	params := make(map[string]string)
+	for _, part := range strings.Split(header[len("digest "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+	}
+	return params, nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateNonce() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read never returns an error on supported platforms
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,159 @@
+package rtsp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// announce builds an ANNOUNCE received on the connection from the given address
+func announce(remoteAddr string) *Request {
+	req := NewRequest()
+	req.Method = Announce
+	req.RequestURI = "rtsp://192.168.0.15/3413821438"
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+// authorize answers a challenge for the request with the given password
+func authorize(t *testing.T, auth *DigestAuthenticator, req *Request, password string) {
+	authorization, err := digestAuthorization(auth.Challenge(req), "iTunes", password, req.Method, req.RequestURI)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	req.Headers["Authorization"] = authorization
+}
+
+func TestAuthenticateNoHeader(t *testing.T) {
+	auth := NewDigestAuthenticator("raop", "secret")
+	if auth.Authenticate(announce("10.0.0.5:50123")) {
+		t.Error("Expected request without Authorization header to be rejected")
+	}
+}
+
+func TestAuthenticateValid(t *testing.T) {
+	auth := NewDigestAuthenticator("raop", "secret")
+	req := announce("10.0.0.5:50123")
+	authorize(t, auth, req, "secret")
+	if !auth.Authenticate(req) {
+		t.Error("Expected request to be authenticated")
+	}
+	// the nonce is good for the rest of the requests on the connection
+	if !auth.Authenticate(req) {
+		t.Error("Expected the nonce to be reusable on the same connection")
+	}
+}
+
+func TestAuthenticateWrongPassword(t *testing.T) {
+	auth := NewDigestAuthenticator("raop", "secret")
+	req := announce("10.0.0.5:50123")
+	authorize(t, auth, req, "guess")
+	if auth.Authenticate(req) {
+		t.Error("Expected request with wrong password to be rejected")
+	}
+}
+
+func TestAuthenticateReplayed(t *testing.T) {
+	auth := NewDigestAuthenticator("raop", "secret")
+	req := announce("10.0.0.5:50123")
+	authorize(t, auth, req, "secret")
+	replayed := announce("10.0.0.66:41000")
+	replayed.Headers["Authorization"] = req.Headers["Authorization"]
+	if auth.Authenticate(replayed) {
+		t.Error("Expected credentials replayed on another connection to be rejected")
+	}
+	// the response was computed for the ANNOUNCE uri
+	req.Method = Teardown
+	req.RequestURI = "rtsp://192.168.0.15/other"
+	if auth.Authenticate(req) {
+		t.Error("Expected credentials for another uri to be rejected")
+	}
+	// nonces we never issued are rejected
+	if auth.Authenticate(announceWithNonce("10.0.0.5:50123", "e0f8fc1fb1fa8fc5f1e1f1e1")) {
+		t.Error("Expected an unknown nonce to be rejected")
+	}
+}
+
+func TestAuthenticateStaleNonce(t *testing.T) {
+	auth := NewDigestAuthenticator("raop", "secret")
+	req := announce("10.0.0.5:50123")
+	authorize(t, auth, req, "secret")
+	for nonce, issued := range auth.nonces {
+		issued.expires = time.Now().Add(-time.Second)
+		auth.nonces[nonce] = issued
+	}
+	if auth.Authenticate(req) {
+		t.Error("Expected an expired nonce to be rejected")
+	}
+	if challenge := auth.Challenge(req); !strings.Contains(challenge, "stale=\"true\"") {
+		t.Errorf("Expected the nonce to be reported stale got: %s", challenge)
+	}
+}
+
+// announceWithNonce builds an ANNOUNCE answering a challenge with the given nonce
+func announceWithNonce(remoteAddr string, nonce string) *Request {
+	req := announce(remoteAddr)
+	response := digestResponse("iTunes", "raop", "secret", "ANNOUNCE", req.RequestURI, nonce)
+	req.Headers["Authorization"] = "Digest username=\"iTunes\", realm=\"raop\", nonce=\"" + nonce + "\", uri=\"" + req.RequestURI + "\", response=\"" + response + "\""
+	return req
+}
+
+func TestChallengeNoncesBounded(t *testing.T) {
+	auth := NewDigestAuthenticator("raop", "secret")
+	req := announce("10.0.0.5:50123")
+	first := announce("10.0.0.5:50123")
+	authorize(t, auth, first, "secret")
+	for i := 0; i < 10; i++ {
+		authorize(t, auth, req, "secret")
+	}
+	if len(auth.nonces) != maxConnNonces {
+		t.Errorf("Expected %d nonces for the connection got: %d", maxConnNonces, len(auth.nonces))
+	}
+	if !auth.Authenticate(req) {
+		t.Error("Expected the latest nonce to be kept")
+	}
+	if auth.Authenticate(first) {
+		t.Error("Expected the oldest nonce to be dropped")
+	}
+	for i := 0; i < maxNonces+10; i++ {
+		auth.Challenge(announce(fmt.Sprintf("10.0.%d.%d:50123", i/256, i%256)))
+	}
+	if len(auth.nonces) != maxNonces {
+		t.Errorf("Expected %d nonces got: %d", maxNonces, len(auth.nonces))
+	}
+}
+
+func TestAuthenticateUpperCaseResponse(t *testing.T) {
+	auth := NewDigestAuthenticator("raop", "secret")
+	auth.nonces["e0f8fc1fb1fa8fc5f1e1f1e1"] = issuedNonce{remoteAddr: "10.0.0.5:50123", expires: time.Now().Add(time.Minute)}
+	req := announceWithNonce("10.0.0.5:50123", "e0f8fc1fb1fa8fc5f1e1f1e1")
+	upper := strings.ToUpper(digestResponse("iTunes", "raop", "secret", "ANNOUNCE", req.RequestURI, "e0f8fc1fb1fa8fc5f1e1f1e1"))
+	req.Headers["Authorization"] = strings.Replace(req.Headers["Authorization"], strings.ToLower(upper), upper, 1)
+	if !auth.Authenticate(req) {
+		t.Error("Expected upper case digest response to be accepted")
+	}
+}
+
+func TestDigestResponse(t *testing.T) {
+	// MD5(MD5("iTunes:raop:secret"):nonce:MD5("ANNOUNCE:rtsp://10.0.0.2/1"))
+	expected := md5Hex(md5Hex("iTunes:raop:secret") + ":abc:" + md5Hex("ANNOUNCE:rtsp://10.0.0.2/1"))
+	response := digestResponse("iTunes", "raop", "secret", "ANNOUNCE", "rtsp://10.0.0.2/1", "abc")
+	if response != expected {
+		t.Error("Unexpected digest response", response)
+	}
+}
+
+func TestParseHeaderWithColons(t *testing.T) {
+	request := "ANNOUNCE rtsp://10.0.0.2/1 RTSP/1.0\r\n" +
+		"CSeq: 1\r\n" +
+		"Authorization: Digest username=\"iTunes\", uri=\"rtsp://10.0.0.2/1\"\r\n" +
+		"\r\n"
+	req, err := readRequest(strings.NewReader(request))
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if req.Headers["Authorization"] != "Digest username=\"iTunes\", uri=\"rtsp://10.0.0.2/1\"" {
+		t.Error("Unexpected Authorization header", req.Headers["Authorization"])
+	}
+}
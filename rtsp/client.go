@@ -1,16 +1,22 @@
 package rtsp
 
 import (
+	"bufio"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"sync/atomic"
 )
 
 // Client Rtsp client
 type Client struct {
-	conn net.Conn
-	seq  int64
+	conn     net.Conn
+	reader   *bufio.Reader
+	seq      int64
+	password string
+	// guards the connection, so interleaved data doesn't end up in the middle of a request
+	connLock sync.Mutex
 }
 
 // NewClient instantiates a new client connecting to the address specified
@@ -19,11 +25,36 @@ func NewClient(address string, port int) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn: conn, seq: 1}, nil
+	return &Client{conn: conn, reader: bufio.NewReader(conn), seq: 1}, nil
+}
+
+// SetPassword sets the password used to answer digest authentication challenges
+func (c *Client) SetPassword(password string) {
+	c.password = password
 }
 
 // Send will send a request to the server
 func (c *Client) Send(request *Request) (*Response, error) {
+	resp, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+	// if the server is password protected, answer the challenge and try again
+	challenge, challenged := resp.Headers["WWW-Authenticate"]
+	if resp.Status == Unauthorized && challenged && c.password != "" {
+		authorization, err := digestAuthorization(challenge, "Bobcaygeon", c.password, request.Method, request.RequestURI)
+		if err != nil {
+			return nil, err
+		}
+		request.Headers["Authorization"] = authorization
+		return c.send(request)
+	}
+	return resp, nil
+}
+
+func (c *Client) send(request *Request) (*Response, error) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
 	request.Headers["CSeq"] = strconv.FormatInt(c.seq, 10)
 	request.Headers["User-Agent"] = "Bobcaygeon/1.0"
 	atomic.AddInt64(&c.seq, 1)
@@ -31,13 +62,25 @@ func (c *Client) Send(request *Request) (*Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	resp, err := readResponse(c.conn)
+	resp, err := readResponse(c.reader)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
+// WriteInterleaved sends binary data framed on the RTSP connection on the given channel
+func (c *Client) WriteInterleaved(channel byte, data []byte) error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return writeInterleaved(c.conn, channel, data)
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
 // LocalAddress returns the local (our) address
 func (c *Client) LocalAddress() string {
 	return c.conn.LocalAddr().(*net.TCPAddr).IP.String()
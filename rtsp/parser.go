@@ -51,7 +51,8 @@ func readRequest(r io.Reader) (*Request, error) {
 		if strings.Trim(headerField, "\r\n") == "" {
 			break
 		}
-		headerParts := strings.Split(headerField, ":")
+		// only split on the first colon, header values (URIs, digest parameters) may contain them
+		headerParts := strings.SplitN(headerField, ":", 2)
 		if len(headerParts) < 2 {
 			return nil, fmt.Errorf("improper header: %s", headerField)
 		}
@@ -152,7 +153,8 @@ func readResponse(r io.Reader) (*Response, error) {
 		if strings.Trim(headerField, "\r\n") == "" {
 			break
 		}
-		headerParts := strings.Split(headerField, ":")
+		// only split on the first colon, header values (URIs, digest parameters) may contain them
+		headerParts := strings.SplitN(headerField, ":", 2)
 		if len(headerParts) < 2 {
 			return nil, fmt.Errorf("improper header: %s", headerField)
 		}
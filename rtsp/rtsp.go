@@ -13,6 +13,9 @@ type Request struct {
 	protocol   string
 	Headers    map[string]string
 	Body       []byte
+	// RemoteAddr is the ip:port of the connection the request was received on,
+	// set by the server so handlers can keep per-connection state
+	RemoteAddr string
 }
 
 // Response RTSP response
@@ -1,28 +1,44 @@
 package rtsp
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 // RequestHandler callback function that gets invoked when a request is received
 type RequestHandler func(req *Request, resp *Response, localAddr string, remoteAddr string)
 
+// DisconnectHandler callback function that gets invoked when a client connection is closed
+type DisconnectHandler func(remoteAddr string)
+
+// InterleavedHandler callback function that gets invoked when binary data is received
+// interleaved on a client connection
+type InterleavedHandler func(remoteAddr string, channel byte, data []byte)
+
 // Server Server for handling Rtsp control requests
 type Server struct {
-	port     int
-	handlers map[Method]RequestHandler
-	done     chan bool
+	port          int
+	handlers      map[Method]RequestHandler
+	onDisconnect  DisconnectHandler
+	onInterleaved InterleavedHandler
+	stopped       int32
+	// guards the listener as well as the client connections
+	connLock sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
 }
 
 // NewServer instantiates a new RtspServer
 func NewServer(port int) *Server {
 	server := Server{}
 	server.port = port
-	server.done = make(chan bool)
 	server.handlers = make(map[Method]RequestHandler)
+	server.conns = make(map[net.Conn]struct{})
 	return &server
 }
 
@@ -31,21 +47,57 @@ func (r *Server) AddHandler(m Method, rh RequestHandler) {
 	r.handlers[m] = rh
 }
 
-// Stop stops the RTSP server
+// SetDisconnectHandler registers a handler invoked when a client closes its connection
+func (r *Server) SetDisconnectHandler(dh DisconnectHandler) {
+	r.onDisconnect = dh
+}
+
+// SetInterleavedHandler registers a handler invoked for every interleaved data frame
+func (r *Server) SetInterleavedHandler(ih InterleavedHandler) {
+	r.onInterleaved = ih
+}
+
+// CloseConnection closes the client connection with the given remote address (ip:port),
+// returns false if there is no such connection
+func (r *Server) CloseConnection(remoteAddr string) bool {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+	for conn := range r.conns {
+		if conn.RemoteAddr().String() == remoteAddr {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// Stop stops the RTSP server, closing any open client connections. A server
+// that was never started, or failed to, has nothing to stop
 func (r *Server) Stop() {
 	log.Println("Stopping RTSP server")
-	r.done <- true
+	atomic.StoreInt32(&r.stopped, 1)
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+	if r.listener != nil {
+		r.listener.Close()
+		r.listener = nil
+	}
+	for conn := range r.conns {
+		conn.Close()
+	}
 }
 
-// Start creates listening socket for the RTSP connection
-func (r *Server) Start(verbose bool) {
+// Start creates listening socket for the RTSP connection, and accepts connections
+// in the background until stopped. An error is returned if it can't listen
+func (r *Server) Start(verbose bool) error {
 	log.Printf("Starting RTSP server on port: %d\n", r.port)
 	tcpListen, err := net.Listen("tcp", fmt.Sprintf(":%d", r.port))
 	if err != nil {
-		log.Fatal("Error listening:", err.Error())
+		return err
 	}
-
-	defer tcpListen.Close()
+	r.connLock.Lock()
+	r.listener = tcpListen
+	r.connLock.Unlock()
 
 	//handle TCP connections
 	go func() {
@@ -53,19 +105,56 @@ func (r *Server) Start(verbose bool) {
 			// Listen for an incoming connection.
 			conn, err := tcpListen.Accept()
 			if err != nil {
+				if atomic.LoadInt32(&r.stopped) == 1 {
+					// the listener was closed as we were stopped
+					return
+				}
 				log.Fatal("Error accepting: ", err.Error())
 			}
-			go read(conn, r.handlers, verbose)
+			r.connLock.Lock()
+			if atomic.LoadInt32(&r.stopped) == 1 {
+				// accepted as we were being stopped
+				r.connLock.Unlock()
+				conn.Close()
+				return
+			}
+			r.conns[conn] = struct{}{}
+			r.connLock.Unlock()
+			go r.read(conn, verbose)
 		}
 	}()
-
-	<-r.done
+	return nil
 }
 
-func read(conn net.Conn, handlers map[Method]RequestHandler, verbose bool) {
+func (r *Server) read(conn net.Conn, verbose bool) {
+	defer func() {
+		r.connLock.Lock()
+		delete(r.conns, conn)
+		r.connLock.Unlock()
+	}()
 	defer conn.Close()
+	defer func() {
+		if r.onDisconnect != nil {
+			r.onDisconnect(conn.RemoteAddr().String())
+		}
+	}()
+	// the reader must outlive a single request, as interleaved frames
+	// may directly follow a request in the same read
+	reader := bufio.NewReader(conn)
 	for {
-		request, err := readRequest(conn)
+		marker, err := reader.Peek(1)
+		if err == nil && marker[0] == interleavedMarker {
+			channel, data, err := readInterleaved(reader)
+			if err != nil {
+				log.Println("Error reading interleaved data: ", err.Error())
+				return
+			}
+			if r.onInterleaved != nil {
+				r.onInterleaved(conn.RemoteAddr().String(), channel, data)
+			}
+			continue
+		}
+		request, err := readRequest(reader)
 		if err != nil {
 			if err == io.EOF {
 				log.Println("Client closed connection")
@@ -75,12 +164,14 @@ func read(conn net.Conn, handlers map[Method]RequestHandler, verbose bool) {
 			return
 		}
 
+		request.RemoteAddr = conn.RemoteAddr().String()
+
 		if verbose {
 			log.Println("Received Request")
 			log.Println(request.String())
 		}
 
-		handler, exists := handlers[request.Method]
+		handler, exists := r.handlers[request.Method]
 		if !exists {
 			log.Printf("Method: %s does not have a handler. Skipping", request.Method)
 			continue
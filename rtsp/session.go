@@ -1,11 +1,13 @@
 package rtsp
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ibiscum/bobcaygeon/sdp"
 )
@@ -29,52 +31,270 @@ type PortSet struct {
 
 // Session a streaming session
 type Session struct {
+	// ID is the RTSP session identifier, as sent in the Session header
+	ID          string
 	Description *sdp.SessionDescription
 	decrypter   Decrypter
 	RemotePorts PortSet
 	LocalPorts  PortSet
+	// Transport is the lower transport the audio data is carried over
+	Transport   Transport
+	dataChannel byte
+	frameWriter FrameWriter
 	dataConn    net.Conn
+	controlConn *net.UDPConn
+	timingConn  *net.UDPConn
 	DataChan    chan []byte
-	stopChan    chan (struct{})
+	// closed once the session stopped, every caller of Close is signalled after
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// closing the session happens once, however many times Close is called
+	closing sync.Once
+	// closed to stop sending, the data channel is left open as others push to it
+	sendDone  chan struct{}
+	closeOnce sync.Once
+	// guards the data channel for interleaved receiving, where packets are pushed by the RTSP server;
+	// packets are sent on it outside the lock, recvDone stops them and sends lets Close wait for them
+	recvLock  sync.Mutex
+	receiving bool
+	closed    bool
+	recvDone  chan struct{}
+	sends     sync.WaitGroup
+	// unix nano timestamp of the last audio packet, or of when the session was created
+	lastActivity int64
+	stats        SessionStats
+	// RTP timestamp of the last audio packet, with rtpTimeSet or'ed in once there is one
+	rtpTime uint64
+}
+
+const rtpTimeSet = 1 << 32
+
+// SessionStats counts the audio packets that went through a session
+type SessionStats struct {
+	Packets uint64
+	Bytes   uint64
+	// packets that could not be decrypted, and were dropped
+	DecodeErrors uint64
 }
 
 // NewSession instantiates a new Session
 func NewSession(description *sdp.SessionDescription, decrypter Decrypter) *Session {
-	return &Session{Description: description, decrypter: decrypter, DataChan: make(chan []byte, 1000)}
+	return &Session{Description: description, decrypter: decrypter, DataChan: make(chan []byte, 1000), recvDone: make(chan struct{}),
+		stopped: make(chan struct{}), lastActivity: time.Now().UnixNano()}
+}
+
+// LastActivity returns when the session last received audio data, or when it was created if it never did
+func (s *Session) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+}
+
+// Stats returns the packet counters of the session
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		Packets:      atomic.LoadUint64(&s.stats.Packets),
+		Bytes:        atomic.LoadUint64(&s.stats.Bytes),
+		DecodeErrors: atomic.LoadUint64(&s.stats.DecodeErrors),
+	}
+}
+
+// Encrypted returns whether the audio data of the session is encrypted
+func (s *Session) Encrypted() bool {
+	return s.decrypter != nil
+}
+
+// RTPTime returns the RTP timestamp of the last audio packet received, false if there was none yet
+func (s *Session) RTPTime() (uint32, bool) {
+	rtpTime := atomic.LoadUint64(&s.rtpTime)
+	return uint32(rtpTime), rtpTime&rtpTimeSet != 0
+}
+
+// touch records the packet was received
+func (s *Session) touch(packet []byte) {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	atomic.AddUint64(&s.stats.Packets, 1)
+	atomic.AddUint64(&s.stats.Bytes, uint64(len(packet)))
+	// RTP version 2 header, the timestamp follows the sequence number
+	if len(packet) >= 12 && packet[0]>>6 == 2 {
+		atomic.StoreUint64(&s.rtpTime, uint64(binary.BigEndian.Uint32(packet[4:8]))|rtpTimeSet)
+	}
 }
 
 // InitReceive initializes the session to for receiving
 func (s *Session) InitReceive() error {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", 0))
+	conn, port, err := listenEphemeral()
 	if err != nil {
 		return err
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	// keep track of the actual connection so we close it later
+	s.dataConn = conn
+	s.LocalPorts.Data = port
+	err = s.initControlAndTiming()
 	if err != nil {
+		conn.Close()
 		return err
 	}
-	// keep track of the actual connection so we close it later
-	s.dataConn = conn
-	localAddr := strings.Split(conn.LocalAddr().String(), ":")
-	port := localAddr[len(localAddr)-1]
-	s.LocalPorts.Data, _ = strconv.Atoi(port)
 	return nil
 }
 
-// Close closes a session
+// InitSend initializes the session for sending, the control and timing ports
+// need to be known before the session is set up with the receiver
+func (s *Session) InitSend() error {
+	return s.initControlAndTiming()
+}
+
+// initControlAndTiming opens the control and timing sockets on ports picked by the OS, so
+// several sessions (or several processes on one host) never compete for the same ones
+func (s *Session) initControlAndTiming() error {
+	controlConn, controlPort, err := listenEphemeral()
+	if err != nil {
+		return err
+	}
+	timingConn, timingPort, err := listenEphemeral()
+	if err != nil {
+		controlConn.Close()
+		return err
+	}
+	s.controlConn = controlConn
+	s.timingConn = timingConn
+	s.LocalPorts.Control = controlPort
+	s.LocalPorts.Timing = timingPort
+	return nil
+}
+
+func (s *Session) closeControlAndTiming() {
+	if s.controlConn != nil {
+		s.controlConn.Close()
+		s.controlConn = nil
+	}
+	if s.timingConn != nil {
+		s.timingConn.Close()
+		s.timingConn = nil
+	}
+	s.LocalPorts.Control = 0
+	s.LocalPorts.Timing = 0
+}
+
+func listenEphemeral() (*net.UDPConn, int, error) {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", 0))
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// UseInterleaved switches the session to receive or send its data framed on the RTSP
+// connection on the given channel rather than over UDP. The writer is only needed for sending
+func (s *Session) UseInterleaved(channel byte, w FrameWriter) {
+	if s.dataConn != nil {
+		// the UDP socket opened by InitReceive is no longer needed
+		s.dataConn.Close()
+		s.dataConn = nil
+		s.LocalPorts.Data = 0
+	}
+	// neither are the control and timing sockets, that traffic would go on the odd channel
+	s.closeControlAndTiming()
+	s.Transport = Interleaved
+	s.dataChannel = channel
+	s.frameWriter = w
+}
+
+// HandleInterleaved accepts a frame of interleaved data received on the RTSP connection
+func (s *Session) HandleInterleaved(channel byte, data []byte) {
+	if channel != s.dataChannel {
+		// control packets (retransmits, sync) are not handled, same as for UDP
+		return
+	}
+	d := data
+	if s.decrypter != nil {
+		var err error
+		d, err = s.decrypter.Decode(data)
+		if err != nil {
+			log.Println("Problem decoding packet", err)
+			atomic.AddUint64(&s.stats.DecodeErrors, 1)
+			return
+		}
+	}
+	s.recvLock.Lock()
+	if !s.receiving || s.closed {
+		s.recvLock.Unlock()
+		return
+	}
+	s.sends.Add(1)
+	s.recvLock.Unlock()
+	defer s.sends.Done()
+	s.touch(data)
+	select {
+	case s.DataChan <- d:
+	case <-s.recvDone:
+		// nobody is going to read it
+	}
+}
+
+// Close closes a session, closeDone is signalled once it stopped. It can be called
+// more than once, every caller is signalled
 func (s *Session) Close(closeDone chan struct{}) {
+	s.closing.Do(s.close)
+	// the caller waits on the channel after this returns
+	go func() {
+		<-s.stopped
+		closeDone <- struct{}{}
+	}()
+}
+
+// close closes the connections of the session, and the data channel when we push to it
+func (s *Session) close() {
 	log.Println("closing session")
-	s.stopChan = closeDone
+	s.closeControlAndTiming()
+	if s.sendDone != nil {
+		s.closeOnce.Do(func() {
+			close(s.sendDone)
+		})
+	}
+	s.recvLock.Lock()
+	receiving := s.receiving
+	s.recvLock.Unlock()
 	if s.dataConn != nil {
 		s.dataConn.Close()
+		if receiving {
+			// the receiving goroutine signals once it has stopped
+			return
+		}
+	} else if s.Transport == Interleaved && receiving {
+		s.recvLock.Lock()
+		s.closed = true
+		close(s.recvDone)
+		s.recvLock.Unlock()
+		// a packet may be on its way, the channel can only be closed after
+		s.sends.Wait()
+		close(s.DataChan)
 	} else {
 		log.Println("Currently no data connection...")
-		s.stopChan <- struct{}{}
 	}
+	// nobody else is going to signal
+	s.stop()
+}
+
+// stop marks the session stopped, signalling the callers of Close
+func (s *Session) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
 }
 
 // StartReceiving starts a session for listening for data
 func (s *Session) StartReceiving() error {
+	s.recvLock.Lock()
+	s.receiving = true
+	s.recvLock.Unlock()
+	if s.Transport == Interleaved {
+		// packets are pushed in through HandleInterleaved
+		log.Println("Session started.  Receiving interleaved audio packets")
+		return nil
+	}
 	// start listening for audio data
 	log.Println("Session started.  Listening for audio packets")
 	go func(conn *net.UDPConn) {
@@ -95,39 +315,65 @@ func (s *Session) StartReceiving() error {
 			}
 			if err != nil {
 				log.Println("Problem decoding packet", err)
+				atomic.AddUint64(&s.stats.DecodeErrors, 1)
 				continue
 			}
 			// once decoded, we can pass it along to be played
 			send := make([]byte, len(d))
 			copy(send, d)
+			// decrypting leaves the header alone
+			s.touch(packet)
 			s.DataChan <- send
 		}
 		log.Println("Signalling Session is closed")
-		if s.stopChan != nil {
-			s.stopChan <- struct{}{}
-		}
+		s.stop()
 	}(s.dataConn.(*net.UDPConn))
 	return nil
 }
 
-// StartSending starts a session for sending data
+// StartSending starts a session for sending data, until it is closed
 func (s *Session) StartSending() error {
-
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", s.RemotePorts.Address, s.RemotePorts.Data))
-	if err != nil {
-		return err
-	}
-	// keep track of the actual connection so we close it later
-	s.dataConn = conn
-	// start listening for audio data
-	log.Println("Session started.  Will start sending packets")
-	go func() {
-		for pkt := range s.DataChan {
+	var send func(pkt []byte) error
+	if s.Transport == Interleaved {
+		log.Println("Session started.  Will start sending interleaved packets")
+		send = func(pkt []byte) error {
+			return s.frameWriter.WriteInterleaved(s.dataChannel, pkt)
+		}
+	} else {
+		conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", s.RemotePorts.Address, s.RemotePorts.Data))
+		if err != nil {
+			return err
+		}
+		// keep track of the actual connection so we close it later
+		s.dataConn = conn
+		log.Println("Session started.  Will start sending packets")
+		send = func(pkt []byte) error {
 			_, err := conn.Write(pkt)
-			if err != nil {
-				log.Fatal(err)
+			return err
+		}
+	}
+	s.sendDone = make(chan struct{})
+	go func(done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case pkt, ok := <-s.DataChan:
+				if !ok {
+					return
+				}
+				err := send(pkt)
+				if err != nil {
+					select {
+					case <-done:
+						// the connection was closed under us
+					default:
+						log.Println("Error sending data", err)
+					}
+					return
+				}
 			}
 		}
-	}()
+	}(s.sendDone)
 	return nil
 }
@@ -0,0 +1,106 @@
+package rtsp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionsGetOwnPorts(t *testing.T) {
+	first := NewSession(nil, nil)
+	second := NewSession(nil, nil)
+	for _, s := range []*Session{first, second} {
+		err := s.InitReceive()
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	ports := map[int]bool{}
+	for _, s := range []*Session{first, second} {
+		for _, port := range []int{s.LocalPorts.Data, s.LocalPorts.Control, s.LocalPorts.Timing} {
+			if port == 0 || ports[port] {
+				t.Error("Expected a distinct port, got:", port)
+			}
+			ports[port] = true
+		}
+	}
+	done := make(chan struct{})
+	first.Close(done)
+	<-done
+	if first.LocalPorts.Control != 0 || first.LocalPorts.Timing != 0 {
+		t.Error("Expected control and timing ports to be released")
+	}
+	second.Close(done)
+	<-done
+}
+
+func TestSessionRTPTime(t *testing.T) {
+	s := NewSession(nil, nil)
+	if _, ok := s.RTPTime(); ok {
+		t.Error("Expected no RTP time before any packet")
+	}
+	s.touch([]byte{0x80, 0x60, 0x00, 0x01, 0x00, 0x06, 0xBB, 0x90, 0, 0, 0, 0, 1, 2, 3})
+	rtpTime, ok := s.RTPTime()
+	if !ok || rtpTime != 441232 {
+		t.Error("Expected RTP time 441232 got:", rtpTime, ok)
+	}
+}
+
+func TestSessionStopsSendingOnClose(t *testing.T) {
+	receiver, port, err := listenEphemeral()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer receiver.Close()
+	s := NewSession(nil, nil)
+	s.RemotePorts = PortSet{Address: "127.0.0.1", Data: port}
+	err = s.StartSending()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	s.DataChan <- []byte{1, 2, 3}
+	buf := make([]byte, 16)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := receiver.ReadFromUDP(buf)
+	if err != nil || n != 3 {
+		t.Fatal("Expected the packet to be sent got:", n, err)
+	}
+	done := make(chan struct{})
+	s.Close(done)
+	<-done
+	s.DataChan <- []byte{4, 5, 6}
+	time.Sleep(50 * time.Millisecond)
+	if len(s.DataChan) != 1 {
+		t.Error("Expected nothing to be sent once closed")
+	}
+}
+
+func TestSessionClosedTwice(t *testing.T) {
+	receiving := NewSession(nil, nil)
+	err := receiving.InitReceive()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	err = receiving.StartReceiving()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	interleaved := NewSession(nil, nil)
+	interleaved.UseInterleaved(0, nil)
+	err = interleaved.StartReceiving()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for _, s := range []*Session{receiving, interleaved} {
+		// i.e: the sender is kicked while it drops the connection
+		first, second := make(chan struct{}), make(chan struct{})
+		go s.Close(first)
+		s.Close(second)
+		for _, done := range []chan struct{}{first, second} {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected every caller to be signalled")
+			}
+		}
+	}
+}
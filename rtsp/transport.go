@@ -0,0 +1,160 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Transport the lower transport audio data is carried over
+type Transport int
+
+const (
+	// UDP data is sent as datagrams to the negotiated server port
+	UDP Transport = iota
+	// Interleaved data is framed on the RTSP (TCP) connection itself, see: https://tools.ietf.org/html/rfc2326#section-10.12
+	Interleaved
+)
+
+// interleavedMarker starts every frame of binary data embedded in the RTSP connection
+const interleavedMarker = '$'
+
+// ParseTransport converts a transport name from config (udp or tcp) to a Transport
+func ParseTransport(name string) (Transport, error) {
+	switch strings.ToLower(name) {
+	case "", "udp":
+		return UDP, nil
+	case "tcp", "interleaved":
+		return Interleaved, nil
+	}
+	return UDP, fmt.Errorf("unknown transport: %s", name)
+}
+
+// TransportSpec a single entry of a Transport header, i.e: RTP/AVP/UDP;unicast;mode=record
+type TransportSpec struct {
+	// Protocol is the transport protocol, profile and optional lower transport
+	Protocol string
+	// Params holds the parameters, flags such as unicast have an empty value
+	Params map[string]string
+	// order of the parameters, so the header can be written back out as it came in
+	keys []string
+}
+
+// NewTransportSpec instantiates a new TransportSpec for the given protocol
+func NewTransportSpec(protocol string) *TransportSpec {
+	return &TransportSpec{Protocol: protocol, Params: make(map[string]string)}
+}
+
+// ParseTransportHeader parses the Transport header, which may list several
+// transports in order of preference
+func ParseTransportHeader(header string) []*TransportSpec {
+	var specs []*TransportSpec
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ";")
+		if parts[0] == "" {
+			continue
+		}
+		spec := NewTransportSpec(parts[0])
+		for _, part := range parts[1:] {
+			kv := strings.SplitN(part, "=", 2)
+			value := ""
+			if len(kv) == 2 {
+				value = kv[1]
+			}
+			spec.Set(kv[0], value)
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// Set sets a parameter, an empty value writes it out as a flag
+func (t *TransportSpec) Set(key string, value string) {
+	if _, exists := t.Params[key]; !exists {
+		t.keys = append(t.keys, key)
+	}
+	t.Params[key] = value
+}
+
+// Int returns the integer value of a parameter, or 0 if not present
+func (t *TransportSpec) Int(key string) int {
+	value, _ := strconv.Atoi(t.Params[key])
+	return value
+}
+
+// Transport returns the lower transport of the spec; RTP/AVP without a lower transport means UDP
+func (t *TransportSpec) Transport() Transport {
+	if strings.HasSuffix(strings.ToUpper(t.Protocol), "/TCP") {
+		return Interleaved
+	}
+	return UDP
+}
+
+// Channels returns the interleaved channels (data and control), defaulting to 0-1
+func (t *TransportSpec) Channels() (byte, byte) {
+	channels := strings.SplitN(t.Params["interleaved"], "-", 2)
+	data, err := strconv.Atoi(channels[0])
+	if err != nil {
+		return 0, 1
+	}
+	control := data + 1
+	if len(channels) == 2 {
+		if c, err := strconv.Atoi(channels[1]); err == nil {
+			control = c
+		}
+	}
+	return byte(data), byte(control)
+}
+
+func (t *TransportSpec) String() string {
+	var b strings.Builder
+	b.WriteString(t.Protocol)
+	for _, key := range t.keys {
+		b.WriteString(";")
+		b.WriteString(key)
+		if value := t.Params[key]; value != "" {
+			b.WriteString("=")
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// FrameWriter writes interleaved binary data on an RTSP connection
+type FrameWriter interface {
+	WriteInterleaved(channel byte, data []byte) error
+}
+
+// readInterleaved reads a frame of the form: $ <channel> <2 byte length> <data>
+func readInterleaved(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	if header[0] != interleavedMarker {
+		return 0, nil, fmt.Errorf("not an interleaved frame: %x", header[0])
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[1], data, nil
+}
+
+func writeInterleaved(w io.Writer, channel byte, data []byte) error {
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("interleaved frame too large: %d bytes", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	frame[0] = interleavedMarker
+	frame[1] = channel
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+	copy(frame[4:], data)
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,133 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseTransportHeader(t *testing.T) {
+	specs := ParseTransportHeader("RTP/AVP/TCP;unicast;interleaved=2-3;mode=record,RTP/AVP/UDP;unicast;control_port=6001;timing_port=6002")
+	if len(specs) != 2 {
+		t.Fatal("Expected 2 transports got:", len(specs))
+	}
+	if specs[0].Transport() != Interleaved {
+		t.Error("Expected first transport to be interleaved")
+	}
+	data, control := specs[0].Channels()
+	if data != 2 || control != 3 {
+		t.Errorf("Expected channels 2-3 got: %d-%d", data, control)
+	}
+	if specs[1].Transport() != UDP {
+		t.Error("Expected second transport to be UDP")
+	}
+	if specs[1].Int("control_port") != 6001 || specs[1].Int("timing_port") != 6002 {
+		t.Error("Unexpected ports", specs[1].Params)
+	}
+}
+
+func TestTransportWithoutLowerTransportIsUDP(t *testing.T) {
+	specs := ParseTransportHeader("RTP/AVP;unicast;interleaved=0-1;mode=record")
+	if specs[0].Transport() != UDP {
+		t.Error("Expected RTP/AVP to default to UDP")
+	}
+}
+
+func TestTransportSpecString(t *testing.T) {
+	header := "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"
+	specs := ParseTransportHeader(header)
+	if specs[0].String() != header {
+		t.Error("Expected "+header+" got:", specs[0].String())
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	transport, err := ParseTransport("tcp")
+	if err != nil || transport != Interleaved {
+		t.Error("Expected tcp to map to interleaved", err)
+	}
+	transport, err = ParseTransport("")
+	if err != nil || transport != UDP {
+		t.Error("Expected default to be UDP", err)
+	}
+	_, err = ParseTransport("sctp")
+	if err == nil {
+		t.Error("Expected error for unknown transport")
+	}
+}
+
+func TestInterleavedRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	err := writeInterleaved(&b, 1, []byte("audio"))
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if !bytes.Equal(b.Bytes()[:4], []byte{'$', 1, 0, 5}) {
+		t.Error("Unexpected frame header", b.Bytes()[:4])
+	}
+	channel, data, err := readInterleaved(bufio.NewReader(&b))
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if channel != 1 || string(data) != "audio" {
+		t.Errorf("Unexpected frame: %d %s", channel, data)
+	}
+}
+
+func TestSessionHandleInterleaved(t *testing.T) {
+	s := NewSession(nil, nil)
+	s.UseInterleaved(0, nil)
+	// nothing is passed on until the session started receiving
+	s.HandleInterleaved(0, []byte("early"))
+	err := s.StartReceiving()
+	if err != nil {
+		t.Error("Unexpected error", err)
+	}
+	s.HandleInterleaved(1, []byte("control"))
+	s.HandleInterleaved(0, []byte("audio"))
+	if len(s.DataChan) != 1 {
+		t.Fatal("Expected one packet got:", len(s.DataChan))
+	}
+	if string(<-s.DataChan) != "audio" {
+		t.Error("Unexpected packet")
+	}
+	if stats := s.Stats(); stats.Packets != 1 || stats.Bytes != 5 {
+		t.Error("Unexpected stats", stats)
+	}
+	done := make(chan struct{})
+	s.Close(done)
+	<-done
+	if _, open := <-s.DataChan; open {
+		t.Error("Expected data channel to be closed")
+	}
+	// late packets must not panic on the closed channel
+	s.HandleInterleaved(0, []byte("late"))
+}
+
+func TestSessionCloseWithFullDataChannel(t *testing.T) {
+	s := NewSession(nil, nil)
+	s.UseInterleaved(0, nil)
+	err := s.StartReceiving()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for i := 0; i < cap(s.DataChan); i++ {
+		s.HandleInterleaved(0, []byte("audio"))
+	}
+	// nobody reads, so this one blocks until the session is closed
+	handled := make(chan struct{})
+	go func() {
+		s.HandleInterleaved(0, []byte("blocked"))
+		close(handled)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	s.Close(done)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected close not to wait on the blocked packet")
+	}
+	<-handled
+}
@@ -0,0 +1,232 @@
+package sdp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtpmapAttribute = "rtpmap"
+	fmtpAttribute   = "fmtp"
+)
+
+// RtpMap a rtpmap attribute: <payload type> <encoding name>[/<clock rate>[/<channels>]]
+type RtpMap struct {
+	PayloadType  int
+	EncodingName string
+	// ClockRate is 0 when not given, AirTunes senders leave it out for AppleLossless
+	ClockRate int
+	// Channels is 0 when not given, meaning a single channel
+	Channels int
+}
+
+// ParseRtpMap parses the value of a rtpmap attribute
+func ParseRtpMap(value string) (RtpMap, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return RtpMap{}, fmt.Errorf("sdp: invalid rtpmap %q: expected <payload type> <encoding>", value)
+	}
+	payloadType, err := parsePayloadType(fields[0])
+	if err != nil {
+		return RtpMap{}, fmt.Errorf("sdp: invalid rtpmap %q: %v", value, err)
+	}
+	encodingParts := strings.Split(fields[1], "/")
+	if len(encodingParts) > 3 || encodingParts[0] == "" {
+		return RtpMap{}, fmt.Errorf("sdp: invalid rtpmap %q: expected <encoding name>[/<clock rate>[/<channels>]]", value)
+	}
+	rtpmap := RtpMap{PayloadType: payloadType, EncodingName: encodingParts[0]}
+	if len(encodingParts) > 1 {
+		rtpmap.ClockRate, err = strconv.Atoi(encodingParts[1])
+		if err != nil || rtpmap.ClockRate <= 0 {
+			return RtpMap{}, fmt.Errorf("sdp: invalid rtpmap %q: invalid clock rate", value)
+		}
+	}
+	if len(encodingParts) > 2 {
+		rtpmap.Channels, err = strconv.Atoi(encodingParts[2])
+		if err != nil || rtpmap.Channels <= 0 {
+			return RtpMap{}, fmt.Errorf("sdp: invalid rtpmap %q: invalid channels", value)
+		}
+	}
+	return rtpmap, nil
+}
+
+func (r RtpMap) String() string {
+	s := fmt.Sprintf("%d %s", r.PayloadType, r.EncodingName)
+	if r.ClockRate > 0 {
+		s += fmt.Sprintf("/%d", r.ClockRate)
+		if r.Channels > 0 {
+			s += fmt.Sprintf("/%d", r.Channels)
+		}
+	}
+	return s
+}
+
+// Fmtp a fmtp attribute: <payload type> <format specific parameters>
+type Fmtp struct {
+	PayloadType int
+	Parameters  string
+}
+
+// ParseFmtp parses the value of a fmtp attribute
+func ParseFmtp(value string) (Fmtp, error) {
+	payloadType, parameters, _ := strings.Cut(strings.TrimSpace(value), " ")
+	pt, err := parsePayloadType(payloadType)
+	if err != nil {
+		return Fmtp{}, fmt.Errorf("sdp: invalid fmtp %q: %v", value, err)
+	}
+	return Fmtp{PayloadType: pt, Parameters: strings.TrimSpace(parameters)}, nil
+}
+
+func (f Fmtp) String() string {
+	return fmt.Sprintf("%d %s", f.PayloadType, f.Parameters)
+}
+
+func parsePayloadType(value string) (int, error) {
+	payloadType, err := strconv.Atoi(value)
+	if err != nil || payloadType < 0 || payloadType > 127 {
+		return 0, fmt.Errorf("invalid payload type: %s", value)
+	}
+	return payloadType, nil
+}
+
+// ALACConfig the parameters of an AppleLossless stream, as carried in its fmtp attribute
+type ALACConfig struct {
+	FrameLength       uint32
+	CompatibleVersion uint8
+	BitDepth          uint8
+	// RiceHistoryMult, RiceInitialHistory and RiceLimit tune the rice coding of the samples
+	RiceHistoryMult    uint8
+	RiceInitialHistory uint8
+	RiceLimit          uint8
+	Channels           uint8
+	MaxRun             uint16
+	MaxFrameBytes      uint32
+	AvgBitRate         uint32
+	SampleRate         uint32
+}
+
+// DefaultALACConfig returns the parameters AirTunes senders stream with
+func DefaultALACConfig() ALACConfig {
+	return ALACConfig{FrameLength: 352, BitDepth: 16, RiceHistoryMult: 40, RiceInitialHistory: 10,
+		RiceLimit: 14, Channels: 2, MaxRun: 255, SampleRate: 44100}
+}
+
+// ParseALACConfig parses the parameters of an AppleLossless fmtp attribute, i.e: 352 0 16 40 10 14 2 255 0 0 44100
+func ParseALACConfig(parameters string) (ALACConfig, error) {
+	fields := strings.Fields(parameters)
+	if len(fields) != 11 {
+		return ALACConfig{}, fmt.Errorf("sdp: invalid ALAC parameters %q: expected 11 fields, got %d", parameters, len(fields))
+	}
+	values := make([]uint64, len(fields))
+	// the sizes of the fields, in bits
+	sizes := []int{32, 8, 8, 8, 8, 8, 8, 16, 32, 32, 32}
+	for i, field := range fields {
+		value, err := strconv.ParseUint(field, 10, sizes[i])
+		if err != nil {
+			return ALACConfig{}, fmt.Errorf("sdp: invalid ALAC parameters %q: field %d: %v", parameters, i+1, err)
+		}
+		values[i] = value
+	}
+	return ALACConfig{
+		FrameLength:        uint32(values[0]),
+		CompatibleVersion:  uint8(values[1]),
+		BitDepth:           uint8(values[2]),
+		RiceHistoryMult:    uint8(values[3]),
+		RiceInitialHistory: uint8(values[4]),
+		RiceLimit:          uint8(values[5]),
+		Channels:           uint8(values[6]),
+		MaxRun:             uint16(values[7]),
+		MaxFrameBytes:      uint32(values[8]),
+		AvgBitRate:         uint32(values[9]),
+		SampleRate:         uint32(values[10]),
+	}, nil
+}
+
+// Parameters returns the parameters as carried in the fmtp attribute
+func (c ALACConfig) Parameters() string {
+	return fmt.Sprintf("%d %d %d %d %d %d %d %d %d %d %d", c.FrameLength, c.CompatibleVersion, c.BitDepth,
+		c.RiceHistoryMult, c.RiceInitialHistory, c.RiceLimit, c.Channels, c.MaxRun, c.MaxFrameBytes, c.AvgBitRate, c.SampleRate)
+}
+
+// RtpMap returns the rtpmap of the given payload type
+func (m *MediaDescription) RtpMap(payloadType int) (RtpMap, bool) {
+	for _, value := range m.Attributes.Values(rtpmapAttribute) {
+		rtpmap, err := ParseRtpMap(value)
+		if err == nil && rtpmap.PayloadType == payloadType {
+			return rtpmap, true
+		}
+	}
+	return RtpMap{}, false
+}
+
+// Fmtp returns the fmtp of the given payload type
+func (m *MediaDescription) Fmtp(payloadType int) (Fmtp, bool) {
+	for _, value := range m.Attributes.Values(fmtpAttribute) {
+		fmtp, err := ParseFmtp(value)
+		if err == nil && fmtp.PayloadType == payloadType {
+			return fmtp, true
+		}
+	}
+	return Fmtp{}, false
+}
+
+// AddFormat adds a payload format to the media description, along with its rtpmap and, if
+// there are any, its format specific parameters
+func (m *MediaDescription) AddFormat(rtpmap RtpMap, parameters string) {
+	m.Formats = append(m.Formats, strconv.Itoa(rtpmap.PayloadType))
+	m.Attributes.Add(rtpmapAttribute, rtpmap.String())
+	if parameters != "" {
+		m.Attributes.Add(fmtpAttribute, Fmtp{PayloadType: rtpmap.PayloadType, Parameters: parameters}.String())
+	}
+}
+
+// NewAudioDescription builds a media description for an audio stream in the given format
+func NewAudioDescription(rtpmap RtpMap, parameters string) MediaDescription {
+	media := MediaDescription{Media: "audio", Proto: "RTP/AVP"}
+	media.AddFormat(rtpmap, parameters)
+	return media
+}
+
+// RtpMap returns the rtpmap of the stream, the first format of the first media description. Senders
+// that leave the rtpmap at the session level are accounted for
+func (sd *SessionDescription) RtpMap() (RtpMap, bool) {
+	payloadType, ok := sd.payloadType()
+	for _, value := range sd.attributeValues(rtpmapAttribute) {
+		rtpmap, err := ParseRtpMap(value)
+		if err == nil && (!ok || rtpmap.PayloadType == payloadType) {
+			return rtpmap, true
+		}
+	}
+	return RtpMap{}, false
+}
+
+// Fmtp returns the fmtp of the stream, the first format of the first media description
+func (sd *SessionDescription) Fmtp() (Fmtp, bool) {
+	payloadType, ok := sd.payloadType()
+	for _, value := range sd.attributeValues(fmtpAttribute) {
+		fmtp, err := ParseFmtp(value)
+		if err == nil && (!ok || fmtp.PayloadType == payloadType) {
+			return fmtp, true
+		}
+	}
+	return Fmtp{}, false
+}
+
+// payloadType returns the payload type of the first format of the first media description
+func (sd *SessionDescription) payloadType() (int, bool) {
+	if len(sd.MediaDescription) == 0 || len(sd.MediaDescription[0].Formats) == 0 {
+		return 0, false
+	}
+	payloadType, err := parsePayloadType(sd.MediaDescription[0].Formats[0])
+	return payloadType, err == nil
+}
+
+// attributeValues returns the values of the attribute for the first media description, then the session
+func (sd *SessionDescription) attributeValues(key string) []string {
+	var values []string
+	if len(sd.MediaDescription) > 0 {
+		values = sd.MediaDescription[0].Attributes.Values(key)
+	}
+	return append(values, sd.Attributes.Values(key)...)
+}
@@ -9,79 +9,259 @@ import (
 	"strings"
 )
 
+// ParseError describes a line of a SDP payload that could not be parsed
+type ParseError struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("sdp: line %d %q: %s", e.Line, e.Text, e.Reason)
+}
+
+// parser keeps track of where in the payload we are
+type parser struct {
+	sdp  *SessionDescription
+	line int
+	text string
+	// seen are the session level types seen so far, for the ones that may only appear once
+	seen map[byte]bool
+	// media is the media description being parsed, nil while parsing the session level
+	media *MediaDescription
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &ParseError{Line: p.line, Text: p.text, Reason: fmt.Sprintf(format, args...)}
+}
+
 // Parse parses out an SDP packet into a SDP struct
 func Parse(r io.Reader) (*SessionDescription, error) {
-	sdp := NewSessionDescription()
+	p := &parser{sdp: NewSessionDescription(), seen: make(map[byte]bool)}
 	s := bufio.NewScanner(r)
 	for s.Scan() {
-		parts := strings.SplitN(s.Text(), "=", 2)
-		typePart := parts[0]
-		valuePart := parts[1]
-		switch typePart {
-		case "v":
-			version, err := strconv.Atoi(valuePart)
-			if err != nil {
-				return nil, err
-			}
-			sdp.Version = version
-		case "o":
-			// <username> <sess-id> <sess-version> <nettype> <addrtype> <unicast-address>
-			originParts := strings.Fields(valuePart)
-			origin := Origin{}
-			origin.Username = originParts[0]
-			origin.SessionID = originParts[1]
-			origin.SessionVersion = originParts[2]
-			origin.NetType = originParts[3]
-			origin.AddrType = originParts[4]
-			origin.UnicastAddress = originParts[5]
-			sdp.Origin = origin
-		case "s":
-			sdp.SessionName = valuePart
-		case "c":
-			// <nettype> <addrtype> <connection-address>
-			connectionParts := strings.Fields(valuePart)
-			connect := ConnectData{}
-			connect.NetType = connectionParts[0]
-			connect.AddrType = connectionParts[1]
-			connect.ConnectionAddress = connectionParts[2]
-			sdp.ConnectData = connect
-		case "t":
-			// <start-time> <stop-time>
-			timingParts := strings.Fields(valuePart)
-			timing := Timing{}
-			start, err := strconv.Atoi(timingParts[0])
-			if err != nil {
-				return nil, err
-			}
-			stop, err := strconv.Atoi(timingParts[1])
-			if err != nil {
-				return nil, err
-			}
-			timing.StartTime = start
-			timing.StopTime = stop
-			sdp.Timing = timing
-		case "m":
-			// <media> <port>/<number of ports> <proto> <fmt>
-			mediaParts := strings.Fields(valuePart)
-			media := MediaDescription{}
-			media.Media = mediaParts[0]
-			media.Port = mediaParts[1]
-			media.Proto = mediaParts[2]
-			media.Fmt = mediaParts[3]
-			sdp.MediaDescription = append(sdp.MediaDescription, media)
-		case "a":
-			attributeParts := strings.Split(valuePart, ":")
-			sdp.Attributes[attributeParts[0]] = attributeParts[1]
-		case "i":
-			sdp.Information = valuePart
-		}
-		//TODO: handle all parameters
-
-	}
-	return sdp, nil
-}
-
-//Write writes a SessionDescription struct to the given writer
+		p.line++
+		p.text = s.Text()
+		if strings.TrimSpace(p.text) == "" {
+			continue
+		}
+		if len(p.text) < 2 || p.text[1] != '=' {
+			return nil, p.errorf("expected <type>=<value>")
+		}
+		if !p.seen['v'] && p.text[0] != 'v' {
+			return nil, p.errorf("expected v= first")
+		}
+		var err error
+		if p.media == nil {
+			err = p.parseSessionLine(p.text[0], p.text[2:])
+		} else {
+			err = p.parseMediaLine(p.text[0], p.text[2:])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	p.flushMedia()
+	for _, required := range []byte{'v', 'o', 's'} {
+		if !p.seen[required] {
+			return nil, fmt.Errorf("sdp: missing required %c= line", required)
+		}
+	}
+	return p.sdp, nil
+}
+
+func (p *parser) parseSessionLine(typ byte, value string) error {
+	switch typ {
+	case 'v', 'o', 's', 'i', 'u', 'c', 'z', 'k':
+		if p.seen[typ] {
+			return p.errorf("%c= may only appear once", typ)
+		}
+	}
+	p.seen[typ] = true
+	sdp := p.sdp
+	switch typ {
+	case 'v':
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			return p.errorf("invalid version: %v", err)
+		}
+		sdp.Version = version
+	case 'o':
+		// <username> <sess-id> <sess-version> <nettype> <addrtype> <unicast-address>
+		originParts := strings.Fields(value)
+		if len(originParts) != 6 {
+			return p.errorf("expected 6 origin fields, got %d", len(originParts))
+		}
+		sdp.Origin = Origin{
+			Username:       originParts[0],
+			SessionID:      originParts[1],
+			SessionVersion: originParts[2],
+			NetType:        originParts[3],
+			AddrType:       originParts[4],
+			UnicastAddress: originParts[5],
+		}
+	case 's':
+		sdp.SessionName = value
+	case 'i':
+		sdp.Information = value
+	case 'u':
+		sdp.URI = value
+	case 'e':
+		sdp.Emails = append(sdp.Emails, value)
+	case 'p':
+		sdp.Phones = append(sdp.Phones, value)
+	case 'c':
+		connect, err := p.parseConnectData(value)
+		if err != nil {
+			return err
+		}
+		sdp.ConnectData = connect
+	case 'b':
+		bandwidth, err := p.parseBandwidth(value)
+		if err != nil {
+			return err
+		}
+		sdp.Bandwidths = append(sdp.Bandwidths, bandwidth)
+	case 't':
+		// <start-time> <stop-time>
+		timingParts := strings.Fields(value)
+		if len(timingParts) != 2 {
+			return p.errorf("expected 2 timing fields, got %d", len(timingParts))
+		}
+		start, err := strconv.ParseUint(timingParts[0], 10, 64)
+		if err != nil {
+			return p.errorf("invalid start time: %v", err)
+		}
+		stop, err := strconv.ParseUint(timingParts[1], 10, 64)
+		if err != nil {
+			return p.errorf("invalid stop time: %v", err)
+		}
+		sdp.Timings = append(sdp.Timings, Timing{StartTime: start, StopTime: stop})
+	case 'r':
+		if len(sdp.Timings) == 0 {
+			return p.errorf("r= must follow a t= line")
+		}
+		if len(strings.Fields(value)) < 3 {
+			return p.errorf("expected at least 3 repeat fields")
+		}
+		last := &sdp.Timings[len(sdp.Timings)-1]
+		last.Repeats = append(last.Repeats, value)
+	case 'z':
+		sdp.TimeZones = value
+	case 'k':
+		sdp.EncryptionKey = value
+	case 'a':
+		sdp.Attributes = append(sdp.Attributes, parseAttribute(value))
+	case 'm':
+		return p.startMedia(value)
+	default:
+		return p.errorf("unknown type %c", typ)
+	}
+	return nil
+}
+
+func (p *parser) parseMediaLine(typ byte, value string) error {
+	media := p.media
+	switch typ {
+	case 'm':
+		p.flushMedia()
+		return p.startMedia(value)
+	case 'i':
+		if media.Information != "" {
+			return p.errorf("i= may only appear once per media description")
+		}
+		media.Information = value
+	case 'c':
+		connect, err := p.parseConnectData(value)
+		if err != nil {
+			return err
+		}
+		media.ConnectData = append(media.ConnectData, connect)
+	case 'b':
+		bandwidth, err := p.parseBandwidth(value)
+		if err != nil {
+			return err
+		}
+		media.Bandwidths = append(media.Bandwidths, bandwidth)
+	case 'k':
+		media.EncryptionKey = value
+	case 'a':
+		media.Attributes = append(media.Attributes, parseAttribute(value))
+	case 'v', 'o', 's', 'u', 'e', 'p', 't', 'r', 'z':
+		return p.errorf("%c= is not allowed in a media description", typ)
+	default:
+		return p.errorf("unknown type %c", typ)
+	}
+	return nil
+}
+
+// startMedia starts a new media description, all lines up to the next m= line belong to it
+func (p *parser) startMedia(value string) error {
+	// <media> <port>[/<number of ports>] <proto> <fmt> ...
+	mediaParts := strings.Fields(value)
+	if len(mediaParts) < 4 {
+		return p.errorf("expected at least 4 media fields, got %d", len(mediaParts))
+	}
+	media := &MediaDescription{Media: mediaParts[0], Proto: mediaParts[2], Formats: mediaParts[3:]}
+	portParts := strings.SplitN(mediaParts[1], "/", 2)
+	port, err := strconv.Atoi(portParts[0])
+	if err != nil || port < 0 || port > 65535 {
+		return p.errorf("invalid port: %s", portParts[0])
+	}
+	media.Port = port
+	if len(portParts) == 2 {
+		numberOfPorts, err := strconv.Atoi(portParts[1])
+		if err != nil || numberOfPorts < 1 {
+			return p.errorf("invalid number of ports: %s", portParts[1])
+		}
+		media.NumberOfPorts = numberOfPorts
+	}
+	p.media = media
+	return nil
+}
+
+func (p *parser) flushMedia() {
+	if p.media != nil {
+		p.sdp.MediaDescription = append(p.sdp.MediaDescription, *p.media)
+		p.media = nil
+	}
+}
+
+func (p *parser) parseConnectData(value string) (ConnectData, error) {
+	// <nettype> <addrtype> <connection-address>
+	connectionParts := strings.Fields(value)
+	if len(connectionParts) != 3 {
+		return ConnectData{}, p.errorf("expected 3 connection fields, got %d", len(connectionParts))
+	}
+	return ConnectData{NetType: connectionParts[0], AddrType: connectionParts[1], ConnectionAddress: connectionParts[2]}, nil
+}
+
+func (p *parser) parseBandwidth(value string) (Bandwidth, error) {
+	// <bwtype>:<bandwidth>
+	bandwidthParts := strings.SplitN(value, ":", 2)
+	if len(bandwidthParts) != 2 || bandwidthParts[0] == "" {
+		return Bandwidth{}, p.errorf("expected <bwtype>:<bandwidth>")
+	}
+	bandwidth, err := strconv.Atoi(bandwidthParts[1])
+	if err != nil {
+		return Bandwidth{}, p.errorf("invalid bandwidth: %v", err)
+	}
+	return Bandwidth{Type: bandwidthParts[0], Bandwidth: bandwidth}, nil
+}
+
+// parseAttribute parses <attribute>:<value>, or just <attribute> for property attributes
+func parseAttribute(value string) Attribute {
+	attributeParts := strings.SplitN(value, ":", 2)
+	if len(attributeParts) == 1 {
+		return Attribute{Key: attributeParts[0]}
+	}
+	return Attribute{Key: attributeParts[0], Value: attributeParts[1]}
+}
+
+// Write writes a SessionDescription struct to the given writer, in the order RFC 4566 requires
 func Write(w io.Writer, session *SessionDescription) (n int, err error) {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("v=%d\r\n", session.Version))
@@ -89,19 +269,74 @@ func Write(w io.Writer, session *SessionDescription) (n int, err error) {
 	o := session.Origin
 	buf.WriteString(fmt.Sprintf("o=%s %s %s %s %s %s\r\n", o.Username, o.SessionID, o.SessionVersion, o.NetType, o.AddrType, o.UnicastAddress))
 	buf.WriteString(fmt.Sprintf("s=%s\r\n", session.SessionName))
+	writeOptional(&buf, 'i', session.Information)
+	writeOptional(&buf, 'u', session.URI)
+	for _, email := range session.Emails {
+		writeOptional(&buf, 'e', email)
+	}
+	for _, phone := range session.Phones {
+		writeOptional(&buf, 'p', phone)
+	}
+	if session.ConnectData != (ConnectData{}) {
+		writeConnectData(&buf, session.ConnectData)
+	}
+	writeBandwidths(&buf, session.Bandwidths)
+	// at least one time description is required
+	timings := session.Timings
+	if len(timings) == 0 {
+		timings = []Timing{{}}
+	}
+	for _, t := range timings {
+		// <start-time> <stop-time>
+		buf.WriteString(fmt.Sprintf("t=%d %d\r\n", t.StartTime, t.StopTime))
+		for _, repeat := range t.Repeats {
+			writeOptional(&buf, 'r', repeat)
+		}
+	}
+	writeOptional(&buf, 'z', session.TimeZones)
+	writeOptional(&buf, 'k', session.EncryptionKey)
+	writeAttributes(&buf, session.Attributes)
+	for _, m := range session.MediaDescription {
+		// <media> <port>[/<number of ports>] <proto> <fmt> ...
+		port := strconv.Itoa(m.Port)
+		if m.NumberOfPorts > 0 {
+			port = fmt.Sprintf("%d/%d", m.Port, m.NumberOfPorts)
+		}
+		buf.WriteString(fmt.Sprintf("m=%s %s %s %s\r\n", m.Media, port, m.Proto, strings.Join(m.Formats, " ")))
+		writeOptional(&buf, 'i', m.Information)
+		for _, c := range m.ConnectData {
+			writeConnectData(&buf, c)
+		}
+		writeBandwidths(&buf, m.Bandwidths)
+		writeOptional(&buf, 'k', m.EncryptionKey)
+		writeAttributes(&buf, m.Attributes)
+	}
+	return w.Write(buf.Bytes())
+}
+
+func writeOptional(buf *bytes.Buffer, typ byte, value string) {
+	if value != "" {
+		buf.WriteString(fmt.Sprintf("%c=%s\r\n", typ, value))
+	}
+}
+
+func writeConnectData(buf *bytes.Buffer, c ConnectData) {
 	// <nettype> <addrtype> <connection-address>
-	c := session.ConnectData
 	buf.WriteString(fmt.Sprintf("c=%s %s %s\r\n", c.NetType, c.AddrType, c.ConnectionAddress))
-	// <start-time> <stop-time>
-	t := session.Timing
-	buf.WriteString(fmt.Sprintf("t=%d %d\r\n", t.StartTime, t.StopTime))
-	for _, m := range session.MediaDescription {
-		// <media> <port>/<number of ports> <proto> <fmt>
-		buf.WriteString(fmt.Sprintf("m=%s %s %s %s\r\n", m.Media, m.Port, m.Proto, m.Fmt))
+}
+
+func writeBandwidths(buf *bytes.Buffer, bandwidths []Bandwidth) {
+	for _, b := range bandwidths {
+		buf.WriteString(fmt.Sprintf("b=%s:%d\r\n", b.Type, b.Bandwidth))
 	}
-	for k, v := range session.Attributes {
-		buf.WriteString(fmt.Sprintf("a=%s:%s\r\n", k, v))
+}
+
+func writeAttributes(buf *bytes.Buffer, attributes Attributes) {
+	for _, a := range attributes {
+		if a.Value == "" {
+			buf.WriteString(fmt.Sprintf("a=%s\r\n", a.Key))
+		} else {
+			buf.WriteString(fmt.Sprintf("a=%s:%s\r\n", a.Key, a.Value))
+		}
 	}
-	buf.WriteString(fmt.Sprintf("i=%s\r\n", session.Information))
-	return w.Write(buf.Bytes())
 }
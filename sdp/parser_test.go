@@ -2,6 +2,8 @@ package sdp
 
 import (
 	"bytes"
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -75,18 +77,25 @@ func TestSDPsParse(t *testing.T) {
 	if m[0].Media != "audio" {
 		t.Error("Unexpected media description media", m[0].Media)
 	}
-	if m[0].Fmt != "96" {
-		t.Error("Unexpected media description format", m[0].Fmt)
+	if len(m[0].Formats) != 1 || m[0].Formats[0] != "96" {
+		t.Error("Unexpected media description format", m[0].Formats)
 	}
-	if m[0].Port != "0" {
+	if m[0].Port != 0 {
 		t.Error("Unexpected media description port", m[0].Port)
 	}
 	if m[0].Proto != "RTP/AVP" {
 		t.Error("Unexpected media description protocol", m[0].Proto)
 	}
-	a := sdp.Attributes
-	if len(a) != 6 {
-		t.Error("Unexpected number of attributes", len(a))
+	// the attributes follow the m= line, so they belong to the media description
+	if len(sdp.Attributes) != 0 {
+		t.Error("Unexpected session attributes", sdp.Attributes)
+	}
+	a := make(map[string]string)
+	for _, attribute := range m[0].Attributes {
+		a[attribute.Key] = attribute.Value
+	}
+	if len(m[0].Attributes) != 6 {
+		t.Error("Unexpected number of attributes", len(m[0].Attributes))
 	}
 	if a["rtpmap"] != "96 AppleLossless" {
 		t.Error("Unexpected rtpmap", a["rtpmap"])
@@ -113,11 +122,11 @@ func TestSDPWrite(t *testing.T) {
 	sdpStr := "v=0\r\n" +
 		"o=AirTunes 1547303657935225515 0 IN IP4 192.168.0.13\r\n" +
 		"s=AirTunes\r\n" +
+		"i=iPhone\r\n" +
 		"c=IN IP4 192.168.0.13\r\n" +
 		"t=0 0\r\n" +
 		"m=audio 0 RTP/AVP 96\r\n" +
-		"a=rtpmap:96 AppleLossless\r\n" +
-		"i=iPhone\r\n"
+		"a=rtpmap:96 AppleLossless\r\n"
 
 	session := SessionDescription{}
 	session.Version = 0
@@ -137,18 +146,16 @@ func TestSDPWrite(t *testing.T) {
 	c.ConnectionAddress = "192.168.0.13"
 	session.ConnectData = c
 	timing := Timing{StartTime: 0, StopTime: 0}
-	session.Timing = timing
+	session.Timings = []Timing{timing}
 	m := make([]MediaDescription, 1)
 	md := MediaDescription{}
 	md.Media = "audio"
-	md.Fmt = "96"
-	md.Port = "0"
+	md.Formats = []string{"96"}
+	md.Port = 0
 	md.Proto = "RTP/AVP"
+	md.Attributes.Add("rtpmap", "96 AppleLossless")
 	m[0] = md
 	session.MediaDescription = m
-	a := make(map[string]string)
-	a["rtpmap"] = "96 AppleLossless"
-	session.Attributes = a
 	var b bytes.Buffer
 	n, err := Write(&b, &session)
 	if err != nil {
@@ -161,3 +168,255 @@ func TestSDPWrite(t *testing.T) {
 		t.Error("Non matching response generated. Expected:"+sdpStr+"got:", b.String())
 	}
 }
+
+// example from RFC 4566 section 5, extended with the fields it leaves out
+const fullSDP = "v=0\r\n" +
+	"o=jdoe 2890844526 2890842807 IN IP4 10.47.16.5\r\n" +
+	"s=SDP Seminar\r\n" +
+	"i=A Seminar on the session description protocol\r\n" +
+	"u=http://www.example.com/seminars/sdp.pdf\r\n" +
+	"e=j.doe@example.com (Jane Doe)\r\n" +
+	"p=+1 617 555-6011\r\n" +
+	"c=IN IP4 224.2.17.12/127\r\n" +
+	"b=CT:128\r\n" +
+	"t=2873397496 2873404696\r\n" +
+	"r=7d 1h 0 25h\r\n" +
+	"z=2882844526 -1h 2898848070 0\r\n" +
+	"k=prompt\r\n" +
+	"a=recvonly\r\n" +
+	"a=tool:sdp:editor\r\n" +
+	"m=audio 49170 RTP/AVP 0\r\n" +
+	"i=Speaker\r\n" +
+	"b=AS:64\r\n" +
+	"a=sendonly\r\n" +
+	"m=video 51372/2 RTP/AVP 99 100\r\n" +
+	"c=IN IP4 224.2.17.13/127\r\n" +
+	"k=clear:secret\r\n" +
+	"a=rtpmap:99 h263-1998/90000\r\n" +
+	"a=rtpmap:100 h264/90000\r\n"
+
+func TestSDPParseFull(t *testing.T) {
+	sdp, err := Parse(strings.NewReader(fullSDP))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if sdp.URI != "http://www.example.com/seminars/sdp.pdf" || len(sdp.Emails) != 1 || len(sdp.Phones) != 1 {
+		t.Error("Unexpected uri, emails or phones", sdp.URI, sdp.Emails, sdp.Phones)
+	}
+	if sdp.ConnectData.ConnectionAddress != "224.2.17.12/127" {
+		t.Error("Unexpected connection address", sdp.ConnectData.ConnectionAddress)
+	}
+	if !reflect.DeepEqual(sdp.Bandwidths, []Bandwidth{{Type: "CT", Bandwidth: 128}}) {
+		t.Error("Unexpected bandwidths", sdp.Bandwidths)
+	}
+	if len(sdp.Timings) != 1 || sdp.Timings[0].StartTime != 2873397496 || !reflect.DeepEqual(sdp.Timings[0].Repeats, []string{"7d 1h 0 25h"}) {
+		t.Error("Unexpected timings", sdp.Timings)
+	}
+	if sdp.TimeZones != "2882844526 -1h 2898848070 0" || sdp.EncryptionKey != "prompt" {
+		t.Error("Unexpected time zones or key", sdp.TimeZones, sdp.EncryptionKey)
+	}
+	if !sdp.Attributes.Has("recvonly") || sdp.Attributes.Value("recvonly") != "" {
+		t.Error("Expected recvonly property attribute", sdp.Attributes)
+	}
+	// only the first : separates the key from the value
+	if sdp.Attributes.Value("tool") != "sdp:editor" {
+		t.Error("Unexpected tool attribute", sdp.Attributes.Value("tool"))
+	}
+	if len(sdp.MediaDescription) != 2 {
+		t.Fatal("Unexpected number of Media Descriptions", len(sdp.MediaDescription))
+	}
+	audio := sdp.MediaDescription[0]
+	if audio.Information != "Speaker" || !audio.Attributes.Has("sendonly") || audio.Attributes.Has("rtpmap") {
+		t.Error("Unexpected audio media description", audio)
+	}
+	video := sdp.MediaDescription[1]
+	if video.Port != 51372 || video.NumberOfPorts != 2 || !reflect.DeepEqual(video.Formats, []string{"99", "100"}) {
+		t.Error("Unexpected video port or formats", video.Port, video.NumberOfPorts, video.Formats)
+	}
+	if len(video.ConnectData) != 1 || video.EncryptionKey != "clear:secret" {
+		t.Error("Unexpected video connection or key", video.ConnectData, video.EncryptionKey)
+	}
+	if !reflect.DeepEqual(video.Attributes.Values("rtpmap"), []string{"99 h263-1998/90000", "100 h264/90000"}) {
+		t.Error("Expected both rtpmap attributes", video.Attributes)
+	}
+	// media attributes override the session ones, the session ones apply otherwise
+	if value, _ := sdp.Attribute("tool"); value != "sdp:editor" {
+		t.Error("Expected session attribute", value)
+	}
+	if !sdp.MediaDescription[0].Attributes.Has("sendonly") {
+		t.Error("Expected media attribute")
+	}
+}
+
+func TestSDPRoundTrip(t *testing.T) {
+	sdp, err := Parse(strings.NewReader(fullSDP))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	var b bytes.Buffer
+	_, err = Write(&b, sdp)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if b.String() != fullSDP {
+		t.Error("Non matching output. Expected:\n" + fullSDP + "got:\n" + b.String())
+	}
+	reparsed, err := Parse(&b)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !reflect.DeepEqual(sdp, reparsed) {
+		t.Error("Expected the same description after a round trip")
+	}
+}
+
+func TestSDPWriteRequiresTiming(t *testing.T) {
+	var b bytes.Buffer
+	_, err := Write(&b, &SessionDescription{SessionName: "AirTunes"})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expected := "v=0\r\no=     \r\ns=AirTunes\r\nt=0 0\r\n"
+	if b.String() != expected {
+		t.Errorf("Expected: %q got: %q", expected, b.String())
+	}
+}
+
+func TestSDPParseMalformed(t *testing.T) {
+	base := "v=0\r\no=AirTunes 1 0 IN IP4 192.168.0.13\r\ns=AirTunes\r\n"
+	tests := map[string]string{
+		"no equals":              base + "garbage\r\n",
+		"short origin":           "v=0\r\no=AirTunes 1\r\ns=AirTunes\r\n",
+		"short connection":       base + "c=IN IP4\r\n",
+		"short media":            base + "m=audio 0\r\n",
+		"bad port":               base + "m=audio port RTP/AVP 96\r\n",
+		"bad number of ports":    base + "m=audio 0/0 RTP/AVP 96\r\n",
+		"bad timing":             base + "t=0\r\n",
+		"bad bandwidth":          base + "b=AS\r\n",
+		"repeat without timing":  base + "r=7d 1h 0 25h\r\n",
+		"unknown type":           base + "x=1\r\n",
+		"duplicate session name": base + "s=again\r\n",
+		"session line in media":  base + "m=audio 0 RTP/AVP 96\r\ns=again\r\n",
+		"version not first":      "s=AirTunes\r\nv=0\r\n",
+		"missing origin":         "v=0\r\ns=AirTunes\r\n",
+	}
+	for name, payload := range tests {
+		_, err := Parse(strings.NewReader(payload))
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	_, err := Parse(strings.NewReader(base + "c=IN IP4\r\n"))
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 4 {
+		t.Error("Expected parse error for line 4 got:", err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	var a Attributes
+	a.Add("rtpmap", "96 AppleLossless")
+	a.Add("rtpmap", "97 L16/44100/2")
+	a.Add("recvonly", "")
+	a.Set("rtpmap", "98 mpeg4-generic/44100/2")
+	if !reflect.DeepEqual(a.Values("rtpmap"), []string{"98 mpeg4-generic/44100/2"}) {
+		t.Error("Expected set to replace every rtpmap", a)
+	}
+	a.Delete("recvonly")
+	if a.Has("recvonly") || len(a) != 1 {
+		t.Error("Expected recvonly to be deleted", a)
+	}
+	if _, ok := a.Get("fmtp"); ok {
+		t.Error("Expected no fmtp")
+	}
+}
+
+func TestRtpMap(t *testing.T) {
+	tests := map[string]RtpMap{
+		"96 AppleLossless":         {PayloadType: 96, EncodingName: "AppleLossless"},
+		"96 mpeg4-generic/44100/2": {PayloadType: 96, EncodingName: "mpeg4-generic", ClockRate: 44100, Channels: 2},
+		"0 PCMU/8000":              {PayloadType: 0, EncodingName: "PCMU", ClockRate: 8000},
+	}
+	for value, expected := range tests {
+		rtpmap, err := ParseRtpMap(value)
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+		if rtpmap != expected {
+			t.Errorf("Expected %+v got: %+v", expected, rtpmap)
+		}
+		if rtpmap.String() != value {
+			t.Errorf("Expected %s got: %s", value, rtpmap.String())
+		}
+	}
+	for _, value := range []string{"", "96", "x AppleLossless", "128 L16/44100", "96 L16/rate", "96 L16/44100/0", "96 /44100"} {
+		if _, err := ParseRtpMap(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestALACConfig(t *testing.T) {
+	config, err := ParseALACConfig("352 0 16 40 10 14 2 255 0 0 44100")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if config != DefaultALACConfig() {
+		t.Errorf("Expected the default config got: %+v", config)
+	}
+	if config.Parameters() != "352 0 16 40 10 14 2 255 0 0 44100" {
+		t.Error("Unexpected parameters", config.Parameters())
+	}
+	for _, parameters := range []string{"352 0 16", "352 0 16 40 10 14 2 255 0 0 44100 1", "352 0 256 40 10 14 2 255 0 0 44100"} {
+		if _, err := ParseALACConfig(parameters); err == nil {
+			t.Errorf("Expected error for %q", parameters)
+		}
+	}
+}
+
+func TestFormatHelpers(t *testing.T) {
+	sdp, err := Parse(strings.NewReader("v=0\r\n" +
+		"o=iTunes 3413821438 0 IN IP4 10.0.0.2\r\n" +
+		"s=iTunes\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 AppleLossless\r\n" +
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 48000\r\n"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	rtpmap, ok := sdp.RtpMap()
+	if !ok || rtpmap.EncodingName != "AppleLossless" {
+		t.Error("Unexpected rtpmap", rtpmap)
+	}
+	fmtp, ok := sdp.Fmtp()
+	if !ok {
+		t.Fatal("Expected fmtp")
+	}
+	config, err := ParseALACConfig(fmtp.Parameters)
+	if err != nil || config.SampleRate != 48000 {
+		t.Error("Unexpected ALAC config", config, err)
+	}
+	if _, ok := sdp.MediaDescription[0].RtpMap(97); ok {
+		t.Error("Expected no rtpmap for payload type 97")
+	}
+
+	media := NewAudioDescription(RtpMap{PayloadType: 96, EncodingName: "AppleLossless"}, DefaultALACConfig().Parameters())
+	media.AddFormat(RtpMap{PayloadType: 97, EncodingName: "L16", ClockRate: 44100, Channels: 2}, "")
+	var b bytes.Buffer
+	_, err = Write(&b, &SessionDescription{MediaDescription: []MediaDescription{media}})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expected := "m=audio 0 RTP/AVP 96 97\r\n" +
+		"a=rtpmap:96 AppleLossless\r\n" +
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n" +
+		"a=rtpmap:97 L16/44100/2\r\n"
+	if !strings.HasSuffix(b.String(), expected) {
+		t.Error("Unexpected media description. Expected:\n" + expected + "got:\n" + b.String())
+	}
+	l16, ok := media.RtpMap(97)
+	if !ok || l16.ClockRate != 44100 {
+		t.Error("Unexpected rtpmap for payload type 97", l16)
+	}
+}
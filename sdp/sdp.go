@@ -12,40 +12,137 @@ type Origin struct {
 
 // ConnectData connection section of a SDP payload
 type ConnectData struct {
-	NetType           string
-	AddrType          string
+	NetType  string
+	AddrType string
+	// ConnectionAddress is kept as written, multicast addresses may carry a ttl and number of addresses
 	ConnectionAddress string
 }
 
-// Timing timing section of a SDP payload
+// Bandwidth bandwidth section of a SDP payload, in kilobits per second
+type Bandwidth struct {
+	Type      string
+	Bandwidth int
+}
+
+// Timing time description of a SDP payload, times are NTP seconds, 0 for unbounded
 type Timing struct {
-	StartTime int
-	StopTime  int
+	StartTime uint64
+	StopTime  uint64
+	// Repeats are the repeat times (r=) for the time description, as written
+	Repeats []string
+}
+
+// Attribute an attribute of a SDP payload, property attributes have no value
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// Attributes the attributes of a session or media description, in the order they appear
+type Attributes []Attribute
+
+// Get returns the value of the first attribute with the given key
+func (a Attributes) Get(key string) (string, bool) {
+	for _, attribute := range a {
+		if attribute.Key == key {
+			return attribute.Value, true
+		}
+	}
+	return "", false
+}
+
+// Value returns the value of the first attribute with the given key, empty if there is none
+func (a Attributes) Value(key string) string {
+	value, _ := a.Get(key)
+	return value
+}
+
+// Values returns the values of every attribute with the given key
+func (a Attributes) Values(key string) []string {
+	var values []string
+	for _, attribute := range a {
+		if attribute.Key == key {
+			values = append(values, attribute.Value)
+		}
+	}
+	return values
+}
+
+// Has returns whether there is an attribute with the given key, i.e: for property attributes
+func (a Attributes) Has(key string) bool {
+	_, ok := a.Get(key)
+	return ok
+}
+
+// Add adds an attribute, keeping any attribute with the same key
+func (a *Attributes) Add(key string, value string) {
+	*a = append(*a, Attribute{Key: key, Value: value})
+}
+
+// Set sets the attribute, replacing every attribute with the same key
+func (a *Attributes) Set(key string, value string) {
+	a.Delete(key)
+	a.Add(key, value)
+}
+
+// Delete removes every attribute with the given key
+func (a *Attributes) Delete(key string) {
+	kept := (*a)[:0]
+	for _, attribute := range *a {
+		if attribute.Key != key {
+			kept = append(kept, attribute)
+		}
+	}
+	*a = kept
 }
 
 // MediaDescription media description of a SDP payload
 type MediaDescription struct {
 	Media string
-	Port  string // keeping string for now (parse later, fmt: <port>/<number of ports>)
-	Proto string
-	Fmt   string
+	Port  int
+	// NumberOfPorts is 0 when not given, meaning a single port
+	NumberOfPorts int
+	Proto         string
+	Formats       []string
+	Information   string
+	ConnectData   []ConnectData
+	Bandwidths    []Bandwidth
+	EncryptionKey string
+	Attributes    Attributes
 }
 
 // SessionDescription a struct representation of a SDP payload
 type SessionDescription struct {
-	Version          int
-	Origin           Origin
-	SessionName      string
-	Information      string
-	ConnectData      ConnectData
-	Timing           Timing
+	Version     int
+	Origin      Origin
+	SessionName string
+	Information string
+	URI         string
+	Emails      []string
+	Phones      []string
+	// ConnectData is optional at the session level, a zero value is left out
+	ConnectData ConnectData
+	Bandwidths  []Bandwidth
+	Timings     []Timing
+	// TimeZones are the time zone adjustments (z=), as written
+	TimeZones        string
+	EncryptionKey    string
+	Attributes       Attributes
 	MediaDescription []MediaDescription
-	Attributes       map[string]string
 }
 
 // NewSessionDescription instantiates a SessionDescription struct
 func NewSessionDescription() *SessionDescription {
-	var mediaDescription []MediaDescription
-	sdp := SessionDescription{Version: 0, Attributes: make(map[string]string), MediaDescription: mediaDescription}
-	return &sdp
+	return &SessionDescription{Version: 0}
+}
+
+// Attribute returns the value of the attribute for the first media description or, when
+// not set there, for the session as a whole; media attributes override session ones
+func (sd *SessionDescription) Attribute(key string) (string, bool) {
+	if len(sd.MediaDescription) > 0 {
+		if value, ok := sd.MediaDescription[0].Attributes.Get(key); ok {
+			return value, true
+		}
+	}
+	return sd.Attributes.Get(key)
 }